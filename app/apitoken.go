@@ -0,0 +1,460 @@
+package app
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+	"github.com/gin-gonic/gin"
+)
+
+// Personal API tokens let scripts use the API without the password: a token
+// is sent in the Authorization header as "Bearer <token>", and wraps the
+// user's keys like a recovery code does, so the server unwraps them with the
+// token itself. Each is limited to scopes, a folder and an expiry, and can be
+// revoked. Tokens are created from a password session, and rotating the keys
+// revokes them all, they wrap the old ones.
+const (
+	errInvalidToken       = "API token is not valid"
+	errTokenScope         = "API token doesn't allow this request"
+	errTokenFolder        = "API token doesn't allow this folder"
+	errTokenNotFound      = "API token not found"
+	errInvalidTokenScopes = "API token scopes are not valid"
+	errInvalidTokenExpiry = "API token expiry is not valid"
+
+	scopeRead   = "read"
+	scopeUpload = "upload"
+	scopeDelete = "delete"
+	scopeAdmin  = "admin"
+
+	apiTokenPrefix       = "gsc_"
+	apiTokenContext      = "gscrypto api token"
+	apiTokenIDLength     = 8
+	apiTokenSecretLength = 32
+	apiTokenTTL          = time.Hour * 24 * 30
+	apiTokenMaxTTL       = time.Hour * 24 * 365
+
+	// the secret is random, so unlike a password it doesn't need a slow KDF,
+	// which would slow down every request made with it
+	apiTokenIterations = 1
+)
+
+// apiToken is a token of UserEntry.APITokens. The token is only known to the
+// user, Hash identifies it and the PGP key and HMAC secret are wrapped by a
+// key derived from it.
+type apiToken struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Scopes      []string  `json:"scopes"`
+	Folder      string    `json:"folder"`
+	CreatedDate time.Time `json:"created_date"`
+	ExpiresAt   time.Time `json:"expires_at"`
+
+	Hash                []byte `json:"hash"`
+	Salt                []byte `json:"salt"`
+	EncryptedPGPKey     []byte `json:"encrypted_pgp_key"`
+	EncryptedHMACSecret []byte `json:"encrypted_hmac_secret"`
+}
+
+// apiTokenInfo is what users see of their tokens.
+type apiTokenInfo struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Scopes      []string  `json:"scopes"`
+	Folder      string    `json:"folder"`
+	CreatedDate time.Time `json:"created_date"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+type apiTokenRequest struct {
+	Password  string    `json:"password"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	Folder    string    `json:"folder"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// apiTokenScopes are the requests each scope allows, by method and path
+// prefix. Requests which aren't listed can't be made with a token at all,
+// like managing the account.
+var apiTokenScopes = []struct {
+	scope  string
+	method string
+	prefix string
+}{
+	{"", http.MethodPost, "/auth/account/verify"},
+	{scopeRead, http.MethodGet, "/auth/account/stat"},
+	{scopeRead, http.MethodGet, "/auth/list/"},
+	{scopeRead, http.MethodGet, "/auth/folder"},
+	{scopeRead, http.MethodGet, "/auth/file/"},
+	{scopeUpload, http.MethodPost, "/auth/file/"},
+	{scopeUpload, "", "/auth/upload/"},
+	{scopeDelete, http.MethodDelete, "/auth/file/"},
+	{scopeDelete, http.MethodDelete, "/auth/folder"},
+	{scopeAdmin, http.MethodGet, "/auth/account/users"},
+	{scopeAdmin, "", "/auth/account/enable/"},
+	{scopeAdmin, "", "/auth/account/webauthn-required/"},
+}
+
+var apiTokenEncoding = base64.RawURLEncoding
+
+func (t *apiToken) info() apiTokenInfo {
+	return apiTokenInfo{ID: t.ID, Name: t.Name, Scopes: t.Scopes, Folder: t.Folder, CreatedDate: t.CreatedDate, ExpiresAt: t.ExpiresAt}
+}
+
+func (t *apiToken) hasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether a request of method to path may be made with t.
+func (t *apiToken) allows(method, path string) bool {
+	for _, s := range apiTokenScopes {
+		if (s.method == "" || s.method == method) && strings.HasPrefix(path, s.prefix) {
+			return s.scope == "" || t.hasScope(s.scope)
+		}
+	}
+	return false
+}
+
+// apiTokenHash returns the Hash of the token of username with id and secret.
+func apiTokenHash(username, id, secret string) []byte {
+	sum := sha256.Sum256(crypto.Context(apiTokenContext, username, id, secret))
+	return sum[:]
+}
+
+// apiTokenKey derives the key the token's secret wraps the keys with.
+func apiTokenKey(secret string, salt []byte) *crypto.CryptoData {
+	return crypto.NewCryptoData([]byte(secret), nil, salt, apiTokenIterations)
+}
+
+// parseAPIToken splits a token into the username, ID and secret it's made of.
+func parseAPIToken(token string) (string, string, string, error) {
+	fields := strings.Split(strings.TrimPrefix(token, apiTokenPrefix), ".")
+
+	if !strings.HasPrefix(token, apiTokenPrefix) || len(fields) != 3 {
+		return "", "", "", errors.New(errInvalidToken)
+	}
+
+	username, err := apiTokenEncoding.DecodeString(fields[0])
+
+	if err != nil {
+		return "", "", "", errors.New(errInvalidToken)
+	}
+
+	return string(username), fields[1], fields[2], nil
+}
+
+func apiTokens(userEntry *gc.UserEntry) ([]apiToken, error) {
+	var tokens []apiToken
+
+	if len(userEntry.APITokens) == 0 {
+		return nil, nil
+	}
+
+	err := json.Unmarshal(userEntry.APITokens, &tokens)
+	return tokens, err
+}
+
+func setAPITokens(userEntry *gc.UserEntry, tokens []apiToken) error {
+	if len(tokens) == 0 {
+		userEntry.APITokens = nil
+		return nil
+	}
+
+	encoded, err := json.Marshal(tokens)
+
+	if err != nil {
+		return err
+	}
+
+	userEntry.APITokens = encoded
+	return nil
+}
+
+func apiTokenIndex(tokens []apiToken, id string) int {
+	for i := range tokens {
+		if tokens[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkAPITokenRequest validates the scopes and expiry of request, and sets
+// the defaults of those left out.
+func (user *userData) checkAPITokenRequest(request *apiTokenRequest) error {
+	if len(request.Scopes) == 0 {
+		return errors.New(errInvalidTokenScopes)
+	}
+
+	for _, scope := range request.Scopes {
+		switch scope {
+		case scopeRead, scopeUpload, scopeDelete:
+		case scopeAdmin:
+			if !user.userEntry.Admin {
+				return errors.New(errInvalidTokenScopes)
+			}
+		default:
+			return errors.New(errInvalidTokenScopes)
+		}
+	}
+
+	now := time.Now()
+
+	if request.ExpiresAt.IsZero() {
+		request.ExpiresAt = now.Add(apiTokenTTL)
+	}
+
+	if !request.ExpiresAt.After(now) || request.ExpiresAt.After(now.Add(apiTokenMaxTTL)) {
+		return errors.New(errInvalidTokenExpiry)
+	}
+
+	request.Folder = normalizeFolder(request.Folder)
+	return nil
+}
+
+// createAPIToken creates a token of request, which is only returned this
+// once.
+func (user *userData) createAPIToken(request *apiTokenRequest) (string, *apiTokenInfo, error) {
+	if err := user.checkAPITokenRequest(request); err != nil {
+		return "", nil, err
+	}
+
+	password := []byte(request.Password)
+	userEntry, id, err := user.unlockEntry(password)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	// the token would only unwrap the keys being replaced
+	if userEntry.Rotating() {
+		return "", nil, errors.New(errRotationInProgress)
+	}
+
+	pgpKey, hmacSecret, err := unwrapKeys(userEntry, password)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	tokens, err := apiTokens(userEntry)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	random, err := crypto.RandomBytes(apiTokenIDLength)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	tokenID := hex.EncodeToString(random)
+
+	if random, err = crypto.RandomBytes(apiTokenSecretLength); err != nil {
+		return "", nil, err
+	}
+
+	secret := apiTokenEncoding.EncodeToString(random)
+	salt, err := crypto.RandomBytes(32)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	t := apiToken{
+		ID:          tokenID,
+		Name:        request.Name,
+		Scopes:      request.Scopes,
+		Folder:      request.Folder,
+		CreatedDate: time.Now(),
+		ExpiresAt:   request.ExpiresAt,
+		Hash:        apiTokenHash(userEntry.Username, tokenID, secret),
+		Salt:        salt,
+	}
+
+	key := apiTokenKey(secret, salt)
+
+	if t.EncryptedPGPKey, err = key.EncryptText(pgpKey); err != nil {
+		return "", nil, err
+	}
+
+	if t.EncryptedHMACSecret, err = key.EncryptText(hmacSecret); err != nil {
+		return "", nil, err
+	}
+
+	if err := setAPITokens(userEntry, append(tokens, t)); err != nil {
+		return "", nil, err
+	}
+
+	if err := user.saveUserEntry(id, userEntry); err != nil {
+		return "", nil, err
+	}
+
+	token := apiTokenPrefix + apiTokenEncoding.EncodeToString([]byte(userEntry.Username)) + "." + tokenID + "." + secret
+	info := t.info()
+	return token, &info, nil
+}
+
+// apiTokenList returns the user's tokens.
+func (user *userData) apiTokenList() ([]apiTokenInfo, error) {
+	userEntry, _, err := user.server.users.GetUserEntry(user.userEntry.Username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := apiTokens(userEntry)
+
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]apiTokenInfo, 0, len(tokens))
+
+	for i := range tokens {
+		list = append(list, tokens[i].info())
+	}
+	return list, nil
+}
+
+// revokeAPIToken removes the user's token with tokenID.
+func (user *userData) revokeAPIToken(tokenID string) error {
+	userEntry, id, err := user.server.users.GetUserEntry(user.userEntry.Username)
+
+	if err != nil {
+		return err
+	}
+
+	tokens, err := apiTokens(userEntry)
+
+	if err != nil {
+		return err
+	}
+
+	i := apiTokenIndex(tokens, tokenID)
+
+	if i < 0 {
+		return errors.New(errTokenNotFound)
+	}
+
+	if err := setAPITokens(userEntry, append(tokens[:i:i], tokens[i+1:]...)); err != nil {
+		return err
+	}
+
+	return user.saveUserEntry(id, userEntry)
+}
+
+// authenticateToken returns the user a token belongs to, with their keys
+// unwrapped by it. Every request checks the token again, so revoking it, or
+// disabling the user, takes effect at once.
+func (s *Server) authenticateToken(token string) (*userData, error) {
+	username, tokenID, secret, err := parseAPIToken(token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	userEntry, _, err := s.users.GetUserEntry(username)
+
+	if err != nil || !userEntry.Enabled || userEntry.ZeroKnowledge || userEntry.Rotating() {
+		return nil, errors.New(errInvalidToken)
+	}
+
+	tokens, err := apiTokens(userEntry)
+
+	if err != nil {
+		return nil, err
+	}
+
+	i := apiTokenIndex(tokens, tokenID)
+
+	if i < 0 || subtle.ConstantTimeCompare(apiTokenHash(username, tokenID, secret), tokens[i].Hash) != 1 {
+		return nil, errors.New(errInvalidToken)
+	}
+
+	t := &tokens[i]
+
+	if !time.Now().Before(t.ExpiresAt) {
+		return nil, errors.New(errInvalidToken)
+	}
+
+	key := apiTokenKey(secret, t.Salt)
+	pgpKey, err := key.DecryptText(t.EncryptedPGPKey)
+
+	if err != nil {
+		return nil, errors.New(errInvalidToken)
+	}
+
+	hmacSecret, err := key.DecryptText(t.EncryptedHMACSecret)
+
+	if err != nil {
+		return nil, errors.New(errInvalidToken)
+	}
+
+	userCrypto := masterKeyOf(userEntry, pgpKey, hmacSecret, userEntry.IndexVersion)
+
+	return &userData{userEntry: *userEntry, cryptoData: *userCrypto, server: s, token: t}, nil
+}
+
+// checkTokenFolder checks the user's token, if they're using one, allows
+// folder.
+func (user *userData) checkTokenFolder(folder string) error {
+	if user.token != nil && !strings.HasPrefix(normalizeFolder(folder), user.token.Folder) {
+		return errors.New(errTokenFolder)
+	}
+	return nil
+}
+
+// authMiddleware authenticates requests with an API token in the
+// Authorization header, and the others with the JWT cookie.
+func (s *Server) authMiddleware() gin.HandlerFunc {
+	jwtMiddleware := s.jwtMiddleware.MiddlewareFunc()
+
+	return func(c *gin.Context) {
+		header := c.Request.Header.Get("Authorization")
+
+		if !strings.HasPrefix(header, "Bearer ") {
+			jwtMiddleware(c)
+			return
+		}
+
+		user, err := s.authenticateToken(strings.TrimPrefix(header, "Bearer "))
+
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"message": errInvalidToken})
+			c.Abort()
+			return
+		}
+
+		// a token doesn't get around a security key the user must register
+		if mustRegisterWebAuthn(&user.userEntry) {
+			c.JSON(http.StatusForbidden, gin.H{"message": errWebAuthnMustRegister})
+			c.Abort()
+			return
+		}
+
+		if !user.token.allows(c.Request.Method, c.Request.URL.Path) {
+			c.JSON(http.StatusForbidden, gin.H{"message": errTokenScope})
+			c.Abort()
+			return
+		}
+
+		c.Set("user", *user)
+		c.Next()
+	}
+}
@@ -0,0 +1,176 @@
+package app
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/levigross/grequests"
+	"github.com/stretchr/testify/assert"
+)
+
+// createAPIToken creates a token of the user of cookie and returns it.
+func createAPIToken(t *testing.T, cookie *http.Cookie, request apiTokenRequest) (string, apiTokenInfo) {
+	var created struct {
+		Token string       `json:"token"`
+		Info  apiTokenInfo `json:"info"`
+	}
+
+	resp, err := grequests.Post(ts.URL+"/auth/account/tokens", &grequests.RequestOptions{
+		Cookies: []*http.Cookie{cookie},
+		JSON:    request,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Nil(t, resp.JSON(&created))
+
+	return created.Token, created.Info
+}
+
+func bearer(token string) map[string]string {
+	return map[string]string{"Authorization": "Bearer " + token}
+}
+
+func uploadWithToken(token, folder, filename string) int {
+	f := grequests.FileUpload{FileName: filename, FileContents: ioutil.NopCloser(strings.NewReader("foo"))}
+	resp, _ := grequests.Post(ts.URL+"/auth/file/", &grequests.RequestOptions{
+		Headers: bearer(token),
+		Files:   []grequests.FileUpload{f},
+		Data:    map[string]string{"virtfolder": folder},
+	})
+	return resp.StatusCode
+}
+
+func TestAPIToken(t *testing.T) {
+	clearDatastore()
+	createAdmin()
+	cookie := loginUser(adminLoginDetails)
+	password := adminLoginDetails["password"]
+
+	for _, request := range []apiTokenRequest{
+		{Password: password},
+		{Password: password, Scopes: []string{"everything"}},
+		{Password: password, Scopes: []string{scopeRead}, ExpiresAt: time.Now().Add(-time.Minute)},
+		{Password: password, Scopes: []string{scopeRead}, ExpiresAt: time.Now().Add(apiTokenMaxTTL * 2)},
+	} {
+		resp, err := grequests.Post(ts.URL+"/auth/account/tokens", &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}, JSON: request})
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+
+	resp, err := grequests.Post(ts.URL+"/auth/account/tokens", &grequests.RequestOptions{
+		Cookies: []*http.Cookie{cookie},
+		JSON:    apiTokenRequest{Password: "wrong password", Scopes: []string{scopeRead}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	full, _ := createAPIToken(t, cookie, apiTokenRequest{Password: password, Name: "sync", Scopes: []string{scopeRead, scopeUpload, scopeDelete}})
+	read, readInfo := createAPIToken(t, cookie, apiTokenRequest{Password: password, Name: "photos", Scopes: []string{scopeRead}, Folder: "photos"})
+	assert.Equal(t, "/photos/", readInfo.Folder)
+
+	// the server unwraps the keys with the token, without the password
+	assert.Equal(t, http.StatusCreated, uploadWithToken(full, "/photos", "a"))
+	assert.Equal(t, http.StatusCreated, uploadWithToken(full, "/documents", "b"))
+
+	list := func(token, path string) *grequests.Response {
+		resp, _ := grequests.Get(ts.URL+"/auth/list/fs", &grequests.RequestOptions{Headers: bearer(token), Params: map[string]string{"path": path}})
+		return resp
+	}
+
+	var photos, documents []FSLayout
+	resp = list(read, "/photos")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, resp.JSON(&photos))
+	assert.Len(t, photos, 1)
+	assert.Nil(t, list(full, "/documents").JSON(&documents))
+	assert.Len(t, documents, 1)
+
+	assert.Equal(t, http.StatusForbidden, list(read, "/").StatusCode)
+	assert.Equal(t, http.StatusForbidden, list(read, "/documents").StatusCode)
+
+	download := func(token string, id int) int {
+		resp, _ := grequests.Get(ts.URL+"/auth/file/"+strconv.Itoa(id), &grequests.RequestOptions{Headers: bearer(token)})
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, download(read, photos[0].ID))
+	assert.Equal(t, http.StatusForbidden, download(read, documents[0].ID))
+
+	// the scopes limit what the token can do
+	assert.Equal(t, http.StatusForbidden, uploadWithToken(read, "/photos", "c"))
+
+	resp, err = grequests.Delete(ts.URL+"/auth/file/"+strconv.Itoa(photos[0].ID), &grequests.RequestOptions{Headers: bearer(read)})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, err = grequests.Post(ts.URL+"/auth/account/tokens", &grequests.RequestOptions{
+		Headers: bearer(full),
+		JSON:    apiTokenRequest{Password: password, Scopes: []string{scopeRead}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, err = grequests.Delete(ts.URL+"/auth/file/"+strconv.Itoa(documents[0].ID), &grequests.RequestOptions{Headers: bearer(full)})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	var tokens struct {
+		Tokens []apiTokenInfo `json:"tokens"`
+	}
+
+	resp, err = grequests.Get(ts.URL+"/auth/account/tokens", &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}})
+	assert.Nil(t, err)
+	assert.Nil(t, resp.JSON(&tokens))
+	assert.Len(t, tokens.Tokens, 2)
+	assert.NotContains(t, resp.String(), "hash")
+
+	resp, err = grequests.Delete(ts.URL+"/auth/account/tokens/"+readInfo.ID, &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	assert.Equal(t, http.StatusUnauthorized, list(read, "/photos").StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, list(read[:len(read)-1], "/photos").StatusCode)
+	assert.Equal(t, http.StatusOK, list(full, "/photos").StatusCode)
+
+	// the tokens wrap the keys which are rotated away
+	assert.Equal(t, http.StatusAccepted, rotateKeys(cookie, password).StatusCode)
+	waitForKeyRotation(t, cookie)
+	assert.Equal(t, http.StatusUnauthorized, list(full, "/photos").StatusCode)
+}
+
+func TestAPITokenWebAuthnRequired(t *testing.T) {
+	clearDatastore()
+	createAdmin()
+	createNormalUser()
+	adminCookie := loginUser(adminLoginDetails)
+	enableUser(normalUserLoginDetails, *adminCookie)
+
+	cookie := loginUser(normalUserLoginDetails)
+	password := normalUserLoginDetails["password"]
+	token, _ := createAPIToken(t, cookie, apiTokenRequest{Password: password, Scopes: []string{scopeRead, scopeUpload}})
+
+	resp, err := grequests.Put(ts.URL+"/auth/account/webauthn-required/"+normalUserLoginDetails["username"], &grequests.RequestOptions{Cookies: []*http.Cookie{adminCookie}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	// the token is as limited as a session until a key is registered
+	list := func() *grequests.Response {
+		resp, _ := grequests.Get(ts.URL+"/auth/list/fs", &grequests.RequestOptions{Headers: bearer(token), Params: map[string]string{"path": "/"}})
+		return resp
+	}
+
+	resp = list()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Contains(t, resp.String(), errWebAuthnMustRegister)
+	assert.Equal(t, http.StatusForbidden, uploadWithToken(token, "/", "a"))
+
+	cookie = loginUser(normalUserLoginDetails)
+	registerSecurityKey(t, cookie, password)
+
+	assert.Equal(t, http.StatusOK, list().StatusCode)
+	assert.Equal(t, http.StatusCreated, uploadWithToken(token, "/", "a"))
+}
@@ -1,38 +1,44 @@
-package main
+package app
 
 import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
 	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
 	"github.com/gin-gonic/gin"
-	cache "github.com/robfig/go-cache"
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/appleboy/gin-jwt.v2"
 )
 
-var jwtMiddleware jwt.GinJWTMiddleware
-
 const (
-	tokenTTL                 = time.Hour * 24 * 7
-	userNotInContext         = "user not found in context"
-	notVerified              = "user not verified"
-	needCaptcha              = "need valid captcha"
-	memoryStoreLogFailPrefix = "failed_login_"
+	tokenTTL         = time.Hour * 24 * 7
+	userNotInContext = "user not found in context"
+	notVerified      = "user not verified"
+	needCaptcha      = "need valid captcha"
+	needSecondFactor = "need second factor"
+	needWebAuthn     = "need security key"
+	needLogin        = "need login"
+
+	// a user whose login failed needs a captcha for a while, on every server
+	// sharing the session store
+	failedLoginPrefix = "failed_login_"
+	failedLoginTTL    = time.Minute * 10
 )
 
-func setupMiddleware(memoryStore *cache.Cache) {
-	jwtMiddleware = jwt.GinJWTMiddleware{
+func (s *Server) setupMiddleware() {
+	s.jwtMiddleware = &jwt.GinJWTMiddleware{
 		Realm:      "auth",
-		Key:        []byte(gc.SecretKey),
+		Key:        []byte(s.config.JWTKey),
 		Timeout:    tokenTTL,
 		MaxRefresh: tokenTTL,
 		Authenticator: func(userId string, password string, context *gin.Context) (string, bool) {
-			if data, exists := memoryStore.Get(memoryStoreLogFailPrefix + userId); exists && data.(bool) {
+			if s.loginFailed(userId) {
 				captcha := context.Request.Header.Get("google-captcha")
 
 				if len(captcha) == 0 {
@@ -40,13 +46,13 @@ func setupMiddleware(memoryStore *cache.Cache) {
 					return userId, false
 				}
 
-				if ok, err := verifyGoogleCaptcha(captcha); err != nil || !ok {
+				if ok, err := s.verifyGoogleCaptcha(captcha); err != nil || !ok {
 					return userId, false
 				}
 			}
 
-			if len(userId) > 0 && len(password) > 0 && verifyUserPassword(userId, []byte(password)) == nil {
-				user, _, err := gc.UserDB.GetUserEntry(userId)
+			if len(userId) > 0 && len(password) > 0 && s.verifyUserPassword(userId, []byte(password)) == nil {
+				user, id, err := s.users.GetUserEntry(userId)
 				if err != nil {
 					return userId, false
 				}
@@ -56,7 +62,25 @@ func setupMiddleware(memoryStore *cache.Cache) {
 					return userId, false
 				}
 
-				c := crypto.NewCryptoData([]byte(password), nil, user.Salt, user.Iterations)
+				// the client holds the keys, the session only identifies
+				// the user
+				if user.ZeroKnowledge {
+					if err := s.checkSecondFactor(user, id, nil, context.Request); err != nil {
+						s.failedSecondFactor(userId, err, context)
+						return userId, false
+					}
+
+					sessionID, err := s.newSession(userData{userEntry: *user, server: s}, context)
+
+					if err != nil {
+						return userId, false
+					}
+
+					s.clearFailedLogin(userId)
+					return sessionID, true
+				}
+
+				c := wrappingKey(user, []byte(password))
 				pgpKey, err := c.DecryptText(user.EncryptedPGPKey)
 
 				if err != nil {
@@ -69,27 +93,86 @@ func setupMiddleware(memoryStore *cache.Cache) {
 					return userId, false
 				}
 
+				userCrypto := masterKeyOf(user, pgpKey, hmacSecret, user.IndexVersion)
+
+				if err := s.checkSecondFactor(user, id, userCrypto, context.Request); err != nil {
+					s.failedSecondFactor(userId, err, context)
+					return userId, false
+				}
+
+				// the password is only known now, so this is when keys wrapped
+				// by an older KDF, or lower costs, are upgraded
+				if s.needsKDFUpgrade(user) {
+					upgraded := *user
+					if err := s.wrapUserKeys(&upgraded, []byte(password), pgpKey, hmacSecret); err != nil {
+						log.WithFields(log.Fields{"user": userId, "error": err}).Warn("failed to upgrade KDF")
+					} else if err := s.users.UpdateUser(id, &upgraded); err != nil {
+						log.WithFields(log.Fields{"user": userId, "error": err}).Warn("failed to upgrade KDF")
+					} else {
+						user = &upgraded
+					}
+				}
+
 				// once a user logs in, story credentials in memory, and expire when token expires.
-				userCrypto := crypto.NewCryptoData(pgpKey, hmacSecret, user.Salt, user.Iterations)
-				userCloudIO := userData{cryptoData: *userCrypto, userEntry: *user}
-				memoryStore.Add(userId, userCloudIO, tokenTTL)
+				userCloudIO := userData{cryptoData: *userCrypto, userEntry: *user, server: s}
+
+				// a rotation interrupted by a restart needs the password
+				// to continue, which is only known now
+				if user.Rotating() {
+					if userCloudIO.nextCryptoData, err = nextMasterKey(user, []byte(password)); err != nil {
+						return userId, false
+					}
+				}
 
-				memoryStore.Delete(memoryStoreLogFailPrefix + userId)
-				return userId, true
-			}
+				// files and folders stored before metadata was encrypted
+				// can't be found until they are, which needs the keys
+				if !user.MetadataEncrypted {
+					if _, err := userCloudIO.migrateMetadata(); err != nil {
+						log.WithFields(log.Fields{"user": userId, "error": err}).Warn("failed to encrypt metadata")
+						return userId, false
+					}
+				}
+
+				// the JWT identifies the session rather than the user. It's
+				// started before a rotation, and has the keys of both
+				// generations until it's done.
+				sessionID, err := s.newSession(userCloudIO, context)
+
+				if err != nil {
+					return userId, false
+				}
+
+				if user.Rotating() {
+					s.runKeyRotation(userCloudIO)
+				}
 
-			// failed to login, store failed login attempt in memory cache
-			if !gin.IsDebugging() {
-				memoryStore.Set(memoryStoreLogFailPrefix+userId, true, time.Minute*10)
+				s.clearFailedLogin(userId)
+				return sessionID, true
 			}
 
+			s.failedLogin(userId)
 			return userId, false
 		},
-		Authorizator: func(userId string, c *gin.Context) bool {
-			if user, exists := memoryStore.Get(userId); exists == true {
-				c.Set("user", user.(userData))
+		Authorizator: func(identity string, c *gin.Context) bool {
+			user, err := s.loadSession(identity)
+
+			// logged out, revoked, expired, or its keys rotated away
+			if err != nil {
+				c.Set("reason", needLogin)
+				return false
+			}
+
+			// a user required to use a security key who has none may
+			// only register one, or log out
+			path := c.Request.URL.Path
+			if mustRegisterWebAuthn(&user.userEntry) && path != "/auth/account/webauthn" && !strings.HasPrefix(path, "/auth/account/webauthn/") &&
+				path != "/auth/account/logout" {
+				c.Set("reason", needWebAuthn)
+				return false
 			}
 
+			s.touchSession(&user, c)
+			c.Set("user", user)
 			return true
 		},
 		Unauthorized: func(c *gin.Context, code int, message string) {
@@ -97,6 +180,13 @@ func setupMiddleware(memoryStore *cache.Cache) {
 				c.JSON(http.StatusUnauthorized, gin.H{"message": "account is not verified"})
 			} else if exists && reason == needCaptcha {
 				c.JSON(http.StatusBadRequest, gin.H{"message": "captcha required"})
+			} else if exists && reason == needSecondFactor {
+				factor, _ := c.Get("second_factor")
+				c.JSON(http.StatusUnauthorized, gin.H{"message": factor})
+			} else if exists && reason == needWebAuthn {
+				c.JSON(http.StatusForbidden, gin.H{"message": errWebAuthnMustRegister})
+			} else if exists && reason == needLogin {
+				c.JSON(http.StatusUnauthorized, gin.H{"message": errSessionRevoked})
 			} else {
 				c.JSON(code, gin.H{
 					"code":    code,
@@ -110,7 +200,44 @@ func setupMiddleware(memoryStore *cache.Cache) {
 	}
 }
 
-func verifyGoogleCaptcha(response string) (bool, error) {
+// failedSecondFactor records why userId, whose password was right, couldn't
+// log in: a missing second factor is asked for, a wrong one is a failed login.
+func (s *Server) failedSecondFactor(userId string, err error, c *gin.Context) {
+	switch err.Error() {
+	case errTOTPRequired, errWebAuthnRequired:
+		c.Set("reason", needSecondFactor)
+		c.Set("second_factor", err.Error())
+	default:
+		s.failedLogin(userId)
+	}
+}
+
+// loginFailed reports whether a login of username failed recently, and the
+// next one needs a captcha. It does if the store can't tell.
+func (s *Server) loginFailed(username string) bool {
+	_, err := s.sessions.GetValue(failedLoginPrefix + username)
+	return err == nil || err.Error() != gc.ErrorValueNotFound
+}
+
+// failedLogin records a login of username failed, outside of debug mode.
+func (s *Server) failedLogin(username string) {
+	if gin.IsDebugging() {
+		return
+	}
+
+	if err := s.sessions.SetValue(failedLoginPrefix+username, []byte{1}, failedLoginTTL); err != nil {
+		log.WithFields(log.Fields{"user": username, "error": err}).Warn("failed to record failed login")
+	}
+}
+
+// clearFailedLogin forgets the failed logins of username.
+func (s *Server) clearFailedLogin(username string) {
+	if err := s.sessions.DeleteValue(failedLoginPrefix + username); err != nil {
+		log.WithFields(log.Fields{"user": username, "error": err}).Warn("failed to clear failed login")
+	}
+}
+
+func (s *Server) verifyGoogleCaptcha(response string) (bool, error) {
 
 	type googleResponse struct {
 		Success    bool
@@ -118,8 +245,8 @@ func verifyGoogleCaptcha(response string) (bool, error) {
 	}
 
 	client := &http.Client{Timeout: 20 * time.Second}
-	resp, err := client.PostForm(config.googleCaptchaURL,
-		url.Values{"secret": {config.googleCaptchaSecret}, "response": {response}})
+	resp, err := client.PostForm(s.googleCaptchaURL,
+		url.Values{"secret": {s.config.GoogleCaptchaSecret}, "response": {response}})
 
 	if err != nil {
 		return false, err
@@ -145,21 +272,28 @@ func verifyGoogleCaptcha(response string) (bool, error) {
 	return true, nil
 }
 
-func generatePasswordHash(password []byte) ([]byte, error) {
-	if p, err := bcrypt.GenerateFromPassword(password, 4); err != nil {
-		return nil, err
-	} else {
-		return p, err
-	}
+func (s *Server) generatePasswordHash(password []byte) ([]byte, error) {
+	kdf := s.config.KDF()
+	return crypto.HashPassword(password, kdf.Time, kdf.Memory, kdf.Threads)
+}
+
+func isWeakPassword(password string) bool {
+	return len(password) < 8 || !strings.ContainsAny(password, "@#$%!?*0987654321")
 }
 
-func verifyUserPassword(username string, plainTextPassword []byte) error {
-	ph, _, err := gc.UserDB.GetUserEntry(username)
+func (s *Server) verifyUserPassword(username string, plainTextPassword []byte) error {
+	ph, _, err := s.users.GetUserEntry(username)
 
 	if err != nil {
 		return err
 	}
 
+	// accounts which haven't logged in since Argon2id was added have bcrypt
+	// hashes until they do
+	if crypto.IsArgon2idHash(ph.Hash) {
+		return crypto.VerifyPassword(ph.Hash, plainTextPassword)
+	}
+
 	if err := bcrypt.CompareHashAndPassword(ph.Hash, plainTextPassword); err != nil {
 		return err
 	}
@@ -1,19 +1,22 @@
-package main
+package app
 
 import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
 
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
 	"github.com/gin-gonic/gin"
 	"github.com/levigross/grequests"
 	"github.com/stretchr/testify/assert"
 )
 
 var ts *httptest.Server
+var testServer *Server
 
 type login struct {
 	Expire string `json:"expire"`
@@ -21,16 +24,48 @@ type login struct {
 }
 
 func init() {
+	// the tests use the in-memory backends unless the environment says otherwise
+	config := gc.DefaultConfig()
+	config.JWTKey = "testing"
+	config.DatabaseBackend = gc.DatabaseBackendMemory
+	config.StorageBackend = gc.StorageBackendMemory
+
+	// the default Argon2id costs would make every login take a while
+	config.KDFTime = 1
+	config.KDFMemory = gc.MinKDFMemory
+	config.KDFThreads = 1
+
+	if err := config.LoadEnv(os.Getenv); err != nil {
+		panic(err)
+	}
+
+	var err error
+	if testServer, err = NewServer(config); err != nil {
+		panic(err)
+	}
+
 	clearDatastore()
-	ts = httptest.NewServer(mainGinEngine())
+	ts = httptest.NewServer(testServer)
+
+	// security keys are used on the test server
+	origin, _ := url.Parse(ts.URL)
+	config.WebAuthn = true
+	config.WebAuthnOrigin, config.WebAuthnRPID = ts.URL, origin.Hostname()
 }
 
 func clearDatastore() {
+	if db, ok := testServer.files.(*gc.MemoryDB); ok {
+		db.Reset()
+		return
+	}
+
 	host := os.Getenv("DATASTORE_EMULATOR_HOST")
 	grequests.Post("http://"+host+"/reset", nil)
 }
 
 func TestAdminNeededFirst(t *testing.T) {
+	clearDatastore()
+
 	signupDetails := map[string]string{
 		"username": "greg",
 		"password": "sdfiopdnndsajiiwqqs3482",
@@ -47,6 +82,8 @@ func TestCreateAdminAndLogin(t *testing.T) {
 		"password": "sdfiopdnndsajiiwqqs3482",
 	}
 
+	clearDatastore()
+
 	resp, err := grequests.Post(ts.URL+"/account/signup", &grequests.RequestOptions{JSON: signupDetails})
 	assert.Nil(t, err)
 	assert.Equal(t, http.StatusCreated, resp.StatusCode, "expected http accepted")
@@ -199,13 +236,13 @@ func TestVerifyCaptcha(t *testing.T) {
 	})
 
 	captchaServer := httptest.NewServer(captchaRouter)
-	config.googleCaptchaURL = captchaServer.URL + "/fake_captcha_acceptor"
+	testServer.googleCaptchaURL = captchaServer.URL + "/fake_captcha_acceptor"
 
-	fmt.Println(verifyGoogleCaptcha("abc"))
+	fmt.Println(testServer.verifyGoogleCaptcha("abc"))
 
-	config.googleCaptchaURL = captchaServer.URL + "/fake_captcha_denier"
+	testServer.googleCaptchaURL = captchaServer.URL + "/fake_captcha_denier"
 
-	fmt.Println(verifyGoogleCaptcha("abc"))
+	fmt.Println(testServer.verifyGoogleCaptcha("abc"))
 }
 
 func TestPasswords(t *testing.T) {
@@ -0,0 +1,87 @@
+// gscrypto-export decrypts every file of a user into a directory, recreating
+// their folders and file names, so they can be read without the server. It
+// only needs read access to the database and storage, takes the same settings
+// as gscrypto followed by the username and directory, and asks for the user's
+// password:
+//
+//	gscrypto-export -config gscrypto.json -verify alice ./alice
+//
+// With -verify each file is checked against the SHA-256 recorded when it was
+// uploaded. Files encrypted to the user's OpenPGP public keys are exported as
+// they're stored, with a .gpg extension, for gpg to decrypt.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+func readPassword() ([]byte, error) {
+	fmt.Fprint(os.Stderr, "password: ")
+	defer fmt.Fprintln(os.Stderr)
+
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return terminal.ReadPassword(int(os.Stdin.Fd()))
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return nil, err
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
+
+func main() {
+	// -verify isn't one of the settings, it's taken out before they're parsed
+	var args []string
+	verify := false
+
+	for _, arg := range os.Args[1:] {
+		if arg == "-verify" || arg == "--verify" {
+			verify = true
+		} else {
+			args = append(args, arg)
+		}
+	}
+
+	if len(args) < 2 || strings.HasPrefix(args[len(args)-2], "-") || strings.HasPrefix(args[len(args)-1], "-") {
+		fmt.Fprintln(os.Stderr, "usage: gscrypto-export [settings] [-verify] username directory")
+		os.Exit(2)
+	}
+
+	username, dir := args[len(args)-2], args[len(args)-1]
+	config, err := gc.LoadConfig(args[:len(args)-2])
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server, err := app.NewServer(config)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	password, err := readPassword()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	exported, err := server.Export(username, password, dir, verify)
+	log.WithFields(log.Fields{"user": username, "files": exported, "directory": dir}).Info("exported files")
+
+	server.Close()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
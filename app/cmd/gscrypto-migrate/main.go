@@ -0,0 +1,78 @@
+// gscrypto-migrate encrypts the metadata of a user's files and folders stored
+// before it was encrypted, gives the files uploaded before per-file data keys
+// a key of their own and binds the encrypted fields of older files to them. It
+// takes the same settings as gscrypto, followed by the username, and asks for
+// the user's password:
+//
+//	gscrypto-migrate -config gscrypto.json alice
+//
+// Stop the server first, or make sure the user isn't using it.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+func readPassword() ([]byte, error) {
+	fmt.Fprint(os.Stderr, "password: ")
+	defer fmt.Fprintln(os.Stderr)
+
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return terminal.ReadPassword(int(os.Stdin.Fd()))
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return nil, err
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
+
+func main() {
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[len(os.Args)-1], "-") {
+		fmt.Fprintln(os.Stderr, "usage: gscrypto-migrate [settings] username")
+		os.Exit(2)
+	}
+
+	username := os.Args[len(os.Args)-1]
+	config, err := gc.LoadConfig(os.Args[1 : len(os.Args)-1])
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server, err := app.NewServer(config)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	password, err := readPassword()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	migrated, err := server.MigrateMetadata(username, password)
+	log.WithFields(log.Fields{"user": username, "files": migrated}).Info("encrypted metadata of files")
+
+	if err == nil {
+		migrated, err = server.MigrateDataKeys(username, password)
+		log.WithFields(log.Fields{"user": username, "files": migrated}).Info("migrated files to data keys")
+	}
+
+	server.Close()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	log.SetLevel(log.DebugLevel)
+
+	config, err := gc.LoadConfig(os.Args[1:])
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server, err := app.NewServer(config)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Fatal(server.Run())
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"io"
 
 	"golang.org/x/crypto/pbkdf2"
@@ -20,6 +21,10 @@ type CryptoData struct {
 
 	Salt       []byte
 	Iterations int
+
+	// AssociatedData is authenticated, but not encrypted, with everything
+	// encrypted by the key, decrypting fails unless it's the same
+	AssociatedData []byte
 }
 
 func NewCryptoData(password []byte, hmacSecret []byte, salt []byte, iterations int) *CryptoData {
@@ -27,6 +32,28 @@ func NewCryptoData(password []byte, hmacSecret []byte, salt []byte, iterations i
 	return &CryptoData{SymmetricKey: symmetricKey, HMACSecret: hmacSecret, Salt: salt, Iterations: iterations}
 }
 
+// WithAssociatedData returns a copy of c which authenticates ad, see Context.
+func (c *CryptoData) WithAssociatedData(ad []byte) *CryptoData {
+	bound := *c
+	bound.AssociatedData = ad
+	return &bound
+}
+
+// Context encodes the fields describing what a ciphertext is, to be used as
+// its associated data. Each field is prefixed by its length, so no two lists
+// of fields are encoded the same.
+func Context(fields ...string) []byte {
+	var context []byte
+	length := make([]byte, 4)
+
+	for _, field := range fields {
+		binary.BigEndian.PutUint32(length, uint32(len(field)))
+		context = append(context, length...)
+		context = append(context, field...)
+	}
+	return context
+}
+
 func RandomBytes(length int) ([]byte, error) {
 	b := make([]byte, length)
 	_, err := rand.Read(b)
@@ -52,7 +79,7 @@ func (cryptoData *CryptoData) EncryptText(str []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	ciphertext := aesgcm.Seal(nil, nonce, plaintext, nil)
+	ciphertext := aesgcm.Seal(nil, nonce, plaintext, cryptoData.AssociatedData)
 	ivCiphertext := append(nonce, ciphertext...)
 
 	return ivCiphertext, nil
@@ -71,7 +98,7 @@ func (cryptoData *CryptoData) DecryptText(str []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	plaintext, err := aesgcm.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := aesgcm.Open(nil, nonce, ciphertext, cryptoData.AssociatedData)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,46 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssociatedData(t *testing.T) {
+	c := newTestCryptoData()
+	bound := c.WithAssociatedData(Context("file", "a"))
+	assert.Nil(t, c.AssociatedData, "the key itself is changed")
+
+	ciphertext, err := bound.EncryptText([]byte("name"))
+	assert.Nil(t, err)
+
+	plaintext, err := bound.DecryptText(ciphertext)
+	assert.Nil(t, err)
+	assert.Equal(t, "name", string(plaintext))
+
+	for _, other := range []*CryptoData{c, c.WithAssociatedData(Context("file", "b")), c.WithAssociatedData(Context("filea"))} {
+		_, err = other.DecryptText(ciphertext)
+		assert.NotNil(t, err)
+	}
+
+	// unbound ciphertexts are what they were before
+	legacy, _ := c.EncryptText([]byte("name"))
+	plaintext, err = c.WithAssociatedData(nil).DecryptText(legacy)
+	assert.Nil(t, err)
+	assert.Equal(t, "name", string(plaintext))
+
+	stream := encryptTestStream(t, bound, []byte("file contents"), StreamCipherAES256GCM, 64)
+
+	var out bytes.Buffer
+	assert.Nil(t, bound.DecryptFile(bytes.NewReader(stream), &out, false))
+	assert.Equal(t, "file contents", out.String())
+	assert.NotNil(t, c.DecryptFile(bytes.NewReader(stream), &out, false))
+	assert.NotNil(t, c.WithAssociatedData(Context("file", "b")).DecryptFile(bytes.NewReader(stream), &out, false))
+}
+
+func TestContext(t *testing.T) {
+	assert.NotEqual(t, Context("ab", "c"), Context("a", "bc"))
+	assert.NotEqual(t, Context("a", ""), Context("a"))
+	assert.Equal(t, Context("a", "b"), Context("a", "b"))
+}
@@ -0,0 +1,164 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// WebAuthn encodes attestation objects and public keys in CBOR (RFC 7049).
+// Only the subset they use is decoded: integers, byte and text strings,
+// arrays, maps, booleans and null. Integers decode to int64, maps to
+// map[interface{}]interface{}.
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+
+	cborMaxDepth = 16
+)
+
+var errInvalidCBOR = errors.New("invalid or unsupported CBOR")
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+// decodeCBOR decodes the first item of data, and returns how many bytes it
+// took.
+func decodeCBOR(data []byte) (interface{}, int, error) {
+	d := &cborDecoder{data: data}
+	v, err := d.value(0)
+	return v, d.pos, err
+}
+
+func (d *cborDecoder) next(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, errInvalidCBOR
+	}
+
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+// head reads the major type and argument of an item.
+func (d *cborDecoder) head() (byte, uint64, error) {
+	b, err := d.next(1)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	major, info := b[0]>>5, b[0]&0x1f
+
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info <= 27:
+		// 24 to 27 are followed by 1, 2, 4 or 8 bytes
+		arg, err := d.next(1 << (info - 24))
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		var buf [8]byte
+		copy(buf[8-len(arg):], arg)
+		return major, binary.BigEndian.Uint64(buf[:]), nil
+	}
+
+	// indefinite lengths aren't used by authenticators
+	return 0, 0, errInvalidCBOR
+}
+
+func (d *cborDecoder) value(depth int) (interface{}, error) {
+	if depth > cborMaxDepth {
+		return nil, errInvalidCBOR
+	}
+
+	major, arg, err := d.head()
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case cborUint:
+		if arg > math.MaxInt64 {
+			return nil, errInvalidCBOR
+		}
+		return int64(arg), nil
+	case cborNegInt:
+		if arg > math.MaxInt64 {
+			return nil, errInvalidCBOR
+		}
+		return -1 - int64(arg), nil
+	case cborBytes:
+		b, err := d.next(arg)
+		return append([]byte(nil), b...), err
+	case cborText:
+		b, err := d.next(arg)
+		return string(b), err
+	case cborArray:
+		// every item takes at least a byte
+		if arg > uint64(len(d.data)-d.pos) {
+			return nil, errInvalidCBOR
+		}
+
+		items := make([]interface{}, arg)
+
+		for i := range items {
+			if items[i], err = d.value(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	case cborMap:
+		if arg > uint64(len(d.data)-d.pos)/2 {
+			return nil, errInvalidCBOR
+		}
+
+		m := make(map[interface{}]interface{}, arg)
+
+		for i := uint64(0); i < arg; i++ {
+			key, err := d.value(depth + 1)
+
+			if err != nil {
+				return nil, err
+			}
+
+			// byte strings and containers can't be map keys in Go
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, errInvalidCBOR
+			}
+
+			if m[key], err = d.value(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case cborTag:
+		// the meaning of tags isn't needed, only the item
+		return d.value(depth + 1)
+	case cborSimple:
+		switch arg {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22:
+			return nil, nil
+		}
+	}
+
+	return nil, errInvalidCBOR
+}
@@ -0,0 +1,46 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeCBOR(t *testing.T) {
+	// {"a": 1, -2: h'0102', "c": [true, null, -300]} followed by extra bytes
+	data := []byte{0xa3, 0x61, 'a', 0x01, 0x21, 0x42, 0x01, 0x02, 0x61, 'c', 0x83, 0xf5, 0xf6, 0x39, 0x01, 0x2b, 0xff}
+
+	v, n, err := decodeCBOR(data)
+	assert.Nil(t, err)
+	assert.Equal(t, len(data)-1, n)
+	assert.Equal(t, map[interface{}]interface{}{
+		"a":       int64(1),
+		int64(-2): []byte{1, 2},
+		"c":       []interface{}{true, nil, int64(-300)},
+	}, v)
+
+	for _, invalid := range [][]byte{
+		{},
+		// truncated byte string
+		{0x45, 0x01},
+		// indefinite length map
+		{0xbf, 0x61, 'a', 0x01, 0xff},
+		// byte string key
+		{0xa1, 0x41, 0x01, 0x01},
+		// array longer than the data
+		{0x9a, 0xff, 0xff, 0xff, 0xff},
+		// float
+		{0xf9, 0x3c, 0x00},
+	} {
+		_, _, err := decodeCBOR(invalid)
+		assert.NotNil(t, err, "%x", invalid)
+	}
+
+	// deeply nested arrays
+	nested := make([]byte, 100)
+	for i := range nested {
+		nested[i] = 0x81
+	}
+	_, _, err = decodeCBOR(nested)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,37 @@
+package crypto
+
+const dataKeySize = 32
+
+// NewDataKey returns a random key for a single file, and the same key
+// wrapped by c to be stored with the file. Leaking a data key only exposes
+// its file.
+func (c *CryptoData) NewDataKey() (key *CryptoData, wrapped []byte, err error) {
+	dataKey, err := RandomBytes(dataKeySize)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if wrapped, err = c.EncryptText(dataKey); err != nil {
+		return nil, nil, err
+	}
+
+	return &CryptoData{SymmetricKey: dataKey}, wrapped, nil
+}
+
+// DataKey unwraps a key returned by NewDataKey. Files stored before data
+// keys existed have none and are encrypted by c itself, so an empty wrapped
+// key returns c.
+func (c *CryptoData) DataKey(wrapped []byte) (*CryptoData, error) {
+	if len(wrapped) == 0 {
+		return c, nil
+	}
+
+	dataKey, err := c.DecryptText(wrapped)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &CryptoData{SymmetricKey: dataKey}, nil
+}
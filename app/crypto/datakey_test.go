@@ -0,0 +1,40 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDataKey(t *testing.T) {
+	master := newTestCryptoData()
+
+	key, wrapped, err := master.NewDataKey()
+	assert.Nil(t, err)
+	assert.False(t, bytes.Equal(master.SymmetricKey, key.SymmetricKey))
+
+	other, _, err := master.NewDataKey()
+	assert.Nil(t, err)
+	assert.False(t, bytes.Equal(key.SymmetricKey, other.SymmetricKey), "data keys are reused")
+
+	ciphertext := encryptTestStream(t, key, []byte("file contents"), StreamCipherAES256GCM, 64)
+
+	unwrapped, err := master.DataKey(wrapped)
+	assert.Nil(t, err)
+
+	var plaintext bytes.Buffer
+	assert.Nil(t, unwrapped.DecryptFile(bytes.NewReader(ciphertext), &plaintext, false))
+	assert.Equal(t, "file contents", plaintext.String())
+
+	// neither the master key nor another user's key can read the file
+	assert.NotNil(t, master.DecryptFile(bytes.NewReader(ciphertext), &plaintext, false))
+
+	_, err = NewCryptoData([]byte("other"), nil, []byte("salt"), 1000).DataKey(wrapped)
+	assert.NotNil(t, err)
+
+	// files without a data key use the master key
+	legacy, err := master.DataKey(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, master, legacy)
+}
@@ -0,0 +1,99 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	ErrorInvalidPasswordHash = "invalid argon2id password hash"
+	ErrorPasswordMismatch    = "password does not match hash"
+
+	passwordHashSaltSize = 16
+	passwordHashKeySize  = 32
+)
+
+var argon2idPrefix = []byte("$argon2id$")
+
+// NewArgon2idCryptoData is NewCryptoData with the key derived by Argon2id,
+// memory is in KiB.
+func NewArgon2idCryptoData(password []byte, hmacSecret []byte, salt []byte, time, memory, threads int) *CryptoData {
+	symmetricKey := argon2.IDKey(password, salt, uint32(time), uint32(memory), uint8(threads), 32)
+	return &CryptoData{SymmetricKey: symmetricKey, HMACSecret: hmacSecret, Salt: salt}
+}
+
+// HashPassword returns an Argon2id hash of password with a random salt, in the
+// PHC string format so the costs can be read back by PasswordHashParams.
+func HashPassword(password []byte, time, memory, threads int) ([]byte, error) {
+	salt, err := RandomBytes(passwordHashSaltSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey(password, salt, uint32(time), uint32(memory), uint8(threads), passwordHashKeySize)
+
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, memory, time, threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))), nil
+}
+
+// IsArgon2idHash reports whether hash was made by HashPassword.
+func IsArgon2idHash(hash []byte) bool {
+	return bytes.HasPrefix(hash, argon2idPrefix)
+}
+
+func parsePasswordHash(hash []byte) (salt, key []byte, time, memory, threads int, err error) {
+	fields := bytes.Split(hash, []byte("$"))
+
+	if len(fields) != 6 || !IsArgon2idHash(hash) {
+		return nil, nil, 0, 0, 0, errors.New(ErrorInvalidPasswordHash)
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(string(fields[2]), "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, 0, 0, 0, errors.New(ErrorInvalidPasswordHash)
+	}
+
+	if _, err := fmt.Sscanf(string(fields[3]), "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil ||
+		memory < 1 || time < 1 || threads < 1 || threads > 255 {
+		return nil, nil, 0, 0, 0, errors.New(ErrorInvalidPasswordHash)
+	}
+
+	if salt, err = base64.RawStdEncoding.DecodeString(string(fields[4])); err != nil {
+		return nil, nil, 0, 0, 0, errors.New(ErrorInvalidPasswordHash)
+	}
+
+	if key, err = base64.RawStdEncoding.DecodeString(string(fields[5])); err != nil || len(key) == 0 {
+		return nil, nil, 0, 0, 0, errors.New(ErrorInvalidPasswordHash)
+	}
+
+	return salt, key, time, memory, threads, nil
+}
+
+// PasswordHashParams returns the costs a hash made by HashPassword was
+// computed with.
+func PasswordHashParams(hash []byte) (time, memory, threads int, err error) {
+	_, _, time, memory, threads, err = parsePasswordHash(hash)
+	return time, memory, threads, err
+}
+
+// VerifyPassword checks password against a hash made by HashPassword.
+func VerifyPassword(hash, password []byte) error {
+	salt, key, time, memory, threads, err := parsePasswordHash(hash)
+
+	if err != nil {
+		return err
+	}
+
+	computed := argon2.IDKey(password, salt, uint32(time), uint32(memory), uint8(threads), uint32(len(key)))
+
+	if subtle.ConstantTimeCompare(key, computed) != 1 {
+		return errors.New(ErrorPasswordMismatch)
+	}
+	return nil
+}
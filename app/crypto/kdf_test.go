@@ -0,0 +1,69 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordHash(t *testing.T) {
+	hash, err := HashPassword([]byte("password"), 2, 1024, 1)
+	assert.Nil(t, err)
+	assert.True(t, IsArgon2idHash(hash))
+
+	other, _ := HashPassword([]byte("password"), 2, 1024, 1)
+	assert.False(t, bytes.Equal(hash, other), "hashes of the same password share a salt")
+
+	time, memory, threads, err := PasswordHashParams(hash)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{2, 1024, 1}, []int{time, memory, threads})
+
+	assert.Nil(t, VerifyPassword(hash, []byte("password")))
+
+	err = VerifyPassword(hash, []byte("Password"))
+	if assert.NotNil(t, err) {
+		assert.Equal(t, ErrorPasswordMismatch, err.Error())
+	}
+
+	type testCase struct {
+		hash string
+	}
+
+	tests := []testCase{
+		testCase{"$2a$04$abcdefghijklmnopqrstuu"},
+		testCase{"$argon2id$v=19$m=1024,t=2,p=1$c2FsdA"},
+		testCase{"$argon2id$v=16$m=1024,t=2,p=1$c2FsdA$a2V5"},
+		testCase{"$argon2id$v=19$m=1024,t=0,p=1$c2FsdA$a2V5"},
+		testCase{"$argon2id$v=19$m=1024,t=2,p=1$c2FsdA$!!"},
+	}
+
+	for _, test := range tests {
+		err := VerifyPassword([]byte(test.hash), []byte("password"))
+		if assert.NotNil(t, err, test.hash) {
+			assert.Equal(t, ErrorInvalidPasswordHash, err.Error())
+		}
+	}
+}
+
+func TestArgon2idCryptoData(t *testing.T) {
+	c := NewArgon2idCryptoData([]byte("password"), nil, []byte("salt"), 1, 1024, 1)
+	ciphertext, err := c.EncryptText([]byte("secret"))
+	assert.Nil(t, err)
+
+	plaintext, err := NewArgon2idCryptoData([]byte("password"), nil, []byte("salt"), 1, 1024, 1).DecryptText(ciphertext)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("secret"), plaintext)
+
+	// every parameter changes the key
+	for _, other := range []*CryptoData{
+		NewArgon2idCryptoData([]byte("password"), nil, []byte("salt2"), 1, 1024, 1),
+		NewArgon2idCryptoData([]byte("password"), nil, []byte("salt"), 2, 1024, 1),
+		NewArgon2idCryptoData([]byte("password"), nil, []byte("salt"), 1, 2048, 1),
+		NewArgon2idCryptoData([]byte("password"), nil, []byte("salt"), 1, 1024, 2),
+		NewCryptoData([]byte("password"), nil, []byte("salt"), 1),
+	} {
+		_, err := other.DecryptText(ciphertext)
+		assert.NotNil(t, err)
+	}
+}
@@ -0,0 +1,56 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"io"
+	"strconv"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// The symmetric key of a CryptoData is the secret the keys used to encrypt
+// are derived from with HKDF, one for each purpose and format version, so no
+// key encrypts two kinds of things and a new purpose gets a key of its own.
+// Formats from before use the symmetric key itself, legacy OpenPGP files as
+// their passphrase.
+//
+// The HMAC secret is a separate secret, the key of blind indexes is derived
+// from it the same way. What the indexes hash is told apart by their prefix.
+const (
+	PurposeDataKey    = "data_key"
+	PurposeFilename   = "filename"
+	PurposeMetadata   = "metadata"
+	PurposeContents   = "contents"
+	PurposeFolderName = "folder_name"
+	PurposeUpload     = "upload"
+	PurposeTOTP       = "totp"
+	PurposeBlindIndex = "blind_index"
+
+	subkeyInfo = "gscrypto subkey"
+	subkeySize = 32
+)
+
+// Subkey returns the key of purpose in format version derived from c, which
+// authenticates the same associated data as c.
+func (c *CryptoData) Subkey(purpose string, version int) *CryptoData {
+	return &CryptoData{SymmetricKey: deriveSubkey(c.SymmetricKey, purpose, version), AssociatedData: c.AssociatedData}
+}
+
+// IndexSubkey returns a copy of c whose HMAC secret is the key of blind
+// indexes in format version derived from it.
+func (c *CryptoData) IndexSubkey(version int) *CryptoData {
+	indexed := *c
+	indexed.HMACSecret = deriveSubkey(c.HMACSecret, PurposeBlindIndex, version)
+	return &indexed
+}
+
+func deriveSubkey(secret []byte, purpose string, version int) []byte {
+	key := make([]byte, subkeySize)
+	info := Context(subkeyInfo, purpose, strconv.Itoa(version))
+
+	// HKDF only runs out after 255 hashes worth of output
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, info), key); err != nil {
+		panic(err)
+	}
+	return key
+}
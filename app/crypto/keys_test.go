@@ -0,0 +1,55 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubkey(t *testing.T) {
+	c := newTestCryptoData()
+	filename := c.Subkey(PurposeFilename, 2)
+
+	assert.Equal(t, filename.SymmetricKey, c.Subkey(PurposeFilename, 2).SymmetricKey)
+	assert.Len(t, filename.SymmetricKey, subkeySize)
+
+	keys := [][]byte{c.SymmetricKey, filename.SymmetricKey, c.Subkey(PurposeFilename, 3).SymmetricKey,
+		c.Subkey(PurposeContents, 2).SymmetricKey, NewCryptoData([]byte("other"), nil, []byte("salt"), 1000).Subkey(PurposeFilename, 2).SymmetricKey}
+
+	for i := range keys {
+		for j := i + 1; j < len(keys); j++ {
+			assert.False(t, bytes.Equal(keys[i], keys[j]), "keys %d and %d are the same", i, j)
+		}
+	}
+
+	ciphertext, err := filename.EncryptText([]byte("name"))
+	assert.Nil(t, err)
+
+	_, err = c.DecryptText(ciphertext)
+	assert.NotNil(t, err)
+	_, err = c.Subkey(PurposeMetadata, 2).DecryptText(ciphertext)
+	assert.NotNil(t, err)
+
+	// the associated data is kept, but doesn't change the key
+	bound := c.WithAssociatedData([]byte("file")).Subkey(PurposeFilename, 2)
+	assert.Equal(t, []byte("file"), bound.AssociatedData)
+	assert.Equal(t, filename.SymmetricKey, bound.SymmetricKey)
+}
+
+func TestIndexSubkey(t *testing.T) {
+	c := newTestCryptoData()
+	indexed := c.IndexSubkey(2)
+
+	assert.Equal(t, c.SymmetricKey, indexed.SymmetricKey)
+	assert.Len(t, indexed.HMACSecret, subkeySize)
+	assert.Equal(t, indexed.HMACSecret, c.IndexSubkey(2).HMACSecret)
+
+	// it's neither the HMAC secret nor any other subkey
+	for _, key := range [][]byte{c.HMACSecret, c.IndexSubkey(3).HMACSecret, c.Subkey(PurposeBlindIndex, 2).SymmetricKey} {
+		assert.False(t, bytes.Equal(indexed.HMACSecret, key))
+	}
+
+	assert.NotEqual(t, c.FolderIndex("/a/"), indexed.FolderIndex("/a/"))
+	assert.NotEqual(t, c.GenerateHMAC([]byte("/a")), indexed.GenerateHMAC([]byte("/a")))
+}
@@ -0,0 +1,100 @@
+package crypto
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+const (
+	folderIndexPrefix = "folder:"
+	tagIndexPrefix    = "tag:"
+
+	// blind indexes are truncated HMACs, 128 bits are plenty to look
+	// records up and keep paths of nested folders short
+	blindIndexSize = 32
+)
+
+// FileMetadata is everything about a file which is stored encrypted by its
+// data key, apart from its name. The database only keeps the blind indexes of
+// Folder and Tags, which are what's looked up.
+type FileMetadata struct {
+	Folder      string   `json:"folder"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	FileType    string   `json:"file_type,omitempty"`
+	FileSize    int64    `json:"file_size"`
+}
+
+func (c *CryptoData) EncryptMetadata(m *FileMetadata) ([]byte, error) {
+	encoded, err := json.Marshal(m)
+
+	if err != nil {
+		return nil, err
+	}
+	return c.EncryptText(encoded)
+}
+
+func (c *CryptoData) DecryptMetadata(encrypted []byte) (*FileMetadata, error) {
+	encoded, err := c.DecryptText(encrypted)
+
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(FileMetadata)
+	if err := json.Unmarshal(encoded, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *CryptoData) blindIndex(value string) string {
+	return c.GenerateHMAC([]byte(value))[:blindIndexSize]
+}
+
+// folderNames splits a folder such as "/a/b/" into its names.
+func folderNames(folder string) []string {
+	var names []string
+
+	for _, name := range strings.Split(folder, "/") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// FolderIndex returns the blind index of folder, which is "/" followed by
+// an index for each folder on the way, the HMAC of the path up to it. It's
+// looked up a folder at a time like the path, but two folders with the same
+// name in different places can't be told apart from two different names.
+func (c *CryptoData) FolderIndex(folder string) string {
+	index, path := "/", "/"
+
+	for _, name := range folderNames(folder) {
+		path += name + "/"
+		index += c.blindIndex(folderIndexPrefix+path) + "/"
+	}
+	return index
+}
+
+// EncryptFolderNames encrypts each name in folder, in the same order as the
+// indexes of FolderIndex.
+func (c *CryptoData) EncryptFolderNames(folder string) ([][]byte, error) {
+	var encrypted [][]byte
+
+	for _, name := range folderNames(folder) {
+		e, err := c.EncryptText([]byte(name))
+
+		if err != nil {
+			return nil, err
+		}
+		encrypted = append(encrypted, e)
+	}
+	return encrypted, nil
+}
+
+// TagIndex returns the blind index of tag, tags are case insensitive.
+func (c *CryptoData) TagIndex(tag string) string {
+	return c.blindIndex(tagIndexPrefix + strings.ToLower(strings.TrimSpace(tag)))
+}
@@ -0,0 +1,52 @@
+package crypto
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadata(t *testing.T) {
+	c := newTestCryptoData()
+	m := &FileMetadata{Folder: "/a/b/", Description: "secret", Tags: []string{"x", "y"}, FileType: "text/plain", FileSize: 42}
+
+	encrypted, err := c.EncryptMetadata(m)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(encrypted), "secret")
+
+	decrypted, err := c.DecryptMetadata(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, m, decrypted)
+
+	_, err = NewCryptoData([]byte("other"), nil, []byte("salt"), 1000).DecryptMetadata(encrypted)
+	assert.NotNil(t, err)
+}
+
+func TestBlindIndexes(t *testing.T) {
+	c := newTestCryptoData()
+	other := NewCryptoData([]byte("password"), []byte("other hmac secret"), []byte("salt"), 1000)
+
+	assert.Equal(t, "/", c.FolderIndex("/"))
+
+	ab := c.FolderIndex("/a/b/")
+	segments := strings.Split(strings.Trim(ab, "/"), "/")
+	assert.Len(t, segments, 2)
+	assert.True(t, strings.HasPrefix(ab, c.FolderIndex("/a/")), "the index of a folder doesn't start with its parent's")
+	assert.NotContains(t, ab, "a/")
+
+	// b is another folder in /b/ than in /a/b/
+	assert.NotEqual(t, segments[1], strings.Trim(c.FolderIndex("/b/"), "/"))
+	assert.NotEqual(t, ab, other.FolderIndex("/a/b/"))
+
+	names, err := c.EncryptFolderNames("/a/b/")
+	assert.Nil(t, err)
+	assert.Len(t, names, 2)
+	b, err := c.DecryptText(names[1])
+	assert.Nil(t, err)
+	assert.Equal(t, "b", string(b))
+
+	assert.Equal(t, c.TagIndex("Tag "), c.TagIndex("tag"))
+	assert.NotEqual(t, c.TagIndex("tag"), other.TagIndex("tag"))
+	assert.NotEqual(t, c.TagIndex("a"), strings.Trim(c.FolderIndex("/a/"), "/"))
+}
@@ -1,13 +1,15 @@
 package crypto
 
 import (
+	"bufio"
+	"bytes"
 	"crypto"
-	"encoding/base64"
 	"errors"
 	"io"
+	"io/ioutil"
 
-	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
 	"golang.org/x/crypto/openpgp/packet"
 )
 
@@ -28,8 +30,6 @@ func init() {
 		DefaultCipher:          packet.CipherAES256,
 		DefaultCompressionAlgo: packet.CompressionNone,
 	}
-
-	log.SetLevel(log.DebugLevel)
 }
 
 func (c *CryptoData) EncryptFile(src io.Reader, w io.Writer, compress bool) (written int64, err error) {
@@ -42,7 +42,6 @@ func (c *CryptoData) EncryptFile(src io.Reader, w io.Writer, compress bool) (wri
 		packetConfig = packetConfigCompression
 	}
 
-	log.WithFields(log.Fields{"key": base64.StdEncoding.EncodeToString(c.SymmetricKey)}).Debug("encrypting")
 	cipherText, err := openpgp.SymmetricallyEncrypt(w, password, nil, &packetConfig)
 
 	if err != nil {
@@ -62,7 +61,22 @@ func (c *CryptoData) EncryptFile(src io.Reader, w io.Writer, compress bool) (wri
 	return
 }
 
+// DecryptFile decrypts both the segmented format and legacy OpenPGP messages,
+// compressed is only used for the latter.
 func (c *CryptoData) DecryptFile(r io.Reader, w io.Writer, compressed bool) (err error) {
+	br := bufio.NewReader(r)
+
+	if magic, _ := br.Peek(len(streamMagic)); IsStreamFormat(magic) {
+		plaintext, err := c.NewDecryptReader(br)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(w, plaintext)
+		return err
+	}
+
 	var packetConfig packet.Config
 	password := c.SymmetricKey
 	failed := false
@@ -73,7 +87,6 @@ func (c *CryptoData) DecryptFile(r io.Reader, w io.Writer, compressed bool) (err
 		packetConfig = packetConfigCompression
 	}
 
-	log.WithFields(log.Fields{"key": base64.StdEncoding.EncodeToString(c.SymmetricKey)}).Debug("decrypting")
 	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
 		// If the given passphrase isn't correct, the function will be called again, forever.
 		if failed {
@@ -83,7 +96,7 @@ func (c *CryptoData) DecryptFile(r io.Reader, w io.Writer, compressed bool) (err
 		return password, nil
 	}
 
-	md, err := openpgp.ReadMessage(r, nil, prompt, &packetConfig)
+	md, err := openpgp.ReadMessage(br, nil, prompt, &packetConfig)
 
 	if err != nil {
 		return
@@ -92,3 +105,62 @@ func (c *CryptoData) DecryptFile(r io.Reader, w io.Writer, compressed bool) (err
 	io.Copy(w, md.UnverifiedBody)
 	return
 }
+
+// EncryptArmored encrypts plaintext with passphrase into an armored OpenPGP
+// message, which gpg decrypts as well.
+func EncryptArmored(plaintext, passphrase []byte) ([]byte, error) {
+	var armored bytes.Buffer
+	w, err := NewArmorWriter(&armored)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := openpgp.SymmetricallyEncrypt(w, passphrase, &openpgp.FileHints{IsBinary: true}, &packetConfigNoCompression)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := ciphertext.Write(plaintext); err != nil {
+		return nil, err
+	}
+
+	if err := ciphertext.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return armored.Bytes(), nil
+}
+
+// DecryptArmored decrypts a message of EncryptArmored, it fails if the
+// passphrase is wrong or the message was changed.
+func DecryptArmored(armored, passphrase []byte) ([]byte, error) {
+	block, err := armor.Decode(bytes.NewReader(armored))
+
+	if err != nil {
+		return nil, err
+	}
+
+	failed := false
+	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		// called again as long as the passphrase is wrong
+		if failed {
+			return nil, errors.New("decryption failed")
+		}
+		failed = true
+		return passphrase, nil
+	}
+
+	md, err := openpgp.ReadMessage(block.Body, nil, prompt, &packetConfigNoCompression)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the integrity of the message is checked once it's read to the end
+	return ioutil.ReadAll(md.UnverifiedBody)
+}
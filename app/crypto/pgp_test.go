@@ -0,0 +1,24 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptArmored(t *testing.T) {
+	armored, err := EncryptArmored([]byte("secret keys"), []byte("passphrase"))
+	assert.Nil(t, err)
+	assert.True(t, bytes.HasPrefix(armored, []byte("-----BEGIN PGP MESSAGE-----")))
+
+	plaintext, err := DecryptArmored(armored, []byte("passphrase"))
+	assert.Nil(t, err)
+	assert.Equal(t, "secret keys", string(plaintext))
+
+	_, err = DecryptArmored(armored, []byte("wrong passphrase"))
+	assert.NotNil(t, err)
+
+	_, err = DecryptArmored([]byte("not armored"), []byte("passphrase"))
+	assert.NotNil(t, err)
+}
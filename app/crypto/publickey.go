@@ -0,0 +1,103 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+const (
+	ErrorInvalidPublicKeys = "not a valid OpenPGP public key"
+	ErrorPrivateKeySent    = "send the public key only, not the private key"
+	ErrorNoEncryptionKey   = "OpenPGP key can't be encrypted to"
+)
+
+// ReadPublicKeys parses an armored OpenPGP keyring, every key in it must be
+// one files can be encrypted to.
+func ReadPublicKeys(armored []byte) (openpgp.EntityList, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(armored))
+
+	if err != nil || len(entities) == 0 {
+		return nil, errors.New(ErrorInvalidPublicKeys)
+	}
+
+	for _, e := range entities {
+		if e.PrivateKey != nil {
+			return nil, errors.New(ErrorPrivateKeySent)
+		}
+
+		// revoked, expired or signing only keys can't be encrypted to
+		w, err := openpgp.Encrypt(ioutil.Discard, openpgp.EntityList{e}, nil, nil, &packetConfigNoCompression)
+
+		if err != nil {
+			return nil, errors.New(ErrorNoEncryptionKey)
+		}
+		w.Close()
+	}
+	return entities, nil
+}
+
+// ArmorPublicKeys serializes the public part of entities as an armored
+// keyring.
+func ArmorPublicKeys(entities openpgp.EntityList) ([]byte, error) {
+	var keyring bytes.Buffer
+	w, err := armor.Encode(&keyring, openpgp.PublicKeyType, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entities {
+		if err := e.Serialize(w); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return keyring.Bytes(), nil
+}
+
+// Fingerprints returns the fingerprints of the primary keys of entities, the
+// way gpg prints them.
+func Fingerprints(entities openpgp.EntityList) []string {
+	fingerprints := make([]string, 0, len(entities))
+
+	for _, e := range entities {
+		fingerprints = append(fingerprints, fmt.Sprintf("%X", e.PrimaryKey.Fingerprint))
+	}
+	return fingerprints
+}
+
+// EncryptToPublicKeys encrypts src to every key in the armored keyring, only
+// their private keys can decrypt it. It returns the size of the plaintext.
+func EncryptToPublicKeys(src io.Reader, w io.Writer, armored []byte) (written int64, err error) {
+	entities, err := ReadPublicKeys(armored)
+
+	if err != nil {
+		return 0, err
+	}
+
+	ciphertext, err := openpgp.Encrypt(w, entities, nil, &openpgp.FileHints{IsBinary: true}, &packetConfigNoCompression)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if written, err = io.Copy(ciphertext, src); err != nil {
+		return written, err
+	}
+	return written, ciphertext.Close()
+}
+
+// NewArmorWriter armors an OpenPGP message written to it into w, it's
+// complete once closed.
+func NewArmorWriter(w io.Writer) (io.WriteCloser, error) {
+	return armor.Encode(w, "PGP MESSAGE", nil)
+}
@@ -0,0 +1,83 @@
+package crypto
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func newTestEntity(t *testing.T, name string) *openpgp.Entity {
+	e, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	assert.Nil(t, err)
+
+	// like keys made by gpg, prefer SHA-256 to the RIPEMD-160 default
+	for _, id := range e.Identities {
+		id.SelfSignature.PreferredHash = []uint8{8}
+		assert.Nil(t, id.SelfSignature.SignUserId(id.UserId.Id, e.PrimaryKey, e.PrivateKey, nil))
+	}
+	return e
+}
+
+func armoredPublicKeys(t *testing.T, entities ...*openpgp.Entity) []byte {
+	keys, err := ArmorPublicKeys(entities)
+	assert.Nil(t, err)
+	return keys
+}
+
+func TestPublicKeys(t *testing.T) {
+	alice, bob := newTestEntity(t, "alice"), newTestEntity(t, "bob")
+	keys := armoredPublicKeys(t, alice, bob)
+
+	entities, err := ReadPublicKeys(keys)
+	assert.Nil(t, err)
+	assert.Len(t, entities, 2)
+	assert.Equal(t, []string{Fingerprints(openpgp.EntityList{alice})[0], Fingerprints(openpgp.EntityList{bob})[0]}, Fingerprints(entities))
+	assert.Len(t, Fingerprints(entities)[0], 40)
+
+	var ciphertext bytes.Buffer
+	written, err := EncryptToPublicKeys(bytes.NewReader([]byte("file contents")), &ciphertext, keys)
+	assert.Nil(t, err)
+	assert.EqualValues(t, len("file contents"), written)
+
+	// each recipient can decrypt it on their own
+	for _, e := range []*openpgp.Entity{alice, bob} {
+		md, err := openpgp.ReadMessage(bytes.NewReader(ciphertext.Bytes()), openpgp.EntityList{e}, nil, nil)
+		assert.Nil(t, err)
+		plaintext, _ := ioutil.ReadAll(md.UnverifiedBody)
+		assert.Equal(t, "file contents", string(plaintext))
+	}
+
+	_, err = openpgp.ReadMessage(bytes.NewReader(ciphertext.Bytes()), openpgp.EntityList{newTestEntity(t, "eve")}, nil, nil)
+	assert.NotNil(t, err)
+
+	var armored bytes.Buffer
+	w, err := NewArmorWriter(&armored)
+	assert.Nil(t, err)
+	w.Write(ciphertext.Bytes())
+	assert.Nil(t, w.Close())
+
+	block, err := armor.Decode(&armored)
+	assert.Nil(t, err)
+	dearmored, _ := ioutil.ReadAll(block.Body)
+	assert.Equal(t, ciphertext.Bytes(), dearmored)
+}
+
+func TestInvalidPublicKeys(t *testing.T) {
+	_, err := ReadPublicKeys([]byte("not a key"))
+	assert.Equal(t, ErrorInvalidPublicKeys, err.Error())
+
+	var private bytes.Buffer
+	w, _ := armor.Encode(&private, openpgp.PrivateKeyType, nil)
+	assert.Nil(t, newTestEntity(t, "alice").SerializePrivate(w, nil))
+	w.Close()
+
+	_, err = ReadPublicKeys(private.Bytes())
+	assert.Equal(t, ErrorPrivateKeySent, err.Error())
+
+	_, err = EncryptToPublicKeys(bytes.NewReader(nil), ioutil.Discard, []byte("not a key"))
+	assert.NotNil(t, err)
+}
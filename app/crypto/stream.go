@@ -0,0 +1,552 @@
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Files are stored as a header followed by independently sealed segments:
+//
+//	header:  magic "GSCF" | version | cipher | segment size (uint32) | salt (16) | nonce prefix (7)
+//	segment: AEAD(plaintext segment) with nonce = nonce prefix | counter (uint32) | last segment flag
+//
+// The file key is derived from the symmetric key and the salt, and the whole
+// header, followed by the associated data of the key, is authenticated as
+// associated data of every segment. Segment i
+// starts at headerSize + i*(segment size + tag size) in the ciphertext, so any
+// part of a file can be read without decrypting what comes before it. Only the
+// last segment has its flag set, which detects truncation, and it is the only
+// one that may be shorter than the segment size.
+const (
+	StreamCipherAES256GCM        byte = 1
+	StreamCipherChaCha20Poly1305 byte = 2
+
+	DefaultSegmentSize = 64 * 1024
+	MaxSegmentSize     = 16 * 1024 * 1024
+
+	streamVersion     = 1
+	streamSaltSize    = 16
+	streamPrefixSize  = 7
+	streamTagSize     = 16
+	streamHeaderSize  = 4 + 1 + 1 + 4 + streamSaltSize + streamPrefixSize
+	streamKeyInfo     = "gscrypto stream file key"
+	maxStreamSegments = 1<<32 - 1
+)
+
+const (
+	ErrorInvalidStreamHeader = "invalid encrypted file header"
+	ErrorSegmentAuthFailed   = "encrypted file segment failed authentication"
+	ErrorStreamTruncated     = "encrypted file is truncated"
+	ErrorStreamTooLarge      = "file is too large for its segment size"
+)
+
+var streamMagic = []byte("GSCF")
+
+type streamCipher struct {
+	aead           cipher.AEAD
+	associatedData []byte
+	noncePrefix    []byte
+	segmentSize    int
+}
+
+func newStreamAEAD(cipherID byte, key []byte) (cipher.AEAD, error) {
+	switch cipherID {
+	case StreamCipherAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case StreamCipherChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	default:
+		return nil, errors.New(ErrorInvalidStreamHeader)
+	}
+}
+
+// parseStreamHeader returns the segment size of header, the cipher is only
+// checked when the key is derived.
+func parseStreamHeader(header []byte) (int, error) {
+	if len(header) != streamHeaderSize || !bytes.Equal(header[:4], streamMagic) || header[4] != streamVersion {
+		return 0, errors.New(ErrorInvalidStreamHeader)
+	}
+
+	segmentSize := binary.BigEndian.Uint32(header[6:10])
+
+	if segmentSize == 0 || segmentSize > MaxSegmentSize {
+		return 0, errors.New(ErrorInvalidStreamHeader)
+	}
+	return int(segmentSize), nil
+}
+
+// streamLayout returns the number of segments, and the size of the
+// plaintext, of a size bytes long encrypted file.
+func streamLayout(segmentSize int, size int64) (segments, plaintext int64, err error) {
+	encryptedSegment := int64(segmentSize + streamTagSize)
+	body := size - streamHeaderSize
+	segments = (body + encryptedSegment - 1) / encryptedSegment
+
+	if segments <= 0 || body-(segments-1)*encryptedSegment < streamTagSize {
+		return 0, 0, errors.New(ErrorStreamTruncated)
+	}
+	return segments, body - segments*streamTagSize, nil
+}
+
+func (c *CryptoData) newStreamCipher(header []byte) (*streamCipher, error) {
+	segmentSize, err := parseStreamHeader(header)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cipherID := header[5]
+	salt := header[10 : 10+streamSaltSize]
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, c.SymmetricKey, salt, []byte(streamKeyInfo)), key); err != nil {
+		return nil, err
+	}
+
+	aead, err := newStreamAEAD(cipherID, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamCipher{
+		aead:           aead,
+		associatedData: append(append([]byte(nil), header...), c.AssociatedData...),
+		noncePrefix:    header[10+streamSaltSize:],
+		segmentSize:    segmentSize,
+	}, nil
+}
+
+func (s *streamCipher) nonce(counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, s.aead.NonceSize())
+	nonce = append(nonce, s.noncePrefix...)
+	nonce = append(nonce, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(nonce[streamPrefixSize:], counter)
+
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+func (s *streamCipher) seal(dst, plaintext []byte, counter uint32, last bool) []byte {
+	return s.aead.Seal(dst, s.nonce(counter, last), plaintext, s.associatedData)
+}
+
+func (s *streamCipher) open(dst, ciphertext []byte, counter uint32, last bool) ([]byte, error) {
+	plaintext, err := s.aead.Open(dst, s.nonce(counter, last), ciphertext, s.associatedData)
+
+	if err != nil {
+		return nil, errors.New(ErrorSegmentAuthFailed)
+	}
+	return plaintext, nil
+}
+
+// IsStreamFormat reports whether data starts like a file written by
+// NewEncryptWriter, rather than a legacy OpenPGP message.
+func IsStreamFormat(data []byte) bool {
+	return bytes.HasPrefix(data, streamMagic)
+}
+
+// ReadStreamHeader reads the header of an encrypted file from r. It can be
+// checked without the key, so files encrypted by a client are validated by
+// the server too.
+func ReadStreamHeader(r io.Reader) ([]byte, error) {
+	header := make([]byte, streamHeaderSize)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.New(ErrorInvalidStreamHeader)
+	}
+
+	if _, err := parseStreamHeader(header); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// PlaintextSize returns the size of the plaintext of a size bytes long
+// encrypted file starting with header.
+func PlaintextSize(header []byte, size int64) (int64, error) {
+	segmentSize, err := parseStreamHeader(header)
+
+	if err != nil {
+		return 0, err
+	}
+
+	_, plaintext, err := streamLayout(segmentSize, size)
+	return plaintext, err
+}
+
+// StreamSize returns the size of the ciphertext of a plaintext of size bytes.
+func StreamSize(size int64, segmentSize int) int64 {
+	segments := (size + int64(segmentSize) - 1) / int64(segmentSize)
+
+	if segments == 0 {
+		segments = 1
+	}
+	return streamHeaderSize + size + segments*streamTagSize
+}
+
+// EncryptWriter encrypts everything written to it using the segmented format.
+type EncryptWriter struct {
+	w       io.Writer
+	stream  *streamCipher
+	buf     []byte
+	out     []byte
+	counter uint32
+	closed  bool
+}
+
+// NewStreamHeader returns the header of a new encrypted file, with a random
+// salt and nonce prefix.
+func NewStreamHeader(cipherID byte, segmentSize int) ([]byte, error) {
+	if segmentSize <= 0 || segmentSize > MaxSegmentSize {
+		return nil, errors.New("invalid segment size")
+	}
+
+	header := make([]byte, streamHeaderSize)
+	copy(header, streamMagic)
+	header[4] = streamVersion
+	header[5] = cipherID
+	binary.BigEndian.PutUint32(header[6:10], uint32(segmentSize))
+
+	random, err := RandomBytes(streamSaltSize + streamPrefixSize)
+	if err != nil {
+		return nil, err
+	}
+	copy(header[10:], random)
+
+	return header, nil
+}
+
+// NewEncryptWriter returns a writer which encrypts everything written to it
+// into w using the segmented format. Close must be called to write the last
+// segment, it doesn't close w.
+func (c *CryptoData) NewEncryptWriter(w io.Writer, cipherID byte, segmentSize int) (*EncryptWriter, error) {
+	header, err := NewStreamHeader(cipherID, segmentSize)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := c.ResumeEncryptWriter(w, header, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// ResumeEncryptWriter continues a file whose header and first segments were
+// written earlier, possibly to a different writer. pending is the plaintext
+// which was written but not yet encrypted, as returned by Pending. Nothing
+// is written to w before the next segment is complete.
+func (c *CryptoData) ResumeEncryptWriter(w io.Writer, header []byte, segments int64, pending []byte) (*EncryptWriter, error) {
+	stream, err := c.newStreamCipher(header)
+	if err != nil {
+		return nil, err
+	}
+
+	if segments < 0 || segments > maxStreamSegments || len(pending) > stream.segmentSize {
+		return nil, errors.New("invalid encrypt writer state")
+	}
+
+	buf := make([]byte, len(pending), stream.segmentSize)
+	copy(buf, pending)
+
+	return &EncryptWriter{
+		w:       w,
+		stream:  stream,
+		buf:     buf,
+		out:     make([]byte, 0, stream.segmentSize+streamTagSize),
+		counter: uint32(segments),
+	}, nil
+}
+
+// Segments returns the number of segments written so far.
+func (e *EncryptWriter) Segments() int64 {
+	return int64(e.counter)
+}
+
+// Pending returns a copy of the plaintext which hasn't been written as a
+// segment yet, at most one segment's worth.
+func (e *EncryptWriter) Pending() []byte {
+	return append([]byte(nil), e.buf...)
+}
+
+func (e *EncryptWriter) writeSegment(last bool) error {
+	if e.counter == maxStreamSegments && !last {
+		return errors.New(ErrorStreamTooLarge)
+	}
+
+	e.out = e.stream.seal(e.out[:0], e.buf, e.counter, last)
+	e.buf = e.buf[:0]
+	e.counter++
+
+	_, err := e.w.Write(e.out)
+	return err
+}
+
+func (e *EncryptWriter) Write(p []byte) (n int, err error) {
+	if e.closed {
+		return 0, errors.New("write to closed encrypt writer")
+	}
+
+	for len(p) > 0 {
+		// a full segment is only written once more data arrives, since
+		// whether it's the last one is only known then.
+		if len(e.buf) == e.stream.segmentSize {
+			if err := e.writeSegment(false); err != nil {
+				return n, err
+			}
+		}
+
+		copied := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+copied]
+		p = p[copied:]
+		n += copied
+	}
+	return n, nil
+}
+
+func (e *EncryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+
+	return e.writeSegment(true)
+}
+
+// EncryptStream encrypts src into w using AES-256-GCM and the default segment
+// size, and returns the number of plaintext bytes written.
+func (c *CryptoData) EncryptStream(src io.Reader, w io.Writer) (written int64, err error) {
+	ew, err := c.NewEncryptWriter(w, StreamCipherAES256GCM, DefaultSegmentSize)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if written, err = io.Copy(ew, src); err != nil {
+		return written, err
+	}
+
+	return written, ew.Close()
+}
+
+type decryptReader struct {
+	r       *bufio.Reader
+	stream  *streamCipher
+	in      []byte
+	plain   []byte
+	counter uint32
+	done    bool
+}
+
+// NewDecryptReader returns a reader of the plaintext of a file written by
+// NewEncryptWriter. Every segment is authenticated before it's returned.
+func (c *CryptoData) NewDecryptReader(r io.Reader) (io.Reader, error) {
+	header := make([]byte, streamHeaderSize)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.New(ErrorInvalidStreamHeader)
+	}
+
+	stream, err := c.newStreamCipher(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		r:      bufio.NewReader(r),
+		stream: stream,
+		in:     make([]byte, stream.segmentSize+streamTagSize),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		if err := d.nextSegment(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) nextSegment() error {
+	n, err := io.ReadFull(d.r, d.in)
+
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		d.done = true
+	case err != nil:
+		return err
+	default:
+		// a full segment is the last one if nothing follows it
+		if _, err := d.r.Peek(1); err == io.EOF {
+			d.done = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if n < streamTagSize {
+		return errors.New(ErrorStreamTruncated)
+	}
+
+	plain, err := d.stream.open(d.in[:0], d.in[:n], d.counter, d.done)
+	if err != nil {
+		return err
+	}
+
+	d.counter++
+	d.plain = plain
+	return nil
+}
+
+// DecryptReaderAt gives random access to the plaintext of a file written by
+// NewEncryptWriter, only the segments covering a read are decrypted. The last
+// segment read is kept, so reads smaller than a segment don't decrypt it again
+// and the underlying reader sees sequential reads as sequential.
+type DecryptReaderAt struct {
+	r        io.ReaderAt
+	stream   *streamCipher
+	size     int64
+	segments int64
+
+	mu     sync.Mutex
+	in     []byte
+	cached int64
+	plain  []byte
+}
+
+// NewDecryptReaderAt reads the header of the size bytes long encrypted file r.
+func (c *CryptoData) NewDecryptReaderAt(r io.ReaderAt, size int64) (*DecryptReaderAt, error) {
+	header := make([]byte, streamHeaderSize)
+
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, errors.New(ErrorInvalidStreamHeader)
+	}
+
+	stream, err := c.newStreamCipher(header)
+	if err != nil {
+		return nil, err
+	}
+
+	segments, plaintextSize, err := streamLayout(stream.segmentSize, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DecryptReaderAt{
+		r:        r,
+		stream:   stream,
+		size:     plaintextSize,
+		segments: segments,
+		cached:   -1,
+	}, nil
+}
+
+// Size returns the size of the plaintext.
+func (d *DecryptReaderAt) Size() int64 {
+	return d.size
+}
+
+// SegmentSize returns the size of the plaintext segments.
+func (d *DecryptReaderAt) SegmentSize() int {
+	return d.stream.segmentSize
+}
+
+// segment returns the plaintext of segment i, it must be called with mu held.
+func (d *DecryptReaderAt) segment(i int64) ([]byte, error) {
+	if i == d.cached {
+		return d.plain, nil
+	}
+
+	encryptedSegment := int64(d.stream.segmentSize + streamTagSize)
+	start := streamHeaderSize + i*encryptedSegment
+	length := encryptedSegment
+
+	last := i == d.segments-1
+	if last {
+		length = streamHeaderSize + d.size + d.segments*streamTagSize - start
+	}
+
+	if d.in == nil {
+		d.in = make([]byte, encryptedSegment)
+	}
+
+	// the previous segment is decrypted in place, reading overwrites it even
+	// if it fails
+	d.cached = -1
+
+	read, err := d.r.ReadAt(d.in[:length], start)
+
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if int64(read) < length {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	plain, err := d.stream.open(d.in[:0], d.in[:length], uint32(i), last)
+	if err != nil {
+		return nil, err
+	}
+
+	d.cached, d.plain = i, plain
+	return plain, nil
+}
+
+func (d *DecryptReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	segmentSize := int64(d.stream.segmentSize)
+
+	for n < len(p) && off < d.size {
+		i := off / segmentSize
+		plain, err := d.segment(i)
+
+		if err != nil {
+			return n, err
+		}
+
+		copied := copy(p[n:], plain[off-i*segmentSize:])
+		n += copied
+		off += int64(copied)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,253 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCryptoData() *CryptoData {
+	return NewCryptoData([]byte("password"), []byte("hmac secret"), []byte("salt"), 1000)
+}
+
+func encryptTestStream(t *testing.T, c *CryptoData, plaintext []byte, cipherID byte, segmentSize int) []byte {
+	var ciphertext bytes.Buffer
+
+	w, err := c.NewEncryptWriter(&ciphertext, cipherID, segmentSize)
+	assert.Nil(t, err)
+
+	// odd sized writes make sure segments don't follow write boundaries
+	for r := bytes.NewReader(plaintext); r.Len() > 0; {
+		io.CopyN(w, r, 7)
+	}
+	assert.Nil(t, w.Close())
+
+	assert.Equal(t, StreamSize(int64(len(plaintext)), segmentSize), int64(ciphertext.Len()))
+	return ciphertext.Bytes()
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	type testCase struct {
+		cipherID    byte
+		segmentSize int
+		size        int
+	}
+
+	tests := []testCase{
+		testCase{StreamCipherAES256GCM, 64, 0},
+		testCase{StreamCipherAES256GCM, 64, 1},
+		testCase{StreamCipherAES256GCM, 64, 64},
+		testCase{StreamCipherAES256GCM, 64, 65},
+		testCase{StreamCipherAES256GCM, 64, 1000},
+		testCase{StreamCipherChaCha20Poly1305, 64, 640},
+		testCase{StreamCipherChaCha20Poly1305, DefaultSegmentSize, 3*DefaultSegmentSize + 17},
+	}
+
+	c := newTestCryptoData()
+
+	for _, test := range tests {
+		plaintext, _ := RandomBytes(test.size)
+		ciphertext := encryptTestStream(t, c, plaintext, test.cipherID, test.segmentSize)
+
+		var decrypted bytes.Buffer
+		assert.Nil(t, c.DecryptFile(bytes.NewReader(ciphertext), &decrypted, false))
+		assert.Equal(t, plaintext, decrypted.Bytes())
+
+		ra, err := c.NewDecryptReaderAt(bytes.NewReader(ciphertext), int64(len(ciphertext)))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(test.size), ra.Size())
+
+		for _, off := range []int{0, 1, test.segmentSize - 1, test.segmentSize, test.size / 2, test.size - 1} {
+			if off < 0 || off >= test.size {
+				continue
+			}
+
+			p := make([]byte, 100)
+			n, err := ra.ReadAt(p, int64(off))
+			end := off + 100
+
+			if end > test.size {
+				end = test.size
+				assert.Equal(t, io.EOF, err)
+			} else {
+				assert.Nil(t, err)
+			}
+			assert.Equal(t, plaintext[off:end], p[:n])
+		}
+	}
+}
+
+// failingReaderAt fails its next read after failAfter bytes when fail is set,
+// the way a connection dropped halfway would.
+type failingReaderAt struct {
+	r         io.ReaderAt
+	fail      bool
+	failAfter int
+	err       error
+}
+
+func (f *failingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if !f.fail {
+		return f.r.ReadAt(p, off)
+	}
+
+	f.fail = false
+	n, _ := f.r.ReadAt(p[:f.failAfter], off)
+	return n, f.err
+}
+
+func TestDecryptReaderAtFailedRead(t *testing.T) {
+	c := newTestCryptoData()
+	plaintext, _ := RandomBytes(200)
+	ciphertext := encryptTestStream(t, c, plaintext, StreamCipherAES256GCM, 64)
+
+	for _, readErr := range []error{errors.New("connection reset"), io.EOF} {
+		r := &failingReaderAt{r: bytes.NewReader(ciphertext), failAfter: 10, err: readErr}
+		ra, err := c.NewDecryptReaderAt(r, int64(len(ciphertext)))
+		assert.Nil(t, err)
+
+		p := make([]byte, 10)
+		_, err = ra.ReadAt(p, 0)
+		assert.Nil(t, err)
+
+		// the failed read of the second segment overwrote the first
+		r.fail = true
+		_, err = ra.ReadAt(p, 64)
+		assert.NotNil(t, err)
+
+		_, err = ra.ReadAt(p, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, plaintext[:10], p)
+
+		_, err = ra.ReadAt(p, 64)
+		assert.Nil(t, err)
+		assert.Equal(t, plaintext[64:74], p)
+	}
+}
+
+func TestStreamResume(t *testing.T) {
+	c := newTestCryptoData()
+	plaintext, _ := RandomBytes(1000)
+
+	header, err := NewStreamHeader(StreamCipherChaCha20Poly1305, 64)
+	assert.Nil(t, err)
+
+	// every chunk goes to a separate part, as if each came with a new request
+	parts := [][]byte{header}
+	var segments int64
+	var pending []byte
+
+	for _, chunk := range [][]byte{plaintext[:10], plaintext[10:64], plaintext[64:65], plaintext[65:500], plaintext[500:]} {
+		var part bytes.Buffer
+
+		w, err := c.ResumeEncryptWriter(&part, header, segments, pending)
+		assert.Nil(t, err)
+
+		_, err = w.Write(chunk)
+		assert.Nil(t, err)
+
+		segments, pending = w.Segments(), w.Pending()
+		if len(parts) == 5 {
+			assert.Nil(t, w.Close())
+		}
+
+		parts = append(parts, part.Bytes())
+	}
+
+	ciphertext := bytes.Join(parts, nil)
+	assert.Equal(t, StreamSize(int64(len(plaintext)), 64), int64(len(ciphertext)))
+
+	var decrypted bytes.Buffer
+	assert.Nil(t, c.DecryptFile(bytes.NewReader(ciphertext), &decrypted, false))
+	assert.Equal(t, plaintext, decrypted.Bytes())
+
+	_, err = c.ResumeEncryptWriter(ioutil.Discard, header, 0, make([]byte, 65))
+	assert.NotNil(t, err)
+}
+
+func TestStreamTampering(t *testing.T) {
+	c := newTestCryptoData()
+	plaintext, _ := RandomBytes(200)
+	ciphertext := encryptTestStream(t, c, plaintext, StreamCipherAES256GCM, 64)
+
+	decrypt := func(ciphertext []byte) error {
+		r, err := c.NewDecryptReader(bytes.NewReader(ciphertext))
+		if err != nil {
+			return err
+		}
+		_, err = ioutil.ReadAll(r)
+		return err
+	}
+
+	assert.Nil(t, decrypt(ciphertext))
+
+	// flipping any bit, in the header or a segment, must fail
+	for _, i := range []int{5, 9, streamHeaderSize, streamHeaderSize + 80, len(ciphertext) - 1} {
+		tampered := append([]byte(nil), ciphertext...)
+		tampered[i] ^= 1
+		assert.NotNil(t, decrypt(tampered), "byte %d", i)
+	}
+
+	// dropping whole segments must fail too, not just partial ones
+	segment := 64 + streamTagSize
+	assert.NotNil(t, decrypt(ciphertext[:streamHeaderSize+2*segment]))
+	assert.NotNil(t, decrypt(ciphertext[:len(ciphertext)-1]))
+
+	// swapping segments breaks their counters
+	swapped := append([]byte(nil), ciphertext[:streamHeaderSize]...)
+	swapped = append(swapped, ciphertext[streamHeaderSize+segment:streamHeaderSize+2*segment]...)
+	swapped = append(swapped, ciphertext[streamHeaderSize:streamHeaderSize+segment]...)
+	swapped = append(swapped, ciphertext[streamHeaderSize+2*segment:]...)
+	assert.NotNil(t, decrypt(swapped))
+
+	other := NewCryptoData([]byte("another password"), nil, []byte("salt"), 1000)
+	_, err := other.NewDecryptReader(bytes.NewReader(ciphertext))
+	assert.Nil(t, err)
+	assert.NotNil(t, other.DecryptFile(bytes.NewReader(ciphertext), ioutil.Discard, false))
+}
+
+func TestLegacyOpenPGPFiles(t *testing.T) {
+	c := newTestCryptoData()
+
+	for _, compress := range []bool{true, false} {
+		plaintext := bytes.Repeat([]byte("legacy file "), 1000)
+
+		var ciphertext bytes.Buffer
+		_, err := c.EncryptFile(bytes.NewReader(plaintext), &ciphertext, compress)
+		assert.Nil(t, err)
+		assert.False(t, IsStreamFormat(ciphertext.Bytes()))
+
+		var decrypted bytes.Buffer
+		assert.Nil(t, c.DecryptFile(&ciphertext, &decrypted, compress))
+		assert.Equal(t, plaintext, decrypted.Bytes())
+	}
+}
+
+func TestPlaintextSize(t *testing.T) {
+	c := newTestCryptoData()
+
+	for _, size := range []int{0, 1, 64, 65, 1000} {
+		ciphertext := encryptTestStream(t, c, bytes.Repeat([]byte("a"), size), StreamCipherAES256GCM, 64)
+
+		header, err := ReadStreamHeader(bytes.NewReader(ciphertext))
+		assert.Nil(t, err)
+		assert.Equal(t, ciphertext[:streamHeaderSize], header)
+
+		plaintextSize, err := PlaintextSize(header, int64(len(ciphertext)))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(size), plaintextSize)
+
+		_, err = PlaintextSize(header, streamHeaderSize+streamTagSize-1)
+		assert.NotNil(t, err)
+	}
+
+	// plaintext, or an OpenPGP message, isn't accepted
+	_, err := ReadStreamHeader(bytes.NewReader(bytes.Repeat([]byte("a"), 100)))
+	assert.NotNil(t, err)
+	_, err = ReadStreamHeader(bytes.NewReader(streamMagic))
+	assert.NotNil(t, err)
+}
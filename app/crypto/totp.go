@@ -0,0 +1,88 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// TOTP codes are those of RFC 6238 authenticator apps expect: HMAC-SHA1, six
+// digits and a new code every 30 seconds. A code of the step before or after
+// is accepted too, for clocks which are a little off.
+const (
+	TOTPSecretSize = 20
+	TOTPDigits     = 6
+	TOTPPeriod     = 30
+	totpModulus    = 1000000
+	totpSkew       = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a random TOTP secret.
+func NewTOTPSecret() ([]byte, error) {
+	return RandomBytes(TOTPSecretSize)
+}
+
+// TOTPStep returns the time step of t.
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / TOTPPeriod
+}
+
+// TOTP returns the code of secret at step, the HOTP of RFC 4226 with the
+// step as the counter.
+func TOTP(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", TOTPDigits, code%totpModulus)
+}
+
+// VerifyTOTP checks code against secret at time t. Codes of steps up to
+// lastStep were used already and are refused, so each code logs in once. It
+// returns the step of the code.
+func VerifyTOTP(secret []byte, code string, t time.Time, lastStep int64) (int64, bool) {
+	now := TOTPStep(t)
+
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare([]byte(TOTP(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// TOTPSecretString returns secret the way it's typed into an authenticator
+// app.
+func TOTPSecretString(secret []byte) string {
+	return totpEncoding.EncodeToString(secret)
+}
+
+// TOTPURI returns the otpauth URI of secret, which authenticator apps add
+// from a QR code.
+func TOTPURI(issuer, account string, secret []byte) string {
+	params := url.Values{}
+	params.Set("secret", TOTPSecretString(secret))
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(TOTPDigits))
+	params.Set("period", fmt.Sprint(TOTPPeriod))
+
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
@@ -0,0 +1,61 @@
+package crypto
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTP(t *testing.T) {
+	// the SHA-1 test vectors of RFC 6238, which are 8 digits long
+	secret := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	}
+
+	for unix, code := range vectors {
+		assert.Equal(t, code[2:], TOTP(secret, TOTPStep(time.Unix(unix, 0))), "time %d", unix)
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	assert.Nil(t, err)
+	assert.Len(t, secret, TOTPSecretSize)
+
+	now := time.Now()
+	step := TOTPStep(now)
+
+	verified, ok := VerifyTOTP(secret, TOTP(secret, step), now, 0)
+	assert.True(t, ok)
+	assert.Equal(t, step, verified)
+
+	// the neighbouring steps are accepted, older ones aren't
+	_, ok = VerifyTOTP(secret, TOTP(secret, step-1), now, 0)
+	assert.True(t, ok)
+	_, ok = VerifyTOTP(secret, TOTP(secret, step+1), now, 0)
+	assert.True(t, ok)
+	_, ok = VerifyTOTP(secret, TOTP(secret, step-2), now, 0)
+	assert.False(t, ok)
+
+	// a code is only used once
+	_, ok = VerifyTOTP(secret, TOTP(secret, step), now, step)
+	assert.False(t, ok)
+
+	_, ok = VerifyTOTP(secret, "000000", now, 0)
+	assert.Equal(t, TOTP(secret, step-1) == "000000" || TOTP(secret, step) == "000000" || TOTP(secret, step+1) == "000000", ok)
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := TOTPURI("gscrypto", "alice", []byte("12345678901234567890"))
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/gscrypto:alice?"))
+	assert.Contains(t, uri, "secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ")
+	assert.Contains(t, uri, "issuer=gscrypto")
+}
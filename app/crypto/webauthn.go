@@ -0,0 +1,290 @@
+package crypto
+
+import (
+	stdcrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+)
+
+// WebAuthn (https://www.w3.org/TR/webauthn/) registers a security key by the
+// public key it creates, and later checks it signed a random challenge. The
+// attestation of where the key comes from isn't checked, the server asks for
+// none, so any authenticator can be registered.
+const (
+	ErrorInvalidWebAuthn = "security key response is not valid"
+	ErrorWebAuthnCloned  = "security key signature counter went back, it may be cloned"
+
+	WebAuthnChallengeSize = 32
+
+	WebAuthnCreate = "webauthn.create"
+	WebAuthnGet    = "webauthn.get"
+
+	// COSEAlgES256 and COSEAlgRS256 are the key algorithms accepted
+	COSEAlgES256 = -7
+	COSEAlgRS256 = -257
+
+	authDataUserPresent = 0x01
+	authDataAttested    = 0x40
+
+	// rpIdHash, flags and signCount, then aaguid and the credential ID
+	// length when a credential is attested
+	authDataMinLength      = 37
+	authDataAttestedLength = 55
+
+	coseKeyType       = 1
+	coseKeyAlg        = 3
+	coseKeyCurve      = -1
+	coseKeyX          = -2
+	coseKeyY          = -3
+	coseKeyRSAModulus = -1
+	coseKeyRSAExp     = -2
+	coseKeyTypeEC2    = 2
+	coseKeyTypeRSA    = 3
+	coseCurveP256     = 1
+)
+
+// WebAuthnCredential is a registered security key. PublicKey is PKIX encoded,
+// SignCount is the last signature counter it sent.
+type WebAuthnCredential struct {
+	ID        []byte `json:"id"`
+	PublicKey []byte `json:"public_key"`
+	Algorithm int    `json:"algorithm"`
+	SignCount uint32 `json:"sign_count"`
+}
+
+// WebAuthnClientData is the collectedClientData the browser passes to the
+// authenticator, which it signs the hash of.
+type WebAuthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    map[interface{}]interface{}
+}
+
+// NewWebAuthnChallenge returns a random challenge of a registration or login.
+func NewWebAuthnChallenge() ([]byte, error) {
+	return RandomBytes(WebAuthnChallengeSize)
+}
+
+// WebAuthnEncoding is the encoding of the challenge in the client data.
+var WebAuthnEncoding = base64.RawURLEncoding
+
+func invalidWebAuthn() error {
+	return errors.New(ErrorInvalidWebAuthn)
+}
+
+// verifyClientData checks clientDataJSON is of a ceremony of type for
+// challenge, made on origin.
+func verifyClientData(clientDataJSON []byte, ceremony string, challenge []byte, origin string) error {
+	var cd WebAuthnClientData
+
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return invalidWebAuthn()
+	}
+
+	sent, err := WebAuthnEncoding.DecodeString(cd.Challenge)
+
+	if err != nil || cd.Type != ceremony || cd.Origin != origin {
+		return invalidWebAuthn()
+	}
+
+	if len(challenge) == 0 || subtle.ConstantTimeCompare(sent, challenge) != 1 {
+		return invalidWebAuthn()
+	}
+	return nil
+}
+
+// parseAuthenticatorData checks data is of rpID and the user was present, and
+// parses the credential it attests if any.
+func parseAuthenticatorData(data []byte, rpID string) (*authenticatorData, error) {
+	if len(data) < authDataMinLength {
+		return nil, invalidWebAuthn()
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rpID))
+
+	if subtle.ConstantTimeCompare(data[:32], rpIDHash[:]) != 1 {
+		return nil, invalidWebAuthn()
+	}
+
+	ad := &authenticatorData{flags: data[32], signCount: binary.BigEndian.Uint32(data[33:37])}
+
+	if ad.flags&authDataUserPresent == 0 {
+		return nil, invalidWebAuthn()
+	}
+
+	if ad.flags&authDataAttested == 0 {
+		return ad, nil
+	}
+
+	if len(data) < authDataAttestedLength {
+		return nil, invalidWebAuthn()
+	}
+
+	idLength := int(binary.BigEndian.Uint16(data[53:55]))
+
+	if len(data) < authDataAttestedLength+idLength {
+		return nil, invalidWebAuthn()
+	}
+
+	ad.credentialID = data[authDataAttestedLength : authDataAttestedLength+idLength]
+
+	// extensions may follow the key, they're ignored
+	key, _, err := decodeCBOR(data[authDataAttestedLength+idLength:])
+	publicKey, ok := key.(map[interface{}]interface{})
+
+	if err != nil || !ok {
+		return nil, invalidWebAuthn()
+	}
+
+	ad.publicKey = publicKey
+	return ad, nil
+}
+
+// parseCOSEKey returns the public key and algorithm of a COSE_Key.
+func parseCOSEKey(key map[interface{}]interface{}) (stdcrypto.PublicKey, int, error) {
+	integer := func(label int64) int64 {
+		i, _ := key[label].(int64)
+		return i
+	}
+	bigInteger := func(label int64) *big.Int {
+		b, _ := key[label].([]byte)
+		return new(big.Int).SetBytes(b)
+	}
+
+	alg := int(integer(coseKeyAlg))
+
+	switch {
+	case integer(coseKeyType) == coseKeyTypeEC2 && alg == COSEAlgES256 && integer(coseKeyCurve) == coseCurveP256:
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: bigInteger(coseKeyX), Y: bigInteger(coseKeyY)}
+
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, 0, invalidWebAuthn()
+		}
+		return pub, alg, nil
+	case integer(coseKeyType) == coseKeyTypeRSA && alg == COSEAlgRS256:
+		pub := &rsa.PublicKey{N: bigInteger(coseKeyRSAModulus), E: int(bigInteger(coseKeyRSAExp).Int64())}
+
+		if pub.N.BitLen() < 2048 || pub.E < 3 {
+			return nil, 0, invalidWebAuthn()
+		}
+		return pub, alg, nil
+	}
+
+	return nil, 0, invalidWebAuthn()
+}
+
+// VerifyWebAuthnRegistration checks the response of navigator.credentials.create
+// to challenge, made on origin for rpID, and returns the credential it
+// created.
+func VerifyWebAuthnRegistration(clientDataJSON, attestationObject, challenge []byte, origin, rpID string) (*WebAuthnCredential, error) {
+	if err := verifyClientData(clientDataJSON, WebAuthnCreate, challenge, origin); err != nil {
+		return nil, err
+	}
+
+	object, _, err := decodeCBOR(attestationObject)
+	attestation, ok := object.(map[interface{}]interface{})
+
+	if err != nil || !ok {
+		return nil, invalidWebAuthn()
+	}
+
+	data, _ := attestation["authData"].([]byte)
+	ad, err := parseAuthenticatorData(data, rpID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ad.publicKey == nil || len(ad.credentialID) == 0 {
+		return nil, invalidWebAuthn()
+	}
+
+	pub, alg, err := parseCOSEKey(ad.publicKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := x509.MarshalPKIXPublicKey(pub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebAuthnCredential{
+		ID:        append([]byte(nil), ad.credentialID...),
+		PublicKey: encoded,
+		Algorithm: alg,
+		SignCount: ad.signCount,
+	}, nil
+}
+
+// VerifyWebAuthnAssertion checks the response of navigator.credentials.get to
+// challenge, made on origin for rpID, was signed by credential, whose
+// SignCount is updated.
+func VerifyWebAuthnAssertion(credential *WebAuthnCredential, clientDataJSON, authData, signature, challenge []byte, origin, rpID string) error {
+	if err := verifyClientData(clientDataJSON, WebAuthnGet, challenge, origin); err != nil {
+		return err
+	}
+
+	ad, err := parseAuthenticatorData(authData, rpID)
+
+	if err != nil {
+		return err
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(credential.PublicKey)
+
+	if err != nil {
+		return err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		var sig struct {
+			R, S *big.Int
+		}
+
+		if rest, err := asn1.Unmarshal(signature, &sig); err != nil || len(rest) > 0 {
+			return invalidWebAuthn()
+		}
+
+		if credential.Algorithm != COSEAlgES256 || !ecdsa.Verify(key, digest[:], sig.R, sig.S) {
+			return invalidWebAuthn()
+		}
+	case *rsa.PublicKey:
+		if credential.Algorithm != COSEAlgRS256 || rsa.VerifyPKCS1v15(key, stdcrypto.SHA256, digest[:], signature) != nil {
+			return invalidWebAuthn()
+		}
+	default:
+		return invalidWebAuthn()
+	}
+
+	// authenticators without a counter always send 0, others must count up
+	if (ad.signCount != 0 || credential.SignCount != 0) && ad.signCount <= credential.SignCount {
+		return errors.New(ErrorWebAuthnCloned)
+	}
+
+	credential.SignCount = ad.signCount
+	return nil
+}
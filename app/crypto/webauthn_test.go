@@ -0,0 +1,91 @@
+package crypto_test
+
+import (
+	"testing"
+
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto/webauthntest"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testOrigin = "https://gscrypto.example.com"
+	testRPID   = "gscrypto.example.com"
+)
+
+func TestWebAuthnRegistration(t *testing.T) {
+	a := webauthntest.New(testOrigin, testRPID)
+	challenge, err := crypto.NewWebAuthnChallenge()
+	assert.Nil(t, err)
+
+	r, err := a.Register(challenge)
+	assert.Nil(t, err)
+
+	credential, err := crypto.VerifyWebAuthnRegistration(r.ClientDataJSON, r.AttestationObject, challenge, testOrigin, testRPID)
+	assert.Nil(t, err)
+	assert.Equal(t, r.CredentialID, credential.ID)
+	assert.Equal(t, crypto.COSEAlgES256, credential.Algorithm)
+
+	other, _ := crypto.NewWebAuthnChallenge()
+
+	for name, verify := range map[string]func() error{
+		"challenge": func() error {
+			_, err := crypto.VerifyWebAuthnRegistration(r.ClientDataJSON, r.AttestationObject, other, testOrigin, testRPID)
+			return err
+		},
+		"origin": func() error {
+			_, err := crypto.VerifyWebAuthnRegistration(r.ClientDataJSON, r.AttestationObject, challenge, "https://evil.example.com", testRPID)
+			return err
+		},
+		"rp id": func() error {
+			_, err := crypto.VerifyWebAuthnRegistration(r.ClientDataJSON, r.AttestationObject, challenge, testOrigin, "evil.example.com")
+			return err
+		},
+		"truncated": func() error {
+			_, err := crypto.VerifyWebAuthnRegistration(r.ClientDataJSON, r.AttestationObject[:len(r.AttestationObject)-10], challenge, testOrigin, testRPID)
+			return err
+		},
+	} {
+		err := verify()
+		if assert.NotNil(t, err, name) {
+			assert.Equal(t, crypto.ErrorInvalidWebAuthn, err.Error(), name)
+		}
+	}
+}
+
+func TestWebAuthnAssertion(t *testing.T) {
+	a := webauthntest.New(testOrigin, testRPID)
+	challenge, _ := crypto.NewWebAuthnChallenge()
+	r, err := a.Register(challenge)
+	assert.Nil(t, err)
+
+	credential, err := crypto.VerifyWebAuthnRegistration(r.ClientDataJSON, r.AttestationObject, challenge, testOrigin, testRPID)
+	assert.Nil(t, err)
+
+	challenge, _ = crypto.NewWebAuthnChallenge()
+	assertion, err := a.Assert(r.CredentialID, challenge)
+	assert.Nil(t, err)
+
+	// a registration can't be used to log in
+	assert.NotNil(t, crypto.VerifyWebAuthnAssertion(credential, r.ClientDataJSON, assertion.AuthenticatorData, assertion.Signature, challenge, testOrigin, testRPID))
+
+	tampered := append([]byte(nil), assertion.Signature...)
+	tampered[len(tampered)-1] ^= 1
+	assert.NotNil(t, crypto.VerifyWebAuthnAssertion(credential, assertion.ClientDataJSON, assertion.AuthenticatorData, tampered, challenge, testOrigin, testRPID))
+
+	assert.Nil(t, crypto.VerifyWebAuthnAssertion(credential, assertion.ClientDataJSON, assertion.AuthenticatorData, assertion.Signature, challenge, testOrigin, testRPID))
+	assert.Equal(t, uint32(1), credential.SignCount)
+
+	// a replayed signature has the same counter
+	err = crypto.VerifyWebAuthnAssertion(credential, assertion.ClientDataJSON, assertion.AuthenticatorData, assertion.Signature, challenge, testOrigin, testRPID)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, crypto.ErrorWebAuthnCloned, err.Error())
+	}
+
+	// another key of the same authenticator doesn't verify
+	second, err := a.Register(challenge)
+	assert.Nil(t, err)
+	assertion, err = a.Assert(second.CredentialID, challenge)
+	assert.Nil(t, err)
+	assert.NotNil(t, crypto.VerifyWebAuthnAssertion(credential, assertion.ClientDataJSON, assertion.AuthenticatorData, assertion.Signature, challenge, testOrigin, testRPID))
+}
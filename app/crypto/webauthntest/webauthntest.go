@@ -0,0 +1,203 @@
+// Package webauthntest is a software WebAuthn authenticator, so tests can
+// register security keys and log in with them the way a browser would:
+//
+//	a := webauthntest.New("https://example.com", "example.com")
+//	registration, err := a.Register(challenge)
+//	...
+//	assertion, err := a.Assert(registration.CredentialID, challenge)
+//
+// It makes P-256 keys, signs with ECDSA and counts up for every signature.
+package webauthntest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+)
+
+const (
+	flagUserPresent = 0x01
+	flagAttested    = 0x40
+)
+
+// Authenticator holds the keys it registered, by credential ID.
+type Authenticator struct {
+	Origin string
+	RPID   string
+
+	keys    map[string]*ecdsa.PrivateKey
+	counter uint32
+}
+
+// Registration is the response of navigator.credentials.create.
+type Registration struct {
+	CredentialID      []byte `json:"credential_id"`
+	ClientDataJSON    []byte `json:"client_data_json"`
+	AttestationObject []byte `json:"attestation_object"`
+}
+
+// Assertion is the response of navigator.credentials.get.
+type Assertion struct {
+	CredentialID      []byte `json:"credential_id"`
+	ClientDataJSON    []byte `json:"client_data_json"`
+	AuthenticatorData []byte `json:"authenticator_data"`
+	Signature         []byte `json:"signature"`
+}
+
+// New returns an authenticator used on origin, which registers keys for rpID.
+func New(origin, rpID string) *Authenticator {
+	return &Authenticator{Origin: origin, RPID: rpID, keys: make(map[string]*ecdsa.PrivateKey)}
+}
+
+func (a *Authenticator) clientData(ceremony string, challenge []byte) ([]byte, error) {
+	return json.Marshal(&crypto.WebAuthnClientData{
+		Type:      ceremony,
+		Challenge: crypto.WebAuthnEncoding.EncodeToString(challenge),
+		Origin:    a.Origin,
+	})
+}
+
+// authenticatorData returns the rpIdHash, flags and counter, which attested
+// follows.
+func (a *Authenticator) authenticatorData(flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.RPID))
+	data := append(rpIDHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.counter)
+	return append(data, attested...)
+}
+
+// Register creates a key for challenge, with an attestation of format none.
+func (a *Authenticator) Register(challenge []byte) (*Registration, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := crypto.RandomBytes(16)
+
+	if err != nil {
+		return nil, err
+	}
+
+	clientDataJSON, err := a.clientData(crypto.WebAuthnCreate, challenge)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// aaguid, the credential ID and the COSE_Key of it
+	attested := make([]byte, 18, 18+len(id))
+	binary.BigEndian.PutUint16(attested[16:], uint16(len(id)))
+	attested = append(attested, id...)
+	attested = append(attested, coseKey(&key.PublicKey)...)
+
+	var object []byte
+	object = appendHead(object, 5, 3)
+	object = appendText(object, "fmt")
+	object = appendText(object, "none")
+	object = appendText(object, "attStmt")
+	object = appendHead(object, 5, 0)
+	object = appendText(object, "authData")
+	object = appendBytes(object, a.authenticatorData(flagUserPresent|flagAttested, attested))
+
+	a.keys[string(id)] = key
+
+	return &Registration{CredentialID: id, ClientDataJSON: clientDataJSON, AttestationObject: object}, nil
+}
+
+// Assert signs challenge with the key of credentialID.
+func (a *Authenticator) Assert(credentialID, challenge []byte) (*Assertion, error) {
+	key, ok := a.keys[string(credentialID)]
+
+	if !ok {
+		return nil, errors.New("webauthntest: unknown credential")
+	}
+
+	clientDataJSON, err := a.clientData(crypto.WebAuthnGet, challenge)
+
+	if err != nil {
+		return nil, err
+	}
+
+	a.counter++
+	authData := a.authenticatorData(flagUserPresent, nil)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := asn1.Marshal(struct{ R, S interface{} }{r, s})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Assertion{
+		CredentialID:      credentialID,
+		ClientDataJSON:    clientDataJSON,
+		AuthenticatorData: authData,
+		Signature:         signature,
+	}, nil
+}
+
+// coseKey encodes pub as an ES256 COSE_Key.
+func coseKey(pub *ecdsa.PublicKey) []byte {
+	coordinate := func(i interface{ Bytes() []byte }) []byte {
+		b := i.Bytes()
+		return append(make([]byte, 32-len(b)), b...)
+	}
+
+	var key []byte
+	key = appendHead(key, 5, 5)
+	key = appendInt(key, 1)
+	key = appendInt(key, 2)
+	key = appendInt(key, 3)
+	key = appendInt(key, crypto.COSEAlgES256)
+	key = appendInt(key, -1)
+	key = appendInt(key, 1)
+	key = appendInt(key, -2)
+	key = appendBytes(key, coordinate(pub.X))
+	key = appendInt(key, -3)
+	key = appendBytes(key, coordinate(pub.Y))
+	return key
+}
+
+// appendHead appends a CBOR item head of major type and argument n.
+func appendHead(b []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(b, major<<5|byte(n))
+	case n <= 0xff:
+		return append(b, major<<5|24, byte(n))
+	case n <= 0xffff:
+		return append(b, major<<5|25, byte(n>>8), byte(n))
+	}
+	return append(b, major<<5|26, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func appendInt(b []byte, i int64) []byte {
+	if i < 0 {
+		return appendHead(b, 1, uint64(-1-i))
+	}
+	return appendHead(b, 0, uint64(i))
+}
+
+func appendBytes(b, data []byte) []byte {
+	return append(appendHead(b, 2, uint64(len(data))), data...)
+}
+
+func appendText(b []byte, s string) []byte {
+	return append(appendHead(b, 3, uint64(len(s))), s...)
+}
@@ -1,4 +1,4 @@
-package main
+package app
 
 import (
 	"context"
@@ -6,8 +6,6 @@ import (
 	"fmt"
 	"path/filepath"
 	"sync"
-
-	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
 )
 
 const (
@@ -16,20 +14,32 @@ const (
 )
 
 func (user *userData) deleteFile(id int64) error {
-	f, err := gc.FileStructDB.GetFile(user.userEntry.Username, id)
+	f, err := user.server.files.GetFile(user.userEntry.Username, id)
 
 	if err != nil {
 		return err
 	}
 
-	err = gc.FileStructDB.DeleteFile(user.userEntry.Username, id)
+	if user.token != nil {
+		m, err := user.decryptMetadata(f)
+
+		if err != nil {
+			return err
+		}
+
+		if err := user.checkTokenFolder(m.Folder); err != nil {
+			return err
+		}
+	}
+
+	err = user.server.files.DeleteFile(user.userEntry.Username, id)
 
 	if err != nil {
 		return err
 	}
 
 	ctx := context.Background()
-	if err := gc.StorageBucket.Object(f.GoogleCloudObject).Delete(ctx); err != nil {
+	if err := user.server.storage.Delete(ctx, f.GoogleCloudObject); err != nil {
 		return fmt.Errorf("unable to delete file: %d", id)
 	} else {
 		fmt.Println("deleted: ", id)
@@ -55,7 +65,6 @@ func (user *userData) deleteFolder(folderPath string) error {
 	for _, fsObject := range nestedObjects {
 		if fsObject.Type == "folder" {
 			user.deleteFolder(fsObject.FullPath)
-			gc.FileStructDB.DeleteFolder(user.userEntry.Username, fsObject.ID)
 		} else {
 			fileID := fsObject.ID
 			deleteFileIDs = append(deleteFileIDs, fileID)
@@ -69,18 +78,21 @@ func (user *userData) deleteFolder(folderPath string) error {
 	}
 
 	var deleteError error
+	var deleteErrorLock sync.Mutex
 	deleteTasks := make(chan int64, 64)
 	for i := 0; i < 50; i++ {
 		wg.Add(1)
 		go func() {
+			defer wg.Done()
 			for id := range deleteTasks {
-				// ignore errors
-				if deleteError = user.deleteFile(id); deleteError != nil {
-					return
+				// keep deleting the remaining files, only the last error is reported
+				if err := user.deleteFile(id); err != nil {
+					deleteErrorLock.Lock()
+					deleteError = err
+					deleteErrorLock.Unlock()
 				}
 			}
 		}()
-		wg.Done()
 	}
 
 	for _, id := range deleteFileIDs {
@@ -90,6 +102,11 @@ func (user *userData) deleteFolder(folderPath string) error {
 	close(deleteTasks)
 	wg.Wait()
 
+	// while the keys are rotated the folder can be stored under both
+	for _, id := range user.folderIDs(folderPath) {
+		user.server.files.DeleteFolder(user.userEntry.Username, id)
+	}
+
 	fmt.Println("deleteError: ", deleteError)
 	return deleteError
 }
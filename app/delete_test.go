@@ -1,4 +1,4 @@
-package main
+package app
 
 import (
 	"fmt"
@@ -9,7 +9,6 @@ import (
 	"strings"
 	"testing"
 
-	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
 	"github.com/levigross/grequests"
 	"github.com/stretchr/testify/assert"
 )
@@ -101,6 +100,11 @@ func TestDeleteFolder(t *testing.T) {
 
 	for _, test := range testCases {
 		clearDatastore()
+
+		// the session of the admin ended with their account
+		createAdmin()
+		adminCookie = loginUser(adminLoginDetails)
+
 		for _, filesToUpload := range test.uploads {
 
 			f := grequests.FileUpload{
@@ -193,6 +197,11 @@ func TestDeleteFiles(t *testing.T) {
 
 	for _, test := range testCases {
 		clearDatastore()
+
+		// the session of the admin ended with their account
+		createAdmin()
+		adminCookie = loginUser(adminLoginDetails)
+
 		for _, filesToUpload := range test.uploads {
 
 			f := grequests.FileUpload{
@@ -233,7 +242,8 @@ func TestDeleteFiles(t *testing.T) {
 		} else {
 			//make sure nothing remains
 			for _, f := range test.uploads {
-				existingFiles, _ := gc.FileStructDB.ListFiles("admin", f.path)
+				admin, _ := cookieSession(adminCookie)
+				existingFiles, _ := testServer.files.ListFiles("admin", admin.cryptoData.FolderIndex(f.path))
 				assert.Empty(t, existingFiles)
 			}
 		}
@@ -1,52 +1,183 @@
-package main
+package app
 
 import (
 	"archive/zip"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"path/filepath"
 	"strings"
 	"time"
 
 	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
 
 	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
 )
 
 const (
 	errorUnableToLoadNestedFolders = "unable to read from nested folder"
 )
 
+// blobReaderAt reads an object with ranged reads. A read continuing where the
+// previous one stopped reuses its response, so reading the object in order
+// only makes one request. It's not safe for concurrent use.
+type blobReaderAt struct {
+	ctx     context.Context
+	storage gc.BlobStore
+	name    string
+
+	r   io.ReadCloser
+	pos int64
+}
+
+func (b *blobReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if b.r == nil || b.pos != off {
+		b.Close()
+
+		r, err := b.storage.GetRange(b.ctx, b.name, off, -1)
+		if err != nil {
+			return 0, err
+		}
+		b.r, b.pos = r, off
+	}
+
+	n, err := io.ReadFull(b.r, p)
+	b.pos += int64(n)
+
+	switch err {
+	case nil, io.EOF:
+	case io.ErrUnexpectedEOF:
+		err = io.EOF
+	default:
+		b.Close()
+	}
+
+	return n, err
+}
+
+func (b *blobReaderAt) Close() error {
+	if b.r == nil {
+		return nil
+	}
+
+	err := b.r.Close()
+	b.r = nil
+	return err
+}
+
+// downloadFile serves a file with support for range and conditional requests,
+// only the segments of the object covering the requested ranges are decrypted.
+// countDownload counts a download of the file id in the background, the
+// download doesn't wait for it or fail with it.
+func (user *userData) countDownload(id int64) {
+	go func() {
+		if err := user.server.files.IncrementDownloads(user.userEntry.Username, id); err != nil {
+			log.WithFields(log.Fields{"user": user.userEntry.Username, "id": id, "error": err}).Warn("failed to count download")
+		}
+	}()
+}
+
 func (user *userData) downloadFile(httpContext *gin.Context, id int64) error {
-	ef, err := gc.FileStructDB.GetFile(user.userEntry.Username, id)
+	ef, err := user.server.files.GetFile(user.userEntry.Username, id)
 
 	if err != nil {
 		return err
 	}
 
-	ef.Downloads++
-	go gc.FileStructDB.UpdateFile(ef, id)
+	if user.userEntry.ZeroKnowledge {
+		return user.downloadEncryptedFile(httpContext, ef)
+	}
 
-	ctx := context.Background()
-	r, err := config.storageBucket.Object(ef.GoogleCloudObject).NewReader(ctx)
+	dataKey, err := user.fileKey(ef)
 
 	if err != nil {
 		return err
 	}
 
-	if plainTextFilename, err := user.cryptoData.DecryptText(ef.Filename); err != nil {
+	plainTextFilename, err := fileFieldKey(dataKey, ef, crypto.PurposeFilename).DecryptText(ef.Filename)
+
+	if err != nil {
 		return err
-	} else {
-		httpContext.Writer.Header().Set("content-disposition", "attachment; filename=\""+string(plainTextFilename)+"\"")
 	}
 
-	f, err := gc.FileStructDB.GetFile(user.userEntry.Username, id)
+	metadata, err := fileMetadata(ef, dataKey)
 
 	if err != nil {
 		return err
 	}
 
-	if err := user.cryptoData.DecryptFile(r, httpContext.Writer, f.Compressed); err != nil {
+	if err := user.checkTokenFolder(metadata.Folder); err != nil {
+		return err
+	}
+
+	ctx := httpContext.Request.Context()
+	attrs, err := user.server.storage.Stat(ctx, ef.GoogleCloudObject)
+
+	if err != nil {
+		return err
+	}
+
+	if ef.PublicKeyEncrypted {
+		return user.downloadPublicKeyFile(httpContext, ef, string(plainTextFilename), attrs.Size)
+	}
+
+	header := httpContext.Writer.Header()
+	header.Set("content-disposition", "attachment; filename=\""+string(plainTextFilename)+"\"")
+	header.Set("Content-Type", metadata.FileType)
+
+	if ef.SHA2 != "" {
+		header.Set("ETag", "\""+ef.SHA2+"\"")
+	}
+
+	// seeking in a video sends a request each time, only count downloads
+	// which start at the beginning of the file.
+	if r := httpContext.GetHeader("Range"); r == "" || strings.HasPrefix(r, "bytes=0-") {
+		user.countDownload(id)
+	}
+
+	object := &blobReaderAt{ctx: ctx, storage: user.server.storage, name: ef.GoogleCloudObject}
+	defer object.Close()
+
+	contentsKey := fileFieldKey(dataKey, ef, crypto.PurposeContents)
+	plaintext, err := contentsKey.NewDecryptReaderAt(object, attrs.Size)
+
+	if err != nil {
+		if err.Error() != crypto.ErrorInvalidStreamHeader {
+			return err
+		}
+		return user.downloadLegacyFile(httpContext, ef, contentsKey)
+	}
+
+	// an object bound to another file fails every segment, checking the
+	// first one fails the download before anything is sent
+	if plaintext.Size() > 0 {
+		if _, err := plaintext.ReadAt(make([]byte, 1), 0); err != nil {
+			return err
+		}
+	}
+
+	http.ServeContent(httpContext.Writer, httpContext.Request, "", ef.UploadDate, io.NewSectionReader(plaintext, 0, plaintext.Size()))
+	return nil
+}
+
+// downloadLegacyFile serves files stored as a single OpenPGP message, which
+// can only be decrypted from the start so ranges are ignored.
+func (user *userData) downloadLegacyFile(httpContext *gin.Context, f *gc.File, key *crypto.CryptoData) error {
+	r, err := user.server.storage.Get(httpContext.Request.Context(), f.GoogleCloudObject)
+
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	httpContext.Writer.Header().Set("Accept-Ranges", "none")
+	httpContext.Writer.Header().Set("Last-Modified", f.UploadDate.UTC().Format(http.TimeFormat))
+
+	if err := key.DecryptFile(r, httpContext.Writer, f.Compressed); err != nil {
 		return err
 	}
 
@@ -55,6 +186,11 @@ func (user *userData) downloadFile(httpContext *gin.Context, id int64) error {
 }
 
 func (user *userData) downloadFolder(httpContext gin.Context, path string) error {
+	// the files would have to be decrypted to be zipped
+	if user.userEntry.ZeroKnowledge {
+		return errors.New(errZeroKnowledge)
+	}
+
 	zipfile := strings.Split(path, "/")
 	zipfileStr := zipfile[len(zipfile)-1] + ".zip"
 
@@ -68,27 +204,46 @@ func (user *userData) downloadFolder(httpContext gin.Context, path string) error
 
 		for _, file := range files {
 			ctx := context.Background()
-			r, err := config.storageBucket.Object(file.GoogleCloudObject).NewReader(ctx)
+			r, err := user.server.storage.Get(ctx, file.GoogleCloudObject)
 
-			if r == nil {
-				fmt.Println(file.ID, " is nil")
-				continue
-			} else {
-				fmt.Println("filesize: ", r.Size())
+			if err != nil {
+				if err.Error() == gc.ErrorBlobNotFound {
+					log.WithFields(log.Fields{"id": file.ID}).Warn("file is missing from storage")
+					continue
+				}
+				return err
+			}
+
+			dataKey, err := user.fileKey(&file)
+
+			if err != nil {
+				r.Close()
+				return err
 			}
 
+			plainTextFilename, err := fileFieldKey(dataKey, &file, crypto.PurposeFilename).DecryptText(file.Filename)
+
 			if err != nil {
+				r.Close()
 				return err
 			}
 
-			plainTextFilename, err := user.cryptoData.DecryptText(file.Filename)
+			metadata, err := fileMetadata(&file, dataKey)
 
 			if err != nil {
+				r.Close()
 				return err
 			}
 
+			name := filepath.Join(metadata.Folder, string(plainTextFilename))
+
+			// the server can't decrypt these, they're added as they're stored
+			if file.PublicKeyEncrypted {
+				name += ".gpg"
+			}
+
 			header := &zip.FileHeader{
-				Name:         filepath.Join(file.Folder, string(plainTextFilename)),
+				Name:         name,
 				Method:       zip.Deflate,
 				ModifiedTime: uint16(time.Now().UnixNano()),
 				ModifiedDate: uint16(time.Now().UnixNano()),
@@ -98,10 +253,18 @@ func (user *userData) downloadFolder(httpContext gin.Context, path string) error
 			fw, err := zw.CreateHeader(header)
 
 			if err != nil {
+				r.Close()
 				return err
 			}
 
-			if err := user.cryptoData.DecryptFile(r, fw, file.Compressed); err != nil {
+			if file.PublicKeyEncrypted {
+				_, err = io.Copy(fw, r)
+			} else {
+				err = fileFieldKey(dataKey, &file, crypto.PurposeContents).DecryptFile(r, fw, file.Compressed)
+			}
+			r.Close()
+
+			if err != nil {
 				fmt.Println(err)
 				return err
 			}
@@ -0,0 +1,201 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	errExportPath      = "file would be exported outside of the directory"
+	errChecksumMissing = "file has no checksum to verify"
+	errChecksumFailed  = "file doesn't match its checksum"
+
+	// publicKeyExtension is added to files encrypted to the user's public
+	// keys, which are exported as the OpenPGP message they're stored as
+	publicKeyExtension = ".gpg"
+)
+
+// exportPath returns where a file named name in folder is exported in dir.
+func exportPath(dir, folder, name string) (string, error) {
+	path := filepath.Join(dir, filepath.FromSlash(folder), name)
+	rel, err := filepath.Rel(dir, path)
+
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New(errExportPath)
+	}
+	return path, nil
+}
+
+// Export decrypts every file of username into dir, in the folders they're
+// listed in and with their names, without the server running. Empty folders
+// are created as well. With verify each file is checked against its SHA-256,
+// files encrypted to the user's public keys can't be and are only copied. A
+// file which fails is logged and the others are still exported, the number
+// exported is returned along with an error if any failed.
+//
+// The files of zero-knowledge accounts can only be decrypted by their client.
+func (s *Server) Export(username string, password []byte, dir string, verify bool) (int, error) {
+	user, err := s.unlockUser(username, password)
+
+	if err != nil {
+		return 0, err
+	}
+
+	// files may be stored with either key while they're rotated
+	if user.userEntry.Rotating() {
+		if user.nextCryptoData, err = nextMasterKey(&user.userEntry, password); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := user.exportFolders(dir); err != nil {
+		return 0, err
+	}
+
+	files, err := s.files.GetAllFiles(username)
+
+	if err != nil {
+		return 0, err
+	}
+
+	exported := 0
+
+	for _, f := range files {
+		path, err := user.exportFile(f, dir, verify)
+
+		if err != nil {
+			log.WithFields(log.Fields{"file": f.ID, "path": path, "error": err}).Error("failed to export file")
+			continue
+		}
+
+		exported++
+	}
+
+	if exported < len(files) {
+		return exported, fmt.Errorf("%d of %d files could not be exported", len(files)-exported, len(files))
+	}
+	return exported, nil
+}
+
+// exportFolders creates every folder of the user in dir, including those
+// named in the clear by accounts whose metadata isn't encrypted yet.
+func (user *userData) exportFolders(dir string) error {
+	mkdir := func(folder string, _ *gc.FolderTree) error {
+		path, err := exportPath(dir, folder, "")
+
+		if err != nil {
+			return err
+		}
+		return os.MkdirAll(path, 0700)
+	}
+
+	if err := user.walkFolders(nil, 0, "/", mkdir); err != nil {
+		return err
+	}
+
+	for generation := user.userEntry.KeyGeneration; ; generation++ {
+		master, err := user.masterKey(generation)
+
+		if err != nil {
+			return nil
+		}
+
+		if err := user.walkFolders(master, generation, "/", mkdir); err != nil {
+			return err
+		}
+	}
+}
+
+// exportFile decrypts f into dir and returns where it was written. A file
+// which fails to decrypt is removed, one which fails to verify is kept.
+func (user *userData) exportFile(f *gc.File, dir string, verify bool) (string, error) {
+	ctx := context.Background()
+	dataKey, err := user.fileKey(f)
+
+	if err != nil {
+		return "", err
+	}
+
+	filename, err := fileFieldKey(dataKey, f, crypto.PurposeFilename).DecryptText(f.Filename)
+
+	if err != nil {
+		return "", err
+	}
+
+	metadata, err := fileMetadata(f, dataKey)
+
+	if err != nil {
+		return "", err
+	}
+
+	name := string(filename)
+	if f.PublicKeyEncrypted {
+		name += publicKeyExtension
+	}
+
+	path, err := exportPath(dir, metadata.Folder, name)
+
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return path, err
+	}
+
+	r, err := user.server.storage.Get(ctx, f.GoogleCloudObject)
+
+	if err != nil {
+		return path, err
+	}
+	defer r.Close()
+
+	w, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+
+	if err != nil {
+		return path, err
+	}
+
+	sha256hash := sha256.New()
+	plaintext := io.MultiWriter(w, sha256hash)
+
+	if f.PublicKeyEncrypted {
+		_, err = io.Copy(plaintext, r)
+	} else {
+		err = fileFieldKey(dataKey, f, crypto.PurposeContents).DecryptFile(r, plaintext, f.Compressed)
+	}
+
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(path)
+		return path, err
+	}
+
+	if !verify {
+		return path, nil
+	}
+
+	switch {
+	case f.PublicKeyEncrypted:
+		log.WithFields(log.Fields{"file": f.ID, "path": path}).Warn("file encrypted to public keys can't be verified")
+	case f.SHA2 == "":
+		return path, errors.New(errChecksumMissing)
+	case fmt.Sprintf("%x", sha256hash.Sum(nil)) != f.SHA2:
+		return path, errors.New(errChecksumFailed)
+	}
+
+	return path, nil
+}
@@ -0,0 +1,65 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExport(t *testing.T) {
+	clearDatastore()
+	clearBucket()
+	createAdmin()
+	cookie := loginUser(adminLoginDetails)
+	username, password := adminLoginDetails["username"], []byte(adminLoginDetails["password"])
+
+	uploadToFolder(t, cookie, "a", "/", "", "")
+	uploadToFolder(t, cookie, "b", "/docs/", "", "")
+	uploadToFolder(t, cookie, "c", "/docs/old/", "", "")
+
+	// files stored before data keys are exported too
+	user, err := testServer.unlockUser(username, password)
+	assert.Nil(t, err)
+	files, _ := testServer.files.GetAllFiles(username)
+	assert.Len(t, files, 3)
+	legacy, _ := user.decryptFilename(files[2])
+	makeLegacyFile(t, user, files[2], []byte("contents of "+string(legacy)), true)
+
+	dir, err := ioutil.TempDir("", "export")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = testServer.Export(username, []byte("wrong password"), dir, false)
+	assert.NotNil(t, err)
+
+	exported, err := testServer.Export(username, password, dir, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, exported)
+
+	for path, contents := range map[string]string{
+		"a":          "contents of a",
+		"docs/b":     "contents of b",
+		"docs/old/c": "contents of c",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(path)))
+		assert.Nil(t, err)
+		assert.Equal(t, contents, string(data))
+	}
+
+	// a file which doesn't match its checksum fails to verify, it's exported
+	// anyway
+	f := files[0]
+	f.SHA2 = "0000"
+	assert.Nil(t, testServer.files.UpdateFile(f, f.ID))
+
+	exported, err = testServer.Export(username, password, dir, true)
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, exported)
+
+	exported, err = testServer.Export(username, password, dir, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, exported)
+}
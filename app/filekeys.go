@@ -0,0 +1,69 @@
+package app
+
+import (
+	"strconv"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+)
+
+// From gc.FileFormatBound the data key, name, metadata and object of a file
+// are encrypted with its context as associated data: the format version, the
+// owner, the object and which of them it is. Swapping any of them between
+// records, or pointing a record to another object, makes decrypting it fail
+// instead of returning the wrong file. The object stands for the file since
+// it's named before the record is added, and renamed whenever the file is
+// encrypted again.
+//
+// From gc.FileFormatSubkeys each of them is also encrypted by a subkey of its
+// own, derived from the user's key for the data key and from the data key for
+// the rest.
+//
+// Files stored before are read the way they were stored until
+// gscrypto-migrate or a key rotation encrypts them again. Zero-knowledge
+// clients encrypt their files themselves, those are neither bound nor use
+// subkeys.
+const (
+	fileContextName = "gscrypto file"
+)
+
+// masterKeyOf returns the user's key of pgpKey and hmacSecret, whose HMACs and
+// blind indexes are made in format indexVersion.
+func masterKeyOf(userEntry *gc.UserEntry, pgpKey, hmacSecret []byte, indexVersion int) *crypto.CryptoData {
+	keySalt, keyIterations := userEntry.FileKeyParams()
+	master := crypto.NewCryptoData(pgpKey, hmacSecret, keySalt, keyIterations)
+
+	if indexVersion >= gc.FileFormatSubkeys {
+		master = master.IndexSubkey(indexVersion)
+	}
+	return master
+}
+
+// fileContext returns the associated data of field of the file stored in
+// object, which is none for files of a legacy format.
+func fileContext(username, object string, version int, field string) []byte {
+	if version < gc.FileFormatBound {
+		return nil
+	}
+	return crypto.Context(fileContextName, strconv.Itoa(version), username, object, field)
+}
+
+// fieldKey returns the key encrypting field, one of the crypto purposes, of
+// the file stored in object in format version, given the key it's derived
+// from.
+func fieldKey(key *crypto.CryptoData, username, object string, version int, field string) *crypto.CryptoData {
+	if version >= gc.FileFormatSubkeys {
+		key = key.Subkey(field, version)
+	}
+	return key.WithAssociatedData(fileContext(username, object, version, field))
+}
+
+// fileFieldKey returns the key encrypting field of f.
+func fileFieldKey(key *crypto.CryptoData, f *gc.File, field string) *crypto.CryptoData {
+	return fieldKey(key, f.Username, f.GoogleCloudObject, f.FormatVersion, field)
+}
+
+// uploadFieldKey returns the key encrypting field of the file u becomes.
+func uploadFieldKey(key *crypto.CryptoData, u *gc.Upload, field string) *crypto.CryptoData {
+	return fieldKey(key, u.Username, u.Object, u.FormatVersion, field)
+}
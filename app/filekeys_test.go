@@ -0,0 +1,158 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+	"github.com/levigross/grequests"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileBinding(t *testing.T) {
+	clearDatastore()
+	clearBucket()
+	createAdmin()
+	cookie := loginUser(adminLoginDetails)
+	username := adminLoginDetails["username"]
+
+	uploadToFolder(t, cookie, "a", "/", "", "")
+	uploadToFolder(t, cookie, "b", "/", "", "")
+
+	files, _ := testServer.files.GetAllFiles(username)
+	assert.Len(t, files, 2)
+	a, b := files[0], files[1]
+	assert.Equal(t, gc.FileFormatVersion, a.FormatVersion)
+
+	download := func(f *gc.File) int {
+		resp, err := grequests.Get(ts.URL+"/auth/file/"+strconv.FormatInt(f.ID, 10), &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}})
+		assert.Nil(t, err)
+		return resp.StatusCode
+	}
+
+	list := func() int {
+		resp, err := grequests.Get(ts.URL+"/auth/list/fs", &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}, Params: map[string]string{"path": "/"}})
+		assert.Nil(t, err)
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, download(a))
+	assert.Equal(t, http.StatusOK, list())
+
+	// each field is swapped with the other file's, which can be decrypted
+	// with the same keys but belongs to another record
+	swaps := map[string]func(f, other *gc.File){
+		"name":     func(f, other *gc.File) { f.Filename = other.Filename },
+		"metadata": func(f, other *gc.File) { f.Metadata = other.Metadata },
+		"data key": func(f, other *gc.File) { f.DataKey = other.DataKey },
+		"object":   func(f, other *gc.File) { f.GoogleCloudObject = other.GoogleCloudObject },
+	}
+
+	for field, swap := range swaps {
+		swapped := *a
+		swap(&swapped, b)
+		assert.Nil(t, testServer.files.UpdateFile(&swapped, a.ID))
+
+		assert.NotEqual(t, http.StatusOK, download(a), "file with the %s of another is downloaded", field)
+		if field != "object" {
+			assert.NotEqual(t, http.StatusOK, list(), "file with the %s of another is listed", field)
+		}
+
+		assert.Nil(t, testServer.files.UpdateFile(a, a.ID))
+	}
+
+	assert.Equal(t, http.StatusOK, download(a))
+	assert.Equal(t, http.StatusOK, list())
+}
+
+func TestFileSubkeys(t *testing.T) {
+	clearDatastore()
+	clearBucket()
+	createAdmin()
+	cookie := loginUser(adminLoginDetails)
+	username := adminLoginDetails["username"]
+
+	uploadToFolder(t, cookie, "a", "/folder/", "", "")
+
+	user, err := testServer.unlockUser(username, []byte(adminLoginDetails["password"]))
+	assert.Nil(t, err)
+
+	files, _ := testServer.files.GetAllFiles(username)
+	f := files[0]
+	assert.Equal(t, gc.FileFormatSubkeys, f.FormatVersion)
+
+	// the data key is wrapped, and the name encrypted, by keys derived for it
+	_, err = user.cryptoData.WithAssociatedData(fileContext(username, f.GoogleCloudObject, f.FormatVersion, crypto.PurposeDataKey)).DataKey(f.DataKey)
+	assert.NotNil(t, err)
+
+	dataKey, err := user.fileKey(f)
+	assert.Nil(t, err)
+
+	_, err = dataKey.WithAssociatedData(fileContext(username, f.GoogleCloudObject, f.FormatVersion, crypto.PurposeFilename)).DecryptText(f.Filename)
+	assert.NotNil(t, err)
+
+	name, err := fileFieldKey(dataKey, f, crypto.PurposeFilename).DecryptText(f.Filename)
+	assert.Nil(t, err)
+	assert.Equal(t, "a", string(name))
+
+	folders, _, _ := testServer.files.ListFolders(username, "/")
+	if assert.Len(t, folders, 1) {
+		assert.Equal(t, gc.FileFormatSubkeys, folders[0].FormatVersion)
+
+		_, err = user.cryptoData.DecryptText(folders[0].EncryptedFolder)
+		assert.NotNil(t, err)
+	}
+
+	assert.ElementsMatch(t, []simpleFile{{path: "/folder", filename: "a"}}, fsLayoutToSimpleFile(getAllFSObjectsUsingAPI("/", cookie)))
+}
+
+func TestBlindIndexSubkey(t *testing.T) {
+	clearDatastore()
+	clearBucket()
+	createAdmin()
+	username := adminLoginDetails["username"]
+	password := []byte(adminLoginDetails["password"])
+
+	userEntry, id, _ := testServer.users.GetUserEntry(username)
+	assert.Equal(t, gc.FileFormatVersion, userEntry.IndexVersion)
+
+	hmacSecret, err := wrappingKey(userEntry, password).DecryptText(userEntry.EncryptedHMACSecret)
+	assert.Nil(t, err)
+
+	// accounts from before index with the HMAC secret itself until their keys
+	// are rotated
+	userEntry.IndexVersion = 0
+	assert.Nil(t, testServer.users.UpdateUser(id, userEntry))
+
+	cookie := loginUser(adminLoginDetails)
+	uploadToFolder(t, cookie, "a", "/folder/", "tag", "")
+
+	legacy := &crypto.CryptoData{HMACSecret: hmacSecret}
+	files, _ := testServer.files.GetAllFiles(username)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, legacy.GenerateHMAC([]byte("/folder/a")), files[0].FilenameHMAC)
+		assert.Equal(t, legacy.FolderIndex("/folder/"), files[0].Folder)
+	}
+
+	assert.Equal(t, http.StatusAccepted, rotateKeys(cookie, string(password)).StatusCode)
+	waitForKeyRotation(t, cookie)
+
+	userEntry, _, _ = testServer.users.GetUserEntry(username)
+	assert.Equal(t, gc.FileFormatVersion, userEntry.IndexVersion)
+
+	hmacSecret, err = wrappingKey(userEntry, password).DecryptText(userEntry.EncryptedHMACSecret)
+	assert.Nil(t, err)
+
+	indexed := (&crypto.CryptoData{HMACSecret: hmacSecret}).IndexSubkey(gc.FileFormatVersion)
+	files, _ = testServer.files.GetAllFiles(username)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, indexed.GenerateHMAC([]byte("/folder/a")), files[0].FilenameHMAC)
+		assert.Equal(t, indexed.FolderIndex("/folder/"), files[0].Folder)
+		assert.Equal(t, []string{indexed.TagIndex("tag")}, files[0].Tags)
+	}
+
+	assert.ElementsMatch(t, []simpleFile{{path: "/folder", filename: "a"}}, fsLayoutToSimpleFile(getAllFSObjectsUsingAPI("/", cookie)))
+	assert.Len(t, listFolder(t, cookie, map[string]string{"path": "/folder/", "tags": "tag"}), 1)
+}
@@ -1,4 +1,4 @@
-package main
+package app
 
 import (
 	"fmt"
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
 )
 
 type FileSystemStructure struct {
@@ -23,6 +24,14 @@ type FileSystemStructure struct {
 	Description string   `json:"description,omitempty"`
 	Tags        []string `json:"tags,omitempty"`
 	SHA2        string   `json:"sha2,omitempty"`
+
+	/* Set for files encrypted to the user's OpenPGP public keys, which are downloaded encrypted */
+	PublicKeyEncrypted bool `json:"public_key_encrypted,omitempty"`
+
+	/* Only displayed for zero-knowledge accounts, instead of Name and the metadata */
+	EncryptedName []byte `json:"encrypted_name,omitempty"`
+	DataKey       []byte `json:"data_key,omitempty"`
+	Metadata      []byte `json:"metadata,omitempty"`
 }
 
 const (
@@ -30,52 +39,178 @@ const (
 	typeFolder   = "folder"
 )
 
+// decryptFilename returns the name of f, which is encrypted by its data key.
+func (user *userData) decryptFilename(f *gc.File) ([]byte, error) {
+	dataKey, err := user.fileKey(f)
+
+	if err != nil {
+		return nil, err
+	}
+	return fileFieldKey(dataKey, f, crypto.PurposeFilename).DecryptText(f.Filename)
+}
+
+// newFileEntry lists f. Files of zero-knowledge accounts are listed with their
+// encrypted name, metadata and data key for the client to decrypt, and their
+// folder's index as their path.
+func (user *userData) newFileEntry(f *gc.File) (FileSystemStructure, error) {
+	entry := FileSystemStructure{
+		ID:         f.ID,
+		Type:       typeFilename,
+		UploadDate: f.UploadDate,
+		SHA2:       f.SHA2,
+
+		PublicKeyEncrypted: f.PublicKeyEncrypted,
+	}
+
+	if user.userEntry.ZeroKnowledge {
+		entry.FullPath, entry.FileSize = f.Folder, f.FileSize
+		entry.EncryptedName, entry.DataKey, entry.Metadata = f.Filename, f.DataKey, f.Metadata
+		return entry, nil
+	}
+
+	dataKey, err := user.fileKey(f)
+
+	if err != nil {
+		return entry, err
+	}
+
+	plainTextFilename, err := fileFieldKey(dataKey, f, crypto.PurposeFilename).DecryptText(f.Filename)
+
+	if err != nil {
+		return entry, err
+	}
+
+	metadata, err := fileMetadata(f, dataKey)
+
+	if err != nil {
+		return entry, err
+	}
+
+	entry.Name = string(plainTextFilename)
+	entry.FullPath = filepath.Clean(filepath.Join(metadata.Folder, string(plainTextFilename)))
+	entry.FileType, entry.FileSize = metadata.FileType, metadata.FileSize
+	entry.Description, entry.Tags = metadata.Description, metadata.Tags
+	return entry, nil
+}
+
+// newFolderEntries lists the folders in path. Folders of zero-knowledge
+// accounts are listed with their encrypted name, and their index as their
+// path.
+func (user *userData) newFolderEntries(path string) ([]FileSystemStructure, error) {
+	folders, names, err := user.listFolders(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []FileSystemStructure{}
+	seen := make(map[string]bool)
+
+	for i, folder := range folders {
+		entry := FileSystemStructure{
+			ID:         folder.ID,
+			Type:       typeFolder,
+			UploadDate: folder.UploadDate,
+		}
+
+		if user.userEntry.ZeroKnowledge {
+			entry.EncryptedName = folder.EncryptedFolder
+			entry.FullPath = normalizeFolder(filepath.Join(path, folder.Folder))
+		} else {
+			entry.Name = normalizeFolder(names[i])
+			entry.FullPath = normalizeFolder(filepath.Join(path, names[i]))
+		}
+
+		// while the keys are rotated a folder can be stored under both
+		if !seen[entry.FullPath] {
+			seen[entry.FullPath] = true
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// listFilesWithTags returns the user's files which have every one of tags.
+// While the keys are rotated, each file's tags are indexed by the key of its
+// generation.
+func (user *userData) listFilesWithTags(tags []string) ([]gc.File, error) {
+	var files []gc.File
+
+	if user.userEntry.ZeroKnowledge {
+		found, err := user.server.files.ListFilesWithTags(tags)
+
+		for _, f := range found {
+			if f.Username == user.userEntry.Username {
+				files = append(files, f)
+			}
+		}
+		return files, err
+	}
+
+	for generation := user.userEntry.KeyGeneration; ; generation++ {
+		master, err := user.masterKey(generation)
+
+		if err != nil {
+			break
+		}
+
+		indexes := make([]string, 0, len(tags))
+		for _, tag := range tags {
+			indexes = append(indexes, master.TagIndex(tag))
+		}
+
+		found, err := user.server.files.ListFilesWithTags(indexes)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range found {
+			if f.Username == user.userEntry.Username && f.KeyGeneration == generation {
+				files = append(files, f)
+			}
+		}
+	}
+	return files, nil
+}
+
 func (user *userData) listFileSystemByTags(path string, tag []string) ([]FileSystemStructure, error) {
 	fs := []FileSystemStructure{}
 	foldersContainingTaggedFiles := []string{}
-	filesWithTag, err := gc.FileStructDB.ListFilesWithTags(tag)
+	path = normalizeFolder(filepath.Clean(path))
+	filesWithTag, err := user.listFilesWithTags(tag)
+
+	if err != nil {
+		return nil, err
+	}
 
 	for _, f := range filesWithTag {
-		foldersContainingTaggedFiles = append(foldersContainingTaggedFiles, f.Folder)
+		newFSEntry, err := user.newFileEntry(&f)
 
-		if f.Folder == path {
-			plainTextFilename, err := user.cryptoData.DecryptText(f.Filename)
+		if err != nil {
+			return nil, err
+		}
 
-			if err != nil {
-				return nil, err
-			}
-			newFSEntry := FileSystemStructure{
-				ID:          f.ID,
-				Type:        typeFilename,
-				Name:        string(plainTextFilename),
-				FullPath:    filepath.Clean(filepath.Join(f.Folder, string(plainTextFilename))),
-				FileType:    f.FileType,
-				FileSize:    f.FileSize,
-				Description: f.Description,
-				Tags:        f.Tags,
-				UploadDate:  f.UploadDate,
-				SHA2:        f.SHA2,
-			}
+		folder := normalizeFolder(filepath.Dir(newFSEntry.FullPath))
+		if user.userEntry.ZeroKnowledge {
+			folder = f.Folder
+		}
+
+		foldersContainingTaggedFiles = append(foldersContainingTaggedFiles, folder)
+
+		if folder == path {
 			fs = append(fs, newFSEntry)
 		}
 	}
 
-	folders, _, err := gc.FileStructDB.ListFolders(user.userEntry.Username, path)
+	folders, err := user.newFolderEntries(path)
 
 	if err != nil {
 		return nil, err
 	}
 
 	var addedFolders []string
-	for _, folder := range folders {
-		newFSEntry := FileSystemStructure{
-			ID:         folder.ID,
-			Type:       typeFolder,
-			Name:       normalizeFolder(folder.Folder),
-			UploadDate: folder.UploadDate,
-			FullPath:   normalizeFolder(filepath.Join(path, folder.Folder)),
-		}
-
+	for _, newFSEntry := range folders {
 		for _, folderWithTag := range foldersContainingTaggedFiles {
 			relativePath, err := filepath.Rel(newFSEntry.FullPath, folderWithTag)
 			fmt.Println(newFSEntry.FullPath, folderWithTag, relativePath)
@@ -104,22 +239,33 @@ func (user *userData) listFileSystemByTags(path string, tag []string) ([]FileSys
 func (user *userData) listAllNestedFiles(path string) []gc.File {
 	var nestedFiles []gc.File
 	path = normalizeFolder(filepath.Clean(path))
-	username := user.userEntry.Username
-	folders, _, _ := gc.FileStructDB.ListFolders(username, path)
-	files, _ := gc.FileStructDB.ListFiles(username, path)
+	_, names, _ := user.listFolders(path)
+	files, _ := user.listFiles(path)
 
 	for _, file := range files {
 		nestedFiles = append(nestedFiles, file)
 	}
 
 	var wg sync.WaitGroup
+	var nestedFilesLock sync.Mutex
+	seen := make(map[string]bool)
+
+	for _, name := range names {
+		// while the keys are rotated a folder can be stored under both
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
 
-	for _, folder := range folders {
 		wg.Add(1)
-		go func(f gc.FolderTree) {
+		go func(name string) {
 			defer wg.Done()
-			nestedFiles = append(nestedFiles, user.listAllNestedFiles(filepath.Join(path, f.Folder))...)
-		}(folder)
+			files := user.listAllNestedFiles(filepath.Join(path, name))
+
+			nestedFilesLock.Lock()
+			nestedFiles = append(nestedFiles, files...)
+			nestedFilesLock.Unlock()
+		}(name)
 	}
 
 	wg.Wait()
@@ -128,7 +274,7 @@ func (user *userData) listAllNestedFiles(path string) []gc.File {
 
 func (user *userData) listFileSystem(path string, tags []string) ([]FileSystemStructure, error) {
 	path = normalizeFolder(filepath.Clean(path))
-	files, err := gc.FileStructDB.ListFiles(user.userEntry.Username, path)
+	files, err := user.listFiles(path)
 
 	if err != nil {
 		return nil, err
@@ -138,43 +284,20 @@ func (user *userData) listFileSystem(path string, tags []string) ([]FileSystemSt
 
 	for _, file := range files {
 
-		plainTextFilename, err := user.cryptoData.DecryptText(file.Filename)
+		newFSEntry, err := user.newFileEntry(&file)
 
 		if err != nil {
 			return nil, err
 		}
 
-		newFSEntry := FileSystemStructure{
-			ID:          file.ID,
-			Type:        typeFilename,
-			Name:        string(plainTextFilename),
-			FullPath:    filepath.Clean(filepath.Join(file.Folder, string(plainTextFilename))),
-			FileType:    file.FileType,
-			FileSize:    file.FileSize,
-			Description: file.Description,
-			Tags:        file.Tags,
-			UploadDate:  file.UploadDate,
-			SHA2:        file.SHA2,
-		}
-
 		fs = append(fs, newFSEntry)
 	}
 
-	folders, _, err := gc.FileStructDB.ListFolders(user.userEntry.Username, path)
+	folders, err := user.newFolderEntries(path)
 
 	if err != nil {
 		return nil, err
 	}
 
-	for _, folder := range folders {
-		newFSEntry := FileSystemStructure{
-			ID:         folder.ID,
-			Type:       typeFolder,
-			Name:       normalizeFolder(folder.Folder),
-			UploadDate: folder.UploadDate,
-			FullPath:   normalizeFolder(filepath.Join(path, folder.Folder))}
-		fs = append(fs, newFSEntry)
-	}
-
-	return fs, nil
+	return append(fs, folders...), nil
 }
@@ -1,8 +1,10 @@
-package main
+package app
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -64,23 +66,24 @@ func init() {
 		"password": "sdddqs!3482",
 	}
 
-	if !strings.Contains(os.Getenv("GOOGLE_CLOUD_STORAGE_BUCKET"), "testing") || !strings.HasPrefix(os.Getenv("DATASTORE_EMULATOR_HOST"), "localhost") {
-		panic("GOOGLE_CLOUD_STORAGE_BUCKET must contain 'test' substring and DATASTORE_EMULATOR_HOST must be set to local host when testing")
-	}
-
 	gin.SetMode(gin.DebugMode)
 }
 
 func clearBucket() {
+	if s, ok := testServer.storage.(*gc.MemoryBlobStore); ok {
+		s.Reset()
+		return
+	}
+
 	ctx := context.Background()
-	it := config.storageBucket.Objects(ctx, nil)
+	objects, err := testServer.storage.List(ctx, "")
 
-	for {
-		if obj, err := it.Next(); err != nil {
-			return
-		} else {
-			config.storageBucket.Object(obj.Name).Delete(ctx)
-		}
+	if err != nil {
+		return
+	}
+
+	for _, obj := range objects {
+		testServer.storage.Delete(ctx, obj)
 	}
 }
 
@@ -240,6 +243,11 @@ func TestDownloadZipFile(t *testing.T) {
 
 	for _, testCase := range testCases {
 		clearDatastore()
+
+		// the session of the admin ended with their account
+		createAdmin()
+		adminCookie = loginUser(adminLoginDetails)
+
 		for idx, uploadFile := range testCase.uploads {
 			testfile, sha1 := createTestFile(uploadFile.filename, uploadFile.filesize)
 			defer os.Remove(testfile)
@@ -401,6 +409,67 @@ func TestUploadDownloadFile(t *testing.T) {
 	}
 }
 
+func TestRangeDownload(t *testing.T) {
+	clearDatastore()
+	createAdmin()
+	cookie := loginUser(adminLoginDetails)
+
+	testfile, _ := createTestFile("rangefile", 300*1024)
+	defer os.Remove(testfile)
+
+	contents, _ := ioutil.ReadFile(testfile)
+	etag := fmt.Sprintf("\"%x\"", sha256.Sum256(contents))
+
+	f, _ := grequests.FileUploadFromDisk(testfile)
+	resp, err := grequests.Post(ts.URL+"/auth/file", &grequests.RequestOptions{Files: f, Cookies: []*http.Cookie{cookie}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	fsObjects := getAllFSObjectsUsingAPI("/", cookie)
+	fileURL := ts.URL + "/auth/file/" + strconv.Itoa(fsObjects[0].ID)
+
+	type testCase struct {
+		headers            map[string]string
+		expectedHTTPStatus int
+		expectedBody       []byte
+		expectedRange      string
+	}
+
+	tests := []testCase{
+		testCase{nil, http.StatusOK, contents, ""},
+		testCase{map[string]string{"Range": "bytes=0-9"}, http.StatusPartialContent, contents[:10], "bytes 0-9/307200"},
+		testCase{map[string]string{"Range": "bytes=65530-200000"}, http.StatusPartialContent, contents[65530:200001], "bytes 65530-200000/307200"},
+		testCase{map[string]string{"Range": "bytes=-100"}, http.StatusPartialContent, contents[len(contents)-100:], "bytes 307100-307199/307200"},
+		testCase{map[string]string{"Range": "bytes=400000-"}, http.StatusRequestedRangeNotSatisfiable, nil, "bytes */307200"},
+		testCase{map[string]string{"Range": "bytes=10-19", "If-Range": etag}, http.StatusPartialContent, contents[10:20], "bytes 10-19/307200"},
+		testCase{map[string]string{"Range": "bytes=10-19", "If-Range": "\"stale\""}, http.StatusOK, contents, ""},
+		testCase{map[string]string{"If-None-Match": etag}, http.StatusNotModified, nil, ""},
+	}
+
+	for _, test := range tests {
+		resp, err := grequests.Get(fileURL, &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}, Headers: test.headers})
+		assert.Nil(t, err)
+		assert.Equal(t, test.expectedHTTPStatus, resp.StatusCode, fmt.Sprint(test.headers))
+
+		// errors don't describe the file, and newer Go versions drop its
+		// headers from them
+		if test.expectedHTTPStatus < http.StatusBadRequest {
+			assert.Equal(t, etag, resp.Header.Get("ETag"))
+		}
+
+		// not modified responses only repeat the ETag
+		if test.expectedHTTPStatus < http.StatusMultipleChoices {
+			assert.NotEmpty(t, resp.Header.Get("Last-Modified"))
+		}
+		assert.Equal(t, test.expectedRange, resp.Header.Get("Content-Range"))
+
+		if test.expectedBody != nil {
+			assert.Equal(t, strconv.Itoa(len(test.expectedBody)), resp.Header.Get("Content-Length"))
+			assert.True(t, bytes.Equal(test.expectedBody, resp.Bytes()), fmt.Sprint(test.headers))
+		}
+	}
+}
+
 func TestFileIsEncrypted(t *testing.T) {
 	clearDatastore()
 
@@ -441,13 +510,13 @@ func TestFileIsEncrypted(t *testing.T) {
 
 	fileID := downloadStruct[0].ID
 
-	file, err := gc.FileStructDB.GetFile(adminLoginDetails["username"], int64(fileID))
+	file, err := testServer.files.GetFile(adminLoginDetails["username"], int64(fileID))
 	ctx := context.Background()
 
-	reader, err := gc.StorageBucket.Object(file.GoogleCloudObject).NewReader(ctx)
-	user, _, err := gc.UserDB.GetUserEntry(adminLoginDetails["username"])
+	reader, err := testServer.storage.Get(ctx, file.GoogleCloudObject)
+	user, _, err := testServer.users.GetUserEntry(adminLoginDetails["username"])
 
-	c := crypto.NewCryptoData([]byte(adminLoginDetails["password"]), nil, user.Salt, user.Iterations)
+	c := wrappingKey(user, []byte(adminLoginDetails["password"]))
 	pgpKey, err := c.DecryptText(user.EncryptedPGPKey)
 
 	assert.NoError(t, err, "errored trying to decrypt pgp key")
@@ -573,6 +642,35 @@ func TestInitialAccount(t *testing.T) {
 	}
 }
 
+func TestIndependentServers(t *testing.T) {
+	config := *testServer.config
+	config.JWTKey = "another testing key"
+
+	db := gc.NewMemoryDB()
+	other, err := NewServerWithBackends(&config, db, gc.NewMemoryBlobStore(), gc.NewMemorySessionStore())
+	assert.Nil(t, err)
+
+	otherTS := httptest.NewServer(other)
+	defer otherTS.Close()
+
+	clearDatastore()
+	createAdmin()
+	adminCookie := loginUser(adminLoginDetails)
+
+	resp, err := grequests.Get(otherTS.URL+"/account/initial", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// tokens are signed with a per server key
+	resp, err = grequests.Post(otherTS.URL+"/auth/account/verify", &grequests.RequestOptions{Cookies: []*http.Cookie{adminCookie}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, err = grequests.Post(ts.URL+"/auth/account/verify", &grequests.RequestOptions{Cookies: []*http.Cookie{adminCookie}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
+
 func TestVerifyUserContext(t *testing.T) {
 	type testCase struct {
 		userHasLoggedIn  bool
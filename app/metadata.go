@@ -0,0 +1,384 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+)
+
+// The folder, description, tags, type and size of a file are encrypted by its
+// data key, and folder names by the user's key. The database looks them up by
+// blind indexes instead, HMACs by the user's key: File.Folder and File.Tags
+// hold the indexes of the folder and tags, and FolderTree.Folder and
+// ParentFolder those of the folders in the path. Records stored before are
+// migrated the next time their user logs in.
+//
+// Zero-knowledge clients encrypt and index the metadata themselves, the
+// folders they send and list are already indexes.
+const (
+	errorMissingFolderNames = "every folder needs its encrypted name"
+)
+
+// folderIndexes returns the indexes folder can be stored under. While the
+// keys are rotated, files and folders can have the index of either.
+func (user *userData) folderIndexes(folder string) []string {
+	folder = normalizeFolder(folder)
+
+	if user.userEntry.ZeroKnowledge {
+		return []string{folder}
+	}
+
+	indexes := []string{user.cryptoData.FolderIndex(folder)}
+
+	// the root has the same index under every key
+	if user.nextCryptoData != nil && folder != "/" {
+		indexes = append(indexes, user.nextCryptoData.FolderIndex(folder))
+	}
+	return indexes
+}
+
+// fileMetadata decrypts the metadata of f with its data key, files stored
+// before metadata was encrypted, which are never bound, have it in the clear.
+func fileMetadata(f *gc.File, dataKey *crypto.CryptoData) (*crypto.FileMetadata, error) {
+	if len(f.Metadata) == 0 && f.FormatVersion < gc.FileFormatBound {
+		return &crypto.FileMetadata{Folder: normalizeFolder(f.Folder), Description: f.Description, Tags: f.Tags,
+			FileType: f.FileType, FileSize: f.FileSize}, nil
+	}
+	return fileFieldKey(dataKey, f, crypto.PurposeMetadata).DecryptMetadata(f.Metadata)
+}
+
+// setFileMetadata encrypts m into f with its data key, and replaces the
+// fields of f holding it by the indexes of master, the key of f's generation.
+func setFileMetadata(f *gc.File, m *crypto.FileMetadata, master, dataKey *crypto.CryptoData) error {
+	encrypted, err := fileFieldKey(dataKey, f, crypto.PurposeMetadata).EncryptMetadata(m)
+
+	if err != nil {
+		return err
+	}
+
+	f.Metadata = encrypted
+	f.Folder = master.FolderIndex(m.Folder)
+	f.Tags = make([]string, 0, len(m.Tags))
+	f.Description, f.FileType, f.FileSize = "", "", 0
+
+	for _, tag := range m.Tags {
+		f.Tags = append(f.Tags, master.TagIndex(tag))
+	}
+	return nil
+}
+
+// decryptMetadata returns the metadata of one of the user's files.
+func (user *userData) decryptMetadata(f *gc.File) (*crypto.FileMetadata, error) {
+	if user.userEntry.ZeroKnowledge {
+		return nil, errors.New(errZeroKnowledge)
+	}
+
+	dataKey, err := user.fileKey(f)
+
+	if err != nil {
+		return nil, err
+	}
+	return fileMetadata(f, dataKey)
+}
+
+// folderNameKey returns the key encrypting the names of folders in format
+// version, given master, the user's key of their generation.
+func folderNameKey(master *crypto.CryptoData, version int) *crypto.CryptoData {
+	if version >= gc.FileFormatSubkeys {
+		return master.Subkey(crypto.PurposeFolderName, version)
+	}
+	return master
+}
+
+// folderName decrypts the name of ft. Zero-knowledge clients decrypt it
+// themselves, so it's left empty.
+func (user *userData) folderName(ft *gc.FolderTree) (string, error) {
+	if user.userEntry.ZeroKnowledge {
+		return "", nil
+	}
+
+	master, err := user.masterKey(ft.KeyGeneration)
+
+	if err != nil {
+		return "", err
+	}
+
+	name, err := folderNameKey(master, ft.FormatVersion).DecryptText(ft.EncryptedFolder)
+
+	if err != nil {
+		return "", err
+	}
+	return string(name), nil
+}
+
+// listFiles returns the files in folder.
+func (user *userData) listFiles(folder string) ([]gc.File, error) {
+	var files []gc.File
+
+	for _, index := range user.folderIndexes(folder) {
+		found, err := user.server.files.ListFiles(user.userEntry.Username, index)
+
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, found...)
+	}
+	return files, nil
+}
+
+// listFolders returns the folders in folder and their names. While the keys
+// are rotated the same folder can be there under each key.
+func (user *userData) listFolders(folder string) ([]gc.FolderTree, []string, error) {
+	var folders []gc.FolderTree
+	var names []string
+
+	for _, index := range user.folderIndexes(folder) {
+		found, _, err := user.server.files.ListFolders(user.userEntry.Username, index)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, ft := range found {
+			name, err := user.folderName(&ft)
+
+			if err != nil {
+				return nil, nil, err
+			}
+
+			folders = append(folders, ft)
+			names = append(names, name)
+		}
+	}
+	return folders, names, nil
+}
+
+// folderIDs returns the ids of folder, under each key it's stored with.
+func (user *userData) folderIDs(folder string) []int64 {
+	var ids []int64
+
+	for _, index := range user.folderIndexes(folder) {
+		if _, id, err := user.server.files.ListFolders(user.userEntry.Username, index); err == nil && id != 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// walkFolders calls fn with the path of every folder in path, and the folders
+// in those, which is named by master, the key of generation. Folders are
+// visited after the folders in them. If master is nil the folders named in
+// the clear, from before metadata was encrypted, are walked instead.
+func (user *userData) walkFolders(master *crypto.CryptoData, generation int, path string, fn func(string, *gc.FolderTree) error) error {
+	index := path
+	if master != nil {
+		index = master.FolderIndex(path)
+	}
+
+	folders, _, err := user.server.files.ListFolders(user.userEntry.Username, index)
+
+	if err != nil {
+		return err
+	}
+
+	for i := range folders {
+		ft := &folders[i]
+		name := ft.Folder
+
+		if master == nil && len(ft.EncryptedFolder) > 0 {
+			continue
+		}
+
+		if master != nil {
+			if len(ft.EncryptedFolder) == 0 || ft.KeyGeneration != generation {
+				continue
+			}
+
+			decrypted, err := folderNameKey(master, ft.FormatVersion).DecryptText(ft.EncryptedFolder)
+
+			if err != nil {
+				return err
+			}
+			name = string(decrypted)
+		}
+
+		folder := normalizeFolder(path + name)
+
+		if err := user.walkFolders(master, generation, folder, fn); err != nil {
+			return err
+		}
+
+		if err := fn(folder, ft); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listTags returns the tags of the user's files.
+func (user *userData) listTags() ([]string, error) {
+	files, err := user.server.files.GetAllFiles(user.userEntry.Username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	tags := []string{}
+
+	for _, f := range files {
+		m, err := user.decryptMetadata(f)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if user.checkTokenFolder(m.Folder) != nil {
+			continue
+		}
+
+		for _, tag := range m.Tags {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// searchFolders returns up to limit folders of the user's files which start
+// with search.
+func (user *userData) searchFolders(search string, limit int) ([]string, error) {
+	files, err := user.server.files.GetAllFiles(user.userEntry.Username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	folders := []string{}
+
+	for _, f := range files {
+		m, err := user.decryptMetadata(f)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if user.checkTokenFolder(m.Folder) != nil {
+			continue
+		}
+
+		if strings.HasPrefix(m.Folder, search) && !seen[m.Folder] {
+			seen[m.Folder] = true
+			folders = append(folders, m.Folder)
+		}
+	}
+
+	sort.Strings(folders)
+
+	if limit > 0 && len(folders) > limit {
+		folders = folders[:limit]
+	}
+	return folders, nil
+}
+
+// migrateMetadata encrypts the metadata of the user's files, and the names of
+// their folders, stored before metadata was encrypted, and returns how many
+// files were migrated. Files are migrated one at a time and folders
+// afterwards, so running it again continues with the records left.
+func (user *userData) migrateMetadata() (int, error) {
+	username := user.userEntry.Username
+
+	if user.userEntry.ZeroKnowledge {
+		return 0, errors.New(errZeroKnowledge)
+	}
+
+	files, err := user.server.files.GetAllFiles(username)
+
+	if err != nil {
+		return 0, err
+	}
+
+	folders := make(map[string]bool)
+	migrated := 0
+
+	for _, f := range files {
+		if len(f.Metadata) > 0 {
+			continue
+		}
+
+		master, err := user.masterKey(f.KeyGeneration)
+
+		if err != nil {
+			return migrated, err
+		}
+
+		dataKey, err := fileFieldKey(master, f, crypto.PurposeDataKey).DataKey(f.DataKey)
+
+		if err != nil {
+			return migrated, err
+		}
+
+		m, _ := fileMetadata(f, dataKey)
+
+		if err := setFileMetadata(f, m, master, dataKey); err != nil {
+			return migrated, err
+		}
+
+		if err := user.server.files.UpdateFile(f, f.ID); err != nil {
+			return migrated, fmt.Errorf("could not migrate file %d: %v", f.ID, err)
+		}
+
+		folders[m.Folder] = true
+		migrated++
+	}
+
+	// every folder, empty ones too, is created again with its name
+	// encrypted before the one named in the clear is deleted
+	var legacyFolders []int64
+
+	if err := user.walkFolders(nil, 0, "/", func(folder string, ft *gc.FolderTree) error {
+		folders[folder] = true
+		legacyFolders = append(legacyFolders, ft.ID)
+		return nil
+	}); err != nil {
+		return migrated, err
+	}
+
+	master, generation := user.currentMasterKey()
+
+	for folder := range folders {
+		if _, err := user.createFolder(master, generation, folder); err != nil {
+			return migrated, err
+		}
+	}
+
+	for _, id := range legacyFolders {
+		if err := user.server.files.DeleteFolder(username, id); err != nil {
+			return migrated, err
+		}
+	}
+
+	userEntry, id, err := user.server.users.GetUserEntry(username)
+
+	if err != nil {
+		return migrated, err
+	}
+
+	userEntry.MetadataEncrypted = true
+
+	if err := user.server.users.UpdateUser(id, userEntry); err != nil {
+		return migrated, err
+	}
+
+	user.userEntry.MetadataEncrypted = true
+	return migrated, nil
+}
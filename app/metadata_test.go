@@ -0,0 +1,197 @@
+package app
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/levigross/grequests"
+	"github.com/stretchr/testify/assert"
+)
+
+func uploadToFolder(t *testing.T, cookie *http.Cookie, name, folder, tags, description string) {
+	f := grequests.FileUpload{FileName: name, FileContents: ioutil.NopCloser(strings.NewReader("contents of " + name))}
+	resp, err := grequests.Post(ts.URL+"/auth/file", &grequests.RequestOptions{
+		Cookies: []*http.Cookie{cookie},
+		Files:   []grequests.FileUpload{f},
+		Data:    map[string]string{"virtfolder": folder, "tags": tags, "description": description},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+}
+
+func listFolder(t *testing.T, cookie *http.Cookie, params map[string]string) []FileSystemStructure {
+	var listing []FileSystemStructure
+	resp, err := grequests.Get(ts.URL+"/auth/list/fs", &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}, Params: params})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, resp.JSON(&listing))
+	return listing
+}
+
+func listTags(t *testing.T, cookie *http.Cookie) []string {
+	var tags []string
+	resp, err := grequests.Get(ts.URL+"/auth/list/tags/", &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}})
+	assert.Nil(t, err)
+	assert.Nil(t, resp.JSON(&tags))
+	return tags
+}
+
+func TestEncryptedMetadata(t *testing.T) {
+	clearDatastore()
+	clearBucket()
+	createAdmin()
+	cookie := loginUser(adminLoginDetails)
+	username := adminLoginDetails["username"]
+
+	uploadToFolder(t, cookie, "report", "/secret/plans/", "Confidential, budget", "the budget")
+	uploadToFolder(t, cookie, "notes", "/secret/", "budget", "")
+	uploadToFolder(t, cookie, "other", "/", "", "")
+
+	// only blind indexes are stored in the clear
+	files, _ := testServer.files.GetAllFiles(username)
+	assert.Len(t, files, 3)
+
+	for _, f := range files {
+		assert.NotEmpty(t, f.Metadata)
+		assert.NotContains(t, f.Folder, "secret")
+		assert.Empty(t, f.Description)
+		assert.Empty(t, f.FileType)
+		assert.Zero(t, f.FileSize)
+
+		for _, tag := range f.Tags {
+			assert.NotContains(t, []string{"confidential", "budget"}, tag)
+		}
+	}
+
+	folders, _, _ := testServer.files.ListFolders(username, "/")
+	if assert.Len(t, folders, 1) {
+		assert.NotEqual(t, "secret", folders[0].Folder)
+		assert.NotContains(t, string(folders[0].EncryptedFolder), "secret")
+	}
+
+	expectedFiles := []simpleFile{{path: "/secret/plans", filename: "report"}, {path: "/secret", filename: "notes"}, {path: "/", filename: "other"}}
+	assert.ElementsMatch(t, expectedFiles, fsLayoutToSimpleFile(getAllFSObjectsUsingAPI("/", cookie)))
+
+	listing := listFolder(t, cookie, map[string]string{"path": "/secret/plans/"})
+	if assert.Len(t, listing, 1) {
+		assert.Equal(t, "the budget", listing[0].Description)
+		assert.ElementsMatch(t, []string{"confidential", "budget"}, listing[0].Tags)
+		assert.Equal(t, int64(len("contents of report")), listing[0].FileSize)
+		assert.NotEmpty(t, listing[0].FileType)
+	}
+
+	assert.Equal(t, []string{"budget", "confidential"}, listTags(t, cookie))
+
+	// tags are case insensitive, folders with tagged files in them are listed
+	listing = listFolder(t, cookie, map[string]string{"path": "/secret/", "tags": "Budget"})
+	var names []string
+	for _, entry := range listing {
+		names = append(names, entry.FullPath)
+	}
+	assert.ElementsMatch(t, []string{"/secret/notes", "/secret/plans/"}, names)
+
+	var found []string
+	resp, _ := grequests.Get(ts.URL+"/auth/folder/search/", &grequests.RequestOptions{
+		Cookies: []*http.Cookie{cookie},
+		Params:  map[string]string{"path": "/sec"},
+	})
+	assert.Nil(t, resp.JSON(&found))
+	assert.Equal(t, []string{"/secret/", "/secret/plans/"}, found)
+
+	var stats struct {
+		Stats fileSystemStats `json:"stats"`
+	}
+	resp, _ = grequests.Get(ts.URL+"/auth/account/stat", &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}})
+	assert.Nil(t, resp.JSON(&stats))
+	assert.Equal(t, int64(len("contents of report")+len("contents of notes")+len("contents of other")), stats.Stats.TotalFileUsage)
+
+	// folders move to the new keys with the files
+	assert.Equal(t, http.StatusAccepted, rotateKeys(cookie, adminLoginDetails["password"]).StatusCode)
+	waitForKeyRotation(t, cookie)
+
+	folders, _, _ = testServer.files.ListFolders(username, "/")
+	if assert.Len(t, folders, 1) {
+		assert.Equal(t, 1, folders[0].KeyGeneration)
+	}
+
+	assert.ElementsMatch(t, expectedFiles, fsLayoutToSimpleFile(getAllFSObjectsUsingAPI("/", cookie)))
+	assert.Equal(t, []string{"budget", "confidential"}, listTags(t, cookie))
+	assert.Len(t, listFolder(t, cookie, map[string]string{"path": "/secret/plans/", "tags": "confidential"}), 1)
+}
+
+func TestMigrateMetadata(t *testing.T) {
+	clearDatastore()
+	clearBucket()
+	createAdmin()
+	cookie := loginUser(adminLoginDetails)
+	username := adminLoginDetails["username"]
+	password := []byte(adminLoginDetails["password"])
+
+	uploadToFolder(t, cookie, "report", "/secret/plans/", "budget", "the budget")
+	uploadToFolder(t, cookie, "other", "/", "", "")
+
+	// store everything the way it was before metadata was encrypted, which
+	// was before files were bound
+	user, err := testServer.unlockUser(username, password)
+	assert.Nil(t, err)
+
+	files, _ := testServer.files.GetAllFiles(username)
+	for _, f := range files {
+		m, err := user.decryptMetadata(f)
+		assert.Nil(t, err)
+		name, err := user.decryptFilename(f)
+		assert.Nil(t, err)
+		makeLegacyFile(t, user, f, []byte("contents of "+string(name)), false)
+
+		f.Folder, f.Description, f.Tags, f.FileType, f.FileSize = m.Folder, m.Description, m.Tags, m.FileType, m.FileSize
+		f.Metadata = nil
+		assert.Nil(t, testServer.files.UpdateFile(f, f.ID))
+	}
+
+	assert.Nil(t, user.walkFolders(&user.cryptoData, 0, "/", func(folder string, ft *gc.FolderTree) error {
+		return testServer.files.DeleteFolder(username, ft.ID)
+	}))
+
+	secretID, _ := testServer.files.AddFolder(&gc.FolderTree{Username: username, Folder: "secret"})
+	testServer.files.AddFolder(&gc.FolderTree{Username: username, ParentKey: secretID, ParentFolder: "secret", Folder: "plans"})
+	testServer.files.AddFolder(&gc.FolderTree{Username: username, Folder: "empty"})
+
+	userEntry, id, _ := testServer.users.GetUserEntry(username)
+	userEntry.MetadataEncrypted = false
+	assert.Nil(t, testServer.users.UpdateUser(id, userEntry))
+
+	// logging in migrates it
+	testServer.revokeSessions(username)
+	cookie = loginUser(adminLoginDetails)
+
+	userEntry, _, _ = testServer.users.GetUserEntry(username)
+	assert.True(t, userEntry.MetadataEncrypted)
+
+	files, _ = testServer.files.GetAllFiles(username)
+	for _, f := range files {
+		assert.NotEmpty(t, f.Metadata)
+		assert.Empty(t, f.Description)
+	}
+
+	folders, _, _ := testServer.files.ListFolders(username, "/secret/")
+	assert.Nil(t, folders, "folders named in the clear are left")
+
+	fsObjects := getAllFSObjectsUsingAPI("/", cookie)
+	assert.ElementsMatch(t, []simpleFile{{path: "/secret/plans", filename: "report"}, {path: "/", filename: "other"}}, fsLayoutToSimpleFile(fsObjects))
+
+	var folderPaths []string
+	for _, o := range fsObjects {
+		if o.Type == typeFolder {
+			folderPaths = append(folderPaths, o.Fullpath)
+		}
+	}
+	assert.ElementsMatch(t, []string{"/secret/", "/secret/plans/", "/empty/"}, folderPaths)
+	assert.Equal(t, []string{"budget"}, listTags(t, cookie))
+
+	migrated, err := testServer.MigrateMetadata(username, password)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, migrated)
+}
@@ -0,0 +1,215 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+	"github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// unlockUser checks password and returns the user with their keys, the same
+// way logging in does.
+func (s *Server) unlockUser(username string, password []byte) (*userData, error) {
+	if err := s.verifyUserPassword(username, password); err != nil {
+		return nil, err
+	}
+
+	userEntry, _, err := s.users.GetUserEntry(username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if userEntry.ZeroKnowledge {
+		return nil, errors.New(errZeroKnowledge)
+	}
+
+	key := wrappingKey(userEntry, password)
+	pgpKey, err := key.DecryptText(userEntry.EncryptedPGPKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	hmacSecret, err := key.DecryptText(userEntry.EncryptedHMACSecret)
+
+	if err != nil {
+		return nil, err
+	}
+
+	userCrypto := masterKeyOf(userEntry, pgpKey, hmacSecret, userEntry.IndexVersion)
+
+	return &userData{cryptoData: *userCrypto, userEntry: *userEntry, server: s}, nil
+}
+
+// MigrateDataKeys gives every file of username uploaded before data keys
+// existed a key of its own, binds those stored before their encrypted fields
+// were bound to them, and returns how many files were migrated. Each file is
+// copied to a new object, so one which fails is left as it was and running it
+// again continues with the files left.
+func (s *Server) MigrateDataKeys(username string, password []byte) (int, error) {
+	user, err := s.unlockUser(username, password)
+
+	if err != nil {
+		return 0, err
+	}
+
+	// a rotation gives the files data keys as well
+	if user.userEntry.Rotating() {
+		return 0, errors.New(errRotationInProgress)
+	}
+
+	files, err := s.files.GetAllFiles(username)
+
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+
+	for _, f := range files {
+		if len(f.DataKey) > 0 && f.FormatVersion >= gc.FileFormatVersion {
+			continue
+		}
+
+		if err := user.reencryptFile(f, &user.cryptoData, f.KeyGeneration); err != nil {
+			return migrated, fmt.Errorf("could not migrate file %d: %v", f.ID, err)
+		}
+
+		migrated++
+	}
+
+	return migrated, nil
+}
+
+// MigrateMetadata encrypts the metadata of the files and folders of username
+// stored before metadata was encrypted, and returns how many files were
+// migrated. It's otherwise done when the user next logs in.
+func (s *Server) MigrateMetadata(username string, password []byte) (int, error) {
+	user, err := s.unlockUser(username, password)
+
+	if err != nil {
+		return 0, err
+	}
+
+	// the files of the next keys can't be read without logging in
+	if user.userEntry.Rotating() {
+		return 0, errors.New(errRotationInProgress)
+	}
+
+	return user.migrateMetadata()
+}
+
+// reencryptFile copies f to a new object encrypted by a new data key, which is
+// wrapped by master, the key of generation. Its name and metadata are
+// encrypted again and indexed by master. Legacy OpenPGP objects are converted
+// to the segmented format on the way, and everything is bound to the new
+// object. Objects encrypted to the owner's public keys are copied unchanged.
+func (user *userData) reencryptFile(f *gc.File, master *crypto.CryptoData, generation int) error {
+	// a new object which is never closed is abandoned once ctx is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	oldKey, err := user.fileKey(f)
+
+	if err != nil {
+		return err
+	}
+
+	filename, err := fileFieldKey(oldKey, f, crypto.PurposeFilename).DecryptText(f.Filename)
+
+	if err != nil {
+		return err
+	}
+
+	reencrypted := &gc.File{Username: f.Username, GoogleCloudObject: uuid.NewV4().String(), FormatVersion: gc.FileFormatVersion}
+	dataKey, wrappedDataKey, err := fileFieldKey(master, reencrypted, crypto.PurposeDataKey).NewDataKey()
+
+	if err != nil {
+		return err
+	}
+
+	encryptedFilename, err := fileFieldKey(dataKey, reencrypted, crypto.PurposeFilename).EncryptText(filename)
+
+	if err != nil {
+		return err
+	}
+
+	metadata, err := fileMetadata(f, oldKey)
+
+	if err != nil {
+		return err
+	}
+
+	r, err := user.server.storage.Get(ctx, f.GoogleCloudObject)
+
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	object := reencrypted.GoogleCloudObject
+	storageWriter, err := user.server.storage.Put(ctx, object, nil)
+
+	if err != nil {
+		return err
+	}
+
+	var written int64
+
+	if f.PublicKeyEncrypted {
+		// only the owner's private key decrypts it, the object is copied as
+		// it is
+		if _, err := io.Copy(storageWriter, r); err != nil {
+			return err
+		}
+		written = metadata.FileSize
+	} else {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(fileFieldKey(oldKey, f, crypto.PurposeContents).DecryptFile(r, pw, f.Compressed))
+		}()
+
+		written, err = fileFieldKey(dataKey, reencrypted, crypto.PurposeContents).EncryptStream(pr, storageWriter)
+		pr.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := storageWriter.Close(); err != nil {
+		return err
+	}
+
+	oldObject := f.GoogleCloudObject
+	f.GoogleCloudObject = object
+	f.Filename = encryptedFilename
+	f.FilenameHMAC = master.GenerateHMAC([]byte(metadata.Folder + string(filename)))
+	f.Compressed = false
+	f.DataKey = wrappedDataKey
+	f.KeyGeneration = generation
+	f.FormatVersion = reencrypted.FormatVersion
+	metadata.FileSize = written
+
+	if err := setFileMetadata(f, metadata, master, dataKey); err != nil {
+		user.server.storage.Delete(ctx, object)
+		return err
+	}
+
+	if err := user.server.files.UpdateFile(f, f.ID); err != nil {
+		user.server.storage.Delete(ctx, object)
+		return err
+	}
+
+	if err := user.server.storage.Delete(ctx, oldObject); err != nil {
+		log.WithFields(log.Fields{"object": oldObject, "error": err}).Warn("failed to delete migrated object")
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/levigross/grequests"
+	"github.com/stretchr/testify/assert"
+)
+
+// makeLegacyFile re-encrypts a file, its name and metadata with the user's
+// key, the way files were stored before data keys and without binding them
+// to the file. OpenPGP is used if legacyFormat is set.
+func makeLegacyFile(t *testing.T, user *userData, f *gc.File, contents []byte, legacyFormat bool) {
+	ctx := context.Background()
+	name, err := user.decryptFilename(f)
+	assert.Nil(t, err)
+	metadata, err := user.decryptMetadata(f)
+	assert.Nil(t, err)
+
+	w, err := testServer.storage.Put(ctx, f.GoogleCloudObject, nil)
+	assert.Nil(t, err)
+
+	if legacyFormat {
+		_, err = user.cryptoData.EncryptFile(bytes.NewReader(contents), w, true)
+	} else {
+		_, err = user.cryptoData.EncryptStream(bytes.NewReader(contents), w)
+	}
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+
+	f.Filename, _ = user.cryptoData.EncryptText(name)
+	f.Metadata, _ = user.cryptoData.EncryptMetadata(metadata)
+	f.Compressed = legacyFormat
+	f.DataKey = nil
+	f.FormatVersion = 0
+	assert.Nil(t, testServer.files.UpdateFile(f, f.ID))
+}
+
+func TestMigrateDataKeys(t *testing.T) {
+	clearDatastore()
+	clearBucket()
+	createAdmin()
+	cookie := loginUser(adminLoginDetails)
+
+	var contents [][]byte
+	for _, name := range []string{"stream", "openpgp", "new"} {
+		testfile, _ := createTestFile(name, 50*1024)
+		defer os.Remove(testfile)
+		data, _ := ioutil.ReadFile(testfile)
+		contents = append(contents, data)
+
+		f, _ := grequests.FileUploadFromDisk(testfile)
+		resp, err := grequests.Post(ts.URL+"/auth/file", &grequests.RequestOptions{Files: f, Cookies: []*http.Cookie{cookie}})
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+
+	files, err := testServer.files.GetAllFiles(adminLoginDetails["username"])
+	assert.Nil(t, err)
+	assert.Len(t, files, 3)
+	assert.NotEmpty(t, files[0].DataKey)
+	assert.NotEqual(t, files[0].DataKey, files[1].DataKey)
+
+	user, err := testServer.unlockUser(adminLoginDetails["username"], []byte(adminLoginDetails["password"]))
+	assert.Nil(t, err)
+	makeLegacyFile(t, user, files[0], contents[0], false)
+	makeLegacyFile(t, user, files[1], contents[1], true)
+
+	assertDownloads := func() {
+		fsObjects := getAllFSObjectsUsingAPI("/", cookie)
+		assert.Len(t, fsObjects, 3)
+
+		for i, f := range files {
+			resp, err := grequests.Get(ts.URL+"/auth/file/"+strconv.FormatInt(f.ID, 10), &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}})
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.True(t, bytes.Equal(contents[i], resp.Bytes()), "file %d differs", i)
+		}
+	}
+
+	assertDownloads()
+
+	_, err = testServer.MigrateDataKeys(adminLoginDetails["username"], []byte("not the password"))
+	assert.NotNil(t, err)
+
+	migrated, err := testServer.MigrateDataKeys(adminLoginDetails["username"], []byte(adminLoginDetails["password"]))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, migrated)
+
+	ctx := context.Background()
+	for _, f := range files[:2] {
+		migratedFile, err := testServer.files.GetFile(adminLoginDetails["username"], f.ID)
+		assert.Nil(t, err)
+		assert.NotEmpty(t, migratedFile.DataKey)
+		assert.Equal(t, gc.FileFormatVersion, migratedFile.FormatVersion)
+		assert.False(t, migratedFile.Compressed)
+		assert.NotEqual(t, f.GoogleCloudObject, migratedFile.GoogleCloudObject)
+
+		_, err = testServer.storage.Stat(ctx, f.GoogleCloudObject)
+		if assert.NotNil(t, err) {
+			assert.Equal(t, gc.ErrorBlobNotFound, err.Error())
+		}
+	}
+
+	assertDownloads()
+
+	migrated, err = testServer.MigrateDataKeys(adminLoginDetails["username"], []byte(adminLoginDetails["password"]))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, migrated)
+}
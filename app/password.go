@@ -0,0 +1,160 @@
+package app
+
+import (
+	"errors"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+)
+
+const (
+	errWrongPassword = "current password is incorrect"
+
+	// fileKeyIterations derive the file key of new users from their PGP key,
+	// which is random, so it doesn't need a slow KDF.
+	fileKeyIterations = 50000
+)
+
+// wrappingKey derives the key wrapping the PGP key and HMAC secret of
+// userEntry from password, using the KDF the keys were wrapped with.
+func wrappingKey(userEntry *gc.UserEntry, password []byte) *crypto.CryptoData {
+	if kdf := userEntry.KDF; kdf.Version == gc.KDFArgon2id {
+		return crypto.NewArgon2idCryptoData(password, nil, userEntry.Salt, kdf.Time, kdf.Memory, kdf.Threads)
+	}
+	return crypto.NewCryptoData(password, nil, userEntry.Salt, userEntry.Iterations)
+}
+
+// wrapUserKeys wraps pgpKey and hmacSecret with password, using a new salt
+// and the configured KDF, and rehashes the password. Only userEntry is
+// changed, the caller saves it.
+func (s *Server) wrapUserKeys(userEntry *gc.UserEntry, password, pgpKey, hmacSecret []byte) error {
+	// the file key may be derived with the salt being replaced, keep it
+	userEntry.KeySalt, userEntry.KeyIterations = userEntry.FileKeyParams()
+
+	salt, err := crypto.RandomBytes(32)
+
+	if err != nil {
+		return err
+	}
+
+	kdf := s.config.KDF()
+	key := crypto.NewArgon2idCryptoData(password, nil, salt, kdf.Time, kdf.Memory, kdf.Threads)
+
+	if userEntry.EncryptedPGPKey, err = key.EncryptText(pgpKey); err != nil {
+		return err
+	}
+
+	if userEntry.EncryptedHMACSecret, err = key.EncryptText(hmacSecret); err != nil {
+		return err
+	}
+
+	if userEntry.Hash, err = s.generatePasswordHash(password); err != nil {
+		return err
+	}
+
+	userEntry.Salt, userEntry.Iterations, userEntry.KDF = salt, 0, kdf
+	return nil
+}
+
+// newUserKeys generates the PGP key, HMAC secret and file key salt of a new
+// user and wraps them with password.
+func (s *Server) newUserKeys(userEntry *gc.UserEntry, password []byte) error {
+	keySalt, err := crypto.RandomBytes(32)
+
+	if err != nil {
+		return err
+	}
+
+	pgpKey, err := crypto.RandomBytes(32)
+
+	if err != nil {
+		return err
+	}
+
+	hmacSecret, err := crypto.RandomBytes(64)
+
+	if err != nil {
+		return err
+	}
+
+	userEntry.KeySalt, userEntry.KeyIterations = keySalt, fileKeyIterations
+	userEntry.IndexVersion = gc.FileFormatVersion
+	return s.wrapUserKeys(userEntry, password, pgpKey, hmacSecret)
+}
+
+// needsKDFUpgrade reports whether the keys or password hash of userEntry were
+// made with an older KDF or lower costs than the configured ones.
+func (s *Server) needsKDFUpgrade(userEntry *gc.UserEntry) bool {
+	kdf := s.config.KDF()
+
+	// wrapUserKeys doesn't wrap the next keys, wait until the rotation ends,
+	// and can't wrap the keys of zero-knowledge accounts at all
+	if userEntry.Rotating() || userEntry.ZeroKnowledge {
+		return false
+	}
+
+	if userEntry.KDF.Weaker(kdf) || !crypto.IsArgon2idHash(userEntry.Hash) {
+		return true
+	}
+
+	time, memory, _, err := crypto.PasswordHashParams(userEntry.Hash)
+	return err != nil || time < kdf.Time || memory < kdf.Memory
+}
+
+// changePassword wraps the user's PGP key and HMAC secret with newPassword and
+// a new salt. The keys themselves don't change, so no file has to be touched,
+// and the hash and wrapped keys are saved in one update so there is never an
+// entry where the password unlocks the wrong keys.
+func (user *userData) changePassword(oldPassword, newPassword []byte) error {
+	username := user.userEntry.Username
+
+	// the keys are wrapped by the client, which would have to re-wrap them
+	if user.userEntry.ZeroKnowledge {
+		return errors.New(errZeroKnowledge)
+	}
+
+	if err := user.server.verifyUserPassword(username, oldPassword); err != nil {
+		return errors.New(errWrongPassword)
+	}
+
+	if isWeakPassword(string(newPassword)) {
+		return errors.New(errWeakPassword)
+	}
+
+	userEntry, id, err := user.server.users.GetUserEntry(username)
+
+	if err != nil {
+		return err
+	}
+
+	// the next keys are wrapped by the old password too
+	if userEntry.Rotating() {
+		return errors.New(errRotationInProgress)
+	}
+
+	oldKey := wrappingKey(userEntry, oldPassword)
+	pgpKey, err := oldKey.DecryptText(userEntry.EncryptedPGPKey)
+
+	if err != nil {
+		return err
+	}
+
+	hmacSecret, err := oldKey.DecryptText(userEntry.EncryptedHMACSecret)
+
+	if err != nil {
+		return err
+	}
+
+	if err := user.server.wrapUserKeys(userEntry, newPassword, pgpKey, hmacSecret); err != nil {
+		return err
+	}
+
+	if err := user.server.users.UpdateUser(id, userEntry); err != nil {
+		return err
+	}
+
+	// the sessions hold the unwrapped keys, which are still valid
+	user.userEntry = *userEntry
+
+	return nil
+}
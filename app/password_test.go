@@ -0,0 +1,160 @@
+package app
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+	"github.com/levigross/grequests"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func changePassword(cookie *http.Cookie, oldPassword, newPassword string) *grequests.Response {
+	resp, _ := grequests.Put(ts.URL+"/auth/account/password", &grequests.RequestOptions{
+		Cookies: []*http.Cookie{cookie},
+		JSON:    map[string]string{"old_password": oldPassword, "new_password": newPassword},
+	})
+	return resp
+}
+
+// makeLegacyUser turns a user into one created before Argon2id and password
+// changes: the keys are wrapped with PBKDF2, the password hashed with bcrypt
+// and the file key derived from the same salt as the wrapping key.
+func makeLegacyUser(t *testing.T, loginDetails map[string]string) *gc.UserEntry {
+	password := []byte(loginDetails["password"])
+	userEntry, id, err := testServer.users.GetUserEntry(loginDetails["username"])
+	assert.Nil(t, err)
+
+	key := wrappingKey(userEntry, password)
+	pgpKey, _ := key.DecryptText(userEntry.EncryptedPGPKey)
+	hmacSecret, _ := key.DecryptText(userEntry.EncryptedHMACSecret)
+
+	userEntry.Salt, _ = crypto.RandomBytes(32)
+	userEntry.Iterations = 1000
+	userEntry.KeySalt, userEntry.KeyIterations = nil, 0
+	userEntry.KDF = gc.KDFParams{}
+
+	key = crypto.NewCryptoData(password, nil, userEntry.Salt, userEntry.Iterations)
+	userEntry.EncryptedPGPKey, _ = key.EncryptText(pgpKey)
+	userEntry.EncryptedHMACSecret, _ = key.EncryptText(hmacSecret)
+	userEntry.Hash, _ = bcrypt.GenerateFromPassword(password, 4)
+
+	assert.Nil(t, testServer.users.UpdateUser(id, userEntry))
+	return userEntry
+}
+
+func TestChangePassword(t *testing.T) {
+	for _, legacyAccount := range []bool{false, true} {
+		clearDatastore()
+		createAdmin()
+
+		if legacyAccount {
+			makeLegacyUser(t, adminLoginDetails)
+		}
+
+		cookie := loginUser(adminLoginDetails)
+
+		testfile, _ := createTestFile("passwordfile", 100*1024)
+		defer os.Remove(testfile)
+		contents, _ := ioutil.ReadFile(testfile)
+
+		f, _ := grequests.FileUploadFromDisk(testfile)
+		resp, err := grequests.Post(ts.URL+"/auth/file", &grequests.RequestOptions{Files: f, Cookies: []*http.Cookie{cookie}})
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		fileURL := ts.URL + "/auth/file/" + strconv.Itoa(getAllFSObjectsUsingAPI("/", cookie)[0].ID)
+		newPassword := "a new password!"
+
+		type testCase struct {
+			oldPassword      string
+			newPassword      string
+			expectedHTTPcode int
+		}
+
+		tests := []testCase{
+			testCase{"not the password", newPassword, http.StatusForbidden},
+			testCase{adminLoginDetails["password"], "weak", http.StatusBadRequest},
+			testCase{adminLoginDetails["password"], newPassword, http.StatusNoContent},
+			testCase{adminLoginDetails["password"], newPassword, http.StatusForbidden},
+		}
+
+		for _, test := range tests {
+			assert.Equal(t, test.expectedHTTPcode, changePassword(cookie, test.oldPassword, test.newPassword).StatusCode)
+		}
+
+		resp, err = grequests.Post(ts.URL+"/account/login", &grequests.RequestOptions{JSON: adminLoginDetails})
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		newCookie := loginUser(map[string]string{"username": adminLoginDetails["username"], "password": newPassword})
+
+		// the existing session keeps working, and files uploaded before
+		// are readable with the new password
+		for _, c := range []*http.Cookie{cookie, newCookie} {
+			resp, err := grequests.Get(fileURL, &grequests.RequestOptions{Cookies: []*http.Cookie{c}})
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.True(t, bytes.Equal(contents, resp.Bytes()), "file differs after password change")
+		}
+
+		assert.Equal(t, http.StatusNoContent, changePassword(newCookie, newPassword, adminLoginDetails["password"]).StatusCode)
+	}
+}
+
+func TestKDFUpgradeOnLogin(t *testing.T) {
+	clearDatastore()
+	createAdmin()
+	legacy := makeLegacyUser(t, adminLoginDetails)
+
+	cookie := loginUser(adminLoginDetails)
+
+	userEntry, _, err := testServer.users.GetUserEntry(adminLoginDetails["username"])
+	assert.Nil(t, err)
+	assert.Equal(t, testServer.config.KDF(), userEntry.KDF)
+	assert.True(t, crypto.IsArgon2idHash(userEntry.Hash))
+	assert.NotEqual(t, legacy.Salt, userEntry.Salt)
+	assert.Equal(t, legacy.Salt, userEntry.KeySalt)
+	assert.Equal(t, legacy.Iterations, userEntry.KeyIterations)
+
+	testfile, _ := createTestFile("kdffile", 10*1024)
+	defer os.Remove(testfile)
+	contents, _ := ioutil.ReadFile(testfile)
+
+	f, _ := grequests.FileUploadFromDisk(testfile)
+	resp, err := grequests.Post(ts.URL+"/auth/file", &grequests.RequestOptions{Files: f, Cookies: []*http.Cookie{cookie}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	fileURL := ts.URL + "/auth/file/" + strconv.Itoa(getAllFSObjectsUsingAPI("/", cookie)[0].ID)
+
+	// raising the costs upgrades users again on their next login
+	defer func(kdfTime int) { testServer.config.KDFTime = kdfTime }(testServer.config.KDFTime)
+	testServer.config.KDFTime++
+
+	cookie = loginUser(adminLoginDetails)
+
+	userEntry, _, err = testServer.users.GetUserEntry(adminLoginDetails["username"])
+	assert.Nil(t, err)
+	assert.Equal(t, testServer.config.KDF(), userEntry.KDF)
+
+	kdfTime, _, _, err := crypto.PasswordHashParams(userEntry.Hash)
+	assert.Nil(t, err)
+	assert.Equal(t, testServer.config.KDFTime, kdfTime)
+
+	resp, err = grequests.Get(fileURL, &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, bytes.Equal(contents, resp.Bytes()), "file differs after KDF upgrade")
+
+	resp, err = grequests.Post(ts.URL+"/account/login", &grequests.RequestOptions{JSON: map[string]string{
+		"username": adminLoginDetails["username"], "password": "not the password"}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
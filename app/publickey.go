@@ -0,0 +1,193 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+	"github.com/gin-gonic/gin"
+)
+
+// Users may register OpenPGP public keys, their own and those of any extra
+// recipients. While they're registered, the contents of uploaded files are
+// encrypted to those keys, which the server can never decrypt, and downloads
+// return the OpenPGP message for the user to decrypt with gpg. Names and
+// metadata are still encrypted by the file's data key so the files can be
+// listed and searched.
+const (
+	errNoPublicKeys = "no OpenPGP public keys are registered"
+
+	publicKeyContentType = "application/pgp-encrypted"
+)
+
+type publicKeysInfo struct {
+	Fingerprints []string `json:"fingerprints"`
+	PublicKeys   string   `json:"public_keys"`
+}
+
+// publicKeys returns the fingerprints of the user's public keys and the keys
+// themselves.
+func (user *userData) publicKeys() (*publicKeysInfo, error) {
+	if len(user.userEntry.PublicKeys) == 0 {
+		return nil, errors.New(errNoPublicKeys)
+	}
+
+	entities, err := crypto.ReadPublicKeys(user.userEntry.PublicKeys)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &publicKeysInfo{
+		Fingerprints: crypto.Fingerprints(entities),
+		PublicKeys:   string(user.userEntry.PublicKeys),
+	}, nil
+}
+
+// setPublicKeys registers the armored keyring, replacing any registered
+// before. Only the public part of the keys is kept. Passing nil removes them,
+// files uploaded afterwards are encrypted by their data key again.
+func (user *userData) setPublicKeys(armored []byte) error {
+	// their files are encrypted by the client already
+	if user.userEntry.ZeroKnowledge {
+		return errors.New(errZeroKnowledge)
+	}
+
+	var keys []byte
+
+	if armored != nil {
+		entities, err := crypto.ReadPublicKeys(armored)
+
+		if err != nil {
+			return err
+		}
+
+		if keys, err = crypto.ArmorPublicKeys(entities); err != nil {
+			return err
+		}
+	}
+
+	username := user.userEntry.Username
+	userEntry, id, err := user.server.users.GetUserEntry(username)
+
+	if err != nil {
+		return err
+	}
+
+	userEntry.PublicKeys = keys
+
+	if err := user.server.users.UpdateUser(id, userEntry); err != nil {
+		return err
+	}
+
+	user.userEntry = *userEntry
+
+	return nil
+}
+
+// encryptUploadToPublicKeys replaces the object of u, composed into object,
+// by its contents encrypted to the user's public keys.
+func (user *userData) encryptUploadToPublicKeys(u *gc.Upload, object string) error {
+	// a new object which is never closed is abandoned once ctx is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	master, err := user.masterKey(u.KeyGeneration)
+
+	if err != nil {
+		return err
+	}
+
+	dataKey, err := uploadFieldKey(master, u, crypto.PurposeDataKey).DataKey(u.DataKey)
+
+	if err != nil {
+		return err
+	}
+
+	r, err := user.server.storage.Get(ctx, object)
+
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	storageWriter, err := user.server.storage.Put(ctx, u.Object, &gc.PutOptions{StorageClass: u.StorageClass})
+
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(uploadFieldKey(dataKey, u, crypto.PurposeContents).DecryptFile(r, pw, false))
+	}()
+
+	_, err = crypto.EncryptToPublicKeys(pr, storageWriter, user.userEntry.PublicKeys)
+	pr.Close()
+
+	if err != nil {
+		return err
+	}
+
+	return storageWriter.Close()
+}
+
+// downloadPublicKeyFile serves the OpenPGP message of f, named filename with
+// the extension gpg gives it. It's armored when asked for with ?armor=true,
+// which can't be served in ranges.
+func (user *userData) downloadPublicKeyFile(httpContext *gin.Context, f *gc.File, filename string, size int64) error {
+	ctx := httpContext.Request.Context()
+	armored := httpContext.Query("armor") == "true"
+
+	extension := ".gpg"
+	if armored {
+		extension = ".asc"
+	}
+
+	header := httpContext.Writer.Header()
+	header.Set("content-disposition", "attachment; filename=\""+filename+extension+"\"")
+	header.Set("Content-Type", publicKeyContentType)
+
+	if r := httpContext.GetHeader("Range"); r == "" || strings.HasPrefix(r, "bytes=0-") {
+		user.countDownload(f.ID)
+	}
+
+	if !armored {
+		object := &blobReaderAt{ctx: ctx, storage: user.server.storage, name: f.GoogleCloudObject}
+		defer object.Close()
+
+		http.ServeContent(httpContext.Writer, httpContext.Request, "", f.UploadDate, io.NewSectionReader(object, 0, size))
+		return nil
+	}
+
+	r, err := user.server.storage.Get(ctx, f.GoogleCloudObject)
+
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	header.Set("Accept-Ranges", "none")
+	header.Set("Last-Modified", f.UploadDate.UTC().Format(http.TimeFormat))
+
+	w, err := crypto.NewArmorWriter(httpContext.Writer)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	httpContext.Writer.Flush()
+	return nil
+}
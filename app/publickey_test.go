@@ -0,0 +1,153 @@
+package app
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+	"github.com/levigross/grequests"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func newPGPEntity(t *testing.T, name string) *openpgp.Entity {
+	e, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	assert.Nil(t, err)
+
+	// like keys made by gpg, prefer SHA-256 to the RIPEMD-160 default
+	for _, id := range e.Identities {
+		id.SelfSignature.PreferredHash = []uint8{8}
+		assert.Nil(t, id.SelfSignature.SignUserId(id.UserId.Id, e.PrimaryKey, e.PrivateKey, nil))
+	}
+	return e
+}
+
+func setPublicKeys(cookie *http.Cookie, keys []byte) *grequests.Response {
+	resp, _ := grequests.Put(ts.URL+"/auth/account/publickeys", &grequests.RequestOptions{
+		Cookies: []*http.Cookie{cookie},
+		JSON:    map[string]string{"public_keys": string(keys)},
+	})
+	return resp
+}
+
+func decryptPGPMessage(t *testing.T, ciphertext []byte, e *openpgp.Entity) []byte {
+	md, err := openpgp.ReadMessage(bytes.NewReader(ciphertext), openpgp.EntityList{e}, nil, nil)
+	assert.Nil(t, err)
+
+	if err != nil {
+		return nil
+	}
+
+	plaintext, err := ioutil.ReadAll(md.UnverifiedBody)
+	assert.Nil(t, err)
+	return plaintext
+}
+
+func TestPublicKeyEncryption(t *testing.T) {
+	clearDatastore()
+	clearBucket()
+	createAdmin()
+	cookie := loginUser(adminLoginDetails)
+	username := adminLoginDetails["username"]
+
+	resp, err := grequests.Get(ts.URL+"/auth/account/publickeys", &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	assert.Equal(t, http.StatusBadRequest, setPublicKeys(cookie, []byte("not a key")).StatusCode)
+
+	alice, bob := newPGPEntity(t, "alice"), newPGPEntity(t, "bob")
+	keys, err := crypto.ArmorPublicKeys(openpgp.EntityList{alice, bob})
+	assert.Nil(t, err)
+
+	var info publicKeysInfo
+	resp = setPublicKeys(cookie, keys)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, resp.JSON(&info))
+	assert.Equal(t, crypto.Fingerprints(openpgp.EntityList{alice, bob}), info.Fingerprints)
+
+	uploadToFolder(t, cookie, "a", "/", "", "")
+
+	// resumable uploads are encrypted to the keys once they're complete
+	contents, _ := crypto.RandomBytes(2*crypto.DefaultSegmentSize + 100)
+	uploadURL := createTusUpload(t, cookie, "tusfile", len(contents))
+	assert.Equal(t, http.StatusNoContent, patchTusUpload(uploadURL, cookie, 0, contents).StatusCode)
+	assertNoUploadParts(t)
+
+	expected := map[string][]byte{"a": []byte("contents of a"), "tusfile": contents}
+
+	files, _ := testServer.files.GetAllFiles(username)
+	assert.Len(t, files, 2)
+
+	download := func(f *gc.File, armored bool) []byte {
+		params := map[string]string{}
+		if armored {
+			params["armor"] = "true"
+		}
+
+		resp, err := grequests.Get(ts.URL+"/auth/file/"+strconv.FormatInt(f.ID, 10), &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}, Params: params})
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, publicKeyContentType, resp.Header.Get("Content-Type"))
+
+		if !armored {
+			return resp.Bytes()
+		}
+
+		block, err := armor.Decode(bytes.NewReader(resp.Bytes()))
+		assert.Nil(t, err)
+		ciphertext, _ := ioutil.ReadAll(block.Body)
+		return ciphertext
+	}
+
+	names := map[int64]string{}
+	for _, entry := range listFolder(t, cookie, map[string]string{"path": "/"}) {
+		assert.True(t, entry.PublicKeyEncrypted)
+		names[entry.ID] = entry.Name
+	}
+
+	for _, f := range files {
+		assert.True(t, f.PublicKeyEncrypted)
+
+		name := names[f.ID]
+		ciphertext := download(f, false)
+		assert.NotEqual(t, expected[name], ciphertext)
+
+		// every recipient can decrypt it, the server can't
+		assert.Equal(t, expected[name], decryptPGPMessage(t, ciphertext, alice))
+		assert.Equal(t, expected[name], decryptPGPMessage(t, ciphertext, bob))
+		assert.Equal(t, expected[name], decryptPGPMessage(t, download(f, true), alice))
+	}
+
+	// rotating the keys copies the objects as they are
+	assert.Equal(t, http.StatusAccepted, rotateKeys(cookie, adminLoginDetails["password"]).StatusCode)
+	assert.Empty(t, waitForKeyRotation(t, cookie).Error)
+
+	files, _ = testServer.files.GetAllFiles(username)
+	for _, f := range files {
+		assert.True(t, f.PublicKeyEncrypted)
+		assert.Equal(t, 1, f.KeyGeneration)
+		assert.Equal(t, expected[names[f.ID]], decryptPGPMessage(t, download(f, false), alice))
+	}
+
+	resp, err = grequests.Delete(ts.URL+"/auth/account/publickeys", &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	uploadToFolder(t, cookie, "b", "/", "", "")
+
+	for _, f := range listFolder(t, cookie, map[string]string{"path": "/"}) {
+		assert.Equal(t, f.Name != "b", f.PublicKeyEncrypted, f.Name)
+
+		if f.Name == "b" {
+			resp, err := grequests.Get(ts.URL+"/auth/file/"+strconv.FormatInt(f.ID, 10), &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}})
+			assert.Nil(t, err)
+			assert.Equal(t, "contents of b", resp.String())
+		}
+	}
+}
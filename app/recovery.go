@@ -0,0 +1,351 @@
+package app
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+)
+
+// A forgotten password can't unwrap the PGP key and HMAC secret, so users may
+// keep them another way: an armored backup encrypted with a passphrase of
+// their choosing, which gpg decrypts too, or one-time recovery codes which
+// each wrap them. Either sets a new password without touching any file.
+// Rotating the keys makes both useless, so a new backup has to be made.
+const (
+	errInvalidRecovery = "recovery code or key backup is not valid"
+	errWeakPassphrase  = "please pick a more secure passphrase for the backup"
+
+	keyBackupVersion = 1
+	keyCheckContext  = "gscrypto key check"
+
+	recoveryCodes      = 10
+	recoveryCodeLength = 10
+
+	// the codes are random, so unlike a password they don't need a slow KDF
+	recoveryCodeIterations = 1
+)
+
+// keyBackup is what a key backup holds, everything needed to derive the
+// user's file key.
+type keyBackup struct {
+	Version       int    `json:"version"`
+	Username      string `json:"username"`
+	PGPKey        []byte `json:"pgp_key"`
+	HMACSecret    []byte `json:"hmac_secret"`
+	KeySalt       []byte `json:"key_salt"`
+	KeyIterations int    `json:"key_iterations"`
+}
+
+// recoveryCode is the PGP key and HMAC secret wrapped by a key derived from
+// one recovery code, UserEntry.RecoveryCodes holds a JSON list of them.
+type recoveryCode struct {
+	Salt                []byte `json:"salt"`
+	EncryptedPGPKey     []byte `json:"encrypted_pgp_key"`
+	EncryptedHMACSecret []byte `json:"encrypted_hmac_secret"`
+}
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// keyCheck returns the UserEntry.KeyCheck of the keys.
+func keyCheck(pgpKey, hmacSecret []byte) []byte {
+	sum := sha256.Sum256(crypto.Context(keyCheckContext, string(pgpKey), string(hmacSecret)))
+	return sum[:]
+}
+
+// recoveryCodeKey derives the key a recovery code wraps the keys with.
+func recoveryCodeKey(code string, salt []byte) *crypto.CryptoData {
+	return crypto.NewCryptoData([]byte(code), nil, salt, recoveryCodeIterations)
+}
+
+// groupCode splits a code in groups of four so it's easier to write down.
+func groupCode(code string) string {
+	var groups []string
+
+	for i := 0; i < len(code); i += 4 {
+		end := i + 4
+		if end > len(code) {
+			end = len(code)
+		}
+		groups = append(groups, code[i:end])
+	}
+	return strings.Join(groups, "-")
+}
+
+// normalizeRecoveryCode removes the dashes and spaces a code may be typed
+// with.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// unwrapKeys returns the PGP key and HMAC secret of userEntry wrapped by
+// password.
+func unwrapKeys(userEntry *gc.UserEntry, password []byte) ([]byte, []byte, error) {
+	key := wrappingKey(userEntry, password)
+	pgpKey, err := key.DecryptText(userEntry.EncryptedPGPKey)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hmacSecret, err := key.DecryptText(userEntry.EncryptedHMACSecret)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pgpKey, hmacSecret, nil
+}
+
+// unlockEntry checks password and returns the user's entry.
+func (user *userData) unlockEntry(password []byte) (*gc.UserEntry, int64, error) {
+	// the keys are wrapped by the client, which backs them up itself
+	if user.userEntry.ZeroKnowledge {
+		return nil, 0, errors.New(errZeroKnowledge)
+	}
+
+	if err := user.server.verifyUserPassword(user.userEntry.Username, password); err != nil {
+		return nil, 0, errors.New(errWrongPassword)
+	}
+
+	return user.server.users.GetUserEntry(user.userEntry.Username)
+}
+
+// saveUserEntry saves userEntry and updates the request's copy of it, the
+// sessions read it from the database.
+func (user *userData) saveUserEntry(id int64, userEntry *gc.UserEntry) error {
+	if err := user.server.users.UpdateUser(id, userEntry); err != nil {
+		return err
+	}
+
+	user.userEntry = *userEntry
+	return nil
+}
+
+// newKeyBackup returns the keys of userEntry, wrapped by password, encrypted
+// with passphrase into an armored OpenPGP message. It sets the KeyCheck the
+// backup is recovered against, the caller saves userEntry.
+func newKeyBackup(userEntry *gc.UserEntry, password, passphrase []byte) ([]byte, error) {
+	if isWeakPassword(string(passphrase)) {
+		return nil, errors.New(errWeakPassphrase)
+	}
+
+	pgpKey, hmacSecret, err := unwrapKeys(userEntry, password)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keySalt, keyIterations := userEntry.FileKeyParams()
+	backup, err := json.Marshal(&keyBackup{
+		Version:       keyBackupVersion,
+		Username:      userEntry.Username,
+		PGPKey:        pgpKey,
+		HMACSecret:    hmacSecret,
+		KeySalt:       keySalt,
+		KeyIterations: keyIterations,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	armored, err := crypto.EncryptArmored(backup, passphrase)
+
+	if err != nil {
+		return nil, err
+	}
+
+	userEntry.KeyCheck = keyCheck(pgpKey, hmacSecret)
+	return armored, nil
+}
+
+// keyBackup returns a backup of the user's keys encrypted with passphrase.
+func (user *userData) keyBackup(password, passphrase []byte) ([]byte, error) {
+	userEntry, id, err := user.unlockEntry(password)
+
+	if err != nil {
+		return nil, err
+	}
+
+	armored, err := newKeyBackup(userEntry, password, passphrase)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := user.saveUserEntry(id, userEntry); err != nil {
+		return nil, err
+	}
+
+	return armored, nil
+}
+
+// newRecoveryCodes replaces the user's recovery codes by new ones, which are
+// only returned this once.
+func (user *userData) newRecoveryCodes(password []byte) ([]string, error) {
+	userEntry, id, err := user.unlockEntry(password)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pgpKey, hmacSecret, err := unwrapKeys(userEntry, password)
+
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodes)
+	wrapped := make([]recoveryCode, 0, recoveryCodes)
+
+	for len(codes) < recoveryCodes {
+		random, err := crypto.RandomBytes(recoveryCodeLength)
+
+		if err != nil {
+			return nil, err
+		}
+
+		salt, err := crypto.RandomBytes(32)
+
+		if err != nil {
+			return nil, err
+		}
+
+		code := recoveryCodeEncoding.EncodeToString(random)
+		key := recoveryCodeKey(code, salt)
+		rc := recoveryCode{Salt: salt}
+
+		if rc.EncryptedPGPKey, err = key.EncryptText(pgpKey); err != nil {
+			return nil, err
+		}
+
+		if rc.EncryptedHMACSecret, err = key.EncryptText(hmacSecret); err != nil {
+			return nil, err
+		}
+
+		codes = append(codes, groupCode(code))
+		wrapped = append(wrapped, rc)
+	}
+
+	if userEntry.RecoveryCodes, err = json.Marshal(wrapped); err != nil {
+		return nil, err
+	}
+
+	if err := user.saveUserEntry(id, userEntry); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// recoverWithCode unwraps the keys of userEntry with one of its recovery
+// codes, which is removed from it.
+func recoverWithCode(userEntry *gc.UserEntry, code string) ([]byte, []byte, error) {
+	var wrapped []recoveryCode
+
+	if len(userEntry.RecoveryCodes) == 0 || json.Unmarshal(userEntry.RecoveryCodes, &wrapped) != nil {
+		return nil, nil, errors.New(errInvalidRecovery)
+	}
+
+	code = normalizeRecoveryCode(code)
+
+	for i, rc := range wrapped {
+		key := recoveryCodeKey(code, rc.Salt)
+		pgpKey, err := key.DecryptText(rc.EncryptedPGPKey)
+
+		if err != nil {
+			continue
+		}
+
+		hmacSecret, err := key.DecryptText(rc.EncryptedHMACSecret)
+
+		if err != nil {
+			continue
+		}
+
+		remaining, err := json.Marshal(append(wrapped[:i:i], wrapped[i+1:]...))
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		userEntry.RecoveryCodes = remaining
+		return pgpKey, hmacSecret, nil
+	}
+
+	return nil, nil, errors.New(errInvalidRecovery)
+}
+
+// recoverWithBackup decrypts a backup made by newKeyBackup, which must hold
+// the keys of userEntry.
+func recoverWithBackup(userEntry *gc.UserEntry, armored, passphrase []byte) ([]byte, []byte, error) {
+	plaintext, err := crypto.DecryptArmored(armored, passphrase)
+
+	if err != nil || len(userEntry.KeyCheck) == 0 {
+		return nil, nil, errors.New(errInvalidRecovery)
+	}
+
+	var backup keyBackup
+
+	if err := json.Unmarshal(plaintext, &backup); err != nil || backup.Username != userEntry.Username {
+		return nil, nil, errors.New(errInvalidRecovery)
+	}
+
+	if subtle.ConstantTimeCompare(keyCheck(backup.PGPKey, backup.HMACSecret), userEntry.KeyCheck) != 1 {
+		return nil, nil, errors.New(errInvalidRecovery)
+	}
+
+	return backup.PGPKey, backup.HMACSecret, nil
+}
+
+// recoverAccount sets a new password for username, whose keys are unwrapped
+// by a recovery code, or if code is empty a key backup and its passphrase.
+// Existing sessions are logged out.
+func (s *Server) recoverAccount(username, code string, backup, passphrase, newPassword []byte) error {
+	userEntry, id, err := s.users.GetUserEntry(username)
+
+	if err != nil {
+		return errors.New(errInvalidRecovery)
+	}
+
+	if userEntry.ZeroKnowledge {
+		return errors.New(errZeroKnowledge)
+	}
+
+	// the next keys are wrapped by the forgotten password
+	if userEntry.Rotating() {
+		return errors.New(errRotationInProgress)
+	}
+
+	if isWeakPassword(string(newPassword)) {
+		return errors.New(errWeakPassword)
+	}
+
+	var pgpKey, hmacSecret []byte
+
+	if code != "" {
+		pgpKey, hmacSecret, err = recoverWithCode(userEntry, code)
+	} else {
+		pgpKey, hmacSecret, err = recoverWithBackup(userEntry, backup, passphrase)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := s.wrapUserKeys(userEntry, newPassword, pgpKey, hmacSecret); err != nil {
+		return err
+	}
+
+	if err := s.users.UpdateUser(id, userEntry); err != nil {
+		return err
+	}
+
+	return s.revokeSessions(username)
+}
@@ -0,0 +1,151 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/levigross/grequests"
+	"github.com/stretchr/testify/assert"
+)
+
+func recoverAccount(request map[string]string) *grequests.Response {
+	resp, _ := grequests.Post(ts.URL+"/account/recover", &grequests.RequestOptions{JSON: request})
+	return resp
+}
+
+// assertFileReadable checks that the only file of username is still decrypted
+// after logging in with password.
+func assertFileReadable(t *testing.T, username, password, contents string) {
+	cookie := loginUser(map[string]string{"username": username, "password": password})
+	assert.NotEmpty(t, cookie.Value)
+
+	files, _ := testServer.files.GetAllFiles(username)
+	assert.Len(t, files, 1)
+
+	resp, err := grequests.Get(ts.URL+"/auth/file/"+strconv.FormatInt(files[0].ID, 10), &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, contents, resp.String())
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	clearDatastore()
+	clearBucket()
+	createAdmin()
+	cookie := loginUser(adminLoginDetails)
+	uploadToFolder(t, cookie, "a", "/", "", "")
+
+	resp, err := grequests.Post(ts.URL+"/auth/account/keys/recovery-codes", &grequests.RequestOptions{
+		Cookies: []*http.Cookie{cookie},
+		JSON:    map[string]string{"password": "wrong password"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	var codes struct {
+		Codes []string `json:"codes"`
+	}
+
+	resp, err = grequests.Post(ts.URL+"/auth/account/keys/recovery-codes", &grequests.RequestOptions{
+		Cookies: []*http.Cookie{cookie},
+		JSON:    map[string]string{"password": adminLoginDetails["password"]},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, resp.JSON(&codes))
+	assert.Len(t, codes.Codes, recoveryCodes)
+
+	request := map[string]string{"username": "admin", "recovery_code": "AAAA-AAAA-AAAA-AAAA", "new_password": "n3w password!"}
+	assert.Equal(t, http.StatusForbidden, recoverAccount(request).StatusCode)
+
+	request["recovery_code"] = codes.Codes[0]
+	request["new_password"] = "weak"
+	assert.Equal(t, http.StatusBadRequest, recoverAccount(request).StatusCode)
+
+	// codes may be typed in lower case and without dashes
+	request["recovery_code"] = strings.ToLower(strings.Replace(codes.Codes[0], "-", "", -1))
+	request["new_password"] = "n3w password!"
+	assert.Equal(t, http.StatusNoContent, recoverAccount(request).StatusCode)
+	assertFileReadable(t, "admin", "n3w password!", "contents of a")
+
+	// each code is only used once
+	request["new_password"] = "an0ther password!"
+	assert.Equal(t, http.StatusForbidden, recoverAccount(request).StatusCode)
+
+	request["recovery_code"] = codes.Codes[1]
+	assert.Equal(t, http.StatusNoContent, recoverAccount(request).StatusCode)
+	assertFileReadable(t, "admin", "an0ther password!", "contents of a")
+}
+
+func TestKeyBackup(t *testing.T) {
+	clearDatastore()
+	clearBucket()
+	createAdmin()
+	cookie := loginUser(adminLoginDetails)
+	uploadToFolder(t, cookie, "a", "/", "", "")
+
+	backup := func(password, passphrase string) *grequests.Response {
+		resp, _ := grequests.Post(ts.URL+"/auth/account/keys/backup", &grequests.RequestOptions{
+			Cookies: []*http.Cookie{cookie},
+			JSON:    map[string]string{"password": password, "passphrase": passphrase},
+		})
+		return resp
+	}
+
+	// the backup isn't recorded until one is made
+	request := map[string]string{"username": "admin", "key_backup": "", "passphrase": "backup passphrase 1", "new_password": "n3w password!"}
+	assert.Equal(t, http.StatusForbidden, recoverAccount(request).StatusCode)
+
+	assert.Equal(t, http.StatusForbidden, backup("wrong password", "backup passphrase 1").StatusCode)
+	assert.Equal(t, http.StatusBadRequest, backup(adminLoginDetails["password"], "weak").StatusCode)
+
+	resp := backup(adminLoginDetails["password"], "backup passphrase 1")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, strings.HasPrefix(resp.String(), "-----BEGIN PGP MESSAGE-----"))
+
+	request["key_backup"] = resp.String()
+	request["passphrase"] = "wrong passphrase 1"
+	assert.Equal(t, http.StatusForbidden, recoverAccount(request).StatusCode)
+
+	// it only recovers the account it was made for
+	createUser(normalUserLoginDetails)
+	request["username"] = normalUserLoginDetails["username"]
+	request["passphrase"] = "backup passphrase 1"
+	assert.Equal(t, http.StatusForbidden, recoverAccount(request).StatusCode)
+
+	request["username"] = "admin"
+	assert.Equal(t, http.StatusNoContent, recoverAccount(request).StatusCode)
+	assertFileReadable(t, "admin", "n3w password!", "contents of a")
+
+	// the backup survives password changes, the keys stay the same
+	cookie = loginUser(map[string]string{"username": "admin", "password": "n3w password!"})
+	assert.Equal(t, http.StatusNoContent, changePassword(cookie, "n3w password!", "an0ther password!").StatusCode)
+
+	request["new_password"] = "th1rd password!"
+	assert.Equal(t, http.StatusNoContent, recoverAccount(request).StatusCode)
+	assertFileReadable(t, "admin", "th1rd password!", "contents of a")
+}
+
+func TestKeyBackupAtSignup(t *testing.T) {
+	clearDatastore()
+	createAdmin()
+
+	signup := map[string]string{"username": "backedup", "password": "s1gnup password", "backup_passphrase": "weak"}
+	assert.Equal(t, http.StatusBadRequest, createUser(signup).StatusCode)
+
+	var created struct {
+		KeyBackup string `json:"key_backup"`
+	}
+
+	signup["backup_passphrase"] = "backup passphrase 1"
+	resp := createUser(signup)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Nil(t, resp.JSON(&created))
+	assert.NotEmpty(t, created.KeyBackup)
+
+	resp = recoverAccount(map[string]string{"username": "backedup", "key_backup": created.KeyBackup,
+		"passphrase": "backup passphrase 1", "new_password": "n3w password!"})
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
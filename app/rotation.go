@@ -0,0 +1,313 @@
+package app
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	errRotationInProgress     = "the keys are being rotated"
+	errUploadsInProgress      = "finish or cancel the uploads in progress first"
+	errorUnknownKeyGeneration = "file is encrypted by keys which no longer exist"
+)
+
+// rotations tracks the key rotations running on this server, and the error of
+// the last one of each user which failed.
+type rotations struct {
+	sync.Mutex
+	running map[string]bool
+	failed  map[string]string
+}
+
+type rotationProgress struct {
+	Rotating   bool   `json:"rotating"`
+	Running    bool   `json:"running"`
+	Generation int    `json:"generation"`
+	Files      int    `json:"files"`
+	Rotated    int    `json:"rotated"`
+	Error      string `json:"error,omitempty"`
+}
+
+// masterKey returns the key of the user's files of generation, during a
+// rotation that is either the current key or the next one.
+func (user *userData) masterKey(generation int) (*crypto.CryptoData, error) {
+	switch {
+	case generation == user.userEntry.KeyGeneration:
+		return &user.cryptoData, nil
+	case generation == user.userEntry.KeyGeneration+1 && user.nextCryptoData != nil:
+		return user.nextCryptoData, nil
+	default:
+		return nil, errors.New(errorUnknownKeyGeneration)
+	}
+}
+
+// currentMasterKey returns the key new files are stored with, and its
+// generation. While a rotation runs it's the next key, so the new files don't
+// need to be rotated.
+func (user *userData) currentMasterKey() (*crypto.CryptoData, int) {
+	if user.nextCryptoData != nil {
+		return user.nextCryptoData, user.userEntry.KeyGeneration + 1
+	}
+	return &user.cryptoData, user.userEntry.KeyGeneration
+}
+
+// fileKey returns the key encrypting the object, name and metadata of f.
+func (user *userData) fileKey(f *gc.File) (*crypto.CryptoData, error) {
+	master, err := user.masterKey(f.KeyGeneration)
+
+	if err != nil {
+		return nil, err
+	}
+	return fileFieldKey(master, f, crypto.PurposeDataKey).DataKey(f.DataKey)
+}
+
+// nextMasterKey unwraps the keys a rotation of userEntry is moving to.
+func nextMasterKey(userEntry *gc.UserEntry, password []byte) (*crypto.CryptoData, error) {
+	key := wrappingKey(userEntry, password)
+	pgpKey, err := key.DecryptText(userEntry.NextEncryptedPGPKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	hmacSecret, err := key.DecryptText(userEntry.NextEncryptedHMACSecret)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the files are indexed again with the next keys, in the current version
+	return masterKeyOf(userEntry, pgpKey, hmacSecret, gc.FileFormatVersion), nil
+}
+
+// startKeyRotation generates a new PGP key and HMAC secret and starts moving
+// the user's files to them in the background. If a rotation was interrupted,
+// by a restart or an error, it's resumed instead. Until it's done every file
+// stays readable, each is read with the keys of its own generation.
+func (user *userData) startKeyRotation(password []byte) error {
+	username := user.userEntry.Username
+
+	if user.userEntry.ZeroKnowledge {
+		return errors.New(errZeroKnowledge)
+	}
+
+	if err := user.server.verifyUserPassword(username, password); err != nil {
+		return errors.New(errWrongPassword)
+	}
+
+	userEntry, id, err := user.server.users.GetUserEntry(username)
+
+	if err != nil {
+		return err
+	}
+
+	if !userEntry.Rotating() {
+		// uploads keep their key until they complete, which could be
+		// after the old one is gone
+		uploads, err := user.server.uploads.ListUploads(time.Now())
+
+		if err != nil {
+			return err
+		}
+
+		for _, u := range uploads {
+			if u.Username == username {
+				return errors.New(errUploadsInProgress)
+			}
+		}
+
+		pgpKey, err := crypto.RandomBytes(32)
+
+		if err != nil {
+			return err
+		}
+
+		hmacSecret, err := crypto.RandomBytes(64)
+
+		if err != nil {
+			return err
+		}
+
+		key := wrappingKey(userEntry, password)
+
+		if userEntry.NextEncryptedPGPKey, err = key.EncryptText(pgpKey); err != nil {
+			return err
+		}
+
+		if userEntry.NextEncryptedHMACSecret, err = key.EncryptText(hmacSecret); err != nil {
+			return err
+		}
+
+		if err := user.server.users.UpdateUser(id, userEntry); err != nil {
+			return err
+		}
+	}
+
+	if user.nextCryptoData, err = nextMasterKey(userEntry, password); err != nil {
+		return err
+	}
+
+	user.userEntry = *userEntry
+
+	// only this session is given the next keys, the others can't read the
+	// files moved to them and are logged out
+	if err := user.server.saveSession(user); err != nil {
+		return err
+	}
+
+	if err := user.revokeOtherSessions(); err != nil {
+		return err
+	}
+
+	user.server.runKeyRotation(*user)
+
+	return nil
+}
+
+// runKeyRotation rotates the keys of user in the background, unless this
+// server is doing it already.
+func (s *Server) runKeyRotation(user userData) {
+	username := user.userEntry.Username
+
+	s.rotations.Lock()
+	defer s.rotations.Unlock()
+
+	if s.rotations.running[username] {
+		return
+	}
+
+	s.rotations.running[username] = true
+	delete(s.rotations.failed, username)
+
+	go func() {
+		err := user.rotateKeys()
+
+		s.rotations.Lock()
+		defer s.rotations.Unlock()
+
+		delete(s.rotations.running, username)
+
+		if err != nil {
+			log.WithFields(log.Fields{"user": username, "error": err}).Warn("key rotation failed")
+			s.rotations.failed[username] = err.Error()
+		}
+	}()
+}
+
+// rotateKeys moves every file and folder to the next keys and then replaces
+// the current keys with them. Files are re-encrypted with new data keys, so a
+// leaked data key is of no use either.
+func (user *userData) rotateKeys() error {
+	username := user.userEntry.Username
+	current := user.userEntry.KeyGeneration
+	next := current + 1
+
+	// folders are created under the next keys first, so the files have
+	// somewhere to be listed, and the old ones deleted once they're moved
+	if err := user.walkFolders(&user.cryptoData, current, "/", func(folder string, ft *gc.FolderTree) error {
+		_, err := user.createFolder(user.nextCryptoData, next, folder)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	for {
+		files, err := user.server.files.GetAllFiles(username)
+
+		if err != nil {
+			return err
+		}
+
+		rotated := 0
+
+		for _, f := range files {
+			if f.KeyGeneration >= next {
+				continue
+			}
+
+			if err := user.reencryptFile(f, user.nextCryptoData, next); err != nil {
+				// the file may have been deleted meanwhile
+				if _, getErr := user.server.files.GetFile(username, f.ID); getErr != nil {
+					continue
+				}
+				return err
+			}
+
+			rotated++
+		}
+
+		// files added with the current key by another server after the
+		// list was read are picked up by the next pass
+		if rotated == 0 {
+			break
+		}
+	}
+
+	if err := user.walkFolders(&user.cryptoData, current, "/", func(folder string, ft *gc.FolderTree) error {
+		return user.server.files.DeleteFolder(username, ft.ID)
+	}); err != nil {
+		return err
+	}
+
+	userEntry, id, err := user.server.users.GetUserEntry(username)
+
+	if err != nil {
+		return err
+	}
+
+	userEntry.EncryptedPGPKey = userEntry.NextEncryptedPGPKey
+	userEntry.EncryptedHMACSecret = userEntry.NextEncryptedHMACSecret
+	userEntry.NextEncryptedPGPKey, userEntry.NextEncryptedHMACSecret = nil, nil
+	userEntry.KeyGeneration = next
+	userEntry.IndexVersion = gc.FileFormatVersion
+
+	// backups, recovery codes and API tokens hold the old keys
+	userEntry.KeyCheck, userEntry.RecoveryCodes, userEntry.APITokens = nil, nil, nil
+
+	if err := rewrapTOTPSecret(userEntry, &user.cryptoData, user.nextCryptoData); err != nil {
+		return err
+	}
+
+	// the sessions move to the next keys the next time they're used
+	return user.server.users.UpdateUser(id, userEntry)
+}
+
+// keyRotationProgress counts the files already moved to the next keys.
+func (user *userData) keyRotationProgress() (*rotationProgress, error) {
+	username := user.userEntry.Username
+	userEntry, _, err := user.server.users.GetUserEntry(username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := user.server.files.GetAllFiles(username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	progress := &rotationProgress{Rotating: userEntry.Rotating(), Generation: userEntry.KeyGeneration, Files: len(files)}
+
+	if progress.Rotating {
+		progress.Generation++
+
+		for _, f := range files {
+			if f.KeyGeneration == progress.Generation {
+				progress.Rotated++
+			}
+		}
+	}
+
+	user.server.rotations.Lock()
+	progress.Running = user.server.rotations.running[username]
+	progress.Error = user.server.rotations.failed[username]
+	user.server.rotations.Unlock()
+
+	return progress, nil
+}
@@ -0,0 +1,194 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+	"github.com/levigross/grequests"
+	"github.com/stretchr/testify/assert"
+)
+
+func rotateKeys(cookie *http.Cookie, password string) *grequests.Response {
+	resp, _ := grequests.Post(ts.URL+"/auth/account/keys/rotation", &grequests.RequestOptions{
+		Cookies: []*http.Cookie{cookie},
+		JSON:    map[string]string{"password": password},
+	})
+	return resp
+}
+
+func waitForKeyRotation(t *testing.T, cookie *http.Cookie) rotationProgress {
+	var progress rotationProgress
+
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+		resp, err := grequests.Get(ts.URL+"/auth/account/keys/rotation", &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}})
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Nil(t, resp.JSON(&progress))
+
+		if !progress.Running {
+			break
+		}
+	}
+
+	return progress
+}
+
+func uploadTestFiles(t *testing.T, cookie *http.Cookie, names ...string) (contents [][]byte) {
+	for _, name := range names {
+		testfile, _ := createTestFile(name, 20*1024)
+		defer os.Remove(testfile)
+		data, _ := ioutil.ReadFile(testfile)
+		contents = append(contents, data)
+
+		f, _ := grequests.FileUploadFromDisk(testfile)
+		resp, err := grequests.Post(ts.URL+"/auth/file", &grequests.RequestOptions{Files: f, Cookies: []*http.Cookie{cookie}})
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+	return contents
+}
+
+func assertFilesReadable(t *testing.T, cookie *http.Cookie, files []*gc.File, contents [][]byte) {
+	for i, f := range files {
+		resp, err := grequests.Get(ts.URL+"/auth/file/"+strconv.FormatInt(f.ID, 10), &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}})
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.True(t, bytes.Equal(contents[i], resp.Bytes()), "file %d differs", i)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	clearDatastore()
+	clearBucket()
+	createAdmin()
+	cookie := loginUser(adminLoginDetails)
+	username := adminLoginDetails["username"]
+
+	contents := uploadTestFiles(t, cookie, "rotated1", "rotated2")
+	files, _ := testServer.files.GetAllFiles(username)
+
+	// files without a data key are rotated too
+	user, err := testServer.unlockUser(username, []byte(adminLoginDetails["password"]))
+	assert.Nil(t, err)
+	makeLegacyFile(t, user, files[1], contents[1], true)
+
+	before, _, _ := testServer.users.GetUserEntry(username)
+
+	assert.Equal(t, http.StatusForbidden, rotateKeys(cookie, "not the password").StatusCode)
+
+	uploadURL := createTusUpload(t, cookie, "pending", 10)
+	assert.Equal(t, http.StatusConflict, rotateKeys(cookie, adminLoginDetails["password"]).StatusCode)
+	assert.Equal(t, http.StatusNoContent, tusRequest("DELETE", uploadURL, cookie, nil, nil).StatusCode)
+
+	resp := rotateKeys(cookie, adminLoginDetails["password"])
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	progress := waitForKeyRotation(t, cookie)
+	assert.Equal(t, rotationProgress{Generation: 1, Files: 2}, progress)
+
+	after, _, _ := testServer.users.GetUserEntry(username)
+	assert.Equal(t, 1, after.KeyGeneration)
+	assert.False(t, after.Rotating())
+	assert.NotEqual(t, before.EncryptedPGPKey, after.EncryptedPGPKey)
+	assert.NotEqual(t, before.EncryptedHMACSecret, after.EncryptedHMACSecret)
+
+	ctx := context.Background()
+	for _, f := range files {
+		rotated, err := testServer.files.GetFile(username, f.ID)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, rotated.KeyGeneration)
+		assert.NotEqual(t, f.FilenameHMAC, rotated.FilenameHMAC)
+		assert.NotEqual(t, f.DataKey, rotated.DataKey)
+
+		_, err = testServer.storage.Stat(ctx, f.GoogleCloudObject)
+		assert.NotNil(t, err, "object encrypted by the old keys is left")
+	}
+
+	// the session in use gets the new keys, and so does a new one
+	assertFilesReadable(t, cookie, files, contents)
+	assertFilesReadable(t, loginUser(adminLoginDetails), files, contents)
+
+	fsObjects := getAllFSObjectsUsingAPI("/", cookie)
+	assert.ElementsMatch(t, []string{"rotated1", "rotated2"}, []string{fsObjects[0].Name, fsObjects[1].Name})
+
+	// the new HMACs still catch duplicates
+	testfile, _ := createTestFile("rotated1", 10)
+	defer os.Remove(testfile)
+	f, _ := grequests.FileUploadFromDisk(testfile)
+	resp, err = grequests.Post(ts.URL+"/auth/file", &grequests.RequestOptions{Files: f, Cookies: []*http.Cookie{cookie}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+}
+
+func TestInterruptedKeyRotation(t *testing.T) {
+	clearDatastore()
+	clearBucket()
+	createAdmin()
+	cookie := loginUser(adminLoginDetails)
+	username := adminLoginDetails["username"]
+	password := []byte(adminLoginDetails["password"])
+
+	contents := uploadTestFiles(t, cookie, "first", "second")
+	files, _ := testServer.files.GetAllFiles(username)
+
+	// a rotation which stopped after the first file, as if the server had
+	// been restarted, started by the session of cookie
+	session, err := cookieSession(cookie)
+	assert.Nil(t, err)
+
+	userEntry, id, _ := testServer.users.GetUserEntry(username)
+	key := wrappingKey(userEntry, password)
+	nextPGPKey, _ := crypto.RandomBytes(32)
+	nextHMACSecret, _ := crypto.RandomBytes(64)
+	userEntry.NextEncryptedPGPKey, _ = key.EncryptText(nextPGPKey)
+	userEntry.NextEncryptedHMACSecret, _ = key.EncryptText(nextHMACSecret)
+	assert.Nil(t, testServer.users.UpdateUser(id, userEntry))
+
+	user, err := testServer.unlockUser(username, password)
+	assert.Nil(t, err)
+	user.nextCryptoData, err = nextMasterKey(userEntry, password)
+	assert.Nil(t, err)
+	session.nextCryptoData = user.nextCryptoData
+	assert.Nil(t, testServer.saveSession(&session))
+	assert.Nil(t, user.reencryptFile(files[0], user.nextCryptoData, 1))
+
+	// both generations are readable meanwhile
+	for i, f := range files {
+		f, _ = testServer.files.GetFile(username, f.ID)
+		dataKey, err := user.fileKey(f)
+		assert.Nil(t, err)
+
+		r, err := testServer.storage.Get(context.Background(), f.GoogleCloudObject)
+		assert.Nil(t, err)
+
+		var plaintext bytes.Buffer
+		assert.Nil(t, fileFieldKey(dataKey, f, crypto.PurposeContents).DecryptFile(r, &plaintext, f.Compressed))
+		assert.True(t, bytes.Equal(contents[i], plaintext.Bytes()), "file %d differs", i)
+		r.Close()
+	}
+
+	// password changes would leave the next keys wrapped by the old password
+	assert.Equal(t, http.StatusConflict, changePassword(cookie, adminLoginDetails["password"], "a new password!").StatusCode)
+
+	// logging in resumes it
+	testServer.revokeSessions(username)
+	cookie = loginUser(adminLoginDetails)
+
+	progress := waitForKeyRotation(t, cookie)
+	assert.Equal(t, rotationProgress{Generation: 1, Files: 2}, progress)
+
+	for _, f := range files {
+		rotated, _ := testServer.files.GetFile(username, f.ID)
+		assert.Equal(t, 1, rotated.KeyGeneration)
+	}
+
+	assertFilesReadable(t, cookie, files, contents)
+}
@@ -0,0 +1,1304 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	crypto "github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/appleboy/gin-jwt.v2"
+
+	"github.com/gin-gonic/gin"
+)
+
+type userData struct {
+	userEntry  gc.UserEntry
+	cryptoData crypto.CryptoData
+	server     *Server
+
+	// nextCryptoData is set while the keys are rotated, see masterKey
+	nextCryptoData *crypto.CryptoData
+
+	// token is set when the request is made with an API token, which may
+	// limit the folders it can use
+	token *apiToken
+
+	// session describes the login the request is made with, see newSession
+	session sessionInfo
+
+	// sessionSecret encrypts the keys in the session, only the JWT has it
+	sessionSecret []byte
+}
+
+const (
+	errWeakUsername = "please pick a username with more characters"
+	errWeakPassword = "please pick a more secure password"
+
+	googleCaptchaURL = "https://www.google.com/recaptcha/api/siteverify"
+)
+
+// Server is a single gscrypto instance. It owns its databases, storage and
+// the store of its logged in users' sessions, so several can run in one
+// process, and several sharing a session store serve the same users.
+type Server struct {
+	config *gc.Config
+
+	files   gc.FileDatabase
+	users   gc.UserDatabase
+	uploads gc.UploadDatabase
+	storage gc.BlobStore
+
+	uploadLocks uploadLocks
+	rotations   rotations
+
+	// sessions also keeps failed logins and security key challenges, a
+	// login may be sent to any of the servers sharing it
+	sessions      gc.SessionStore
+	jwtMiddleware *jwt.GinJWTMiddleware
+
+	googleCaptchaURL string
+
+	router *gin.Engine
+}
+
+// NewServer opens the database, storage and session backends selected by
+// config.
+func NewServer(config *gc.Config) (*Server, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	// never let the tests touch real buckets or databases
+	if gin.IsDebugging() {
+		if config.StorageBackend == gc.StorageBackendGCS && !strings.Contains(config.GoogleCloudStorageBucket, "testing") {
+			return nil, errors.New("GOOGLE_CLOUD_STORAGE_BUCKET must contain 'testing' substring when testing")
+		}
+
+		if config.DatabaseBackend == gc.DatabaseBackendDatastore && !strings.HasPrefix(os.Getenv("DATASTORE_EMULATOR_HOST"), "localhost") {
+			return nil, errors.New("DATASTORE_EMULATOR_HOST must be set to localhost when testing")
+		}
+	}
+
+	db, err := gc.OpenDatabase(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	storage, err := gc.OpenBlobStore(config)
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	sessions, err := gc.OpenSessionStore(config)
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return NewServerWithBackends(config, db, storage, sessions)
+}
+
+// NewServerWithBackends creates a server using already opened backends, the
+// backend settings in config are ignored.
+func NewServerWithBackends(config *gc.Config, db gc.Database, storage gc.BlobStore, sessions gc.SessionStore) (*Server, error) {
+	if config.JWTKey == "" {
+		return nil, errors.New("did you set JWT_KEY?")
+	}
+
+	if !gin.IsDebugging() && config.GoogleCaptchaSecret == "" {
+		return nil, errors.New("did you set GOOGLE_CAPTCHA_SECRET?")
+	}
+
+	s := &Server{
+		config:           config,
+		files:            db,
+		users:            db,
+		uploads:          db,
+		storage:          storage,
+		uploadLocks:      uploadLocks{locked: make(map[string]bool)},
+		rotations:        rotations{running: make(map[string]bool), failed: make(map[string]string)},
+		sessions:         sessions,
+		googleCaptchaURL: googleCaptchaURL,
+	}
+
+	s.setupMiddleware()
+	s.router = s.routes()
+
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+// Run listens on the configured address until it fails, removing expired
+// uploads in the background.
+func (s *Server) Run() error {
+	go func() {
+		for range time.Tick(time.Hour) {
+			if err := s.removeExpiredUploads(); err != nil {
+				log.WithField("error", err.Error()).Warn("failed to remove expired uploads")
+			}
+		}
+	}()
+
+	return s.router.Run(s.config.ListenAddress)
+}
+
+// Close closes the database and the session store, the server must not be
+// used afterwards.
+func (s *Server) Close() {
+	s.files.Close()
+	s.sessions.Close()
+}
+
+// When a user successfully logs in, or makes a request with a valid JWT token,
+// the "user" context is added to the request: see the authentication code
+// for more details.
+func getUserFromContext(c *gin.Context) userData {
+	user, exists := c.Get("user")
+
+	if exists == false {
+		log.Debug("user missing from context")
+		c.AbortWithError(http.StatusUnauthorized, fmt.Errorf(userNotInContext))
+		return userData{}
+
+	} else {
+		log.WithFields(log.Fields{"user": user.(userData).userEntry.Username}).Debug("got user from context")
+	}
+
+	return user.(userData)
+}
+
+func (s *Server) routes() *gin.Engine {
+	router := gin.Default()
+	private := router.Group("/auth")
+
+	private.Use(s.authMiddleware())
+
+	router.POST("/account/login", s.jwtMiddleware.LoginHandler)
+
+	// verify if valid jwt passed, useful for redirecting to login page
+	private.POST("/account/verify", func(c *gin.Context) {
+		_, exists := c.Get("user")
+		if !exists {
+			c.Status(http.StatusUnauthorized)
+		} else {
+			c.Status(http.StatusNoContent)
+		}
+	})
+
+	private.GET("/account/users", func(c *gin.Context) {
+		user := getUserFromContext(c)
+		if user.userEntry.Admin {
+			if users, err := s.users.GetUsers(); err != nil {
+				log.Warn("failed to retrieve users")
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "failed to get users"})
+			} else {
+				c.JSON(http.StatusOK, users)
+			}
+		} else {
+			c.JSON(http.StatusForbidden, gin.H{"status": "only admin user can get get user data"})
+		}
+		return
+	})
+
+	private.PUT("/account/password", func(c *gin.Context) {
+		type passwordChange struct {
+			OldPassword string `json:"old_password"`
+			NewPassword string `json:"new_password"`
+		}
+
+		user := getUserFromContext(c)
+		var request passwordChange
+
+		// BindJSON responds with 400 itself
+		if err := c.BindJSON(&request); err != nil {
+			return
+		}
+
+		if err := user.changePassword([]byte(request.OldPassword), []byte(request.NewPassword)); err != nil {
+			switch err.Error() {
+			case errWrongPassword:
+				c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+			case errWeakPassword:
+				c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+			case errRotationInProgress:
+				c.JSON(http.StatusConflict, gin.H{"status": err.Error()})
+			case errZeroKnowledge:
+				c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "unable to change password: " + err.Error()})
+			}
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	private.GET("/account/keys/rotation", func(c *gin.Context) {
+		user := getUserFromContext(c)
+		progress, err := user.keyRotationProgress()
+
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, progress)
+	})
+
+	// starts rotating the keys, or resumes a rotation which was interrupted
+	private.POST("/account/keys/rotation", func(c *gin.Context) {
+		type rotationRequest struct {
+			Password string `json:"password"`
+		}
+
+		user := getUserFromContext(c)
+		var request rotationRequest
+
+		// BindJSON responds with 400 itself
+		if err := c.BindJSON(&request); err != nil {
+			return
+		}
+
+		if err := user.startKeyRotation([]byte(request.Password)); err != nil {
+			switch err.Error() {
+			case errWrongPassword:
+				c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+			case errUploadsInProgress:
+				c.JSON(http.StatusConflict, gin.H{"status": err.Error()})
+			case errZeroKnowledge:
+				c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "unable to rotate keys: " + err.Error()})
+			}
+			return
+		}
+
+		progress, err := user.keyRotationProgress()
+
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusAccepted, progress)
+	})
+
+	private.GET("/account/stat", func(c *gin.Context) {
+		user := getUserFromContext(c)
+		stats, err := user.getUserStats()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "unable to get file stats: " + err.Error()})
+		} else {
+			c.JSON(http.StatusOK, gin.H{"stats": *stats})
+		}
+	})
+
+	private.PUT("/account/enable/:user", func(c *gin.Context) {
+		user := getUserFromContext(c)
+		if user.userEntry.Admin {
+			userToEnable := c.Param("user")
+			if user, id, err := s.users.GetUserEntry(userToEnable); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "failed to get users"})
+				return
+			} else {
+				user.Enabled = true
+				s.users.UpdateUser(id, user)
+				c.Status(http.StatusNoContent)
+			}
+		} else {
+			c.JSON(http.StatusForbidden, gin.H{"status": "only admin user can get get user data"})
+		}
+		return
+	})
+
+	private.DELETE("/account/enable/:user", func(c *gin.Context) {
+		user := getUserFromContext(c)
+		if user.userEntry.Admin {
+			userToDisable := c.Param("user")
+			if user, id, err := s.users.GetUserEntry(userToDisable); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "failed to get users"})
+			} else {
+				user.Enabled = false
+				s.users.UpdateUser(id, user)
+				c.Status(http.StatusNoContent)
+			}
+		} else {
+			c.JSON(http.StatusForbidden, gin.H{"status": "only admin user can get get user data"})
+		}
+		return
+	})
+
+	// the salt and KDF parameters zero-knowledge clients derive their keys
+	// with, which is needed before they can log in
+	router.GET("/account/kdf/:user", func(c *gin.Context) {
+		c.JSON(http.StatusOK, s.loginParams(c.Param("user")))
+	})
+
+	// returns the options navigator.credentials.get is called with, the
+	// assertion is then sent with the credentials to /account/login
+	router.POST("/account/webauthn/login", func(c *gin.Context) {
+		type loginRequest struct {
+			Username string `json:"username"`
+		}
+
+		var request loginRequest
+
+		// BindJSON responds with 400 itself
+		if err := c.BindJSON(&request); err != nil {
+			return
+		}
+
+		options, err := s.webAuthnLoginOptions(request.Username)
+
+		if err != nil {
+			switch err.Error() {
+			case errWebAuthnDisabled:
+				c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "unable to create challenge: " + err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, options)
+	})
+
+	private.GET("/account/keys", func(c *gin.Context) {
+		user := getUserFromContext(c)
+		keys, err := user.zeroKnowledgeKeys()
+
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, keys)
+	})
+
+	// an armored backup of the keys encrypted with passphrase, which can
+	// recover the account if the password is forgotten
+	private.POST("/account/keys/backup", func(c *gin.Context) {
+		type backupRequest struct {
+			Password   string `json:"password"`
+			Passphrase string `json:"passphrase"`
+		}
+
+		user := getUserFromContext(c)
+		var request backupRequest
+
+		// BindJSON responds with 400 itself
+		if err := c.BindJSON(&request); err != nil {
+			return
+		}
+
+		backup, err := user.keyBackup([]byte(request.Password), []byte(request.Passphrase))
+
+		if err != nil {
+			switch err.Error() {
+			case errWrongPassword:
+				c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+			case errWeakPassphrase, errZeroKnowledge:
+				c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "unable to back up keys: " + err.Error()})
+			}
+			return
+		}
+
+		c.Header("content-disposition", "attachment; filename=\"gscrypto-"+user.userEntry.Username+"-keys.asc\"")
+		c.Data(http.StatusOK, "text/plain", backup)
+	})
+
+	// replaces the recovery codes, which are only shown this once
+	private.POST("/account/keys/recovery-codes", func(c *gin.Context) {
+		type recoveryCodesRequest struct {
+			Password string `json:"password"`
+		}
+
+		user := getUserFromContext(c)
+		var request recoveryCodesRequest
+
+		// BindJSON responds with 400 itself
+		if err := c.BindJSON(&request); err != nil {
+			return
+		}
+
+		codes, err := user.newRecoveryCodes([]byte(request.Password))
+
+		if err != nil {
+			switch err.Error() {
+			case errWrongPassword:
+				c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+			case errZeroKnowledge:
+				c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "unable to create recovery codes: " + err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"codes": codes})
+	})
+
+	// sets a new password with a recovery code, or a key backup and its
+	// passphrase. Failures need a captcha afterwards, like failed logins.
+	router.POST("/account/recover", func(c *gin.Context) {
+		type recoverRequest struct {
+			Username     string `json:"username"`
+			RecoveryCode string `json:"recovery_code"`
+			KeyBackup    string `json:"key_backup"`
+			Passphrase   string `json:"passphrase"`
+			NewPassword  string `json:"new_password"`
+		}
+
+		var request recoverRequest
+
+		// BindJSON responds with 400 itself
+		if err := c.BindJSON(&request); err != nil {
+			return
+		}
+
+		if s.loginFailed(request.Username) {
+			if ok, err := s.verifyGoogleCaptcha(c.GetHeader("google-captcha")); err != nil || !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"message": "captcha required"})
+				return
+			}
+		}
+
+		err := s.recoverAccount(request.Username, request.RecoveryCode, []byte(request.KeyBackup),
+			[]byte(request.Passphrase), []byte(request.NewPassword))
+
+		if err != nil {
+			switch err.Error() {
+			case errInvalidRecovery:
+				s.failedLogin(request.Username)
+				c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+			case errWeakPassword, errZeroKnowledge:
+				c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+			case errRotationInProgress:
+				c.JSON(http.StatusConflict, gin.H{"status": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "unable to recover account: " + err.Error()})
+			}
+			return
+		}
+
+		s.clearFailedLogin(request.Username)
+		c.Status(http.StatusNoContent)
+	})
+
+	// starts enrolling a TOTP authenticator, which is enabled once a code of
+	// it is confirmed
+	private.POST("/account/totp", func(c *gin.Context) {
+		type totpRequest struct {
+			Password string `json:"password"`
+		}
+
+		user := getUserFromContext(c)
+		var request totpRequest
+
+		// BindJSON responds with 400 itself
+		if err := c.BindJSON(&request); err != nil {
+			return
+		}
+
+		enrollment, err := user.startTOTP([]byte(request.Password))
+
+		if err != nil {
+			switch err.Error() {
+			case errWrongPassword:
+				c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+			case errTOTPEnabled:
+				c.JSON(http.StatusConflict, gin.H{"status": err.Error()})
+			case errZeroKnowledge:
+				c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "unable to enroll: " + err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, enrollment)
+	})
+
+	// enables two-factor authentication and returns the backup codes
+	private.POST("/account/totp/confirm", func(c *gin.Context) {
+		type confirmRequest struct {
+			Code string `json:"code"`
+		}
+
+		user := getUserFromContext(c)
+		var request confirmRequest
+
+		// BindJSON responds with 400 itself
+		if err := c.BindJSON(&request); err != nil {
+			return
+		}
+
+		codes, err := user.confirmTOTP(request.Code)
+
+		if err != nil {
+			switch err.Error() {
+			case errInvalidTOTP, errTOTPNotEnrolling:
+				c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+			case errTOTPEnabled:
+				c.JSON(http.StatusConflict, gin.H{"status": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "unable to enroll: " + err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"backup_codes": codes})
+	})
+
+	private.POST("/account/totp/backup-codes", func(c *gin.Context) {
+		type backupCodesRequest struct {
+			Password string `json:"password"`
+		}
+
+		user := getUserFromContext(c)
+		var request backupCodesRequest
+
+		// BindJSON responds with 400 itself
+		if err := c.BindJSON(&request); err != nil {
+			return
+		}
+
+		codes, err := user.renewTOTPBackupCodes([]byte(request.Password))
+
+		if err != nil {
+			switch err.Error() {
+			case errWrongPassword:
+				c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+			case errTOTPNotEnabled, errZeroKnowledge:
+				c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "unable to create backup codes: " + err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"backup_codes": codes})
+	})
+
+	private.DELETE("/account/totp", func(c *gin.Context) {
+		type disableRequest struct {
+			Password string `json:"password"`
+		}
+
+		user := getUserFromContext(c)
+		var request disableRequest
+
+		// BindJSON responds with 400 itself
+		if err := c.BindJSON(&request); err != nil {
+			return
+		}
+
+		if err := user.disableTOTP([]byte(request.Password)); err != nil {
+			switch err.Error() {
+			case errWrongPassword:
+				c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+			case errZeroKnowledge:
+				c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "unable to disable two-factor authentication: " + err.Error()})
+			}
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	// returns the options navigator.credentials.create registers a security
+	// key with
+	private.POST("/account/webauthn/register", func(c *gin.Context) {
+		type registerRequest struct {
+			Password string `json:"password"`
+		}
+
+		user := getUserFromContext(c)
+		var request registerRequest
+
+		// BindJSON responds with 400 itself
+		if err := c.BindJSON(&request); err != nil {
+			return
+		}
+
+		options, err := user.startWebAuthnRegistration([]byte(request.Password))
+
+		if err != nil {
+			switch err.Error() {
+			case errWebAuthnDisabled:
+				c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+			case errWrongPassword:
+				c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "unable to register security key: " + err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, options)
+	})
+
+	private.POST("/account/webauthn/register/finish", func(c *gin.Context) {
+		user := getUserFromContext(c)
+		var registration webAuthnRegistration
+
+		// BindJSON responds with 400 itself
+		if err := c.BindJSON(&registration); err != nil {
+			return
+		}
+
+		credential, err := user.finishWebAuthnRegistration(&registration)
+
+		if err != nil {
+			switch err.Error() {
+			case errWebAuthnDisabled:
+				c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+			case errInvalidWebAuthn, errWebAuthnNotRegistering:
+				c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+			case errWebAuthnRegistered:
+				c.JSON(http.StatusConflict, gin.H{"status": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "unable to register security key: " + err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusCreated, credential)
+	})
+
+	private.GET("/account/webauthn", func(c *gin.Context) {
+		user := getUserFromContext(c)
+		credentials, err := user.webAuthnCredentialList()
+
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "unable to list security keys: " + err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"credentials": credentials})
+	})
+
+	// the ID is base64url encoded, like in the browser
+	private.DELETE("/account/webauthn/:id", func(c *gin.Context) {
+		type removeRequest struct {
+			Password string `json:"password"`
+		}
+
+		user := getUserFromContext(c)
+		var request removeRequest
+
+		// BindJSON responds with 400 itself
+		if err := c.BindJSON(&request); err != nil {
+			return
+		}
+
+		credentialID, err := crypto.WebAuthnEncoding.DecodeString(c.Param("id"))
+
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "invalid security key ID"})
+			return
+		}
+
+		if err := user.removeWebAuthnCredential([]byte(request.Password), credentialID); err != nil {
+			switch err.Error() {
+			case errWrongPassword:
+				c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+			case errWebAuthnNotFound:
+				c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+			case errWebAuthnLastRequired:
+				c.JSON(http.StatusConflict, gin.H{"status": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "unable to remove security key: " + err.Error()})
+			}
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	// requires :user to log in with a security key, one who has none can
+	// only register one after logging in
+	private.PUT("/account/webauthn-required/:user", func(c *gin.Context) {
+		user := getUserFromContext(c)
+		if !user.userEntry.Admin {
+			c.JSON(http.StatusForbidden, gin.H{"status": "only admin user can change user policies"})
+			return
+		}
+
+		// users couldn't register the key they're required to have
+		if !s.config.WebAuthn {
+			c.JSON(http.StatusNotFound, gin.H{"status": errWebAuthnDisabled})
+			return
+		}
+
+		userEntry, id, err := s.users.GetUserEntry(c.Param("user"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"status": "user not found"})
+			return
+		}
+
+		userEntry.WebAuthnRequired = true
+		if err := s.users.UpdateUser(id, userEntry); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "failed to update user: " + err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	private.DELETE("/account/webauthn-required/:user", func(c *gin.Context) {
+		user := getUserFromContext(c)
+		if !user.userEntry.Admin {
+			c.JSON(http.StatusForbidden, gin.H{"status": "only admin user can change user policies"})
+			return
+		}
+
+		userEntry, id, err := s.users.GetUserEntry(c.Param("user"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"status": "user not found"})
+			return
+		}
+
+		userEntry.WebAuthnRequired = false
+		if err := s.users.UpdateUser(id, userEntry); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "failed to update user: " + err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	private.GET("/account/publickeys", func(c *gin.Context) {
+		user := getUserFromContext(c)
+		keys, err := user.publicKeys()
+
+		if err != nil {
+			if err.Error() == errNoPublicKeys {
+				c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"status": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, keys)
+	})
+
+	// files uploaded from now on are encrypted to the armored public keys
+	private.PUT("/account/publickeys", func(c *gin.Context) {
+		type publicKeysRequest struct {
+			PublicKeys string `json:"public_keys"`
+		}
+
+		user := getUserFromContext(c)
+		var request publicKeysRequest
+
+		// BindJSON responds with 400 itself
+		if err := c.BindJSON(&request); err != nil {
+			return
+		}
+
+		if err := user.setPublicKeys([]byte(request.PublicKeys)); err != nil {
+			switch err.Error() {
+			case crypto.ErrorInvalidPublicKeys, crypto.ErrorPrivateKeySent, crypto.ErrorNoEncryptionKey, errZeroKnowledge:
+				c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "unable to set public keys: " + err.Error()})
+			}
+			return
+		}
+
+		keys, err := user.publicKeys()
+
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, keys)
+	})
+
+	private.DELETE("/account/publickeys", func(c *gin.Context) {
+		user := getUserFromContext(c)
+
+		if err := user.setPublicKeys(nil); err != nil {
+			if err.Error() == errZeroKnowledge {
+				c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "unable to remove public keys: " + err.Error()})
+			}
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	// the token is only returned this once
+	private.POST("/account/tokens", func(c *gin.Context) {
+		user := getUserFromContext(c)
+		var request apiTokenRequest
+
+		// BindJSON responds with 400 itself
+		if err := c.BindJSON(&request); err != nil {
+			return
+		}
+
+		token, info, err := user.createAPIToken(&request)
+
+		if err != nil {
+			switch err.Error() {
+			case errWrongPassword:
+				c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+			case errInvalidTokenScopes, errInvalidTokenExpiry, errZeroKnowledge:
+				c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+			case errRotationInProgress:
+				c.JSON(http.StatusConflict, gin.H{"status": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "unable to create API token: " + err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"token": token, "info": info})
+	})
+
+	private.GET("/account/tokens", func(c *gin.Context) {
+		user := getUserFromContext(c)
+		tokens, err := user.apiTokenList()
+
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "unable to list API tokens: " + err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"tokens": tokens})
+	})
+
+	private.DELETE("/account/tokens/:id", func(c *gin.Context) {
+		user := getUserFromContext(c)
+
+		if err := user.revokeAPIToken(c.Param("id")); err != nil {
+			if err.Error() == errTokenNotFound {
+				c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "unable to revoke API token: " + err.Error()})
+			}
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	// revokes the session the request is made with
+	private.POST("/account/logout", func(c *gin.Context) {
+		user := getUserFromContext(c)
+
+		if err := s.revokeSession(user.userEntry.Username, user.session.ID); err != nil {
+			switch err.Error() {
+			case gc.ErrorSessionNotFound:
+				c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"status": err.Error()})
+			}
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	private.GET("/account/sessions", func(c *gin.Context) {
+		user := getUserFromContext(c)
+		sessions, err := user.sessionList()
+
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+	})
+
+	// revokes every session of the user, the current one too
+	private.DELETE("/account/sessions", func(c *gin.Context) {
+		user := getUserFromContext(c)
+
+		if err := s.revokeSessions(user.userEntry.Username); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": err.Error()})
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	private.DELETE("/account/sessions/:id", func(c *gin.Context) {
+		user := getUserFromContext(c)
+
+		if err := s.revokeSession(user.userEntry.Username, c.Param("id")); err != nil {
+			switch err.Error() {
+			case gc.ErrorSessionNotFound:
+				c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"status": err.Error()})
+			}
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	// send 404 if no admin accounts exists else 204
+	router.GET("/account/initial", func(c *gin.Context) {
+		if passwordData, _, _ := s.users.GetUserEntry("admin"); passwordData != nil {
+			c.Status(http.StatusNoContent)
+			return
+		}
+		c.Status(http.StatusNotFound)
+	})
+
+	router.POST("/account/signup", func(c *gin.Context) {
+		type signup struct {
+			Password string `form:"password" json:"password"`
+			Username string `form:"username" json:"username"`
+
+			// set by clients of zero-knowledge accounts, Password is then
+			// their login key
+			ZeroKnowledge *zeroKnowledgeKeys `json:"zero_knowledge"`
+
+			// if set a backup of the keys encrypted with it is returned,
+			// the account can't log in before an admin enables it
+			BackupPassphrase string `json:"backup_passphrase"`
+		}
+
+		var signupRequest signup
+
+		if err := c.BindJSON(&signupRequest); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"status": "unauthorized"})
+			return
+		}
+
+		if !gin.IsDebugging() {
+			if accepted, err := s.verifyGoogleCaptcha(c.Request.Header.Get("google-captcha")); err != nil {
+				log.WithField("error", err.Error()).Warn("failed to verify captcha")
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			} else if !accepted {
+				log.Debug("failed to verify captcha")
+				c.JSON(http.StatusUnauthorized, gin.H{"status": "failed to verify captcha"})
+				return
+			}
+		} else {
+			log.Warn("not verifying captcha since we are running in debug mode")
+		}
+
+		// if `admin` user doesn't exit, it must be created before creating non-admin users.
+		if _, _, err := s.users.GetUserEntry("admin"); err != nil && err.Error() == gc.ErrorNoDatabaseEntryFound {
+			if signupRequest.Username != "admin" {
+				log.WithFields(log.Fields{"user": signupRequest.Username, "password": signupRequest.Password}).Debug("attempted signup before 'admin' exists")
+				c.JSON(http.StatusForbidden, gin.H{"status": "create 'admin' user first"})
+				return
+			}
+		}
+
+		if passwordData, _, _ := s.users.GetUserEntry(signupRequest.Username); passwordData != nil {
+			c.JSON(http.StatusConflict, gin.H{"status": "account already exists"})
+			return
+		}
+
+		password := signupRequest.Password
+		username := signupRequest.Username
+
+		// the password of zero-knowledge accounts is checked by the client
+		if signupRequest.ZeroKnowledge == nil && isWeakPassword(password) {
+			c.JSON(http.StatusUnauthorized, gin.H{"status": errWeakPassword})
+			return
+		}
+
+		if len(username) < 4 || strings.Contains(username, " ") {
+			c.JSON(http.StatusUnauthorized, gin.H{"status": errWeakUsername})
+			return
+		}
+
+		userEntry := &gc.UserEntry{
+			Username: signupRequest.Username,
+			Admin:    signupRequest.Username == "admin",
+
+			// by default, all account are disabled unless the user is an admin
+			Enabled:     signupRequest.Username == "admin",
+			CreatedDate: time.Now(),
+
+			MetadataEncrypted: true,
+		}
+
+		if signupRequest.ZeroKnowledge != nil {
+			if err := s.newZeroKnowledgeUser(userEntry, []byte(password), signupRequest.ZeroKnowledge); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+				return
+			}
+		} else if err := s.newUserKeys(userEntry, []byte(password)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to encrypt keys: " + err.Error()})
+			return
+		}
+
+		var backup []byte
+
+		if signupRequest.ZeroKnowledge == nil && signupRequest.BackupPassphrase != "" {
+			var err error
+			if backup, err = newKeyBackup(userEntry, []byte(password), []byte(signupRequest.BackupPassphrase)); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+				return
+			}
+		}
+
+		err := s.users.SetUserEntry(userEntry)
+		if err == nil {
+			log.WithFields(log.Fields{"user": userEntry.Username}).Debug("user created successfully")
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if backup != nil {
+			c.JSON(http.StatusCreated, gin.H{"key_backup": string(backup)})
+			return
+		}
+
+		c.Status(http.StatusCreated)
+	})
+
+	private.POST("/file/", func(c *gin.Context) {
+		user := getUserFromContext(c)
+		err := user.processFileUpload(c)
+
+		// send resource conflict on duplicate file
+		if err != nil {
+			if err.Error() == errorFileIsDuplicate {
+				c.JSON(http.StatusConflict, err.Error())
+			} else if err.Error() == errTokenFolder {
+				c.JSON(http.StatusForbidden, gin.H{"fail": err.Error()})
+			} else if err.Error() == errorMissingEncryptedMeta || err.Error() == errorMissingFolderNames ||
+				err.Error() == crypto.ErrorInvalidStreamHeader {
+				c.JSON(http.StatusBadRequest, gin.H{"fail": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"fail": err.Error()})
+			}
+			return
+		}
+
+		c.Status(http.StatusCreated)
+	})
+
+	router.OPTIONS("/auth/upload/", tusOptions)
+	uploads := private.Group("/upload", tusResumable)
+
+	uploads.POST("/", func(c *gin.Context) {
+		user := getUserFromContext(c)
+
+		if err := user.createUpload(c); err != nil {
+			c.JSON(tusErrorStatus(err), gin.H{"status": err.Error()})
+		}
+	})
+
+	uploads.HEAD("/:id", func(c *gin.Context) {
+		user := getUserFromContext(c)
+
+		// responses to HEAD have no body
+		if err := user.uploadStatus(c, c.Param("id")); err != nil {
+			c.Header("Cache-Control", "no-store")
+			c.Status(tusErrorStatus(err))
+		}
+	})
+
+	uploads.PATCH("/:id", func(c *gin.Context) {
+		user := getUserFromContext(c)
+
+		if err := user.patchUpload(c, c.Param("id")); err != nil {
+			c.JSON(tusErrorStatus(err), gin.H{"status": err.Error()})
+		}
+	})
+
+	uploads.DELETE("/:id", func(c *gin.Context) {
+		user := getUserFromContext(c)
+
+		if err := user.deleteUpload(c.Param("id")); err != nil {
+			c.JSON(tusErrorStatus(err), gin.H{"status": err.Error()})
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	private.DELETE("/file/:uuid", func(c *gin.Context) {
+		user := getUserFromContext(c)
+		id, err := strconv.ParseInt(c.Param("uuid"), 10, 64)
+
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, err)
+			return
+		}
+
+		err = user.deleteFile(id)
+
+		if err != nil {
+			switch err.Error() {
+			case gc.ErrorNotRequestingUsers:
+				c.JSON(http.StatusUnauthorized, err.Error())
+			case errTokenFolder:
+				c.JSON(http.StatusForbidden, err.Error())
+			default:
+				c.JSON(http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	private.DELETE("/folder", func(c *gin.Context) {
+		user := getUserFromContext(c)
+		folderDeletePath := c.Query("path")
+
+		if err := user.checkTokenFolder(folderDeletePath); err != nil {
+			c.JSON(http.StatusForbidden, err.Error())
+			return
+		}
+
+		err := user.deleteFolder(folderDeletePath)
+
+		if err != nil {
+			c.JSON(http.StatusForbidden, err.Error())
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	private.GET("/list/tags/", func(c *gin.Context) {
+		user := getUserFromContext(c)
+		tags, err := user.listTags()
+
+		if err != nil {
+			if err.Error() == errZeroKnowledge {
+				c.JSON(http.StatusBadRequest, err.Error())
+			} else {
+				c.JSON(http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, tags)
+	})
+
+	private.GET("/list/fs", func(c *gin.Context) {
+		user := getUserFromContext(c)
+		path := c.Query("path")
+		tags := c.QueryArray("tags")
+
+		if len(path) == 0 && len(tags) == 0 {
+			c.JSON(http.StatusInternalServerError, fmt.Errorf("path/tag is missing"))
+			return
+		}
+
+		if err := user.checkTokenFolder(path); err != nil {
+			c.JSON(http.StatusForbidden, err.Error())
+			return
+		}
+
+		if len(tags) > 0 {
+			trimmedTags := []string{}
+			for _, tag := range tags {
+				trimmedTags = append(trimmedTags, strings.TrimSpace(tag))
+			}
+
+			if fs, err := user.listFileSystemByTags(path, trimmedTags); err != nil {
+				c.JSON(http.StatusInternalServerError, err)
+			} else {
+				c.JSON(http.StatusOK, fs)
+			}
+			return
+		}
+
+		if fs, err := user.listFileSystem(path, nil); err != nil {
+			c.JSON(http.StatusInternalServerError, err)
+		} else {
+			c.IndentedJSON(http.StatusOK, fs)
+		}
+	})
+
+	private.GET("/folder", func(c *gin.Context) {
+		user := getUserFromContext(c)
+		path := c.Query("path")
+		path = filepath.Clean(path)
+
+		if err := user.checkTokenFolder(path); err != nil {
+			c.JSON(http.StatusForbidden, err.Error())
+			return
+		}
+
+		if err := user.downloadFolder(*c, path); err != nil {
+			c.JSON(http.StatusInternalServerError, err)
+			return
+		}
+	})
+
+	private.GET("/folder/search/", func(c *gin.Context) {
+		user := getUserFromContext(c)
+		searchPath := c.Query("path")
+
+		if len(searchPath) < 1 {
+			c.JSON(http.StatusForbidden, "search must be 2 character or more")
+			return
+		}
+
+		folders, err := user.searchFolders(searchPath, 20)
+
+		if err != nil {
+			if err.Error() == errZeroKnowledge {
+				c.JSON(http.StatusBadRequest, err.Error())
+			} else {
+				c.JSON(http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, folders)
+		return
+	})
+
+	private.GET("/file/:key", func(c *gin.Context) {
+		user := getUserFromContext(c)
+		key := c.Param("key")
+		id, err := strconv.ParseInt(key, 10, 64)
+
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, err)
+			return
+		}
+
+		if err := user.downloadFile(c, id); err != nil {
+			if err.Error() == errTokenFolder {
+				c.JSON(http.StatusForbidden, err.Error())
+			} else {
+				c.JSON(http.StatusNotFound, err)
+			}
+			return
+		}
+	})
+
+	return router
+}
@@ -0,0 +1,345 @@
+package app
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// Each login is a session of its own, kept in the session store so that every
+// server sharing the store can serve it, and a restart doesn't end it. The
+// JWT's "id" claim, which gin-jwt identifies requests by, carries the
+// session's ID and a secret only the client has: the user's unwrapped keys are
+// stored encrypted by it, so the store alone gives nothing away. Logging out,
+// or revoking the session from another one, removes it from the store and the
+// JWT is of no use anymore.
+const (
+	errSessionRevoked = "session is no longer valid, please log in again"
+	errInvalidSession = "invalid session"
+
+	sessionIDLength     = 16
+	sessionSecretLength = 32
+	sessionContext      = "gscrypto session"
+
+	// how often the last use of a session is updated, not every request
+	// needs to write it
+	sessionTouchInterval = time.Minute
+)
+
+// sessionInfo describes a session, what users see of theirs.
+type sessionInfo struct {
+	ID          string    `json:"id"`
+	IP          string    `json:"ip"`
+	UserAgent   string    `json:"user_agent"`
+	CreatedDate time.Time `json:"created_date"`
+	LastUsed    time.Time `json:"last_used"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Current     bool      `json:"current"`
+}
+
+// storedSession is a session as it's kept in the session store. The user's
+// entry isn't, it's read from the database with every request.
+type storedSession struct {
+	Info     sessionInfo `json:"info"`
+	Username string      `json:"username"`
+
+	// KeyGeneration is the generation of Keys.Current
+	KeyGeneration int `json:"key_generation"`
+
+	// Keys is sessionKeys encrypted by the session's secret
+	Keys []byte `json:"keys"`
+}
+
+// sessionKeys are the keys of a session, Current is nil for zero-knowledge
+// accounts, Next is set while the keys are rotated.
+type sessionKeys struct {
+	Current *crypto.CryptoData `json:"current"`
+	Next    *crypto.CryptoData `json:"next"`
+}
+
+// sessionKey returns the key encrypting the keys of the session with id.
+func sessionKey(id string, secret []byte) *crypto.CryptoData {
+	return crypto.NewCryptoData(secret, nil, []byte(id), 1).WithAssociatedData(crypto.Context(sessionContext, id))
+}
+
+// sessionIdentity returns what the JWT identifies the session of user by.
+func sessionIdentity(user *userData) string {
+	return user.session.ID + "." + base64.RawURLEncoding.EncodeToString(user.sessionSecret)
+}
+
+// parseSessionIdentity returns the ID and secret of a session identity.
+func parseSessionIdentity(identity string) (string, []byte, error) {
+	parts := strings.Split(identity, ".")
+
+	if len(parts) != 2 {
+		return "", nil, errors.New(errInvalidSession)
+	}
+
+	secret, err := base64.RawURLEncoding.DecodeString(parts[1])
+
+	if err != nil || len(secret) != sessionSecretLength {
+		return "", nil, errors.New(errInvalidSession)
+	}
+
+	return parts[0], secret, nil
+}
+
+// encodeSession returns the session of user as it's stored.
+func encodeSession(user *userData) ([]byte, error) {
+	keys := sessionKeys{Next: user.nextCryptoData}
+
+	if !user.userEntry.ZeroKnowledge {
+		keys.Current = &user.cryptoData
+	}
+
+	plaintext, err := json.Marshal(keys)
+
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := sessionKey(user.session.ID, user.sessionSecret).EncryptText(plaintext)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(storedSession{
+		Info:          user.session,
+		Username:      user.userEntry.Username,
+		KeyGeneration: user.userEntry.KeyGeneration,
+		Keys:          encrypted,
+	})
+}
+
+// newSession starts a session of user, logging in with c, and returns the
+// identity the JWT carries.
+func (s *Server) newSession(user userData, c *gin.Context) (string, error) {
+	random, err := crypto.RandomBytes(sessionIDLength)
+
+	if err != nil {
+		return "", err
+	}
+
+	if user.sessionSecret, err = crypto.RandomBytes(sessionSecretLength); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	user.session = sessionInfo{
+		ID:          hex.EncodeToString(random),
+		IP:          c.ClientIP(),
+		UserAgent:   c.Request.UserAgent(),
+		CreatedDate: now,
+		LastUsed:    now,
+		ExpiresAt:   now.Add(tokenTTL),
+	}
+
+	session, err := encodeSession(&user)
+
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.sessions.SetSession(user.userEntry.Username, user.session.ID, session, tokenTTL); err != nil {
+		return "", err
+	}
+
+	return sessionIdentity(&user), nil
+}
+
+// saveSession saves the session of user, keeping when it expires. Requests
+// made with an API token have no session, and nothing is saved.
+func (s *Server) saveSession(user *userData) error {
+	if user.session.ID == "" {
+		return nil
+	}
+
+	session, err := encodeSession(user)
+
+	if err != nil {
+		return err
+	}
+
+	ttl := time.Until(user.session.ExpiresAt)
+
+	if ttl <= 0 {
+		return errors.New(gc.ErrorSessionNotFound)
+	}
+
+	// a session revoked since the request read it stays revoked
+	return s.sessions.UpdateSession(user.userEntry.Username, user.session.ID, session, ttl)
+}
+
+// loadSession returns the user of the session identity refers to, unless it
+// expired, was revoked, or its keys are out of date.
+func (s *Server) loadSession(identity string) (userData, error) {
+	id, secret, err := parseSessionIdentity(identity)
+
+	if err != nil {
+		return userData{}, err
+	}
+
+	data, err := s.sessions.GetSession(id)
+
+	if err != nil {
+		return userData{}, err
+	}
+
+	var stored storedSession
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return userData{}, err
+	}
+
+	plaintext, err := sessionKey(id, secret).DecryptText(stored.Keys)
+
+	if err != nil {
+		return userData{}, errors.New(errInvalidSession)
+	}
+
+	var keys sessionKeys
+	if err := json.Unmarshal(plaintext, &keys); err != nil {
+		return userData{}, err
+	}
+
+	userEntry, _, err := s.users.GetUserEntry(stored.Username)
+
+	if err != nil {
+		return userData{}, err
+	}
+
+	user := userData{userEntry: *userEntry, server: s, session: stored.Info, sessionSecret: secret}
+
+	if userEntry.ZeroKnowledge {
+		return user, nil
+	}
+
+	if keys.Current == nil {
+		return userData{}, errors.New(errSessionRevoked)
+	}
+
+	switch {
+	case userEntry.KeyGeneration == stored.KeyGeneration:
+		user.cryptoData = *keys.Current
+
+		// a rotation started by another session, which couldn't give this
+		// one the next keys
+		if userEntry.Rotating() {
+			if keys.Next == nil {
+				return userData{}, errors.New(errSessionRevoked)
+			}
+			user.nextCryptoData = keys.Next
+		}
+	case userEntry.KeyGeneration == stored.KeyGeneration+1 && keys.Next != nil && !userEntry.Rotating():
+		// the rotation finished since the session was saved
+		user.cryptoData = *keys.Next
+
+		if err := s.saveSession(&user); err != nil {
+			return userData{}, err
+		}
+	default:
+		return userData{}, errors.New(errSessionRevoked)
+	}
+
+	return user, nil
+}
+
+// touchSession records the session of user is used by c.
+func (s *Server) touchSession(user *userData, c *gin.Context) {
+	if time.Since(user.session.LastUsed) < sessionTouchInterval {
+		return
+	}
+
+	user.session.IP = c.ClientIP()
+	user.session.UserAgent = c.Request.UserAgent()
+	user.session.LastUsed = time.Now()
+
+	if err := s.saveSession(user); err != nil {
+		log.WithFields(log.Fields{"user": user.userEntry.Username, "error": err}).Debug("failed to update session")
+	}
+}
+
+// userSessions returns the sessions of username.
+func (s *Server) userSessions(username string) ([]sessionInfo, error) {
+	ids, err := s.sessions.SessionIDs(username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []sessionInfo
+
+	for _, id := range ids {
+		data, err := s.sessions.GetSession(id)
+
+		// expired since it was listed
+		if err != nil && err.Error() == gc.ErrorSessionNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var stored storedSession
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, stored.Info)
+	}
+	return sessions, nil
+}
+
+// revokeSession removes the session of username with id.
+func (s *Server) revokeSession(username, id string) error {
+	return s.sessions.DeleteSession(username, id)
+}
+
+// revokeSessions removes every session of username.
+func (s *Server) revokeSessions(username string) error {
+	return s.sessions.DeleteSessions(username)
+}
+
+// revokeOtherSessions removes every session of the user but the one they're
+// using.
+func (user *userData) revokeOtherSessions() error {
+	sessions, err := user.server.userSessions(user.userEntry.Username)
+
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		if session.ID == user.session.ID {
+			continue
+		}
+
+		if err := user.server.revokeSession(user.userEntry.Username, session.ID); err != nil && err.Error() != gc.ErrorSessionNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// sessionList returns the user's sessions, marking the one they're using.
+func (user *userData) sessionList() ([]sessionInfo, error) {
+	sessions, err := user.server.userSessions(user.userEntry.Username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]sessionInfo, 0, len(sessions))
+
+	for _, info := range sessions {
+		info.Current = info.ID == user.session.ID
+		list = append(list, info)
+	}
+	return list, nil
+}
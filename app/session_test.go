@@ -0,0 +1,183 @@
+package app
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/levigross/grequests"
+	"github.com/stretchr/testify/assert"
+)
+
+// cookieSession returns the user of the session the JWT in cookie refers to.
+func cookieSession(cookie *http.Cookie) (userData, error) {
+	parts := strings.Split(cookie.Value, ".")
+
+	if len(parts) != 3 {
+		return userData{}, errors.New(errInvalidSession)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+
+	if err != nil {
+		return userData{}, err
+	}
+
+	var claims struct {
+		ID string `json:"id"`
+	}
+
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return userData{}, err
+	}
+	return testServer.loadSession(claims.ID)
+}
+
+func countSessions(username string) int {
+	sessions, _ := testServer.userSessions(username)
+	return len(sessions)
+}
+
+func verifySession(cookie *http.Cookie) int {
+	resp, _ := grequests.Post(ts.URL+"/auth/account/verify", &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}})
+	return resp.StatusCode
+}
+
+func listSessions(t *testing.T, cookie *http.Cookie) []sessionInfo {
+	var list struct {
+		Sessions []sessionInfo `json:"sessions"`
+	}
+
+	resp, err := grequests.Get(ts.URL+"/auth/account/sessions", &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, resp.JSON(&list))
+	return list.Sessions
+}
+
+func TestSessions(t *testing.T) {
+	clearDatastore()
+	createAdmin()
+
+	// the sessions of earlier tests outlive the datastore
+	testServer.revokeSessions("admin")
+
+	laptop := loginUser(adminLoginDetails)
+	phone := loginUser(adminLoginDetails)
+
+	sessions := listSessions(t, laptop)
+	assert.Len(t, sessions, 2)
+
+	var other string
+	for _, session := range sessions {
+		assert.NotEmpty(t, session.IP)
+		assert.NotEmpty(t, session.UserAgent)
+		assert.False(t, session.LastUsed.IsZero())
+
+		if !session.Current {
+			other = session.ID
+		}
+	}
+
+	resp, err := grequests.Delete(ts.URL+"/auth/account/sessions/nonexistent", &grequests.RequestOptions{Cookies: []*http.Cookie{laptop}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// revoking a session makes its JWT useless at once
+	resp, err = grequests.Delete(ts.URL+"/auth/account/sessions/"+other, &grequests.RequestOptions{Cookies: []*http.Cookie{laptop}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	assert.Equal(t, http.StatusUnauthorized, verifySession(phone))
+	assert.Equal(t, http.StatusNoContent, verifySession(laptop))
+	assert.Equal(t, 1, countSessions("admin"))
+
+	resp, err = grequests.Post(ts.URL+"/auth/account/logout", &grequests.RequestOptions{Cookies: []*http.Cookie{laptop}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, verifySession(laptop))
+	assert.Zero(t, countSessions("admin"))
+
+	// sessions of other users can't be revoked
+	createNormalUser()
+	enableUser(normalUserLoginDetails, *loginUser(adminLoginDetails))
+	testServer.revokeSessions(normalUserLoginDetails["username"])
+	alice := loginUser(normalUserLoginDetails)
+	aliceSessions := listSessions(t, alice)
+	assert.Len(t, aliceSessions, 1)
+
+	admin := loginUser(adminLoginDetails)
+	resp, err = grequests.Delete(ts.URL+"/auth/account/sessions/"+aliceSessions[0].ID, &grequests.RequestOptions{Cookies: []*http.Cookie{admin}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, http.StatusNoContent, verifySession(alice))
+
+	resp, err = grequests.Delete(ts.URL+"/auth/account/sessions", &grequests.RequestOptions{Cookies: []*http.Cookie{admin}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, verifySession(admin))
+	assert.Zero(t, countSessions("admin"))
+}
+
+func TestSharedSessionStore(t *testing.T) {
+	clearDatastore()
+	createAdmin()
+	testServer.revokeSessions("admin")
+
+	// another replica, or the same server restarted, sharing the backends
+	other, err := NewServerWithBackends(testServer.config, testServer.files.(gc.Database), testServer.storage, testServer.sessions)
+	assert.Nil(t, err)
+
+	otherTS := httptest.NewServer(other)
+	defer otherTS.Close()
+
+	cookie := loginUser(adminLoginDetails)
+	uploadToFolder(t, cookie, "shared", "/", "", "")
+
+	var files []FSLayout
+	resp, err := grequests.Get(otherTS.URL+"/auth/list/fs", &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}, Params: map[string]string{"path": "/"}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, resp.JSON(&files))
+	assert.Len(t, files, 1)
+
+	// the store only has the keys encrypted by the secret the JWT carries
+	session, err := cookieSession(cookie)
+	assert.Nil(t, err)
+	stored, err := testServer.sessions.GetSession(session.session.ID)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(stored), base64.StdEncoding.EncodeToString(session.cryptoData.SymmetricKey))
+
+	_, err = testServer.loadSession(session.session.ID + "." + base64.RawURLEncoding.EncodeToString(make([]byte, sessionSecretLength)))
+	assert.NotNil(t, err)
+
+	// a login may ask one server for a security key challenge and answer it
+	// on another
+	a, credentialID := registerSecurityKey(t, cookie, adminLoginDetails["password"])
+	assertion := securityKeyAssertion(t, a, "admin", credentialID)
+	resp, err = grequests.Post(otherTS.URL+"/account/login", &grequests.RequestOptions{
+		JSON:    adminLoginDetails,
+		Headers: map[string]string{headerWebAuthnAssertion: assertion},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// and a failed login on one server needs a captcha on every one, tests
+	// don't record them so it's recorded here
+	assert.Nil(t, testServer.sessions.SetValue(failedLoginPrefix+"admin", []byte{1}, failedLoginTTL))
+	resp, err = grequests.Post(otherTS.URL+"/account/login", &grequests.RequestOptions{JSON: adminLoginDetails})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	testServer.clearFailedLogin("admin")
+
+	// logging out on one server logs out on every one
+	resp, err = grequests.Post(otherTS.URL+"/auth/account/logout", &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, verifySession(cookie))
+}
@@ -1,9 +1,7 @@
-package main
+package app
 
 import (
 	"time"
-
-	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
 )
 
 type fileSystemStats struct {
@@ -27,11 +25,22 @@ type fileSystemStats struct {
 
 func (user *userData) getUserStats() (*fileSystemStats, error) {
 	fileSysStats := new(fileSystemStats)
-	files, err := gc.FileStructDB.GetAllFiles(user.userEntry.Username)
+	files, err := user.server.files.GetAllFiles(user.userEntry.Username)
 
 	for _, f := range files {
+		// the server knows the size of files of zero-knowledge accounts
+		size := f.FileSize
+
+		if !user.userEntry.ZeroKnowledge {
+			metadata, err := user.decryptMetadata(f)
+
+			if err != nil {
+				return nil, err
+			}
+			size = metadata.FileSize
+		}
 
-		fileSysStats.TotalFileUsage += f.FileSize
+		fileSysStats.TotalFileUsage += size
 
 		switch {
 		case f.UploadDate.After(time.Now().AddDate(0, 0, -7)):
@@ -47,17 +56,17 @@ func (user *userData) getUserStats() (*fileSystemStats, error) {
 		}
 
 		switch {
-		case f.FileSize < 500*1024*1024:
+		case size < 500*1024*1024:
 			fileSysStats.FilesBetween0MB500MB++
-		case f.FileSize <= 1000*1024*1024:
+		case size <= 1000*1024*1024:
 			fileSysStats.FilesBetween500MB1GB++
-		case f.FileSize <= 2000*1024*1024:
+		case size <= 2000*1024*1024:
 			fileSysStats.FilesBetween1GB2GB++
-		case f.FileSize <= 3000*1024*1024:
+		case size <= 3000*1024*1024:
 			fileSysStats.FilesBetween2GB3GB++
-		case f.FileSize <= 4000*1024*1024:
+		case size <= 4000*1024*1024:
 			fileSysStats.FilesBetween3GB4GB++
-		case f.FileSize <= 5000*1024*1024:
+		case size <= 5000*1024*1024:
 			fileSysStats.FilesBetween4GB5GB++
 		default:
 			fileSysStats.FilesOver5GB++
@@ -0,0 +1,268 @@
+package app
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"time"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+)
+
+// Users may add a second factor to logging in: a TOTP authenticator app, or
+// one of the backup codes they're given when enrolling if they lose it. The
+// secret is encrypted by the user's key, so the code is checked once the
+// password unwrapped it and before the keys are kept in the session. Logging
+// in without a code is refused with needSecondFactor, the client then sends
+// the credentials again with the code in the totp-code header.
+const (
+	errTOTPRequired       = "two-factor code required"
+	errInvalidTOTP        = "two-factor code is not valid"
+	errTOTPEnabled        = "two-factor authentication is already enabled"
+	errTOTPNotEnabled     = "two-factor authentication is not enabled"
+	errTOTPNotEnrolling   = "start enrolling two-factor authentication first"
+	headerTOTPCode        = "totp-code"
+	totpIssuer            = "gscrypto"
+	totpKeyVersion        = 1
+	totpBackupCodes       = 10
+	totpBackupCodeLength  = 10
+	totpBackupCodeContext = "gscrypto totp backup code"
+)
+
+type totpEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// totpKey returns the key encrypting the TOTP secret, given the user's key.
+func totpKey(master *crypto.CryptoData) *crypto.CryptoData {
+	return master.Subkey(crypto.PurposeTOTP, totpKeyVersion)
+}
+
+// totpBackupCodeHash returns the hash a backup code of username is kept as.
+func totpBackupCodeHash(username, code string) []byte {
+	sum := sha256.Sum256(crypto.Context(totpBackupCodeContext, username, normalizeRecoveryCode(code)))
+	return sum[:]
+}
+
+// newTOTPBackupCodes returns new backup codes of username, and the hashes of
+// them to keep in UserEntry.TOTPBackupCodes.
+func newTOTPBackupCodes(username string) ([]string, []byte, error) {
+	codes := make([]string, 0, totpBackupCodes)
+	hashes := make([][]byte, 0, totpBackupCodes)
+
+	for len(codes) < totpBackupCodes {
+		random, err := crypto.RandomBytes(totpBackupCodeLength)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		code := recoveryCodeEncoding.EncodeToString(random)
+		codes = append(codes, groupCode(code))
+		hashes = append(hashes, totpBackupCodeHash(username, code))
+	}
+
+	encoded, err := json.Marshal(hashes)
+	return codes, encoded, err
+}
+
+// useTOTPBackupCode removes code from the backup codes of userEntry, and
+// reports whether it was one.
+func useTOTPBackupCode(userEntry *gc.UserEntry, code string) bool {
+	var hashes [][]byte
+
+	if len(userEntry.TOTPBackupCodes) == 0 || json.Unmarshal(userEntry.TOTPBackupCodes, &hashes) != nil {
+		return false
+	}
+
+	hash := totpBackupCodeHash(userEntry.Username, code)
+
+	for i := range hashes {
+		if subtle.ConstantTimeCompare(hashes[i], hash) != 1 {
+			continue
+		}
+
+		remaining, err := json.Marshal(append(hashes[:i:i], hashes[i+1:]...))
+
+		if err != nil {
+			return false
+		}
+
+		userEntry.TOTPBackupCodes = remaining
+		return true
+	}
+	return false
+}
+
+// checkTOTP checks the second factor of userEntry, whose key is master, if it
+// has one. A code which is accepted is used up, and userEntry is saved.
+func (s *Server) checkTOTP(userEntry *gc.UserEntry, id int64, master *crypto.CryptoData, code string) error {
+	if !userEntry.TOTPEnabled {
+		return nil
+	}
+
+	if code == "" {
+		return errors.New(errTOTPRequired)
+	}
+
+	if len(code) == crypto.TOTPDigits {
+		secret, err := totpKey(master).DecryptText(userEntry.TOTPSecret)
+
+		if err != nil {
+			return err
+		}
+
+		step, ok := crypto.VerifyTOTP(secret, code, time.Now(), userEntry.TOTPLastStep)
+
+		if !ok {
+			return errors.New(errInvalidTOTP)
+		}
+
+		userEntry.TOTPLastStep = step
+	} else if !useTOTPBackupCode(userEntry, code) {
+		return errors.New(errInvalidTOTP)
+	}
+
+	return s.users.UpdateUser(id, userEntry)
+}
+
+// startTOTP creates a new TOTP secret for the user, which is only enabled once
+// a code of it is confirmed.
+func (user *userData) startTOTP(password []byte) (*totpEnrollment, error) {
+	userEntry, id, err := user.unlockEntry(password)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if userEntry.TOTPEnabled {
+		return nil, errors.New(errTOTPEnabled)
+	}
+
+	secret, err := crypto.NewTOTPSecret()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the secret is read with the key the password unwraps at login
+	if userEntry.TOTPSecret, err = totpKey(&user.cryptoData).EncryptText(secret); err != nil {
+		return nil, err
+	}
+
+	if err := user.saveUserEntry(id, userEntry); err != nil {
+		return nil, err
+	}
+
+	return &totpEnrollment{
+		Secret: crypto.TOTPSecretString(secret),
+		URI:    crypto.TOTPURI(totpIssuer, userEntry.Username, secret),
+	}, nil
+}
+
+// confirmTOTP enables the secret of startTOTP if code is one of its codes,
+// and returns the backup codes.
+func (user *userData) confirmTOTP(code string) ([]string, error) {
+	userEntry, id, err := user.server.users.GetUserEntry(user.userEntry.Username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if userEntry.TOTPEnabled {
+		return nil, errors.New(errTOTPEnabled)
+	}
+
+	if len(userEntry.TOTPSecret) == 0 {
+		return nil, errors.New(errTOTPNotEnrolling)
+	}
+
+	secret, err := totpKey(&user.cryptoData).DecryptText(userEntry.TOTPSecret)
+
+	if err != nil {
+		return nil, err
+	}
+
+	step, ok := crypto.VerifyTOTP(secret, code, time.Now(), 0)
+
+	if !ok {
+		return nil, errors.New(errInvalidTOTP)
+	}
+
+	codes, hashes, err := newTOTPBackupCodes(userEntry.Username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	userEntry.TOTPEnabled = true
+	userEntry.TOTPLastStep = step
+	userEntry.TOTPBackupCodes = hashes
+
+	if err := user.saveUserEntry(id, userEntry); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// renewTOTPBackupCodes replaces the user's backup codes by new ones.
+func (user *userData) renewTOTPBackupCodes(password []byte) ([]string, error) {
+	userEntry, id, err := user.unlockEntry(password)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !userEntry.TOTPEnabled {
+		return nil, errors.New(errTOTPNotEnabled)
+	}
+
+	codes, hashes, err := newTOTPBackupCodes(userEntry.Username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	userEntry.TOTPBackupCodes = hashes
+
+	if err := user.saveUserEntry(id, userEntry); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// disableTOTP removes the user's second factor.
+func (user *userData) disableTOTP(password []byte) error {
+	userEntry, id, err := user.unlockEntry(password)
+
+	if err != nil {
+		return err
+	}
+
+	userEntry.TOTPSecret, userEntry.TOTPEnabled = nil, false
+	userEntry.TOTPLastStep, userEntry.TOTPBackupCodes = 0, nil
+
+	return user.saveUserEntry(id, userEntry)
+}
+
+// rewrapTOTPSecret encrypts the TOTP secret of userEntry, encrypted by from,
+// by to instead.
+func rewrapTOTPSecret(userEntry *gc.UserEntry, from, to *crypto.CryptoData) error {
+	if len(userEntry.TOTPSecret) == 0 {
+		return nil
+	}
+
+	secret, err := totpKey(from).DecryptText(userEntry.TOTPSecret)
+
+	if err != nil {
+		return err
+	}
+
+	userEntry.TOTPSecret, err = totpKey(to).EncryptText(secret)
+	return err
+}
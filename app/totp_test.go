@@ -0,0 +1,84 @@
+package app
+
+import (
+	"encoding/base32"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+	"github.com/levigross/grequests"
+	"github.com/stretchr/testify/assert"
+)
+
+func loginWithTOTP(userdata map[string]string, code string) *grequests.Response {
+	resp, _ := grequests.Post(ts.URL+"/account/login", &grequests.RequestOptions{
+		JSON:    userdata,
+		Headers: map[string]string{headerTOTPCode: code},
+	})
+	return resp
+}
+
+func TestTOTP(t *testing.T) {
+	clearDatastore()
+	createAdmin()
+	cookie := loginUser(adminLoginDetails)
+
+	totpRequest := func(method, path string, body map[string]string) *grequests.Response {
+		resp, _ := grequests.DoRegularRequest(method, ts.URL+"/auth/account/totp"+path, &grequests.RequestOptions{
+			Cookies: []*http.Cookie{cookie},
+			JSON:    body,
+		})
+		return resp
+	}
+
+	password := map[string]string{"password": adminLoginDetails["password"]}
+	assert.Equal(t, http.StatusBadRequest, totpRequest("POST", "/confirm", map[string]string{"code": "123456"}).StatusCode)
+	assert.Equal(t, http.StatusForbidden, totpRequest("POST", "", map[string]string{"password": "wrong password"}).StatusCode)
+
+	var enrollment totpEnrollment
+	resp := totpRequest("POST", "", password)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, resp.JSON(&enrollment))
+	assert.Contains(t, enrollment.URI, "otpauth://totp/")
+
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	assert.Nil(t, err)
+
+	// until a code is confirmed, logging in doesn't need one
+	assert.NotEmpty(t, loginUser(adminLoginDetails).Value)
+
+	step := crypto.TOTPStep(time.Now())
+	assert.Equal(t, http.StatusBadRequest, totpRequest("POST", "/confirm", map[string]string{"code": "000000"}).StatusCode)
+
+	var backup struct {
+		Codes []string `json:"backup_codes"`
+	}
+
+	resp = totpRequest("POST", "/confirm", map[string]string{"code": crypto.TOTP(secret, step-1)})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, resp.JSON(&backup))
+	assert.Len(t, backup.Codes, totpBackupCodes)
+
+	resp = loginWithTOTP(adminLoginDetails, "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, resp.String(), errTOTPRequired)
+
+	assert.Equal(t, http.StatusUnauthorized, loginWithTOTP(adminLoginDetails, "000000").StatusCode)
+	assert.Equal(t, http.StatusOK, loginWithTOTP(adminLoginDetails, crypto.TOTP(secret, step)).StatusCode)
+
+	// each code logs in once
+	assert.Equal(t, http.StatusUnauthorized, loginWithTOTP(adminLoginDetails, crypto.TOTP(secret, step)).StatusCode)
+
+	assert.Equal(t, http.StatusOK, loginWithTOTP(adminLoginDetails, backup.Codes[0]).StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, loginWithTOTP(adminLoginDetails, backup.Codes[0]).StatusCode)
+	assert.Equal(t, http.StatusOK, loginWithTOTP(adminLoginDetails, backup.Codes[1]).StatusCode)
+
+	// the code still reads the secret once the keys are rotated
+	assert.Equal(t, http.StatusAccepted, rotateKeys(cookie, adminLoginDetails["password"]).StatusCode)
+	waitForKeyRotation(t, cookie)
+	assert.Equal(t, http.StatusOK, loginWithTOTP(adminLoginDetails, crypto.TOTP(secret, step+1)).StatusCode)
+
+	assert.Equal(t, http.StatusNoContent, totpRequest("DELETE", "", password).StatusCode)
+	assert.NotEmpty(t, loginUser(adminLoginDetails).Value)
+}
@@ -0,0 +1,648 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+	"github.com/gin-gonic/gin"
+	"github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Resumable uploads follow the tus protocol (https://tus.io/protocols/resumable-upload),
+// with the creation, termination and expiration extensions. Every PATCH is
+// encrypted into its own object, see gc.Upload, and the objects are composed
+// into the file once the upload is complete.
+const (
+	tusVersion     = "1.0.0"
+	tusExtensions  = "creation,termination,expiration"
+	tusContentType = "application/offset+octet-stream"
+
+	// uploadTTL is how long an upload may take, incomplete uploads are
+	// removed afterwards.
+	uploadTTL = 24 * time.Hour
+)
+
+const (
+	errorTusVersion          = "unsupported tus version"
+	errorInvalidUploadLength = "invalid Upload-Length"
+	errorInvalidUploadOffset = "invalid Upload-Offset"
+	errorInvalidUploadMeta   = "invalid Upload-Metadata, a filename is required"
+	errorTusContentType      = "Content-Type must be " + tusContentType
+	errorUploadLocked        = "upload is being written by another request"
+	errorUploadOffset        = "Upload-Offset doesn't match the upload"
+	errorUploadTooLarge      = "request body is longer than the rest of the upload"
+	errorUploadFailed        = "upload failed and can't be resumed, start it again"
+)
+
+// uploadMetadata is what the client sent in Upload-Metadata, it's stored
+// encrypted until the file entry is created.
+type uploadMetadata struct {
+	Filename    string   `json:"filename"`
+	FileType    string   `json:"filetype"`
+	VirtFolder  string   `json:"virtfolder"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+
+	StorageClass string `json:"-"`
+}
+
+// uploadLocks makes sure only one request at a time writes to an upload, a
+// second one is turned away instead of waiting.
+type uploadLocks struct {
+	mu     sync.Mutex
+	locked map[string]bool
+}
+
+func (l *uploadLocks) lock(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.locked[id] {
+		return false
+	}
+
+	l.locked[id] = true
+	return true
+}
+
+func (l *uploadLocks) unlock(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.locked, id)
+}
+
+// tusResumable rejects requests for other protocol versions.
+func tusResumable(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{"status": errorTusVersion})
+	}
+}
+
+// tusOptions is how clients discover the versions and extensions, it doesn't
+// need a session.
+func tusOptions(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	c.Status(http.StatusNoContent)
+}
+
+func tusErrorStatus(err error) int {
+	switch err.Error() {
+	case errorInvalidUploadLength, errorInvalidUploadOffset, errorInvalidUploadMeta:
+		return http.StatusBadRequest
+	case errorTusContentType:
+		return http.StatusUnsupportedMediaType
+	case errorUploadTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case errorUploadLocked:
+		return http.StatusLocked
+	case errZeroKnowledge, errTokenFolder:
+		return http.StatusForbidden
+	case errorUploadOffset, gc.ErrorUploadConflict, errorFileIsDuplicate:
+		return http.StatusConflict
+	case gc.ErrorNoDatabaseEntryFound:
+		return http.StatusNotFound
+	case errorUploadFailed:
+		return http.StatusGone
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func setUploadHeaders(c *gin.Context, u *gc.Upload) {
+	c.Header("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	c.Header("Upload-Expires", u.CreatedDate.Add(uploadTTL).UTC().Format(http.TimeFormat))
+}
+
+// parseUploadMetadata parses comma separated "key base64(value)" pairs.
+func parseUploadMetadata(header string) (*uploadMetadata, error) {
+	values := make(map[string]string)
+
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+
+		if len(fields) == 0 || len(fields) > 2 {
+			continue
+		}
+
+		var value []byte
+		if len(fields) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, errors.New(errorInvalidUploadMeta)
+			}
+			value = decoded
+		}
+
+		values[fields[0]] = string(value)
+	}
+
+	meta := &uploadMetadata{
+		Filename:    values["filename"],
+		FileType:    values["filetype"],
+		VirtFolder:  values["virtfolder"],
+		Description: values["description"],
+
+		StorageClass: strings.ToUpper(values["storage_class"]),
+	}
+
+	if len(meta.Filename) == 0 {
+		return nil, errors.New(errorInvalidUploadMeta)
+	}
+
+	if len(meta.FileType) == 0 {
+		meta.FileType = "application/octet-stream"
+	}
+
+	for _, tag := range strings.Split(values["tags"], ",") {
+		tag := strings.ToLower(strings.TrimSpace(tag))
+		if len(tag) > 0 {
+			meta.Tags = append(meta.Tags, tag)
+		}
+	}
+
+	return meta, nil
+}
+
+func (user *userData) createUpload(c *gin.Context) error {
+	// the parts are encrypted by the server
+	if user.userEntry.ZeroKnowledge {
+		return errors.New(errZeroKnowledge)
+	}
+
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+
+	if err != nil || length < 0 {
+		return errors.New(errorInvalidUploadLength)
+	}
+
+	meta, err := parseUploadMetadata(c.GetHeader("Upload-Metadata"))
+
+	if err != nil {
+		return err
+	}
+
+	// the same check is done once the upload completes, but there is no
+	// point in accepting the data if the file can't be created
+	folder := normalizeFolder(filepath.Join(meta.VirtFolder, filepath.Dir(meta.Filename)))
+	if err := user.checkTokenFolder(folder); err != nil {
+		return err
+	}
+
+	if user.isFileDuplicate(folder, filepath.Base(meta.Filename)) {
+		return errors.New(errorFileIsDuplicate)
+	}
+
+	header, err := crypto.NewStreamHeader(crypto.StreamCipherAES256GCM, crypto.DefaultSegmentSize)
+
+	if err != nil {
+		return err
+	}
+
+	hashState, err := sha256.New().(encoding.BinaryMarshaler).MarshalBinary()
+
+	if err != nil {
+		return err
+	}
+
+	encodedMeta, err := json.Marshal(meta)
+
+	if err != nil {
+		return err
+	}
+
+	master, generation := user.currentMasterKey()
+
+	u := &gc.Upload{
+		ID:            uuid.NewV4().String(),
+		Username:      user.userEntry.Username,
+		Length:        length,
+		CreatedDate:   time.Now(),
+		Object:        uuid.NewV4().String(),
+		StorageClass:  meta.StorageClass,
+		Header:        header,
+		KeyGeneration: generation,
+		FormatVersion: gc.FileFormatVersion,
+	}
+
+	if _, u.DataKey, err = uploadFieldKey(master, u, crypto.PurposeDataKey).NewDataKey(); err != nil {
+		return err
+	}
+
+	state := uploadStateKey(master, u)
+
+	for _, field := range []struct {
+		dst       *[]byte
+		plaintext []byte
+	}{{&u.Pending, nil}, {&u.HashState, hashState}, {&u.Metadata, encodedMeta}} {
+		if *field.dst, err = state.EncryptText(field.plaintext); err != nil {
+			return err
+		}
+	}
+
+	// the header is the first part, the data follows in the parts written
+	// by each PATCH
+	if err := user.writeUploadPart(u.ID, 0, header); err != nil {
+		return err
+	}
+	u.Parts = 1
+
+	if err := user.server.uploads.AddUpload(u); err != nil {
+		user.server.removeUploadParts(u)
+		return err
+	}
+
+	// an empty file is complete as soon as it's created
+	if length == 0 {
+		if err := user.appendUpload(u, strings.NewReader("")); err != nil {
+			return err
+		}
+	}
+
+	c.Header("Location", "/auth/upload/"+u.ID)
+	setUploadHeaders(c, u)
+	c.Status(http.StatusCreated)
+	return nil
+}
+
+func (user *userData) writeUploadPart(id string, n int64, data []byte) error {
+	w, err := user.server.storage.Put(context.Background(), gc.UploadPartName(id, n), nil)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+// getUpload returns an upload of the user which hasn't expired yet.
+func (user *userData) getUpload(id string) (*gc.Upload, error) {
+	u, err := user.server.uploads.GetUpload(user.userEntry.Username, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Since(u.CreatedDate) > uploadTTL {
+		return nil, errors.New(gc.ErrorNoDatabaseEntryFound)
+	}
+
+	return u, nil
+}
+
+func (user *userData) uploadStatus(c *gin.Context, id string) error {
+	u, err := user.getUpload(id)
+
+	if err != nil {
+		return err
+	}
+
+	c.Header("Upload-Length", strconv.FormatInt(u.Length, 10))
+	c.Header("Cache-Control", "no-store")
+	setUploadHeaders(c, u)
+	c.Status(http.StatusOK)
+	return nil
+}
+
+func (user *userData) patchUpload(c *gin.Context, id string) error {
+	if c.ContentType() != tusContentType {
+		return errors.New(errorTusContentType)
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+
+	if err != nil || offset < 0 {
+		return errors.New(errorInvalidUploadOffset)
+	}
+
+	if !user.server.uploadLocks.lock(id) {
+		return errors.New(errorUploadLocked)
+	}
+	defer user.server.uploadLocks.unlock(id)
+
+	u, err := user.getUpload(id)
+
+	if err != nil {
+		return err
+	}
+
+	if offset != u.Offset {
+		return errors.New(errorUploadOffset)
+	}
+
+	if c.Request.ContentLength > u.Length-u.Offset {
+		return errors.New(errorUploadTooLarge)
+	}
+
+	if err := user.appendUpload(u, c.Request.Body); err != nil {
+		return err
+	}
+
+	setUploadHeaders(c, u)
+	c.Status(http.StatusNoContent)
+	return nil
+}
+
+// bodyReader remembers the error of the client's request body, so it can be
+// told apart from a storage error.
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// uploadStateKey returns the key encrypting the progress and metadata of u,
+// given master, the user's key of its generation.
+func uploadStateKey(master *crypto.CryptoData, u *gc.Upload) *crypto.CryptoData {
+	if u.FormatVersion >= gc.FileFormatSubkeys {
+		return master.Subkey(crypto.PurposeUpload, u.FormatVersion)
+	}
+	return master
+}
+
+// appendUpload encrypts body into the next part of u and saves the progress,
+// completing the upload once all of it has been received. If the client goes
+// away halfway, what was received so far is kept. A body longer than the rest
+// of the upload is refused, none of it is kept. If the progress can't be
+// saved the upload is removed.
+func (user *userData) appendUpload(u *gc.Upload, body io.Reader) error {
+	var pending, hashState []byte
+
+	master, err := user.masterKey(u.KeyGeneration)
+
+	if err != nil {
+		return err
+	}
+
+	state := uploadStateKey(master, u)
+
+	if pending, err = state.DecryptText(u.Pending); err != nil {
+		return err
+	}
+
+	if hashState, err = state.DecryptText(u.HashState); err != nil {
+		return err
+	}
+
+	sha256hash := sha256.New()
+	if err := sha256hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(hashState); err != nil {
+		return err
+	}
+
+	// a part which is never closed is abandoned once ctx is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	part := gc.UploadPartName(u.ID, u.Parts)
+
+	// the part is only there if a request stored it but failed to save its
+	// progress, sealing its segments again would reuse their nonces
+	if _, err := user.server.storage.Stat(ctx, part); err == nil {
+		user.server.removeUpload(u)
+		return errors.New(errorUploadFailed)
+	} else if err.Error() != gc.ErrorBlobNotFound {
+		return err
+	}
+
+	storageWriter, err := user.server.storage.Put(ctx, part, nil)
+
+	if err != nil {
+		return err
+	}
+
+	// the part is discarded unless it's closed
+	closed := false
+	defer func() {
+		if !closed {
+			storageWriter.CloseWithError(errors.New("upload aborted"))
+		}
+	}()
+
+	dataKey, err := uploadFieldKey(master, u, crypto.PurposeDataKey).DataKey(u.DataKey)
+
+	if err != nil {
+		return err
+	}
+
+	ew, err := uploadFieldKey(dataKey, u, crypto.PurposeContents).ResumeEncryptWriter(storageWriter, u.Header, u.Segments, pending)
+
+	if err != nil {
+		return err
+	}
+
+	// a byte more than what's left is read to tell a body too long apart
+	remaining := u.Length - u.Offset
+	r := &bodyReader{r: io.LimitReader(body, remaining+1)}
+	written, err := io.Copy(ew, io.TeeReader(r, sha256hash))
+
+	if err != nil && err != r.err {
+		return err
+	} else if err != nil {
+		log.WithFields(log.Fields{"upload": u.ID, "error": err}).Debug("upload interrupted")
+	}
+
+	if written > remaining {
+		return errors.New(errorUploadTooLarge)
+	}
+
+	previousOffset := u.Offset
+	u.Offset += written
+
+	if u.Offset == u.Length {
+		if err := ew.Close(); err != nil {
+			return err
+		}
+	}
+
+	closed = true
+	if err := storageWriter.Close(); err != nil {
+		return err
+	}
+
+	if hashState, err = sha256hash.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+		return err
+	}
+
+	if u.Pending, err = state.EncryptText(ew.Pending()); err != nil {
+		return err
+	}
+
+	if u.HashState, err = state.EncryptText(hashState); err != nil {
+		return err
+	}
+
+	u.Parts++
+	u.Segments = ew.Segments()
+
+	if err := user.server.uploads.UpdateUpload(u, previousOffset); err != nil {
+		// the segments of the part were sealed under counters which are
+		// still free in the saved progress, or another server wrote to the
+		// upload at the same time and its part may have been overwritten by
+		// this one, either way the upload can't continue
+		user.server.removeUpload(u)
+		return err
+	}
+
+	if u.Offset < u.Length {
+		return nil
+	}
+
+	return user.completeUpload(u, fmt.Sprintf("%x", sha256hash.Sum(nil)))
+}
+
+// completeUpload composes the parts of u into its object and adds the file.
+// The upload is removed whether or not that succeeds, a failure here can't be
+// fixed by sending the data again.
+func (user *userData) completeUpload(u *gc.Upload, sha2 string) error {
+	defer user.server.removeUpload(u)
+
+	master, err := user.masterKey(u.KeyGeneration)
+
+	if err != nil {
+		return err
+	}
+
+	state := uploadStateKey(master, u)
+
+	encodedMeta, err := state.DecryptText(u.Metadata)
+
+	if err != nil {
+		return err
+	}
+
+	var meta uploadMetadata
+	if err := json.Unmarshal(encodedMeta, &meta); err != nil {
+		return err
+	}
+
+	parts := make([]string, u.Parts)
+	for n := range parts {
+		parts[n] = gc.UploadPartName(u.ID, int64(n))
+	}
+
+	// files of users with public keys are composed into the next part, which
+	// is removed with the others, and encrypted to the keys from there
+	publicKeyEncrypted := len(user.userEntry.PublicKeys) > 0
+	composed := u.Object
+	if publicKeyEncrypted {
+		composed = gc.UploadPartName(u.ID, u.Parts)
+	}
+
+	ctx := context.Background()
+	if err := user.server.storage.Compose(ctx, composed, parts, &gc.PutOptions{StorageClass: u.StorageClass}); err != nil {
+		return err
+	}
+
+	if publicKeyEncrypted {
+		if err := user.encryptUploadToPublicKeys(u, composed); err != nil {
+			return err
+		}
+	}
+
+	file := &uploadedFile{
+		fileID:        u.Object,
+		contentType:   meta.FileType,
+		sha2:          sha2,
+		fileSize:      u.Length,
+		fileName:      meta.Filename,
+		dataKey:       u.DataKey,
+		keyGeneration: u.KeyGeneration,
+		formatVersion: u.FormatVersion,
+
+		publicKeyEncrypted: publicKeyEncrypted,
+	}
+
+	if err := user.createFileEntry(file, meta.Description, meta.VirtFolder, "", meta.Tags); err != nil {
+		user.server.storage.Delete(ctx, u.Object)
+		return err
+	}
+
+	return nil
+}
+
+func (user *userData) deleteUpload(id string) error {
+	if !user.server.uploadLocks.lock(id) {
+		return errors.New(errorUploadLocked)
+	}
+	defer user.server.uploadLocks.unlock(id)
+
+	u, err := user.server.uploads.GetUpload(user.userEntry.Username, id)
+
+	if err != nil {
+		return err
+	}
+
+	return user.server.removeUpload(u)
+}
+
+// removeUploadParts deletes the parts of u, including one which may have been
+// left behind by a request that failed before saving its progress.
+func (s *Server) removeUploadParts(u *gc.Upload) {
+	ctx := context.Background()
+
+	for n := int64(0); n <= u.Parts; n++ {
+		if err := s.storage.Delete(ctx, gc.UploadPartName(u.ID, n)); err != nil && err.Error() != gc.ErrorBlobNotFound {
+			log.WithFields(log.Fields{"upload": u.ID, "part": n, "error": err}).Warn("failed to delete upload part")
+		}
+	}
+}
+
+func (s *Server) removeUpload(u *gc.Upload) error {
+	s.removeUploadParts(u)
+	return s.uploads.DeleteUpload(u.Username, u.ID)
+}
+
+// removeExpiredUploads removes the uploads which weren't completed in time.
+func (s *Server) removeExpiredUploads() error {
+	uploads, err := s.uploads.ListUploads(time.Now().Add(-uploadTTL))
+
+	if err != nil {
+		return err
+	}
+
+	for _, u := range uploads {
+		if !s.uploadLocks.lock(u.ID) {
+			continue
+		}
+
+		if err := s.removeUpload(u); err != nil {
+			log.WithFields(log.Fields{"upload": u.ID, "error": err}).Warn("failed to remove expired upload")
+		}
+
+		s.uploadLocks.unlock(u.ID)
+	}
+
+	return nil
+}
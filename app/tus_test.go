@@ -0,0 +1,303 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+	"github.com/levigross/grequests"
+	"github.com/stretchr/testify/assert"
+)
+
+func tusMetadata(filename string) string {
+	return "filename " + base64.StdEncoding.EncodeToString([]byte(filename)) +
+		",tags " + base64.StdEncoding.EncodeToString([]byte("Resumed, tus"))
+}
+
+func tusRequest(method, url string, cookie *http.Cookie, headers map[string]string, body []byte) *grequests.Response {
+	allHeaders := map[string]string{"Tus-Resumable": tusVersion}
+	for k, v := range headers {
+		allHeaders[k] = v
+	}
+
+	ro := &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}, Headers: allHeaders}
+	if body != nil {
+		ro.RequestBody = bytes.NewReader(body)
+	}
+
+	resp, _ := grequests.Req(method, url, ro)
+	return resp
+}
+
+func createTusUpload(t *testing.T, cookie *http.Cookie, filename string, length int) string {
+	resp := tusRequest("POST", ts.URL+"/auth/upload/", cookie, map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": tusMetadata(filename),
+	}, nil)
+
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "0", resp.Header.Get("Upload-Offset"))
+	assert.NotEmpty(t, resp.Header.Get("Upload-Expires"))
+
+	return ts.URL + resp.Header.Get("Location")
+}
+
+func patchTusUpload(uploadURL string, cookie *http.Cookie, offset int, data []byte) *grequests.Response {
+	return tusRequest("PATCH", uploadURL, cookie, map[string]string{
+		"Content-Type":  tusContentType,
+		"Upload-Offset": strconv.Itoa(offset),
+	}, data)
+}
+
+func assertNoUploadParts(t *testing.T) {
+	parts, err := testServer.storage.List(context.Background(), "upload-")
+	assert.Nil(t, err)
+	assert.Empty(t, parts)
+}
+
+func TestTusResumedUpload(t *testing.T) {
+	clearDatastore()
+	clearBucket()
+	createAdmin()
+	cookie := loginUser(adminLoginDetails)
+
+	resp, err := grequests.Options(ts.URL+"/auth/upload/", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, tusVersion, resp.Header.Get("Tus-Version"))
+	assert.Equal(t, tusExtensions, resp.Header.Get("Tus-Extension"))
+
+	resp, err = grequests.Post(ts.URL+"/auth/upload/", &grequests.RequestOptions{Cookies: []*http.Cookie{cookie},
+		Headers: map[string]string{"Upload-Length": "1", "Upload-Metadata": tusMetadata("tusfile")}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	resp = tusRequest("POST", ts.URL+"/auth/upload/", cookie, map[string]string{"Upload-Length": "1"}, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	contents, _ := crypto.RandomBytes(3*crypto.DefaultSegmentSize + 100)
+	uploadURL := createTusUpload(t, cookie, "tusfile", len(contents))
+
+	type testCase struct {
+		offset             int
+		data               []byte
+		expectedHTTPStatus int
+		expectedOffset     int
+	}
+
+	// the first request stops in the middle of a segment, as if the
+	// connection dropped, and the client resumes from the offset it's sent
+	tests := []testCase{
+		testCase{0, contents[:70000], http.StatusNoContent, 70000},
+		testCase{0, contents[:10], http.StatusConflict, 70000},
+		testCase{70001, contents[70001:70010], http.StatusConflict, 70000},
+		testCase{70000, contents[70000:150000], http.StatusNoContent, 150000},
+	}
+
+	for _, test := range tests {
+		resp := patchTusUpload(uploadURL, cookie, test.offset, test.data)
+		assert.Equal(t, test.expectedHTTPStatus, resp.StatusCode)
+
+		resp = tusRequest("HEAD", uploadURL, cookie, nil, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, strconv.Itoa(test.expectedOffset), resp.Header.Get("Upload-Offset"))
+		assert.Equal(t, strconv.Itoa(len(contents)), resp.Header.Get("Upload-Length"))
+		assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+	}
+
+	resp = tusRequest("PATCH", uploadURL, cookie, map[string]string{"Upload-Offset": "150000"}, contents[150000:])
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+
+	resp = patchTusUpload(uploadURL, cookie, 150000, contents[150000:])
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, strconv.Itoa(len(contents)), resp.Header.Get("Upload-Offset"))
+
+	// a completed upload is gone, it's a file now
+	resp = tusRequest("HEAD", uploadURL, cookie, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assertNoUploadParts(t)
+
+	fsObjects := getAllFSObjectsUsingAPI("/", cookie)
+	assert.Len(t, fsObjects, 1)
+	assert.Equal(t, "tusfile", fsObjects[0].Name)
+
+	file, err := testServer.files.GetFile(adminLoginDetails["username"], int64(fsObjects[0].ID))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, file.DataKey)
+
+	resp, err = grequests.Get(ts.URL+"/auth/file/"+strconv.Itoa(fsObjects[0].ID), &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, fmt.Sprintf("\"%x\"", sha256.Sum256(contents)), resp.Header.Get("ETag"))
+	assert.True(t, bytes.Equal(contents, resp.Bytes()), "downloaded file differs from upload")
+
+	// uploading the same file again is refused before any data is sent
+	resp = tusRequest("POST", ts.URL+"/auth/upload/", cookie, map[string]string{
+		"Upload-Length":   strconv.Itoa(len(contents)),
+		"Upload-Metadata": tusMetadata("tusfile"),
+	}, nil)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+}
+
+func TestTusUploadTooLarge(t *testing.T) {
+	clearDatastore()
+	createAdmin()
+	cookie := loginUser(adminLoginDetails)
+
+	// parts of the local backend are written to temporary files first, none
+	// of them may be left behind
+	dir := t.TempDir()
+	storage, err := gc.OpenBlobStore(&gc.Config{StorageBackend: gc.StorageBackendLocal, LocalStoragePath: dir})
+	assert.Nil(t, err)
+
+	other, err := NewServerWithBackends(testServer.config, testServer.files.(gc.Database), storage, testServer.sessions)
+	assert.Nil(t, err)
+
+	otherTS := httptest.NewServer(other)
+	defer otherTS.Close()
+
+	contents, _ := crypto.RandomBytes(1000)
+	resp := tusRequest("POST", otherTS.URL+"/auth/upload/", cookie, map[string]string{
+		"Upload-Length":   strconv.Itoa(len(contents)),
+		"Upload-Metadata": tusMetadata("toolarge"),
+	}, nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	id := strings.TrimPrefix(resp.Header.Get("Location"), "/auth/upload/")
+	uploadURL := otherTS.URL + resp.Header.Get("Location")
+
+	// refused up front when the length of the body is known, or once more
+	// than the rest of the upload was read
+	resp = patchTusUpload(uploadURL, cookie, 0, append(contents, 'x'))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	resp, err = grequests.Req("PATCH", uploadURL, &grequests.RequestOptions{
+		Cookies:     []*http.Cookie{cookie},
+		Headers:     map[string]string{"Tus-Resumable": tusVersion, "Content-Type": tusContentType, "Upload-Offset": "0"},
+		RequestBody: ioutil.NopCloser(bytes.NewReader(append(contents, 'x'))),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	resp = tusRequest("HEAD", uploadURL, cookie, nil, nil)
+	assert.Equal(t, "0", resp.Header.Get("Upload-Offset"))
+
+	// only the header written when the upload was created is stored
+	entries, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, gc.UploadPartName(id, 0), entries[0].Name())
+	}
+
+	resp = patchTusUpload(uploadURL, cookie, 0, contents)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
+
+// failingUploadDB fails to save the progress of uploads while fail is set.
+type failingUploadDB struct {
+	gc.Database
+	fail bool
+}
+
+func (db *failingUploadDB) UpdateUpload(u *gc.Upload, offset int64) error {
+	if db.fail {
+		return errors.New("database unavailable")
+	}
+	return db.Database.UpdateUpload(u, offset)
+}
+
+func TestTusUploadProgressNotSaved(t *testing.T) {
+	clearDatastore()
+	clearBucket()
+	createAdmin()
+	cookie := loginUser(adminLoginDetails)
+
+	db := &failingUploadDB{Database: testServer.files.(gc.Database), fail: true}
+	other, err := NewServerWithBackends(testServer.config, db, testServer.storage, testServer.sessions)
+	assert.Nil(t, err)
+
+	otherTS := httptest.NewServer(other)
+	defer otherTS.Close()
+
+	contents, _ := crypto.RandomBytes(1000)
+
+	// the segments stored can't be sealed again, so the upload is removed
+	uploadURL := createTusUpload(t, cookie, "unsaved", len(contents))
+	resp := patchTusUpload(strings.Replace(uploadURL, ts.URL, otherTS.URL, 1), cookie, 0, contents[:500])
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+	resp = tusRequest("HEAD", uploadURL, cookie, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assertNoUploadParts(t)
+
+	// a part left behind by such a request stops the upload too, even when
+	// removing the upload failed
+	uploadURL = createTusUpload(t, cookie, "unsaved", len(contents))
+	id := uploadURL[strings.LastIndex(uploadURL, "/")+1:]
+
+	w, err := testServer.storage.Put(context.Background(), gc.UploadPartName(id, 1), nil)
+	assert.Nil(t, err)
+	w.Write([]byte("sealed segments"))
+	assert.Nil(t, w.Close())
+
+	resp = patchTusUpload(uploadURL, cookie, 0, contents[:500])
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+
+	resp = tusRequest("HEAD", uploadURL, cookie, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assertNoUploadParts(t)
+}
+
+func TestTusTerminateUpload(t *testing.T) {
+	clearDatastore()
+	clearBucket()
+	createAdmin()
+	createNormalUser()
+	adminCookie := loginUser(adminLoginDetails)
+	enableUser(normalUserLoginDetails, *adminCookie)
+	userCookie := loginUser(normalUserLoginDetails)
+
+	contents, _ := crypto.RandomBytes(1000)
+	uploadURL := createTusUpload(t, adminCookie, "terminated", len(contents))
+
+	resp := patchTusUpload(uploadURL, adminCookie, 0, contents[:500])
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	// uploads are private to their user
+	for _, method := range []string{"HEAD", "PATCH", "DELETE"} {
+		resp := tusRequest(method, uploadURL, userCookie, map[string]string{
+			"Content-Type":  tusContentType,
+			"Upload-Offset": "500",
+		}, nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, method)
+	}
+
+	resp = tusRequest("DELETE", uploadURL, adminCookie, nil, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = tusRequest("HEAD", uploadURL, adminCookie, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = tusRequest("DELETE", uploadURL, adminCookie, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	assertNoUploadParts(t)
+	assert.Empty(t, getAllFSObjectsUsingAPI("/", adminCookie))
+
+	// an empty upload completes as soon as it's created
+	createTusUpload(t, adminCookie, "empty", 0)
+	fsObjects := getAllFSObjectsUsingAPI("/", adminCookie)
+	assert.Len(t, fsObjects, 1)
+	assert.Equal(t, "empty", fsObjects[0].Name)
+	assertNoUploadParts(t)
+}
@@ -1,7 +1,6 @@
-package main
+package app
 
 import (
-	"bufio"
 	"context"
 	"crypto/sha256"
 	"errors"
@@ -13,11 +12,10 @@ import (
 	"strings"
 	"time"
 
-	"cloud.google.com/go/storage"
 	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
 	"github.com/gin-gonic/gin"
 	"github.com/satori/go.uuid"
-	"gopkg.in/h2non/filetype.v1"
 )
 
 const (
@@ -28,83 +26,144 @@ type uploadedFile struct {
 	fileID      string
 	contentType string
 	sha2        string
-	compressed  bool
 	fileSize    int64
 	fileName    string
+
+	// dataKey is the key the object was encrypted with, wrapped by the
+	// user's key of keyGeneration
+	dataKey       []byte
+	keyGeneration int
+	formatVersion int
+
+	// set when the object is encrypted to the user's public keys
+	publicKeyEncrypted bool
+
+	// set instead of fileName by zero-knowledge accounts
+	encryptedFileName []byte
+	fileNameHMAC      string
+	metadata          []byte
 }
 
 func (user *userData) isFileDuplicate(plaintextFolder, plaintextFilename string) bool {
 	fullPath := []byte(plaintextFolder + plaintextFilename)
 	hmac := user.cryptoData.GenerateHMAC(fullPath)
-	return gc.FileStructDB.FilenameHMACExists(user.userEntry.Username, hmac)
+
+	if user.server.files.FilenameHMACExists(user.userEntry.Username, hmac) {
+		return true
+	}
+
+	// while the keys are rotated, the file may have the HMAC of the next key
+	if user.nextCryptoData != nil {
+		hmac = user.nextCryptoData.GenerateHMAC(fullPath)
+		return user.server.files.FilenameHMACExists(user.userEntry.Username, hmac)
+	}
+	return false
 }
 
-func (user *userData) doUpload(fileReader io.Reader, storageClass string) (string, int64, string, bool, error) {
-	ctx := context.Background()
+// doUpload encrypts fileReader into a new object, to the user's public keys
+// if they registered any. The name and content type of the returned file are
+// left for the caller.
+func (user *userData) doUpload(fileReader io.Reader, storageClass string) (*uploadedFile, error) {
+	// an upload which is never closed is abandoned once ctx is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	sha256hash := sha256.New()
 
+	username := user.userEntry.Username
 	filename := uuid.NewV4().String()
-	googleStorageWrite := gc.StorageBucket.Object(filename).NewWriter(ctx)
-	googleStorageWrite.ACL = []storage.ACLRule{{Entity: storage.AllAuthenticatedUsers, Role: storage.RoleReader}}
-	googleStorageWrite.ContentType = "octet/stream"
-	googleStorageWrite.CacheControl = "public, max-age=86400"
-	googleStorageWrite.StorageClass = storageClass
-
-	compressable := true
-	fileBuffer := bufio.NewReader(fileReader)
-
-	if peek, _ := fileBuffer.Peek(512); len(peek) > 0 {
-		if kind, err := filetype.Match(peek); err == nil {
-			switch kind.MIME.Type {
-			case "image", "video", "audio":
-				compressable = false
-			}
-		}
+
+	master, generation := user.currentMasterKey()
+	master = fieldKey(master, username, filename, gc.FileFormatVersion, crypto.PurposeDataKey)
+	dataKey, wrappedDataKey, err := master.NewDataKey()
+
+	if err != nil {
+		return nil, err
+	}
+
+	storageWriter, err := user.server.storage.Put(ctx, filename, &gc.PutOptions{StorageClass: storageClass})
+
+	if err != nil {
+		return nil, err
 	}
 
-	r := io.TeeReader(fileBuffer, sha256hash)
-	w := io.MultiWriter(googleStorageWrite)
+	r := io.TeeReader(fileReader, sha256hash)
+	publicKeys := user.userEntry.PublicKeys
+	var written int64
 
-	written, err := user.cryptoData.EncryptFile(r, w, compressable)
+	if len(publicKeys) > 0 {
+		written, err = crypto.EncryptToPublicKeys(r, storageWriter, publicKeys)
+	} else {
+		dataKey = fieldKey(dataKey, username, filename, gc.FileFormatVersion, crypto.PurposeContents)
+		written, err = dataKey.EncryptStream(r, storageWriter)
+	}
 
 	if err != nil {
-		return "", 0, "", compressable, err
+		return nil, err
 	}
 
-	if err := googleStorageWrite.Close(); err != nil {
-		return "", 0, "", compressable, err
+	if err := storageWriter.Close(); err != nil {
+		return nil, err
 	}
 
-	return filename, written, fmt.Sprintf("%x", sha256hash.Sum(nil)), compressable, nil
+	return &uploadedFile{
+		fileID:        filename,
+		sha2:          fmt.Sprintf("%x", sha256hash.Sum(nil)),
+		fileSize:      written,
+		dataKey:       wrappedDataKey,
+		keyGeneration: generation,
+		formatVersion: gc.FileFormatVersion,
+
+		publicKeyEncrypted: len(publicKeys) > 0,
+	}, nil
 }
 
 func (user *userData) createFileEntry(file *uploadedFile, desc, virtualFolder, title string, tags []string) error {
 	folder := normalizeFolder(filepath.Join(virtualFolder, filepath.Dir(file.fileName)))
 	_, filename := filepath.Split(file.fileName)
 
-	if encryptedFilename, err := user.cryptoData.EncryptText([]byte(filename)); err != nil {
+	if err := user.checkTokenFolder(folder); err != nil {
+		return err
+	}
+
+	master, err := user.masterKey(file.keyGeneration)
+
+	if err != nil {
+		return err
+	}
+
+	newFile := &gc.File{
+		Username:           user.userEntry.Username,
+		UploadDate:         time.Now(),
+		SHA2:               file.sha2,
+		FilenameHMAC:       master.GenerateHMAC([]byte(folder + filename)),
+		GoogleCloudObject:  file.fileID,
+		DataKey:            file.dataKey,
+		KeyGeneration:      file.keyGeneration,
+		FormatVersion:      file.formatVersion,
+		PublicKeyEncrypted: file.publicKeyEncrypted}
+
+	dataKey, err := fileFieldKey(master, newFile, crypto.PurposeDataKey).DataKey(file.dataKey)
+
+	if err != nil {
+		return err
+	}
+
+	if newFile.Filename, err = fileFieldKey(dataKey, newFile, crypto.PurposeFilename).EncryptText([]byte(filename)); err != nil {
 		return err
 	} else {
-		newFile := &gc.File{
-			Username:          user.userEntry.Username,
-			UploadDate:        time.Now(),
-			SHA2:              file.sha2,
-			Folder:            folder,
-			Filename:          encryptedFilename,
-			FilenameHMAC:      user.cryptoData.GenerateHMAC([]byte(folder + filename)),
-			GoogleCloudObject: file.fileID,
-			FileSize:          file.fileSize,
-			FileType:          file.contentType,
-			Description:       desc,
-			Compressed:        file.compressed,
-			Tags:              tags}
+		metadata := &crypto.FileMetadata{Folder: folder, Description: desc, Tags: tags, FileType: file.contentType, FileSize: file.fileSize}
+
+		if err := setFileMetadata(newFile, metadata, master, dataKey); err != nil {
+			return err
+		}
 
 		if !user.isFileDuplicate(folder, filename) {
-			newFileID, err := gc.FileStructDB.AddFile(newFile)
+			newFileID, err := user.server.files.AddFile(newFile)
 			if err != nil {
 				return errors.New("error adding file to database: " + err.Error())
 			} else {
-				if _, err := user.createDirectoryTree(folder); err == nil {
+				if _, err := user.createFolder(master, file.keyGeneration, folder); err == nil {
 					fmt.Println(newFileID)
 				}
 			}
@@ -122,12 +181,32 @@ func (user *userData) processFileUpload(c *gin.Context) error {
 	var description, title, virtfolder, storageClass string
 	var tags []string
 	var uploadedFiles []uploadedFile
+	var encryptedMeta encryptedUploadMeta
 
 	for {
 		p, err := mr.NextPart()
 
 		// only after the entire response is posted do we have access to all form parameters
 		if err == io.EOF {
+			if user.userEntry.ZeroKnowledge {
+				if err := encryptedMeta.apply(uploadedFiles); err != nil {
+					return err
+				}
+
+				folderNames, err := encryptedMeta.decodeFolderNames()
+
+				if err != nil {
+					return err
+				}
+
+				for _, f := range uploadedFiles {
+					if err := user.createEncryptedFileEntry(&f, virtfolder, folderNames, tags); err != nil {
+						return err
+					}
+				}
+				break
+			}
+
 			for _, f := range uploadedFiles {
 				if err := user.createFileEntry(&f, description, virtfolder, title, tags); err != nil {
 					return err
@@ -158,6 +237,10 @@ func (user *userData) processFileUpload(c *gin.Context) error {
 			tmp, _ := ioutil.ReadAll(p)
 			storageClass = strings.ToUpper(string(tmp))
 
+		case "filename", "filename_hmac", "data_key", "metadata", "folder_names":
+			tmp, _ := ioutil.ReadAll(p)
+			encryptedMeta.add(p.FormName(), tmp)
+
 		case "tags":
 			tmp, _ := ioutil.ReadAll(p)
 			unprocessedTags := string(tmp)
@@ -171,17 +254,20 @@ func (user *userData) processFileUpload(c *gin.Context) error {
 		}
 
 		if p.FormName() == "file" && len(fileName) > 0 && len(contentType) > 0 {
-			fileid, filesize, sha2, compressable, err := user.doUpload(p, storageClass)
+			var f *uploadedFile
+
+			if user.userEntry.ZeroKnowledge {
+				f, err = user.storeEncryptedUpload(p, storageClass)
+			} else {
+				f, err = user.doUpload(p, storageClass)
+			}
+
 			if err != nil {
 				return err
 			} else {
-				uploadedFiles = append(uploadedFiles,
-					uploadedFile{fileID: fileid,
-						contentType: contentType,
-						fileSize:    filesize,
-						sha2:        sha2,
-						compressed:  compressable,
-						fileName:    fileName})
+				f.contentType = contentType
+				f.fileName = fileName
+				uploadedFiles = append(uploadedFiles, *f)
 			}
 		}
 
@@ -211,22 +297,44 @@ func normalizeFolder(path string) string {
 	return path
 }
 
+// createFolder creates folder, and the folders it's in, named by master, the
+// user's key of generation.
+func (user *userData) createFolder(master *crypto.CryptoData, generation int, folder string) (int64, error) {
+	names, err := folderNameKey(master, gc.FileFormatVersion).EncryptFolderNames(folder)
+
+	if err != nil {
+		return 0, err
+	}
+	return user.createDirectoryTree(master.FolderIndex(folder), names, generation, gc.FileFormatVersion)
+}
+
 // createDirectoryTree traverses the datastore and creates folders if they don't exist.
-func (user *userData) createDirectoryTree(path string) (int64, error) {
+// path is the blind index of a folder, and names the encrypted names of the
+// folders in it by the user's key of generation, in format version.
+func (user *userData) createDirectoryTree(path string, names [][]byte, generation, version int) (int64, error) {
 	var lastSeenKey int64
 	var lastFolder []string
 
-	for _, pathSegment := range gc.PathToFolderTree(path) {
+	segments := gc.PathToFolderTree(path)
+
+	if len(names) != len(segments) {
+		return 0, errors.New(errorMissingFolderNames)
+	}
+
+	for i, pathSegment := range segments {
 		lastFolder = append(lastFolder, pathSegment.Folder)
 		searchFolder := normalizeFolder(strings.Join(lastFolder, "/"))
 
-		if foundExistingFolder, foundExistingKey, _ := gc.FileStructDB.ListFolders(user.userEntry.Username, searchFolder); foundExistingFolder != nil {
+		if foundExistingFolder, foundExistingKey, _ := user.server.files.ListFolders(user.userEntry.Username, searchFolder); foundExistingFolder != nil {
 			lastSeenKey = foundExistingKey
 		} else {
 			pathSegment.Username = user.userEntry.Username
 			pathSegment.ParentKey = lastSeenKey
 			pathSegment.UploadDate = time.Now()
-			newFolderKey, err := gc.FileStructDB.AddFolder(pathSegment)
+			pathSegment.EncryptedFolder = names[i]
+			pathSegment.KeyGeneration = generation
+			pathSegment.FormatVersion = version
+			newFolderKey, err := user.server.files.AddFolder(pathSegment)
 
 			if err != nil {
 				return 0, err
@@ -0,0 +1,444 @@
+package app
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+)
+
+// Security keys are a second factor like TOTP: a user registers keys with
+// WebAuthn, and once one is registered logging in needs an assertion of it,
+// sent as JSON in the webauthn-assertion header, for a challenge asked for
+// before. Each login asking for a challenge gets an ID of its own, sent back
+// with the assertion, so that logins of the same user don't answer each
+// other's. Admins may require a key, users who don't have one can then only
+// register one after logging in. Keys are only used if the server is
+// configured for them.
+const (
+	errWebAuthnDisabled       = "security keys are not enabled"
+	errWebAuthnRequired       = "security key required"
+	errInvalidWebAuthn        = "security key response is not valid"
+	errWebAuthnNotRegistering = "start registering a security key first"
+	errWebAuthnRegistered     = "security key is already registered"
+	errWebAuthnNotFound       = "security key not found"
+	errWebAuthnLastRequired   = "a security key is required, register another one before removing this one"
+	errWebAuthnMustRegister   = "a security key is required, register one first"
+	headerWebAuthnAssertion   = "webauthn-assertion"
+	webAuthnChallengePrefix   = "webauthn_"
+	webAuthnRegister          = "register_"
+	webAuthnLogin             = "login_"
+	webAuthnTimeout           = time.Minute * 5
+	webAuthnCeremonyIDLength  = 16
+	webAuthnRPName            = "gscrypto"
+	webAuthnCredentialType    = "public-key"
+)
+
+// webAuthnCredential is a security key of UserEntry.WebAuthnCredentials.
+type webAuthnCredential struct {
+	crypto.WebAuthnCredential
+	Name        string    `json:"name"`
+	CreatedDate time.Time `json:"created_date"`
+}
+
+// webAuthnCredentialInfo is what users see of their security keys.
+type webAuthnCredentialInfo struct {
+	ID          []byte    `json:"id"`
+	Name        string    `json:"name"`
+	CreatedDate time.Time `json:"created_date"`
+}
+
+type webAuthnCredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   []byte `json:"id"`
+}
+
+type webAuthnCredentialParameters struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// webAuthnRegistrationOptions are the PublicKeyCredentialCreationOptions
+// navigator.credentials.create is called with, binary fields are base64.
+type webAuthnRegistrationOptions struct {
+	Challenge []byte `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          []byte `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams   []webAuthnCredentialParameters `json:"pubKeyCredParams"`
+	Timeout            int64                          `json:"timeout"`
+	Attestation        string                         `json:"attestation"`
+	ExcludeCredentials []webAuthnCredentialDescriptor `json:"excludeCredentials"`
+}
+
+// webAuthnLoginOptions are the PublicKeyCredentialRequestOptions
+// navigator.credentials.get is called with, which ignores CeremonyID. It
+// identifies the login, and is sent back with the assertion.
+type webAuthnLoginOptions struct {
+	CeremonyID       string                         `json:"ceremony_id"`
+	Challenge        []byte                         `json:"challenge"`
+	RPID             string                         `json:"rpId"`
+	Timeout          int64                          `json:"timeout"`
+	AllowCredentials []webAuthnCredentialDescriptor `json:"allowCredentials"`
+}
+
+// webAuthnRegistration is the response of navigator.credentials.create.
+type webAuthnRegistration struct {
+	Name              string `json:"name"`
+	ClientDataJSON    []byte `json:"client_data_json"`
+	AttestationObject []byte `json:"attestation_object"`
+}
+
+// webAuthnAssertion is the response of navigator.credentials.get, and the
+// ceremony ID of the options it was called with.
+type webAuthnAssertion struct {
+	CeremonyID        string `json:"ceremony_id"`
+	CredentialID      []byte `json:"credential_id"`
+	ClientDataJSON    []byte `json:"client_data_json"`
+	AuthenticatorData []byte `json:"authenticator_data"`
+	Signature         []byte `json:"signature"`
+}
+
+func webAuthnCredentials(userEntry *gc.UserEntry) ([]webAuthnCredential, error) {
+	var credentials []webAuthnCredential
+
+	if len(userEntry.WebAuthnCredentials) == 0 {
+		return nil, nil
+	}
+
+	err := json.Unmarshal(userEntry.WebAuthnCredentials, &credentials)
+	return credentials, err
+}
+
+func setWebAuthnCredentials(userEntry *gc.UserEntry, credentials []webAuthnCredential) error {
+	if len(credentials) == 0 {
+		userEntry.WebAuthnCredentials = nil
+		return nil
+	}
+
+	encoded, err := json.Marshal(credentials)
+
+	if err != nil {
+		return err
+	}
+
+	userEntry.WebAuthnCredentials = encoded
+	return nil
+}
+
+func webAuthnDescriptors(credentials []webAuthnCredential) []webAuthnCredentialDescriptor {
+	descriptors := make([]webAuthnCredentialDescriptor, 0, len(credentials))
+
+	for _, c := range credentials {
+		descriptors = append(descriptors, webAuthnCredentialDescriptor{Type: webAuthnCredentialType, ID: c.ID})
+	}
+	return descriptors
+}
+
+// newWebAuthnChallenge returns a challenge which is kept for key until
+// takeWebAuthnChallenge, by every server sharing the session store.
+func (s *Server) newWebAuthnChallenge(key string) ([]byte, error) {
+	challenge, err := crypto.NewWebAuthnChallenge()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.sessions.SetValue(webAuthnChallengePrefix+key, challenge, webAuthnTimeout); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// takeWebAuthnChallenge returns the challenge kept for key, each is answered
+// once.
+func (s *Server) takeWebAuthnChallenge(key string) []byte {
+	challenge, err := s.sessions.TakeValue(webAuthnChallengePrefix + key)
+
+	if err != nil {
+		return nil
+	}
+	return challenge
+}
+
+// verifiedEntry checks password and returns the user's entry. Security keys
+// don't need the user's keys, so zero-knowledge accounts may use them too.
+func (user *userData) verifiedEntry(password []byte) (*gc.UserEntry, int64, error) {
+	if err := user.server.verifyUserPassword(user.userEntry.Username, password); err != nil {
+		return nil, 0, errors.New(errWrongPassword)
+	}
+
+	return user.server.users.GetUserEntry(user.userEntry.Username)
+}
+
+// startWebAuthnRegistration returns the options to register a security key
+// with.
+func (user *userData) startWebAuthnRegistration(password []byte) (*webAuthnRegistrationOptions, error) {
+	if !user.server.config.WebAuthn {
+		return nil, errors.New(errWebAuthnDisabled)
+	}
+
+	userEntry, _, err := user.verifiedEntry(password)
+
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := webAuthnCredentials(userEntry)
+
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, err := user.server.newWebAuthnChallenge(webAuthnRegister + userEntry.Username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	options := &webAuthnRegistrationOptions{
+		Challenge: challenge,
+		PubKeyCredParams: []webAuthnCredentialParameters{
+			{webAuthnCredentialType, crypto.COSEAlgES256},
+			{webAuthnCredentialType, crypto.COSEAlgRS256},
+		},
+		Timeout:            int64(webAuthnTimeout / time.Millisecond),
+		Attestation:        "none",
+		ExcludeCredentials: webAuthnDescriptors(credentials),
+	}
+	options.RP.ID, options.RP.Name = user.server.config.WebAuthnRPID, webAuthnRPName
+	options.User.ID = []byte(userEntry.Username)
+	options.User.Name, options.User.DisplayName = userEntry.Username, userEntry.Username
+
+	return options, nil
+}
+
+// finishWebAuthnRegistration adds the security key of registration.
+func (user *userData) finishWebAuthnRegistration(registration *webAuthnRegistration) (*webAuthnCredentialInfo, error) {
+	if !user.server.config.WebAuthn {
+		return nil, errors.New(errWebAuthnDisabled)
+	}
+
+	challenge := user.server.takeWebAuthnChallenge(webAuthnRegister + user.userEntry.Username)
+
+	if challenge == nil {
+		return nil, errors.New(errWebAuthnNotRegistering)
+	}
+
+	config := user.server.config
+	credential, err := crypto.VerifyWebAuthnRegistration(registration.ClientDataJSON, registration.AttestationObject, challenge,
+		config.WebAuthnOrigin, config.WebAuthnRPID)
+
+	if err != nil {
+		return nil, errors.New(errInvalidWebAuthn)
+	}
+
+	userEntry, id, err := user.server.users.GetUserEntry(user.userEntry.Username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := webAuthnCredentials(userEntry)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if webAuthnCredentialIndex(credentials, credential.ID) >= 0 {
+		return nil, errors.New(errWebAuthnRegistered)
+	}
+
+	added := webAuthnCredential{WebAuthnCredential: *credential, Name: registration.Name, CreatedDate: time.Now()}
+
+	if err := setWebAuthnCredentials(userEntry, append(credentials, added)); err != nil {
+		return nil, err
+	}
+
+	if err := user.saveUserEntry(id, userEntry); err != nil {
+		return nil, err
+	}
+
+	return &webAuthnCredentialInfo{ID: added.ID, Name: added.Name, CreatedDate: added.CreatedDate}, nil
+}
+
+// webAuthnCredentialList returns the user's security keys.
+func (user *userData) webAuthnCredentialList() ([]webAuthnCredentialInfo, error) {
+	userEntry, _, err := user.server.users.GetUserEntry(user.userEntry.Username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := webAuthnCredentials(userEntry)
+
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]webAuthnCredentialInfo, 0, len(credentials))
+
+	for _, c := range credentials {
+		list = append(list, webAuthnCredentialInfo{ID: c.ID, Name: c.Name, CreatedDate: c.CreatedDate})
+	}
+	return list, nil
+}
+
+// removeWebAuthnCredential removes the user's security key with credentialID.
+func (user *userData) removeWebAuthnCredential(password, credentialID []byte) error {
+	userEntry, id, err := user.verifiedEntry(password)
+
+	if err != nil {
+		return err
+	}
+
+	credentials, err := webAuthnCredentials(userEntry)
+
+	if err != nil {
+		return err
+	}
+
+	i := webAuthnCredentialIndex(credentials, credentialID)
+
+	if i < 0 {
+		return errors.New(errWebAuthnNotFound)
+	}
+
+	if userEntry.WebAuthnRequired && len(credentials) == 1 {
+		return errors.New(errWebAuthnLastRequired)
+	}
+
+	if err := setWebAuthnCredentials(userEntry, append(credentials[:i:i], credentials[i+1:]...)); err != nil {
+		return err
+	}
+
+	return user.saveUserEntry(id, userEntry)
+}
+
+func webAuthnCredentialIndex(credentials []webAuthnCredential, id []byte) int {
+	for i := range credentials {
+		if string(credentials[i].ID) == string(id) {
+			return i
+		}
+	}
+	return -1
+}
+
+// webAuthnLoginKey returns the key the challenge of the login of username
+// with ceremonyID is kept under.
+func webAuthnLoginKey(ceremonyID, username string) string {
+	return webAuthnLogin + ceremonyID + "_" + username
+}
+
+// webAuthnLoginOptions returns the options to log in as username with a
+// security key. Users without keys get a challenge too, so they can't be told
+// apart, but it's not kept.
+func (s *Server) webAuthnLoginOptions(username string) (*webAuthnLoginOptions, error) {
+	if !s.config.WebAuthn {
+		return nil, errors.New(errWebAuthnDisabled)
+	}
+
+	ceremonyID, err := crypto.RandomBytes(webAuthnCeremonyIDLength)
+
+	if err != nil {
+		return nil, err
+	}
+
+	options := &webAuthnLoginOptions{
+		CeremonyID:       hex.EncodeToString(ceremonyID),
+		RPID:             s.config.WebAuthnRPID,
+		Timeout:          int64(webAuthnTimeout / time.Millisecond),
+		AllowCredentials: []webAuthnCredentialDescriptor{},
+	}
+
+	var credentials []webAuthnCredential
+
+	if userEntry, _, err := s.users.GetUserEntry(username); err == nil {
+		if credentials, err = webAuthnCredentials(userEntry); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(credentials) == 0 {
+		options.Challenge, err = crypto.NewWebAuthnChallenge()
+		return options, err
+	}
+
+	options.AllowCredentials = webAuthnDescriptors(credentials)
+	options.Challenge, err = s.newWebAuthnChallenge(webAuthnLoginKey(options.CeremonyID, username))
+	return options, err
+}
+
+// checkWebAuthn checks assertion, as sent in the webauthn-assertion header,
+// answers the challenge of its login of userEntry. The signature counter of
+// the key is saved.
+func (s *Server) checkWebAuthn(userEntry *gc.UserEntry, id int64, header string) error {
+	var assertion webAuthnAssertion
+
+	if err := json.Unmarshal([]byte(header), &assertion); err != nil || assertion.CeremonyID == "" {
+		return errors.New(errInvalidWebAuthn)
+	}
+
+	challenge := s.takeWebAuthnChallenge(webAuthnLoginKey(assertion.CeremonyID, userEntry.Username))
+
+	if challenge == nil {
+		return errors.New(errInvalidWebAuthn)
+	}
+
+	credentials, err := webAuthnCredentials(userEntry)
+
+	if err != nil {
+		return err
+	}
+
+	i := webAuthnCredentialIndex(credentials, assertion.CredentialID)
+
+	if i < 0 {
+		return errors.New(errInvalidWebAuthn)
+	}
+
+	if err := crypto.VerifyWebAuthnAssertion(&credentials[i].WebAuthnCredential, assertion.ClientDataJSON,
+		assertion.AuthenticatorData, assertion.Signature, challenge, s.config.WebAuthnOrigin, s.config.WebAuthnRPID); err != nil {
+		return errors.New(errInvalidWebAuthn)
+	}
+
+	if err := setWebAuthnCredentials(userEntry, credentials); err != nil {
+		return err
+	}
+
+	return s.users.UpdateUser(id, userEntry)
+}
+
+// checkSecondFactor checks the security key or TOTP code r logs userEntry in
+// with, if it has a second factor. Users with a security key but without TOTP,
+// or who are required to use one, must use it, they can't log in while keys
+// aren't enabled.
+func (s *Server) checkSecondFactor(userEntry *gc.UserEntry, id int64, master *crypto.CryptoData, r *http.Request) error {
+	hasKeys := len(userEntry.WebAuthnCredentials) > 0
+
+	if assertion := r.Header.Get(headerWebAuthnAssertion); assertion != "" && hasKeys && s.config.WebAuthn {
+		return s.checkWebAuthn(userEntry, id, assertion)
+	}
+
+	if hasKeys && (userEntry.WebAuthnRequired || !userEntry.TOTPEnabled) {
+		return errors.New(errWebAuthnRequired)
+	}
+
+	return s.checkTOTP(userEntry, id, master, r.Header.Get(headerTOTPCode))
+}
+
+// mustRegisterWebAuthn reports whether a session of userEntry may only
+// register a security key.
+func mustRegisterWebAuthn(userEntry *gc.UserEntry) bool {
+	return userEntry.WebAuthnRequired && len(userEntry.WebAuthnCredentials) == 0
+}
@@ -0,0 +1,221 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto/webauthntest"
+	"github.com/levigross/grequests"
+	"github.com/stretchr/testify/assert"
+)
+
+// registerSecurityKey registers a key of a new authenticator for the user of
+// cookie, and returns the authenticator.
+func registerSecurityKey(t *testing.T, cookie *http.Cookie, password string) (*webauthntest.Authenticator, []byte) {
+	var options webAuthnRegistrationOptions
+
+	resp, err := grequests.Post(ts.URL+"/auth/account/webauthn/register", &grequests.RequestOptions{
+		Cookies: []*http.Cookie{cookie},
+		JSON:    map[string]string{"password": password},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, resp.JSON(&options))
+
+	a := webauthntest.New(ts.URL, options.RP.ID)
+	registration, err := a.Register(options.Challenge)
+	assert.Nil(t, err)
+
+	resp, err = grequests.Post(ts.URL+"/auth/account/webauthn/register/finish", &grequests.RequestOptions{
+		Cookies: []*http.Cookie{cookie},
+		JSON:    webAuthnRegistration{Name: "test key", ClientDataJSON: registration.ClientDataJSON, AttestationObject: registration.AttestationObject},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	return a, registration.CredentialID
+}
+
+// startSecurityKeyLogin asks for the options to log in as username with a
+// security key.
+func startSecurityKeyLogin(t *testing.T, username string) webAuthnLoginOptions {
+	var options webAuthnLoginOptions
+
+	resp, err := grequests.Post(ts.URL+"/account/webauthn/login", &grequests.RequestOptions{JSON: map[string]string{"username": username}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, resp.JSON(&options))
+	assert.NotEmpty(t, options.CeremonyID)
+	return options
+}
+
+// answerSecurityKeyLogin returns the assertion of the challenge of options,
+// as sent in the webauthn-assertion header.
+func answerSecurityKeyLogin(t *testing.T, a *webauthntest.Authenticator, options webAuthnLoginOptions, credentialID []byte) string {
+	assertion, err := a.Assert(credentialID, options.Challenge)
+	assert.Nil(t, err)
+
+	header, err := json.Marshal(webAuthnAssertion{
+		CeremonyID:        options.CeremonyID,
+		CredentialID:      assertion.CredentialID,
+		ClientDataJSON:    assertion.ClientDataJSON,
+		AuthenticatorData: assertion.AuthenticatorData,
+		Signature:         assertion.Signature,
+	})
+	assert.Nil(t, err)
+	return string(header)
+}
+
+// securityKeyAssertion asks for a login challenge of username and returns the
+// assertion of it.
+func securityKeyAssertion(t *testing.T, a *webauthntest.Authenticator, username string, credentialID []byte) string {
+	options := startSecurityKeyLogin(t, username)
+	assert.Len(t, options.AllowCredentials, 1)
+	return answerSecurityKeyLogin(t, a, options, credentialID)
+}
+
+func loginWithSecurityKey(userdata map[string]string, assertion string) *grequests.Response {
+	resp, _ := grequests.Post(ts.URL+"/account/login", &grequests.RequestOptions{
+		JSON:    userdata,
+		Headers: map[string]string{headerWebAuthnAssertion: assertion},
+	})
+	return resp
+}
+
+func TestWebAuthnLogin(t *testing.T) {
+	clearDatastore()
+	createAdmin()
+	cookie := loginUser(adminLoginDetails)
+
+	resp, err := grequests.Post(ts.URL+"/auth/account/webauthn/register", &grequests.RequestOptions{
+		Cookies: []*http.Cookie{cookie},
+		JSON:    map[string]string{"password": "wrong password"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	a, credentialID := registerSecurityKey(t, cookie, adminLoginDetails["password"])
+
+	var list struct {
+		Credentials []webAuthnCredentialInfo `json:"credentials"`
+	}
+
+	resp, err = grequests.Get(ts.URL+"/auth/account/webauthn", &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}})
+	assert.Nil(t, err)
+	assert.Nil(t, resp.JSON(&list))
+	assert.Len(t, list.Credentials, 1)
+	assert.Equal(t, credentialID, list.Credentials[0].ID)
+
+	resp = loginWithSecurityKey(adminLoginDetails, "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, resp.String(), errWebAuthnRequired)
+
+	assertion := securityKeyAssertion(t, a, "admin", credentialID)
+	assert.Equal(t, http.StatusOK, loginWithSecurityKey(adminLoginDetails, assertion).StatusCode)
+
+	// each challenge is answered once
+	assert.Equal(t, http.StatusUnauthorized, loginWithSecurityKey(adminLoginDetails, assertion).StatusCode)
+
+	// logins at the same time each answer their own challenge
+	first, second := startSecurityKeyLogin(t, "admin"), startSecurityKeyLogin(t, "admin")
+	assert.NotEqual(t, first.CeremonyID, second.CeremonyID)
+	assert.Equal(t, http.StatusOK, loginWithSecurityKey(adminLoginDetails, answerSecurityKeyLogin(t, a, first, credentialID)).StatusCode)
+
+	// the challenge of one login doesn't answer another
+	swapped := second
+	swapped.CeremonyID = startSecurityKeyLogin(t, "admin").CeremonyID
+	assert.Equal(t, http.StatusUnauthorized, loginWithSecurityKey(adminLoginDetails, answerSecurityKeyLogin(t, a, swapped, credentialID)).StatusCode)
+
+	// nor does one of another user
+	assert.Equal(t, http.StatusUnauthorized, loginWithSecurityKey(adminLoginDetails, answerSecurityKeyLogin(t, a, startSecurityKeyLogin(t, "greg"), credentialID)).StatusCode)
+
+	assert.Equal(t, http.StatusOK, loginWithSecurityKey(adminLoginDetails, answerSecurityKeyLogin(t, a, second, credentialID)).StatusCode)
+
+	// a key of another authenticator isn't accepted
+	other := webauthntest.New(a.Origin, a.RPID)
+	registration, err := other.Register([]byte("challenge"))
+	assert.Nil(t, err)
+	assertion = securityKeyAssertion(t, other, "admin", registration.CredentialID)
+	assert.Equal(t, http.StatusUnauthorized, loginWithSecurityKey(adminLoginDetails, assertion).StatusCode)
+
+	remove := func(cookie *http.Cookie, password string, id []byte) int {
+		resp, _ := grequests.Delete(ts.URL+"/auth/account/webauthn/"+crypto.WebAuthnEncoding.EncodeToString(id), &grequests.RequestOptions{
+			Cookies: []*http.Cookie{cookie},
+			JSON:    map[string]string{"password": password},
+		})
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusNotFound, remove(cookie, adminLoginDetails["password"], registration.CredentialID))
+	assert.Equal(t, http.StatusNoContent, remove(cookie, adminLoginDetails["password"], credentialID))
+	assert.NotEmpty(t, loginUser(adminLoginDetails).Value)
+}
+
+func TestWebAuthnRequired(t *testing.T) {
+	clearDatastore()
+	createAdmin()
+	createNormalUser()
+	adminCookie := loginUser(adminLoginDetails)
+	enableUser(normalUserLoginDetails, *adminCookie)
+
+	require := func(cookie *http.Cookie, username string) int {
+		resp, _ := grequests.Put(ts.URL+"/auth/account/webauthn-required/"+username, &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}})
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusNoContent, require(adminCookie, normalUserLoginDetails["username"]))
+
+	// until a key is registered, that's all the user can do
+	cookie := loginUser(normalUserLoginDetails)
+	assert.NotEmpty(t, cookie.Value)
+	assert.Equal(t, http.StatusForbidden, require(cookie, "admin"))
+
+	listRoot := &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}, Params: map[string]string{"path": "/"}}
+	resp, err := grequests.Get(ts.URL+"/auth/list/fs", listRoot)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	a, credentialID := registerSecurityKey(t, cookie, normalUserLoginDetails["password"])
+
+	resp, err = grequests.Get(ts.URL+"/auth/list/fs", listRoot)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the only key can't be removed
+	resp, err = grequests.Delete(ts.URL+"/auth/account/webauthn/"+crypto.WebAuthnEncoding.EncodeToString(credentialID), &grequests.RequestOptions{
+		Cookies: []*http.Cookie{cookie},
+		JSON:    map[string]string{"password": normalUserLoginDetails["password"]},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	assert.Equal(t, http.StatusUnauthorized, loginWithSecurityKey(normalUserLoginDetails, "").StatusCode)
+	assertion := securityKeyAssertion(t, a, normalUserLoginDetails["username"], credentialID)
+	assert.Equal(t, http.StatusOK, loginWithSecurityKey(normalUserLoginDetails, assertion).StatusCode)
+}
+
+func TestWebAuthnDisabled(t *testing.T) {
+	clearDatastore()
+	createAdmin()
+	cookie := loginUser(adminLoginDetails)
+
+	testServer.config.WebAuthn = false
+	defer func() { testServer.config.WebAuthn = true }()
+
+	resp, err := grequests.Post(ts.URL+"/account/webauthn/login", &grequests.RequestOptions{JSON: map[string]string{"username": "admin"}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = grequests.Post(ts.URL+"/auth/account/webauthn/register", &grequests.RequestOptions{
+		Cookies: []*http.Cookie{cookie},
+		JSON:    map[string]string{"password": adminLoginDetails["password"]},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = grequests.Put(ts.URL+"/auth/account/webauthn-required/admin", &grequests.RequestOptions{Cookies: []*http.Cookie{cookie}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
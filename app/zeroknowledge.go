@@ -0,0 +1,300 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+	"github.com/gin-gonic/gin"
+	"github.com/satori/go.uuid"
+)
+
+// Zero-knowledge accounts are used through the client package, which derives
+// two keys from the password: one wrapping the PGP key and HMAC secret, and
+// one sent instead of the password to log in. Files, their names, metadata
+// and folder names arrive encrypted, along with the HMACs and blind indexes
+// they're looked up by, and are served the same way, so the server never
+// holds anything which decrypts them.
+const (
+	errZeroKnowledge          = "not available for zero-knowledge accounts, their files can only be read by the client"
+	errNotZeroKnowledge       = "only available for zero-knowledge accounts"
+	errInvalidZeroKnowledge   = "zero-knowledge signups need a salt, KDF parameters, wrapped keys and a login key of at least 32 characters"
+	errorMissingEncryptedMeta = "every encrypted file needs a filename, filename_hmac, data_key and metadata"
+
+	// headers of a file downloaded by a zero-knowledge account, the values
+	// are base64 encoded
+	headerEncryptedFilename = "X-Encrypted-Filename"
+	headerDataKey           = "X-Data-Key"
+
+	zeroKnowledgeSaltInfo = "gscrypto zero-knowledge salt "
+)
+
+// zeroKnowledgeKeys are the parameters a client needs to unlock its keys,
+// which it sends when signing up. Everything but the salt and KDF parameters
+// is only returned once logged in.
+type zeroKnowledgeKeys struct {
+	Salt       []byte `json:"salt"`
+	KDFTime    int    `json:"kdf_time"`
+	KDFMemory  int    `json:"kdf_memory"`
+	KDFThreads int    `json:"kdf_threads"`
+
+	EncryptedPGPKey     []byte `json:"encrypted_pgp_key,omitempty"`
+	EncryptedHMACSecret []byte `json:"encrypted_hmac_secret,omitempty"`
+	KeySalt             []byte `json:"key_salt,omitempty"`
+	KeyIterations       int    `json:"key_iterations,omitempty"`
+}
+
+func (k *zeroKnowledgeKeys) valid() bool {
+	return len(k.Salt) >= 16 && k.KDFTime >= 1 && k.KDFMemory >= gc.MinKDFMemory && k.KDFThreads >= 1 && k.KDFThreads <= 255 &&
+		len(k.EncryptedPGPKey) > 0 && len(k.EncryptedHMACSecret) > 0 && len(k.KeySalt) >= 16 && k.KeyIterations >= 1
+}
+
+// newZeroKnowledgeUser fills in the keys of a new zero-knowledge account,
+// loginKey is what the client sends as the password.
+func (s *Server) newZeroKnowledgeUser(userEntry *gc.UserEntry, loginKey []byte, keys *zeroKnowledgeKeys) error {
+	if len(loginKey) < 32 || !keys.valid() {
+		return errors.New(errInvalidZeroKnowledge)
+	}
+
+	hash, err := s.generatePasswordHash(loginKey)
+
+	if err != nil {
+		return err
+	}
+
+	userEntry.ZeroKnowledge = true
+	userEntry.Hash = hash
+	userEntry.Salt = keys.Salt
+	userEntry.KDF = gc.KDFParams{Version: gc.KDFArgon2id, Time: keys.KDFTime, Memory: keys.KDFMemory, Threads: keys.KDFThreads}
+	userEntry.EncryptedPGPKey = keys.EncryptedPGPKey
+	userEntry.EncryptedHMACSecret = keys.EncryptedHMACSecret
+	userEntry.KeySalt = keys.KeySalt
+	userEntry.KeyIterations = keys.KeyIterations
+
+	return nil
+}
+
+// loginParams returns the salt and KDF parameters a client derives the keys
+// of username with before logging in. Unknown and regular accounts get a salt
+// which stays the same, so they can't be told apart from zero-knowledge ones.
+func (s *Server) loginParams(username string) *zeroKnowledgeKeys {
+	if userEntry, _, err := s.users.GetUserEntry(username); err == nil && userEntry.ZeroKnowledge {
+		kdf := userEntry.KDF
+		return &zeroKnowledgeKeys{Salt: userEntry.Salt, KDFTime: kdf.Time, KDFMemory: kdf.Memory, KDFThreads: kdf.Threads}
+	}
+
+	mac := hmac.New(sha256.New, []byte(s.config.JWTKey))
+	mac.Write([]byte(zeroKnowledgeSaltInfo + username))
+
+	kdf := s.config.KDF()
+	return &zeroKnowledgeKeys{Salt: mac.Sum(nil), KDFTime: kdf.Time, KDFMemory: kdf.Memory, KDFThreads: kdf.Threads}
+}
+
+// zeroKnowledgeKeys returns everything the client needs to unlock the user's
+// keys.
+func (user *userData) zeroKnowledgeKeys() (*zeroKnowledgeKeys, error) {
+	if !user.userEntry.ZeroKnowledge {
+		return nil, errors.New(errNotZeroKnowledge)
+	}
+
+	u := user.userEntry
+	return &zeroKnowledgeKeys{
+		Salt:                u.Salt,
+		KDFTime:             u.KDF.Time,
+		KDFMemory:           u.KDF.Memory,
+		KDFThreads:          u.KDF.Threads,
+		EncryptedPGPKey:     u.EncryptedPGPKey,
+		EncryptedHMACSecret: u.EncryptedHMACSecret,
+		KeySalt:             u.KeySalt,
+		KeyIterations:       u.KeyIterations,
+	}, nil
+}
+
+// storeEncryptedUpload stores a file encrypted by the client as it is. Only
+// its header is checked, which catches clients sending plaintext.
+func (user *userData) storeEncryptedUpload(fileReader io.Reader, storageClass string) (*uploadedFile, error) {
+	// an upload which is never closed is abandoned once ctx is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	header, err := crypto.ReadStreamHeader(fileReader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	filename := uuid.NewV4().String()
+	storageWriter, err := user.server.storage.Put(ctx, filename, &gc.PutOptions{StorageClass: storageClass})
+
+	if err != nil {
+		return nil, err
+	}
+
+	written, err := io.Copy(storageWriter, io.MultiReader(bytes.NewReader(header), fileReader))
+
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := crypto.PlaintextSize(header, written)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := storageWriter.Close(); err != nil {
+		return nil, err
+	}
+
+	return &uploadedFile{fileID: filename, fileSize: size}, nil
+}
+
+// createEncryptedFileEntry adds a file uploaded by a zero-knowledge account,
+// its name, HMAC, data key and metadata are set by the client. virtualFolder
+// and tags are blind indexes, and folderNames the encrypted names of the
+// folders in virtualFolder.
+func (user *userData) createEncryptedFileEntry(file *uploadedFile, virtualFolder string, folderNames [][]byte, tags []string) error {
+	folder := normalizeFolder(virtualFolder)
+
+	if len(gc.PathToFolderTree(folder)) != len(folderNames) {
+		return errors.New(errorMissingFolderNames)
+	}
+
+	if user.server.files.FilenameHMACExists(user.userEntry.Username, file.fileNameHMAC) {
+		return errors.New(errorFileIsDuplicate)
+	}
+
+	newFile := &gc.File{
+		Username:          user.userEntry.Username,
+		UploadDate:        time.Now(),
+		Folder:            folder,
+		Filename:          file.encryptedFileName,
+		FilenameHMAC:      file.fileNameHMAC,
+		GoogleCloudObject: file.fileID,
+		FileSize:          file.fileSize,
+		Tags:              tags,
+		DataKey:           file.dataKey,
+		KeyGeneration:     user.userEntry.KeyGeneration,
+		Metadata:          file.metadata}
+
+	if _, err := user.server.files.AddFile(newFile); err != nil {
+		return errors.New("error adding file to database: " + err.Error())
+	}
+
+	_, err := user.createDirectoryTree(folder, folderNames, user.userEntry.KeyGeneration, 0)
+	return err
+}
+
+// encryptedUploadMeta collects the filename, filename_hmac, data_key and
+// metadata fields of an upload by a zero-knowledge account, the n-th value of
+// each belongs to the n-th file. folder_names are the names of the folders in
+// virtfolder, separated by commas.
+type encryptedUploadMeta struct {
+	filenames, hmacs, dataKeys, metadata []string
+	folderNames                          string
+}
+
+func (m *encryptedUploadMeta) add(field string, value []byte) {
+	switch field {
+	case "filename":
+		m.filenames = append(m.filenames, string(value))
+	case "filename_hmac":
+		m.hmacs = append(m.hmacs, string(value))
+	case "data_key":
+		m.dataKeys = append(m.dataKeys, string(value))
+	case "metadata":
+		m.metadata = append(m.metadata, string(value))
+	case "folder_names":
+		m.folderNames = string(value)
+	}
+}
+
+// apply sets the name, HMAC and data key of files.
+func (m *encryptedUploadMeta) apply(files []uploadedFile) error {
+	if len(m.filenames) != len(files) || len(m.hmacs) != len(files) || len(m.dataKeys) != len(files) || len(m.metadata) != len(files) {
+		return errors.New(errorMissingEncryptedMeta)
+	}
+
+	for i := range files {
+		filename, err := base64.StdEncoding.DecodeString(m.filenames[i])
+
+		if err != nil || len(filename) == 0 {
+			return errors.New(errorMissingEncryptedMeta)
+		}
+
+		dataKey, err := base64.StdEncoding.DecodeString(m.dataKeys[i])
+
+		if err != nil || len(dataKey) == 0 || len(m.hmacs[i]) == 0 {
+			return errors.New(errorMissingEncryptedMeta)
+		}
+
+		metadata, err := base64.StdEncoding.DecodeString(m.metadata[i])
+
+		if err != nil || len(metadata) == 0 {
+			return errors.New(errorMissingEncryptedMeta)
+		}
+
+		files[i].encryptedFileName = filename
+		files[i].fileNameHMAC = m.hmacs[i]
+		files[i].dataKey = dataKey
+		files[i].metadata = metadata
+	}
+	return nil
+}
+
+// decodeFolderNames returns the encrypted folder names, in order.
+func (m *encryptedUploadMeta) decodeFolderNames() ([][]byte, error) {
+	var names [][]byte
+
+	for _, encoded := range strings.Split(m.folderNames, ",") {
+		if encoded == "" {
+			continue
+		}
+
+		name, err := base64.StdEncoding.DecodeString(encoded)
+
+		if err != nil || len(name) == 0 {
+			return nil, errors.New(errorMissingFolderNames)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// downloadEncryptedFile serves the object of f as it is stored, ranges are
+// supported the same way. The client decrypts it, and the filename, with the
+// data key sent in the headers.
+func (user *userData) downloadEncryptedFile(httpContext *gin.Context, f *gc.File) error {
+	ctx := httpContext.Request.Context()
+	attrs, err := user.server.storage.Stat(ctx, f.GoogleCloudObject)
+
+	if err != nil {
+		return err
+	}
+
+	header := httpContext.Writer.Header()
+	header.Set("content-disposition", "attachment; filename=\""+strconv.FormatInt(f.ID, 10)+"\"")
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set(headerEncryptedFilename, base64.StdEncoding.EncodeToString(f.Filename))
+	header.Set(headerDataKey, base64.StdEncoding.EncodeToString(f.DataKey))
+
+	if r := httpContext.GetHeader("Range"); r == "" || strings.HasPrefix(r, "bytes=0-") {
+		user.countDownload(f.ID)
+	}
+
+	object := &blobReaderAt{ctx: ctx, storage: user.server.storage, name: f.GoogleCloudObject}
+	defer object.Close()
+
+	http.ServeContent(httpContext.Writer, httpContext.Request, "", f.UploadDate, io.NewSectionReader(object, 0, attrs.Size))
+	return nil
+}
@@ -0,0 +1,170 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/client"
+	"github.com/levigross/grequests"
+	"github.com/stretchr/testify/assert"
+)
+
+// cookieRecorder keeps the session cookie the client sends, so the tests can
+// make requests the client wouldn't.
+type cookieRecorder struct {
+	cookie *http.Cookie
+}
+
+func (r *cookieRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	if cookie, err := req.Cookie("jwt"); err == nil {
+		r.cookie = cookie
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func newTestClient(recorder *cookieRecorder) *client.Client {
+	c := client.New(ts.URL)
+	c.HTTPClient = &http.Client{Transport: recorder}
+	c.KDFTime, c.KDFMemory, c.KDFThreads = 1, gc.MinKDFMemory, 1
+	return c
+}
+
+func TestZeroKnowledge(t *testing.T) {
+	clearDatastore()
+	clearBucket()
+	createAdmin()
+	adminCookie := loginUser(adminLoginDetails)
+
+	username, password := "zeroknowledge", "a password the server never sees!1"
+	recorder := &cookieRecorder{}
+	c := newTestClient(recorder)
+
+	assert.Nil(t, c.Signup(username, password))
+	enableUser(user{"username": username}, *adminCookie)
+
+	assert.NotNil(t, c.Login(username, "not the password"))
+	assert.Nil(t, c.Login(username, password))
+
+	// nothing able to decrypt the files is known to the server
+	userEntry, _, err := testServer.users.GetUserEntry(username)
+	assert.Nil(t, err)
+	assert.True(t, userEntry.ZeroKnowledge)
+	assert.NotNil(t, testServer.verifyUserPassword(username, []byte(password)))
+
+	// the login parameters of other accounts don't give away whether they
+	// exist, or are zero-knowledge ones
+	var params, again, known zeroKnowledgeKeys
+	resp, _ := grequests.Get(ts.URL+"/account/kdf/nobody", nil)
+	assert.Nil(t, resp.JSON(&params))
+	resp, _ = grequests.Get(ts.URL+"/account/kdf/nobody", nil)
+	assert.Nil(t, resp.JSON(&again))
+	resp, _ = grequests.Get(ts.URL+"/account/kdf/"+username, nil)
+	assert.Nil(t, resp.JSON(&known))
+	assert.Equal(t, params, again)
+	assert.Len(t, params.Salt, len(known.Salt))
+	assert.Equal(t, userEntry.Salt, known.Salt)
+	assert.Empty(t, known.EncryptedPGPKey)
+
+	var contents [][]byte
+	for _, name := range []string{"first", "second"} {
+		testfile, _ := createTestFile(name, 150*1024)
+		defer os.Remove(testfile)
+		data, _ := ioutil.ReadFile(testfile)
+		contents = append(contents, data)
+
+		assert.Nil(t, c.Upload("/docs", name, "text/plain", bytes.NewReader(data)))
+	}
+
+	err = c.Upload("/docs/", "first", "", bytes.NewReader([]byte("again")))
+	if assert.NotNil(t, err) {
+		assert.Equal(t, client.ErrorFileExists, err.Error())
+	}
+	assert.Nil(t, c.Upload("/", "first", "", bytes.NewReader([]byte("another folder"))))
+
+	files, err := c.List("/docs/")
+	assert.Nil(t, err)
+	assert.Len(t, files, 2)
+
+	ctx := context.Background()
+	for _, f := range files {
+		i := map[string]int{"first": 0, "second": 1}[f.Name]
+		assert.Equal(t, "/docs/"+f.Name, f.FullPath)
+		assert.Equal(t, int64(len(contents[i])), f.FileSize)
+		assert.Equal(t, "text/plain", f.FileType)
+
+		var plaintext bytes.Buffer
+		name, err := c.Download(f.ID, &plaintext)
+		assert.Nil(t, err)
+		assert.Equal(t, f.Name, name)
+		assert.True(t, bytes.Equal(contents[i], plaintext.Bytes()))
+
+		stored, _ := testServer.files.GetFile(username, f.ID)
+		assert.NotContains(t, string(stored.Filename), f.Name)
+		assert.NotContains(t, stored.Folder, "docs")
+		assert.Empty(t, stored.FileType)
+
+		r, err := testServer.storage.Get(ctx, stored.GoogleCloudObject)
+		assert.Nil(t, err)
+		object, _ := ioutil.ReadAll(r)
+		r.Close()
+		assert.False(t, bytes.Contains(object, contents[i][:1024]))
+	}
+
+	// folders are named by the client as well
+	root, err := c.List("/")
+	assert.Nil(t, err)
+	if assert.Len(t, root, 2) {
+		assert.ElementsMatch(t, []string{"/docs/", "/first"}, []string{root[0].FullPath, root[1].FullPath})
+	}
+
+	folders, _, _ := testServer.files.ListFolders(username, "/")
+	if assert.Len(t, folders, 1) {
+		assert.NotEqual(t, "docs", folders[0].Folder)
+		assert.NotContains(t, string(folders[0].EncryptedFolder), "docs")
+	}
+
+	session, err := cookieSession(recorder.cookie)
+	if assert.Nil(t, err) {
+		assert.Empty(t, session.cryptoData.SymmetricKey)
+		assert.Empty(t, session.cryptoData.HMACSecret)
+	}
+
+	cookies := &grequests.RequestOptions{Cookies: []*http.Cookie{recorder.cookie}}
+
+	// ranges are of the encrypted file
+	resp, _ = grequests.Get(ts.URL+"/auth/file/"+strconv.FormatInt(files[0].ID, 10), &grequests.RequestOptions{
+		Cookies: []*http.Cookie{recorder.cookie},
+		Headers: map[string]string{"Range": "bytes=0-3"},
+	})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "GSCF", resp.String())
+
+	// files which aren't encrypted are refused
+	testfile, _ := createTestFile("plaintext", 1024)
+	defer os.Remove(testfile)
+	f, _ := grequests.FileUploadFromDisk(testfile)
+	resp, _ = grequests.Post(ts.URL+"/auth/file", &grequests.RequestOptions{
+		Files:   f,
+		Cookies: []*http.Cookie{recorder.cookie},
+		Data:    map[string]string{"filename": "bmFtZQ==", "filename_hmac": "hmac", "data_key": "a2V5"},
+	})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// neither is anything which needs the server to have the keys
+	assert.Equal(t, http.StatusBadRequest, changePassword(recorder.cookie, password, "a new password!1").StatusCode)
+	assert.Equal(t, http.StatusBadRequest, rotateKeys(recorder.cookie, password).StatusCode)
+	assert.Equal(t, http.StatusForbidden, tusRequest("POST", ts.URL+"/auth/upload/", recorder.cookie, map[string]string{"Upload-Length": "10"}, nil).StatusCode)
+
+	resp, _ = grequests.Get(ts.URL+"/auth/folder?path=/docs", cookies)
+	assert.NotEqual(t, http.StatusOK, resp.StatusCode)
+
+	// and the keys are only handed to zero-knowledge accounts
+	resp, _ = grequests.Get(ts.URL+"/auth/account/keys", &grequests.RequestOptions{Cookies: []*http.Cookie{adminCookie}})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
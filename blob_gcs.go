@@ -0,0 +1,152 @@
+package gscrypto
+
+import (
+	"errors"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+)
+
+// gcsMaxComposeSources is the most objects a single compose request accepts.
+const gcsMaxComposeSources = 32
+
+type gcsBlobStore struct {
+	bucket *storage.BucketHandle
+}
+
+var _ BlobStore = &gcsBlobStore{}
+
+func newGCSBlobStore(bucket *storage.BucketHandle) *gcsBlobStore {
+	return &gcsBlobStore{bucket: bucket}
+}
+
+func setObjectAttrs(attrs *storage.ObjectAttrs, opts *PutOptions) {
+	attrs.ACL = []storage.ACLRule{{Entity: storage.AllAuthenticatedUsers, Role: storage.RoleReader}}
+	attrs.ContentType = "octet/stream"
+	attrs.CacheControl = "public, max-age=86400"
+
+	if opts != nil {
+		attrs.StorageClass = opts.StorageClass
+	}
+}
+
+// gcsBlobWriter cancels the context of its writer to discard the object.
+type gcsBlobWriter struct {
+	*storage.Writer
+	cancel context.CancelFunc
+}
+
+func (w *gcsBlobWriter) CloseWithError(err error) error {
+	w.cancel()
+	w.Writer.Close()
+	return nil
+}
+
+func (w *gcsBlobWriter) Close() error {
+	defer w.cancel()
+	return w.Writer.Close()
+}
+
+func (s *gcsBlobStore) Put(ctx context.Context, name string, opts *PutOptions) (BlobWriter, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	w := s.bucket.Object(name).NewWriter(ctx)
+	setObjectAttrs(&w.ObjectAttrs, opts)
+
+	return &gcsBlobWriter{Writer: w, cancel: cancel}, nil
+}
+
+func (s *gcsBlobStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	r, err := s.bucket.Object(name).NewReader(ctx)
+
+	if err == storage.ErrObjectNotExist {
+		return nil, errors.New(ErrorBlobNotFound)
+	}
+
+	return r, err
+}
+
+func (s *gcsBlobStore) GetRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	r, err := s.bucket.Object(name).NewRangeReader(ctx, offset, length)
+
+	if err == storage.ErrObjectNotExist {
+		return nil, errors.New(ErrorBlobNotFound)
+	}
+
+	return r, err
+}
+
+func (s *gcsBlobStore) Delete(ctx context.Context, name string) error {
+	err := s.bucket.Object(name).Delete(ctx)
+
+	if err == storage.ErrObjectNotExist {
+		return errors.New(ErrorBlobNotFound)
+	}
+
+	return err
+}
+
+func (s *gcsBlobStore) List(ctx context.Context, prefix string) ([]string, error) {
+	names := make([]string, 0)
+	it := s.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+
+	for {
+		obj, err := it.Next()
+
+		if err == iterator.Done {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		names = append(names, obj.Name)
+	}
+
+	return names, nil
+}
+
+func (s *gcsBlobStore) Stat(ctx context.Context, name string) (*BlobAttrs, error) {
+	attrs, err := s.bucket.Object(name).Attrs(ctx)
+
+	if err == storage.ErrObjectNotExist {
+		return nil, errors.New(ErrorBlobNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &BlobAttrs{Name: attrs.Name, Size: attrs.Size, Updated: attrs.Updated}, nil
+}
+
+func (s *gcsBlobStore) Compose(ctx context.Context, name string, parts []string, opts *PutOptions) error {
+	dst := s.bucket.Object(name)
+	srcs := make([]*storage.ObjectHandle, 0, gcsMaxComposeSources)
+
+	// more parts than a single request accepts are composed in batches, each
+	// batch is appended to what the previous ones composed into dst
+	for i, part := range parts {
+		if i > 0 && len(srcs) == 0 {
+			srcs = append(srcs, dst)
+		}
+		srcs = append(srcs, s.bucket.Object(part))
+
+		if len(srcs) < gcsMaxComposeSources && i < len(parts)-1 {
+			continue
+		}
+
+		c := dst.ComposerFrom(srcs...)
+		setObjectAttrs(&c.ObjectAttrs, opts)
+
+		if _, err := c.Run(ctx); err == storage.ErrObjectNotExist {
+			return errors.New(ErrorBlobNotFound)
+		} else if err != nil {
+			return err
+		}
+
+		srcs = srcs[:0]
+	}
+
+	return nil
+}
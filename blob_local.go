@@ -0,0 +1,207 @@
+package gscrypto
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+const localBlobTempPrefix = ".upload-"
+
+// localBlobStore keeps every object as a single file in one directory, useful
+// for single node installs and development without a bucket.
+type localBlobStore struct {
+	dir string
+}
+
+var _ BlobStore = &localBlobStore{}
+
+func newLocalBlobStore(dir string) (*localBlobStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create storage directory: %v", err)
+	}
+	return &localBlobStore{dir: dir}, nil
+}
+
+func (s *localBlobStore) path(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", errors.New(ErrorInvalidBlobName)
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+// localBlobWriter writes to a temporary file which is renamed into place on
+// Close, so a failed upload never leaves a partial object behind.
+type localBlobWriter struct {
+	tmp    *os.File
+	dest   string
+	closed bool
+}
+
+func (w *localBlobWriter) Write(p []byte) (int, error) {
+	return w.tmp.Write(p)
+}
+
+func (w *localBlobWriter) CloseWithError(err error) error {
+	if w.closed {
+		return nil
+	}
+
+	w.closed = true
+	w.tmp.Close()
+	return os.Remove(w.tmp.Name())
+}
+
+func (w *localBlobWriter) Close() error {
+	w.closed = true
+
+	if err := w.tmp.Close(); err != nil {
+		os.Remove(w.tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(w.tmp.Name(), w.dest); err != nil {
+		os.Remove(w.tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (s *localBlobStore) Put(ctx context.Context, name string, opts *PutOptions) (BlobWriter, error) {
+	dest, err := s.path(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempFile(s.dir, localBlobTempPrefix)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &localBlobWriter{tmp: tmp, dest: dest}, nil
+}
+
+func (s *localBlobStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	p, err := s.path(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(p)
+
+	if os.IsNotExist(err) {
+		return nil, errors.New(ErrorBlobNotFound)
+	}
+
+	return f, err
+}
+
+func (s *localBlobStore) GetRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	r, err := s.Get(ctx, name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	f := r.(*os.File)
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if length < 0 {
+		return f, nil
+	}
+
+	return readCloser{io.LimitReader(f, length), f}, nil
+}
+
+func (s *localBlobStore) Delete(ctx context.Context, name string) error {
+	p, err := s.path(name)
+
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(p)
+
+	if os.IsNotExist(err) {
+		return errors.New(ErrorBlobNotFound)
+	}
+
+	return err
+}
+
+func (s *localBlobStore) List(ctx context.Context, prefix string) ([]string, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+func (s *localBlobStore) Stat(ctx context.Context, name string) (*BlobAttrs, error) {
+	p, err := s.path(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(p)
+
+	if os.IsNotExist(err) {
+		return nil, errors.New(ErrorBlobNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &BlobAttrs{Name: name, Size: fi.Size(), Updated: fi.ModTime()}, nil
+}
+
+func (s *localBlobStore) Compose(ctx context.Context, name string, parts []string, opts *PutOptions) error {
+	w, err := s.Put(ctx, name, opts)
+
+	if err != nil {
+		return err
+	}
+
+	for _, part := range parts {
+		r, err := s.Get(ctx, part)
+
+		if err != nil {
+			w.CloseWithError(err)
+			return err
+		}
+
+		_, err = io.Copy(w, r)
+		r.Close()
+
+		if err != nil {
+			w.CloseWithError(err)
+			return err
+		}
+	}
+
+	return w.Close()
+}
@@ -0,0 +1,157 @@
+package gscrypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestLocalBlobStore(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := newLocalBlobStore(dir)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+
+	// objects are single files in the directory, nothing may escape it
+	for _, name := range []string{"", ".", "..", ".hidden", "../escape", "a/b", "/etc/passwd", localBlobTempPrefix + "x"} {
+		_, err := s.Put(ctx, name, nil)
+		assert.EqualError(t, err, ErrorInvalidBlobName, name)
+
+		_, err = s.Get(ctx, name)
+		assert.EqualError(t, err, ErrorInvalidBlobName, name)
+
+		_, err = s.GetRange(ctx, name, 0, 1)
+		assert.EqualError(t, err, ErrorInvalidBlobName, name)
+
+		_, err = s.Stat(ctx, name)
+		assert.EqualError(t, err, ErrorInvalidBlobName, name)
+
+		assert.EqualError(t, s.Delete(ctx, name), ErrorInvalidBlobName, name)
+	}
+
+	_, err = os.Stat(filepath.Join(filepath.Dir(dir), "escape"))
+	assert.True(t, os.IsNotExist(err))
+
+	data := make([]byte, 1000)
+	rand.Read(data)
+
+	w, err := s.Put(ctx, "object", nil)
+	assert.NoError(t, err)
+
+	_, err = w.Write(data)
+	assert.NoError(t, err)
+
+	// the object only appears once it's complete
+	_, err = s.Stat(ctx, "object")
+	assert.EqualError(t, err, ErrorBlobNotFound)
+
+	names, err := s.List(ctx, "")
+	assert.NoError(t, err)
+	assert.Empty(t, names, "the temporary file is listed")
+
+	assert.NoError(t, w.Close())
+	assert.NoError(t, w.CloseWithError(errors.New("too late")))
+
+	attrs, err := s.Stat(ctx, "object")
+	assert.NoError(t, err)
+	assert.EqualValues(t, len(data), attrs.Size)
+
+	r, err := s.Get(ctx, "object")
+	assert.NoError(t, err)
+
+	downloaded, err := ioutil.ReadAll(r)
+	r.Close()
+
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, downloaded), "downloaded object differs from upload")
+
+	type byteRange struct {
+		offset, length int64
+		expected       []byte
+	}
+
+	size := int64(len(data))
+	for _, br := range []byteRange{
+		{0, 0, []byte{}},
+		{0, -1, data},
+		{1, 10, data[1:11]},
+		{size / 2, -1, data[size/2:]},
+		{size - 1, 1, data[size-1:]},
+		{size - 1, 10, data[size-1:]},
+		{size, -1, []byte{}},
+		{size + 10, 10, []byte{}},
+	} {
+		r, err := s.GetRange(ctx, "object", br.offset, br.length)
+		assert.NoError(t, err)
+
+		downloaded, err := ioutil.ReadAll(r)
+		r.Close()
+
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(br.expected, downloaded), "ranged download differs from upload")
+	}
+
+	_, err = s.GetRange(ctx, "object", -1, 10)
+	assert.Error(t, err)
+
+	// a failed upload leaves neither the object nor its temporary file
+	w, err = s.Put(ctx, "failed", nil)
+	assert.NoError(t, err)
+
+	w.Write(data)
+	assert.NoError(t, w.CloseWithError(errors.New("client went away")))
+	assert.NoError(t, w.CloseWithError(errors.New("client went away")))
+
+	_, err = s.Stat(ctx, "failed")
+	assert.EqualError(t, err, ErrorBlobNotFound)
+
+	for _, name := range []string{"part-0", "part-1", "other"} {
+		w, err := s.Put(ctx, name, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+	}
+
+	// dot files and directories in the storage directory aren't objects
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, ".part-hidden"), nil, 0600))
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "part-dir"), 0700))
+
+	names, err = s.List(ctx, "")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"object", "part-0", "part-1", "other"}, names)
+
+	names, err = s.List(ctx, "part-")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"part-0", "part-1"}, names)
+
+	names, err = s.List(ctx, "missing")
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+
+	entries, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 6, "temporary files are left behind")
+
+	for _, name := range []string{"object", "part-0", "part-1", "other"} {
+		assert.NoError(t, s.Delete(ctx, name))
+
+		_, err := s.Get(ctx, name)
+		assert.EqualError(t, err, ErrorBlobNotFound)
+
+		_, err = s.GetRange(ctx, name, 0, 1)
+		assert.EqualError(t, err, ErrorBlobNotFound)
+
+		_, err = s.Stat(ctx, name)
+		assert.EqualError(t, err, ErrorBlobNotFound)
+
+		assert.EqualError(t, s.Delete(ctx, name), ErrorBlobNotFound)
+	}
+}
@@ -0,0 +1,162 @@
+package gscrypto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type memoryBlob struct {
+	data    []byte
+	updated time.Time
+}
+
+// MemoryBlobStore keeps objects in memory, it's meant for tests.
+type MemoryBlobStore struct {
+	mu    sync.RWMutex
+	blobs map[string]*memoryBlob
+}
+
+var _ BlobStore = &MemoryBlobStore{}
+
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{blobs: make(map[string]*memoryBlob)}
+}
+
+// Reset removes every object.
+func (s *MemoryBlobStore) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.blobs = make(map[string]*memoryBlob)
+}
+
+type memoryBlobWriter struct {
+	bytes.Buffer
+	name  string
+	store *MemoryBlobStore
+}
+
+// CloseWithError does nothing, the blob is only stored by Close.
+func (w *memoryBlobWriter) CloseWithError(err error) error {
+	return nil
+}
+
+func (w *memoryBlobWriter) Close() error {
+	w.store.mu.Lock()
+	defer w.store.mu.Unlock()
+
+	w.store.blobs[w.name] = &memoryBlob{data: w.Bytes(), updated: time.Now()}
+	return nil
+}
+
+func (s *MemoryBlobStore) Put(ctx context.Context, name string, opts *PutOptions) (BlobWriter, error) {
+	if name == "" {
+		return nil, errors.New(ErrorInvalidBlobName)
+	}
+	return &memoryBlobWriter{name: name, store: s}, nil
+}
+
+func (s *MemoryBlobStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	blob, ok := s.blobs[name]
+
+	if !ok {
+		return nil, errors.New(ErrorBlobNotFound)
+	}
+
+	// blobs are never modified once written, so the reader can share them
+	return ioutil.NopCloser(bytes.NewReader(blob.data)), nil
+}
+
+func (s *MemoryBlobStore) GetRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	blob, ok := s.blobs[name]
+
+	if !ok {
+		return nil, errors.New(ErrorBlobNotFound)
+	}
+
+	if offset < 0 || offset > int64(len(blob.data)) {
+		return nil, errors.New("invalid range")
+	}
+
+	data := blob.data[offset:]
+
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *MemoryBlobStore) Delete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.blobs[name]; !ok {
+		return errors.New(ErrorBlobNotFound)
+	}
+
+	delete(s.blobs, name)
+	return nil
+}
+
+func (s *MemoryBlobStore) List(ctx context.Context, prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0)
+	for name := range s.blobs {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *MemoryBlobStore) Stat(ctx context.Context, name string) (*BlobAttrs, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	blob, ok := s.blobs[name]
+
+	if !ok {
+		return nil, errors.New(ErrorBlobNotFound)
+	}
+
+	return &BlobAttrs{Name: name, Size: int64(len(blob.data)), Updated: blob.updated}, nil
+}
+
+func (s *MemoryBlobStore) Compose(ctx context.Context, name string, parts []string, opts *PutOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var data []byte
+
+	for _, part := range parts {
+		blob, ok := s.blobs[part]
+
+		if !ok {
+			return errors.New(ErrorBlobNotFound)
+		}
+
+		data = append(data, blob.data...)
+	}
+
+	s.blobs[name] = &memoryBlob{data: data, updated: time.Now()}
+	return nil
+}
@@ -0,0 +1,284 @@
+package gscrypto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"golang.org/x/net/context"
+)
+
+const (
+	// s3PartSize is the size of each part of a multipart upload, uploads are
+	// streamed so their size is unknown up front and every object larger
+	// than one part is uploaded in parts.
+	s3PartSize = 16 * 1024 * 1024
+
+	// s3MinPartSize is the smallest part S3 accepts, except for the last one.
+	s3MinPartSize = 5 * 1024 * 1024
+
+	s3ErrorNoSuchKey = "NoSuchKey"
+)
+
+// s3BlobStore stores objects in an S3 compatible service such as AWS S3 or MinIO.
+type s3BlobStore struct {
+	client   *minio.Client
+	bucket   string
+	partSize uint64
+}
+
+var _ BlobStore = &s3BlobStore{}
+
+func newS3BlobStore(endpoint, region, accessKey, secretKey, bucket string, secure bool) (*s3BlobStore, error) {
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: secure,
+		Region: region,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3BlobStore{client: client, bucket: bucket, partSize: s3PartSize}, nil
+}
+
+// s3StorageClass maps the storage_class upload field, which uses Google Cloud
+// Storage names, onto S3 storage classes. S3 class names are accepted as is,
+// except for the classes which need an explicit restore before an object can
+// be downloaded again.
+func s3StorageClass(class string) string {
+	switch strings.ToUpper(class) {
+	case "STANDARD", "MULTI_REGIONAL", "REGIONAL", "DURABLE_REDUCED_AVAILABILITY":
+		return "STANDARD"
+	case "NEARLINE":
+		return "STANDARD_IA"
+	case "COLDLINE", "ARCHIVE":
+		return "GLACIER_IR"
+	case "STANDARD_IA", "ONEZONE_IA", "INTELLIGENT_TIERING", "GLACIER_IR", "REDUCED_REDUNDANCY":
+		return strings.ToUpper(class)
+	default:
+		// use the bucket default
+		return ""
+	}
+}
+
+func isS3NotFound(err error) bool {
+	return minio.ToErrorResponse(err).Code == s3ErrorNoSuchKey
+}
+
+// s3BlobWriter feeds a streaming multipart upload running in the background,
+// Close waits for the upload to complete. done is closed once it did, err is
+// then its result.
+type s3BlobWriter struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	err  error
+}
+
+func (w *s3BlobWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+// CloseWithError fails the upload with err, nothing is stored.
+func (w *s3BlobWriter) CloseWithError(err error) error {
+	w.pw.CloseWithError(err)
+	<-w.done
+	return nil
+}
+
+func (w *s3BlobWriter) Close() error {
+	w.pw.Close()
+	<-w.done
+	return w.err
+}
+
+func (s *s3BlobStore) Put(ctx context.Context, name string, opts *PutOptions) (BlobWriter, error) {
+	if name == "" {
+		return nil, errors.New(ErrorInvalidBlobName)
+	}
+
+	putOptions := minio.PutObjectOptions{
+		ContentType:  "application/octet-stream",
+		CacheControl: "public, max-age=86400",
+		PartSize:     s.partSize,
+	}
+
+	if opts != nil {
+		putOptions.StorageClass = s3StorageClass(opts.StorageClass)
+	}
+
+	pr, pw := io.Pipe()
+	w := &s3BlobWriter{pw: pw, done: make(chan struct{})}
+
+	go func() {
+		_, err := s.client.PutObject(ctx, s.bucket, name, pr, -1, putOptions)
+		// unblock the writer if the upload failed before consuming everything
+		pr.CloseWithError(err)
+		w.err = err
+		close(w.done)
+	}()
+
+	return w, nil
+}
+
+func (s *s3BlobStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return s.getObject(ctx, name, minio.GetObjectOptions{})
+}
+
+func (s *s3BlobStore) getObject(ctx context.Context, name string, opts minio.GetObjectOptions) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, name, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// GetObject is lazy, stat the object so a missing key is reported here
+	// rather than on the first read.
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		if isS3NotFound(err) {
+			return nil, errors.New(ErrorBlobNotFound)
+		}
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+func (s *s3BlobStore) GetRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		// S3 has no way to ask for an empty range
+		if _, err := s.Stat(ctx, name); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	opts := minio.GetObjectOptions{}
+
+	var err error
+	switch {
+	case length > 0:
+		err = opts.SetRange(offset, offset+length-1)
+	case offset > 0:
+		err = opts.SetRange(offset, 0)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.getObject(ctx, name, opts)
+}
+
+func (s *s3BlobStore) Compose(ctx context.Context, name string, parts []string, opts *PutOptions) error {
+	srcs := make([]minio.CopySrcOptions, len(parts))
+	serverSide := len(parts) > 0
+
+	for i, part := range parts {
+		attrs, err := s.Stat(ctx, part)
+
+		if err != nil {
+			return err
+		}
+
+		// S3 composes objects as a multipart upload copying each part, so
+		// they're subject to the same minimum part size
+		if attrs.Size < s3MinPartSize && i < len(parts)-1 {
+			serverSide = false
+		}
+
+		srcs[i] = minio.CopySrcOptions{Bucket: s.bucket, Object: part}
+	}
+
+	if !serverSide {
+		return s.composeByCopy(ctx, name, parts, opts)
+	}
+
+	dst := minio.CopyDestOptions{
+		Bucket:       s.bucket,
+		Object:       name,
+		ContentType:  "application/octet-stream",
+		CacheControl: "public, max-age=86400",
+	}
+
+	if opts != nil {
+		if class := s3StorageClass(opts.StorageClass); class != "" {
+			dst.UserMetadata = map[string]string{"X-Amz-Storage-Class": class}
+			dst.ReplaceMetadata = true
+		}
+	}
+
+	_, err := s.client.ComposeObject(ctx, dst, srcs...)
+	return err
+}
+
+// composeByCopy downloads parts and uploads them again as one object, for
+// parts too small to be composed by S3.
+func (s *s3BlobStore) composeByCopy(ctx context.Context, name string, parts []string, opts *PutOptions) error {
+	w, err := s.Put(ctx, name, opts)
+
+	if err != nil {
+		return err
+	}
+
+	for _, part := range parts {
+		r, err := s.Get(ctx, part)
+
+		if err != nil {
+			w.CloseWithError(err)
+			return err
+		}
+
+		_, err = io.Copy(w, r)
+		r.Close()
+
+		if err != nil {
+			w.CloseWithError(err)
+			return err
+		}
+	}
+
+	return w.Close()
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, name string) error {
+	// S3 deletes are idempotent, check the object exists to behave like
+	// the other backends.
+	if _, err := s.Stat(ctx, name); err != nil {
+		return err
+	}
+
+	return s.client.RemoveObject(ctx, s.bucket, name, minio.RemoveObjectOptions{})
+}
+
+func (s *s3BlobStore) List(ctx context.Context, prefix string) ([]string, error) {
+	names := make([]string, 0)
+
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		names = append(names, obj.Key)
+	}
+
+	return names, nil
+}
+
+func (s *s3BlobStore) Stat(ctx context.Context, name string) (*BlobAttrs, error) {
+	info, err := s.client.StatObject(ctx, s.bucket, name, minio.StatObjectOptions{})
+
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, errors.New(ErrorBlobNotFound)
+		}
+		return nil, err
+	}
+
+	return &BlobAttrs{Name: info.Key, Size: info.Size, Updated: info.LastModified}, nil
+}
@@ -0,0 +1,195 @@
+package gscrypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+const testS3Bucket = "gscrypto-testing"
+
+// newTestS3BlobStore runs an in process S3 stand-in, the same requests are
+// sent to it as would be sent to MinIO or AWS.
+func newTestS3BlobStore(t *testing.T) (*s3BlobStore, func()) {
+	backend := s3mem.New()
+	if err := backend.CreateBucket(testS3Bucket); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(gofakes3.New(backend).Server())
+	u, _ := url.Parse(ts.URL)
+
+	s, err := newS3BlobStore(u.Host, "us-east-1", "access", "secret", testS3Bucket, false)
+	if err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+
+	// smallest part size S3 accepts, so the large test case uses several parts
+	s.partSize = 5 * 1024 * 1024
+	return s, ts.Close
+}
+
+func TestS3BlobStore(t *testing.T) {
+	s, closeServer := newTestS3BlobStore(t)
+	defer closeServer()
+
+	type testCase struct {
+		name string
+		size int
+	}
+
+	tests := []testCase{
+		testCase{"empty", 0},
+		testCase{"small", 1024},
+		testCase{"multipart", 12 * 1024 * 1024},
+	}
+
+	ctx := context.Background()
+
+	for _, test := range tests {
+		data := make([]byte, test.size)
+		rand.Read(data)
+
+		w, err := s.Put(ctx, test.name, &PutOptions{StorageClass: "nearline"})
+		assert.NoError(t, err)
+
+		_, err = w.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close(), "upload failed for "+test.name)
+
+		attrs, err := s.Stat(ctx, test.name)
+		assert.NoError(t, err)
+		assert.EqualValues(t, test.size, attrs.Size)
+
+		r, err := s.Get(ctx, test.name)
+		assert.NoError(t, err)
+
+		downloaded, err := ioutil.ReadAll(r)
+		r.Close()
+
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(data, downloaded), "downloaded object differs from upload: "+test.name)
+
+		type byteRange struct {
+			offset, length int64
+		}
+
+		for _, br := range []byteRange{{0, 0}, {0, -1}, {1, 10}, {int64(test.size) / 2, -1}, {int64(test.size) - 1, 1}} {
+			if br.offset < 0 || br.offset+br.length > int64(test.size) {
+				continue
+			}
+
+			expected := data[br.offset:]
+			if br.length >= 0 {
+				expected = expected[:br.length]
+			}
+
+			r, err := s.GetRange(ctx, test.name, br.offset, br.length)
+			assert.NoError(t, err)
+
+			downloaded, err := ioutil.ReadAll(r)
+			r.Close()
+
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(expected, downloaded), "ranged download differs from upload: "+test.name)
+		}
+	}
+
+	names, err := s.List(ctx, "")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"empty", "small", "multipart"}, names)
+
+	names, err = s.List(ctx, "multi")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"multipart"}, names)
+
+	for _, test := range tests {
+		assert.NoError(t, s.Delete(ctx, test.name))
+
+		_, err := s.Get(ctx, test.name)
+		assert.EqualError(t, err, ErrorBlobNotFound)
+
+		_, err = s.Stat(ctx, test.name)
+		assert.EqualError(t, err, ErrorBlobNotFound)
+
+		assert.EqualError(t, s.Delete(ctx, test.name), ErrorBlobNotFound)
+	}
+}
+
+func TestS3Compose(t *testing.T) {
+	s, closeServer := newTestS3BlobStore(t)
+	defer closeServer()
+
+	ctx := context.Background()
+
+	var expected []byte
+	parts := []string{"part-0", "part-1", "part-2"}
+
+	for i, part := range parts {
+		data := make([]byte, 1000*(i+1))
+		rand.Read(data)
+		expected = append(expected, data...)
+
+		w, err := s.Put(ctx, part, nil)
+		assert.NoError(t, err)
+
+		w.Write(data)
+		assert.NoError(t, w.Close())
+	}
+
+	// parts this small can't be composed by S3, they're copied instead
+	assert.NoError(t, s.Compose(ctx, "composed", parts, &PutOptions{StorageClass: "nearline"}))
+
+	r, err := s.Get(ctx, "composed")
+	assert.NoError(t, err)
+
+	downloaded, err := ioutil.ReadAll(r)
+	r.Close()
+
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(expected, downloaded), "composed object differs from its parts")
+
+	names, err := s.List(ctx, "part-")
+	assert.NoError(t, err)
+	assert.Equal(t, parts, names)
+
+	assert.EqualError(t, s.Compose(ctx, "missing", []string{"part-0", "part-3"}, nil), ErrorBlobNotFound)
+
+	_, err = s.Stat(ctx, "missing")
+	assert.EqualError(t, err, ErrorBlobNotFound)
+}
+
+func TestS3StorageClass(t *testing.T) {
+	type testCase struct {
+		formValue    string
+		storageClass string
+	}
+
+	tests := []testCase{
+		testCase{"", ""},
+		testCase{"STANDARD", "STANDARD"},
+		testCase{"MULTI_REGIONAL", "STANDARD"},
+		testCase{"REGIONAL", "STANDARD"},
+		testCase{"NEARLINE", "STANDARD_IA"},
+		testCase{"COLDLINE", "GLACIER_IR"},
+		testCase{"ARCHIVE", "GLACIER_IR"},
+		testCase{"onezone_ia", "ONEZONE_IA"},
+		testCase{"INTELLIGENT_TIERING", "INTELLIGENT_TIERING"},
+		testCase{"GLACIER", ""},
+		testCase{"DEEP_ARCHIVE", ""},
+		testCase{"bogus", ""},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.storageClass, s3StorageClass(test.formValue), test.formValue)
+	}
+}
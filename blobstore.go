@@ -0,0 +1,56 @@
+package gscrypto
+
+import (
+	"io"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	ErrorBlobNotFound    = "no object found in storage"
+	ErrorInvalidBlobName = "invalid object name"
+)
+
+// BlobStore stores the encrypted file contents that File.GoogleCloudObject
+// refers to. Objects are opaque: everything written is already encrypted.
+type BlobStore interface {
+	// Put returns a writer for a new object, the object only becomes
+	// visible once the writer is closed without error.
+	Put(ctx context.Context, name string, opts *PutOptions) (BlobWriter, error)
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// GetRange reads length bytes starting at offset, or everything after
+	// offset if length is negative. offset must not be past the end.
+	GetRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error)
+	// Compose writes a new object holding the contents of parts one after
+	// the other, the parts themselves are left in place.
+	Compose(ctx context.Context, name string, parts []string, opts *PutOptions) error
+	Delete(ctx context.Context, name string) error
+	List(ctx context.Context, prefix string) ([]string, error)
+	Stat(ctx context.Context, name string) (*BlobAttrs, error)
+}
+
+// BlobWriter writes an object returned by BlobStore.Put.
+type BlobWriter interface {
+	io.WriteCloser
+	// CloseWithError discards what was written, the object isn't created.
+	// Calling it after Close does nothing.
+	CloseWithError(err error) error
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type PutOptions struct {
+	// StorageClass is passed as is from the upload form, backends which
+	// don't support storage classes ignore it.
+	StorageClass string
+}
+
+type BlobAttrs struct {
+	Name    string
+	Size    int64
+	Updated time.Time
+}
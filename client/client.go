@@ -0,0 +1,481 @@
+// Package client uses a gscrypto server with a zero-knowledge account. The
+// keys are derived from the password, and files, their names and folders
+// encrypted, before anything is sent, so the server never holds anything
+// which decrypts them:
+//
+//	c := client.New("https://gscrypto.example.com")
+//	if err := c.Login("alice", password); err != nil {
+//		...
+//	}
+//	err := c.Upload("/photos/", "cat.jpg", "image/jpeg", f)
+package client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GregorioDiStefano/gcloud-web-crypto/app/crypto"
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	ErrorNotLoggedIn = "not logged in"
+	ErrorFileExists  = "this filename already exists in folder"
+
+	// the same costs as the server's defaults
+	DefaultKDFTime    = 3
+	DefaultKDFMemory  = 64 * 1024
+	DefaultKDFThreads = 4
+
+	keyIterations = 50000
+)
+
+// Client is a session of a zero-knowledge account, it's not safe for
+// concurrent use.
+type Client struct {
+	URL        string
+	HTTPClient *http.Client
+
+	// the KDF costs of accounts created by Signup, memory is in KiB
+	KDFTime    int
+	KDFMemory  int
+	KDFThreads int
+
+	token string
+	keys  *crypto.CryptoData
+}
+
+// File is a file or folder listed by List, Name and the metadata are
+// decrypted.
+type File struct {
+	ID          int64     `json:"id"`
+	Type        string    `json:"type"`
+	Name        string    `json:"name"`
+	FullPath    string    `json:"fullpath"`
+	UploadDate  time.Time `json:"upload_date"`
+	FileType    string    `json:"filetype"`
+	FileSize    int64     `json:"filesize"`
+	Description string    `json:"description"`
+	Tags        []string  `json:"tags"`
+
+	EncryptedName []byte `json:"encrypted_name"`
+	DataKey       []byte `json:"data_key"`
+	Metadata      []byte `json:"metadata"`
+}
+
+// keyParams mirrors what the server keeps for zero-knowledge accounts.
+type keyParams struct {
+	Salt       []byte `json:"salt"`
+	KDFTime    int    `json:"kdf_time"`
+	KDFMemory  int    `json:"kdf_memory"`
+	KDFThreads int    `json:"kdf_threads"`
+
+	EncryptedPGPKey     []byte `json:"encrypted_pgp_key,omitempty"`
+	EncryptedHMACSecret []byte `json:"encrypted_hmac_secret,omitempty"`
+	KeySalt             []byte `json:"key_salt,omitempty"`
+	KeyIterations       int    `json:"key_iterations,omitempty"`
+}
+
+// New returns a client of the server at url.
+func New(url string) *Client {
+	return &Client{
+		URL:        strings.TrimRight(url, "/"),
+		HTTPClient: http.DefaultClient,
+		KDFTime:    DefaultKDFTime,
+		KDFMemory:  DefaultKDFMemory,
+		KDFThreads: DefaultKDFThreads,
+	}
+}
+
+// deriveKeys derives the key wrapping the account's keys, and the login key
+// sent instead of the password, from password.
+func deriveKeys(password string, p *keyParams) (*crypto.CryptoData, string) {
+	key := argon2.IDKey([]byte(password), p.Salt, uint32(p.KDFTime), uint32(p.KDFMemory), uint8(p.KDFThreads), 64)
+	return &crypto.CryptoData{SymmetricKey: key[:32]}, base64.StdEncoding.EncodeToString(key[32:])
+}
+
+// Signup creates a zero-knowledge account, it has to be enabled by the admin
+// before it can log in unless it's the admin. The server doesn't see the
+// password, so checking it's strong enough is up to the caller.
+func (c *Client) Signup(username, password string) error {
+	salt, err := crypto.RandomBytes(32)
+
+	if err != nil {
+		return err
+	}
+
+	keySalt, err := crypto.RandomBytes(32)
+
+	if err != nil {
+		return err
+	}
+
+	pgpKey, err := crypto.RandomBytes(32)
+
+	if err != nil {
+		return err
+	}
+
+	hmacSecret, err := crypto.RandomBytes(64)
+
+	if err != nil {
+		return err
+	}
+
+	params := &keyParams{Salt: salt, KDFTime: c.KDFTime, KDFMemory: c.KDFMemory, KDFThreads: c.KDFThreads,
+		KeySalt: keySalt, KeyIterations: keyIterations}
+	wrappingKey, loginKey := deriveKeys(password, params)
+
+	if params.EncryptedPGPKey, err = wrappingKey.EncryptText(pgpKey); err != nil {
+		return err
+	}
+
+	if params.EncryptedHMACSecret, err = wrappingKey.EncryptText(hmacSecret); err != nil {
+		return err
+	}
+
+	signup := map[string]interface{}{"username": username, "password": loginKey, "zero_knowledge": params}
+	return c.doJSON("POST", "/account/signup", signup, nil, http.StatusCreated)
+}
+
+// Login logs in and unwraps the account's keys.
+func (c *Client) Login(username, password string) error {
+	var params keyParams
+
+	if err := c.doJSON("GET", "/account/kdf/"+url.PathEscape(username), nil, &params, http.StatusOK); err != nil {
+		return err
+	}
+
+	wrappingKey, loginKey := deriveKeys(password, &params)
+
+	var login struct {
+		Token string `json:"token"`
+	}
+
+	credentials := map[string]string{"username": username, "password": loginKey}
+	if err := c.doJSON("POST", "/account/login", credentials, &login, http.StatusOK); err != nil {
+		return err
+	}
+
+	c.token = login.Token
+
+	if err := c.doJSON("GET", "/auth/account/keys", nil, &params, http.StatusOK); err != nil {
+		return err
+	}
+
+	pgpKey, err := wrappingKey.DecryptText(params.EncryptedPGPKey)
+
+	if err != nil {
+		return err
+	}
+
+	hmacSecret, err := wrappingKey.DecryptText(params.EncryptedHMACSecret)
+
+	if err != nil {
+		return err
+	}
+
+	c.keys = crypto.NewCryptoData(pgpKey, hmacSecret, params.KeySalt, params.KeyIterations)
+	return nil
+}
+
+// Upload encrypts r and stores it as name in folder. The content type is
+// encrypted with the folder, it defaults to application/octet-stream.
+func (c *Client) Upload(folder, name, contentType string, r io.Reader) error {
+	if c.keys == nil {
+		return errors.New(ErrorNotLoggedIn)
+	}
+
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	folder = normalizeFolder(folder)
+	dataKey, wrappedDataKey, err := c.keys.NewDataKey()
+
+	if err != nil {
+		return err
+	}
+
+	encryptedName, err := dataKey.EncryptText([]byte(name))
+
+	if err != nil {
+		return err
+	}
+
+	// the server knows the size, it's not worth reading r twice for
+	metadata, err := dataKey.EncryptMetadata(&crypto.FileMetadata{Folder: folder, FileType: contentType})
+
+	if err != nil {
+		return err
+	}
+
+	folderNames, err := c.keys.EncryptFolderNames(folder)
+
+	if err != nil {
+		return err
+	}
+
+	encodedNames := make([]string, 0, len(folderNames))
+	for _, n := range folderNames {
+		encodedNames = append(encodedNames, base64.StdEncoding.EncodeToString(n))
+	}
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	go func() {
+		pw.CloseWithError(writeUpload(mw, map[string]string{
+			"virtfolder":    c.keys.FolderIndex(folder),
+			"folder_names":  strings.Join(encodedNames, ","),
+			"filename":      base64.StdEncoding.EncodeToString(encryptedName),
+			"filename_hmac": c.keys.GenerateHMAC([]byte(folder + name)),
+			"data_key":      base64.StdEncoding.EncodeToString(wrappedDataKey),
+			"metadata":      base64.StdEncoding.EncodeToString(metadata),
+		}, dataKey, r))
+	}()
+
+	resp, err := c.do("POST", "/auth/file/", pr, mw.FormDataContentType())
+	pr.Close()
+
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return nil
+	case http.StatusConflict:
+		return errors.New(ErrorFileExists)
+	default:
+		return statusError(resp)
+	}
+}
+
+// writeUpload writes the fields of an upload, and then the file encrypted by
+// dataKey, to mw.
+func writeUpload(mw *multipart.Writer, fields map[string]string, dataKey *crypto.CryptoData, r io.Reader) error {
+	for name, value := range fields {
+		if err := mw.WriteField(name, value); err != nil {
+			return err
+		}
+	}
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="file"; filename="encrypted"`)
+	header.Set("Content-Type", "application/octet-stream")
+
+	w, err := mw.CreatePart(header)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := dataKey.EncryptStream(r, w); err != nil {
+		return err
+	}
+	return mw.Close()
+}
+
+// List returns the files and folders in folder.
+func (c *Client) List(folder string) ([]File, error) {
+	if c.keys == nil {
+		return nil, errors.New(ErrorNotLoggedIn)
+	}
+
+	var files []File
+	folder = normalizeFolder(folder)
+	index := c.keys.FolderIndex(folder)
+
+	if err := c.doJSON("GET", "/auth/list/fs?path="+url.QueryEscape(index), nil, &files, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	for i := range files {
+		if err := c.decryptFile(folder, &files[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// decryptFile decrypts the name and metadata of f, listed in folder. Folders
+// are named the way the server names them, with slashes around.
+func (c *Client) decryptFile(folder string, f *File) error {
+	if f.Type == "folder" {
+		name, err := c.keys.DecryptText(f.EncryptedName)
+
+		if err != nil {
+			return err
+		}
+
+		f.Name = normalizeFolder(string(name))
+		f.FullPath = normalizeFolder(filepath.Join(folder, string(name)))
+		return nil
+	}
+
+	dataKey, err := c.keys.DataKey(f.DataKey)
+
+	if err != nil {
+		return err
+	}
+
+	name, err := dataKey.DecryptText(f.EncryptedName)
+
+	if err != nil {
+		return err
+	}
+
+	metadata, err := dataKey.DecryptMetadata(f.Metadata)
+
+	if err != nil {
+		return err
+	}
+
+	f.Name = string(name)
+	f.FullPath = filepath.Join(metadata.Folder, string(name))
+	f.FileType, f.Description, f.Tags = metadata.FileType, metadata.Description, metadata.Tags
+	return nil
+}
+
+// Download decrypts the file id into w and returns its name.
+func (c *Client) Download(id int64, w io.Writer) (string, error) {
+	if c.keys == nil {
+		return "", errors.New(ErrorNotLoggedIn)
+	}
+
+	resp, err := c.do("GET", "/auth/file/"+strconv.FormatInt(id, 10), nil, "")
+
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", statusError(resp)
+	}
+
+	wrappedDataKey, err := base64.StdEncoding.DecodeString(resp.Header.Get("X-Data-Key"))
+
+	if err != nil {
+		return "", err
+	}
+
+	encryptedName, err := base64.StdEncoding.DecodeString(resp.Header.Get("X-Encrypted-Filename"))
+
+	if err != nil {
+		return "", err
+	}
+
+	dataKey, err := c.keys.DataKey(wrappedDataKey)
+
+	if err != nil {
+		return "", err
+	}
+
+	name, err := dataKey.DecryptText(encryptedName)
+
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := dataKey.NewDecryptReader(resp.Body)
+
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := io.Copy(w, plaintext); err != nil {
+		return "", err
+	}
+	return string(name), nil
+}
+
+func (c *Client) do(method, path string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.URL+path, body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if c.token != "" {
+		req.AddCookie(&http.Cookie{Name: "jwt", Value: c.token})
+	}
+
+	return c.HTTPClient.Do(req)
+}
+
+// doJSON sends request, unless it's nil, as JSON and decodes the response
+// into response if its status is expected.
+func (c *Client) doJSON(method, path string, request, response interface{}, expected int) error {
+	var body io.Reader
+	var contentType string
+
+	if request != nil {
+		encoded, err := json.Marshal(request)
+
+		if err != nil {
+			return err
+		}
+		body, contentType = bytes.NewReader(encoded), "application/json"
+	}
+
+	resp, err := c.do(method, path, body, contentType)
+
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expected {
+		return statusError(resp)
+	}
+
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+func statusError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// normalizeFolder formats folder the way the server does, the HMAC of a file
+// is computed over it.
+func normalizeFolder(folder string) string {
+	folder = filepath.Clean(folder)
+
+	if folder == "." {
+		return "/"
+	}
+
+	if !strings.HasPrefix(folder, "/") {
+		folder = "/" + folder
+	}
+
+	if !strings.HasSuffix(folder, "/") {
+		folder = folder + "/"
+	}
+	return folder
+}
@@ -1,8 +1,15 @@
 package gscrypto
 
 import (
-	"log"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 
 	"cloud.google.com/go/datastore"
 	"cloud.google.com/go/storage"
@@ -10,45 +17,344 @@ import (
 	"golang.org/x/net/context"
 )
 
-var (
-	FileStructDB FileDatabase
-	UserDB       UserDatabase
+const (
+	DatabaseBackendDatastore = "datastore"
+	DatabaseBackendMemory    = "memory"
 
-	Password          []byte
-	PlainTextPassword []byte
+	StorageBackendGCS   = "gcs"
+	StorageBackendLocal = "local"
+	StorageBackendS3    = "s3"
 
-	StorageBucket     *storage.BucketHandle
-	StorageBucketName string
+	// the memory backends lose everything on restart, they're meant for tests
+	StorageBackendMemory = "memory"
 
-	SecretKey string
+	SessionBackendMemory = "memory"
+	SessionBackendRedis  = "redis"
 )
 
-func init() {
-	var err error
-	ProjectID := os.Getenv("GOOGLE_CLOUD_PROJECT_ID")
-	StorageBucketName := os.Getenv("GOOGLE_CLOUD_STORAGE_BUCKET")
-	SecretKey = os.Getenv("JWT_KEY")
+// Config holds everything needed to run a server. It can be filled in
+// directly, or built by LoadConfig from a JSON file, environment variables
+// and command line flags.
+type Config struct {
+	ListenAddress       string `json:"listen_address"`
+	JWTKey              string `json:"jwt_key"`
+	GoogleCaptchaSecret string `json:"google_captcha_secret"`
 
-	if ProjectID == "" || StorageBucketName == "" || SecretKey == "" {
-		panic("did you set GOOGLE_CLOUD_PROJECT_ID, GOOGLE_CLOUD_STORAGE_BUCKET and JWT_KEY?")
+	// DatabaseBackend is one of "datastore", "sqlite", "postgres" or "memory"
+	DatabaseBackend      string `json:"database_backend"`
+	GoogleCloudProjectID string `json:"google_cloud_project_id"`
+	DatabaseURL          string `json:"database_url"`
+
+	// StorageBackend is one of "gcs", "local", "s3" or "memory"
+	StorageBackend           string `json:"storage_backend"`
+	GoogleCloudStorageBucket string `json:"google_cloud_storage_bucket"`
+	LocalStoragePath         string `json:"local_storage_path"`
+	S3Endpoint               string `json:"s3_endpoint"`
+	S3Region                 string `json:"s3_region"`
+	S3Bucket                 string `json:"s3_bucket"`
+	S3AccessKey              string `json:"s3_access_key"`
+	S3SecretKey              string `json:"s3_secret_key"`
+
+	// plain http is only meant for a local MinIO
+	S3Insecure bool `json:"s3_insecure"`
+
+	// Argon2id costs of new keys and password hashes, zero means the
+	// default. Users whose keys were derived with lower costs are upgraded
+	// when they log in, so these can be raised at any time.
+	KDFTime    int `json:"kdf_time"`
+	KDFMemory  int `json:"kdf_memory"`
+	KDFThreads int `json:"kdf_threads"`
+
+	// WebAuthn lets users log in with security keys. WebAuthnOrigin is the
+	// URL the web app is served from, and keys are registered for the domain
+	// WebAuthnRPID, the host of the origin or one it's part of. Both are
+	// required, the host requests claim to be made to can't be trusted.
+	WebAuthn       bool   `json:"webauthn"`
+	WebAuthnOrigin string `json:"webauthn_origin"`
+	WebAuthnRPID   string `json:"webauthn_rp_id"`
+
+	// SessionBackend is "memory", the default, or "redis". Servers sharing
+	// a redis backend, and the same JWT key, share their logged in users.
+	SessionBackend string `json:"session_backend"`
+	RedisURL       string `json:"redis_url"`
+}
+
+// configFields maps every setting to its environment variable and flag.
+var configFields = []struct {
+	env   string
+	flag  string
+	usage string
+	field func(c *Config) interface{}
+}{
+	{"LISTEN_ADDRESS", "listen", "address to listen on", func(c *Config) interface{} { return &c.ListenAddress }},
+	{"JWT_KEY", "jwt-key", "secret used to sign login tokens", func(c *Config) interface{} { return &c.JWTKey }},
+	{"GOOGLE_CAPTCHA_SECRET", "google-captcha-secret", "reCAPTCHA secret, required outside of debug mode", func(c *Config) interface{} { return &c.GoogleCaptchaSecret }},
+	{"DATABASE_BACKEND", "database-backend", "datastore, sqlite, postgres or memory", func(c *Config) interface{} { return &c.DatabaseBackend }},
+	{"GOOGLE_CLOUD_PROJECT_ID", "google-cloud-project-id", "project of the datastore backend", func(c *Config) interface{} { return &c.GoogleCloudProjectID }},
+	{"DATABASE_URL", "database-url", "data source of the sqlite and postgres backends", func(c *Config) interface{} { return &c.DatabaseURL }},
+	{"STORAGE_BACKEND", "storage-backend", "gcs, local, s3 or memory", func(c *Config) interface{} { return &c.StorageBackend }},
+	{"GOOGLE_CLOUD_STORAGE_BUCKET", "google-cloud-storage-bucket", "bucket of the gcs backend", func(c *Config) interface{} { return &c.GoogleCloudStorageBucket }},
+	{"LOCAL_STORAGE_PATH", "local-storage-path", "directory of the local backend", func(c *Config) interface{} { return &c.LocalStoragePath }},
+	{"S3_ENDPOINT", "s3-endpoint", "host[:port] of the s3 backend", func(c *Config) interface{} { return &c.S3Endpoint }},
+	{"S3_REGION", "s3-region", "region of the s3 backend", func(c *Config) interface{} { return &c.S3Region }},
+	{"S3_BUCKET", "s3-bucket", "bucket of the s3 backend", func(c *Config) interface{} { return &c.S3Bucket }},
+	{"S3_ACCESS_KEY", "s3-access-key", "access key of the s3 backend", func(c *Config) interface{} { return &c.S3AccessKey }},
+	{"S3_SECRET_KEY", "s3-secret-key", "secret key of the s3 backend", func(c *Config) interface{} { return &c.S3SecretKey }},
+	{"S3_INSECURE", "s3-insecure", "use plain http for the s3 backend", func(c *Config) interface{} { return &c.S3Insecure }},
+	{"KDF_TIME", "kdf-time", "Argon2id passes over memory", func(c *Config) interface{} { return &c.KDFTime }},
+	{"KDF_MEMORY", "kdf-memory", "Argon2id memory in KiB", func(c *Config) interface{} { return &c.KDFMemory }},
+	{"KDF_THREADS", "kdf-threads", "Argon2id parallelism", func(c *Config) interface{} { return &c.KDFThreads }},
+	{"WEBAUTHN", "webauthn", "let users log in with security keys", func(c *Config) interface{} { return &c.WebAuthn }},
+	{"WEBAUTHN_ORIGIN", "webauthn-origin", "URL the web app is served from, for security keys", func(c *Config) interface{} { return &c.WebAuthnOrigin }},
+	{"WEBAUTHN_RP_ID", "webauthn-rp-id", "domain security keys are registered for", func(c *Config) interface{} { return &c.WebAuthnRPID }},
+	{"SESSION_BACKEND", "session-backend", "memory or redis", func(c *Config) interface{} { return &c.SessionBackend }},
+	{"REDIS_URL", "redis-url", "URL of the redis session backend, such as redis://host:6379/0", func(c *Config) interface{} { return &c.RedisURL }},
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		ListenAddress:   ":3000",
+		DatabaseBackend: DatabaseBackendDatastore,
+		StorageBackend:  StorageBackendGCS,
+		SessionBackend:  SessionBackendMemory,
 	}
+}
 
-	FileStructDB, err = configureDatastoreDB(ProjectID)
+// LoadFile overrides the settings found in the JSON file at path.
+func (c *Config) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
 
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	UserDB, err = configureDatastoreDB(ProjectID)
+	if err := json.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("could not parse %s: %v", path, err)
+	}
+	return nil
+}
 
-	if err != nil {
-		log.Fatal(err)
+// LoadEnv overrides the settings whose environment variable is set.
+func (c *Config) LoadEnv(getenv func(string) string) error {
+	for _, f := range configFields {
+		value := getenv(f.env)
+
+		if value == "" {
+			continue
+		}
+
+		switch field := f.field(c).(type) {
+		case *string:
+			*field = value
+		case *bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", f.env, err)
+			}
+			*field = b
+		case *int:
+			i, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", f.env, err)
+			}
+			*field = i
+		}
 	}
+	return nil
+}
 
-	StorageBucket, err = configureStorage(StorageBucketName)
+// RegisterFlags adds a flag for every setting to fs. The current values are
+// the defaults, so flags override whatever was loaded before parsing.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	for _, f := range configFields {
+		usage := f.usage + " (" + f.env + ")"
 
-	if err != nil {
-		log.Fatal(err)
+		switch field := f.field(c).(type) {
+		case *string:
+			fs.StringVar(field, f.flag, *field, usage)
+		case *bool:
+			fs.BoolVar(field, f.flag, *field, usage)
+		case *int:
+			fs.IntVar(field, f.flag, *field, usage)
+		}
+	}
+}
+
+// LoadConfig builds the configuration of the gscrypto binary. The defaults are
+// overridden by the JSON file given by -config or GSCRYPTO_CONFIG, then by the
+// environment and finally by the command line flags.
+func LoadConfig(args []string) (*Config, error) {
+	c := DefaultConfig()
+
+	// the first pass only looks for -config, the flags are parsed again
+	// once the file and the environment are loaded so they win.
+	fs := flag.NewFlagSet("gscrypto", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("GSCRYPTO_CONFIG"), "path to a JSON config file (GSCRYPTO_CONFIG)")
+	DefaultConfig().RegisterFlags(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configPath != "" {
+		if err := c.LoadFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.LoadEnv(os.Getenv); err != nil {
+		return nil, err
+	}
+
+	fs = flag.NewFlagSet("gscrypto", flag.ContinueOnError)
+	fs.String("config", "", "")
+	c.RegisterFlags(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	return c, c.Validate()
+}
+
+// Validate checks that the settings needed by the selected backends are set.
+func (c *Config) Validate() error {
+	if c.JWTKey == "" {
+		return errors.New("did you set JWT_KEY?")
+	}
+
+	switch c.DatabaseBackend {
+	case DatabaseBackendDatastore:
+		if c.GoogleCloudProjectID == "" {
+			return errors.New("did you set GOOGLE_CLOUD_PROJECT_ID?")
+		}
+	case SQLDialectSQLite, SQLDialectPostgres:
+		if c.DatabaseURL == "" {
+			return errors.New("did you set DATABASE_URL?")
+		}
+	case DatabaseBackendMemory:
+	default:
+		return errors.New("unknown DATABASE_BACKEND: " + c.DatabaseBackend)
+	}
+
+	switch c.StorageBackend {
+	case StorageBackendGCS:
+		if c.GoogleCloudStorageBucket == "" {
+			return errors.New("did you set GOOGLE_CLOUD_STORAGE_BUCKET?")
+		}
+	case StorageBackendLocal:
+		if c.LocalStoragePath == "" {
+			return errors.New("did you set LOCAL_STORAGE_PATH?")
+		}
+	case StorageBackendS3:
+		if c.S3Endpoint == "" || c.S3Bucket == "" {
+			return errors.New("did you set S3_ENDPOINT and S3_BUCKET?")
+		}
+	case StorageBackendMemory:
+	default:
+		return errors.New("unknown STORAGE_BACKEND: " + c.StorageBackend)
+	}
+
+	switch c.SessionBackend {
+	case SessionBackendMemory, "":
+	case SessionBackendRedis:
+		if c.RedisURL == "" {
+			return errors.New("did you set REDIS_URL?")
+		}
+	default:
+		return errors.New("unknown SESSION_BACKEND: " + c.SessionBackend)
+	}
+
+	if c.WebAuthn {
+		if c.WebAuthnOrigin == "" || c.WebAuthnRPID == "" {
+			return errors.New("did you set WEBAUTHN_ORIGIN and WEBAUTHN_RP_ID?")
+		}
+
+		origin, err := url.Parse(c.WebAuthnOrigin)
+
+		if err != nil || origin.Scheme == "" || origin.Host == "" {
+			return errors.New("WEBAUTHN_ORIGIN must be a URL such as https://example.com")
+		}
+
+		if host := origin.Hostname(); host != c.WebAuthnRPID && !strings.HasSuffix(host, "."+c.WebAuthnRPID) {
+			return errors.New("WEBAUTHN_RP_ID must be the host of WEBAUTHN_ORIGIN or a domain it's part of")
+		}
+	}
+
+	if kdf := c.KDF(); kdf.Time < 1 || kdf.Memory < MinKDFMemory || kdf.Threads < 1 || kdf.Threads > 255 {
+		return fmt.Errorf("KDF_TIME must be at least 1, KDF_MEMORY at least %d and KDF_THREADS between 1 and 255", MinKDFMemory)
+	}
+
+	return nil
+}
+
+// KDF returns the key derivation used for new keys and password hashes.
+func (c *Config) KDF() KDFParams {
+	kdf := KDFParams{Version: KDFArgon2id, Time: c.KDFTime, Memory: c.KDFMemory, Threads: c.KDFThreads}
+
+	if kdf.Time == 0 {
+		kdf.Time = DefaultKDFTime
+	}
+	if kdf.Memory == 0 {
+		kdf.Memory = DefaultKDFMemory
+	}
+	if kdf.Threads == 0 {
+		kdf.Threads = DefaultKDFThreads
+	}
+	return kdf
+}
+
+// Database stores files, users and uploads, every backend implements all of
+// them.
+type Database interface {
+	FileDatabase
+	UserDatabase
+	UploadDatabase
+}
+
+// OpenDatabase connects to the database backend selected by c.
+func OpenDatabase(c *Config) (Database, error) {
+	switch c.DatabaseBackend {
+	case DatabaseBackendDatastore:
+		return configureDatastoreDB(c.GoogleCloudProjectID)
+	case SQLDialectSQLite, SQLDialectPostgres:
+		return newSQLDB(c.DatabaseBackend, c.DatabaseURL)
+	case DatabaseBackendMemory:
+		return NewMemoryDB(), nil
+	default:
+		return nil, errors.New("unknown DATABASE_BACKEND: " + c.DatabaseBackend)
+	}
+}
+
+// OpenBlobStore connects to the storage backend selected by c.
+func OpenBlobStore(c *Config) (BlobStore, error) {
+	switch c.StorageBackend {
+	case StorageBackendGCS:
+		bucket, err := configureStorage(c.GoogleCloudStorageBucket)
+		if err != nil {
+			return nil, err
+		}
+		return newGCSBlobStore(bucket), nil
+	case StorageBackendLocal:
+		return newLocalBlobStore(c.LocalStoragePath)
+	case StorageBackendS3:
+		return newS3BlobStore(c.S3Endpoint, c.S3Region, c.S3AccessKey, c.S3SecretKey, c.S3Bucket, !c.S3Insecure)
+	case StorageBackendMemory:
+		return NewMemoryBlobStore(), nil
+	default:
+		return nil, errors.New("unknown STORAGE_BACKEND: " + c.StorageBackend)
+	}
+}
+
+// OpenSessionStore connects to the session backend selected by c.
+func OpenSessionStore(c *Config) (SessionStore, error) {
+	switch c.SessionBackend {
+	case SessionBackendMemory, "":
+		return NewMemorySessionStore(), nil
+	case SessionBackendRedis:
+		return newRedisSessionStore(c.RedisURL)
+	default:
+		return nil, errors.New("unknown SESSION_BACKEND: " + c.SessionBackend)
 	}
 }
 
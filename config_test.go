@@ -0,0 +1,77 @@
+package gscrypto
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := ioutil.WriteFile(path, []byte(`{
+		"jwt_key": "from file",
+		"database_backend": "sqlite",
+		"database_url": "from file",
+		"storage_backend": "memory"
+	}`), 0600)
+	assert.Nil(t, err)
+
+	t.Setenv("GSCRYPTO_CONFIG", path)
+	t.Setenv("DATABASE_URL", "from env")
+	t.Setenv("JWT_KEY", "from env")
+	t.Setenv("KDF_TIME", "4")
+	t.Setenv("KDF_MEMORY", "1")
+
+	c, err := LoadConfig([]string{"-jwt-key", "from flag", "-s3-insecure", "-kdf-memory", "131072"})
+	assert.Nil(t, err)
+
+	assert.Equal(t, ":3000", c.ListenAddress)
+	assert.Equal(t, SQLDialectSQLite, c.DatabaseBackend)
+	assert.Equal(t, "from env", c.DatabaseURL)
+	assert.Equal(t, StorageBackendMemory, c.StorageBackend)
+	assert.Equal(t, "from flag", c.JWTKey)
+	assert.True(t, c.S3Insecure)
+	assert.Equal(t, KDFParams{Version: KDFArgon2id, Time: 4, Memory: 131072, Threads: DefaultKDFThreads}, c.KDF())
+
+	t.Setenv("KDF_THREADS", "many")
+	_, err = LoadConfig(nil)
+	assert.NotNil(t, err)
+}
+
+func TestValidateConfig(t *testing.T) {
+	type testCase struct {
+		config        Config
+		expectedError string
+	}
+
+	tests := []testCase{
+		testCase{Config{DatabaseBackend: DatabaseBackendMemory, StorageBackend: StorageBackendMemory}, "did you set JWT_KEY?"},
+		testCase{Config{JWTKey: "a", DatabaseBackend: DatabaseBackendDatastore, StorageBackend: StorageBackendMemory}, "did you set GOOGLE_CLOUD_PROJECT_ID?"},
+		testCase{Config{JWTKey: "a", DatabaseBackend: SQLDialectPostgres, StorageBackend: StorageBackendMemory}, "did you set DATABASE_URL?"},
+		testCase{Config{JWTKey: "a", DatabaseBackend: "mysql", StorageBackend: StorageBackendMemory}, "unknown DATABASE_BACKEND: mysql"},
+		testCase{Config{JWTKey: "a", DatabaseBackend: DatabaseBackendMemory, StorageBackend: StorageBackendGCS}, "did you set GOOGLE_CLOUD_STORAGE_BUCKET?"},
+		testCase{Config{JWTKey: "a", DatabaseBackend: DatabaseBackendMemory, StorageBackend: StorageBackendS3, S3Endpoint: "localhost"}, "did you set S3_ENDPOINT and S3_BUCKET?"},
+		testCase{Config{JWTKey: "a", DatabaseBackend: DatabaseBackendMemory, StorageBackend: StorageBackendMemory, SessionBackend: SessionBackendRedis}, "did you set REDIS_URL?"},
+		testCase{Config{JWTKey: "a", DatabaseBackend: DatabaseBackendMemory, StorageBackend: StorageBackendMemory, SessionBackend: "memcached"}, "unknown SESSION_BACKEND: memcached"},
+		testCase{Config{JWTKey: "a", DatabaseBackend: DatabaseBackendMemory, StorageBackend: StorageBackendMemory, WebAuthn: true, WebAuthnRPID: "example.com"}, "did you set WEBAUTHN_ORIGIN and WEBAUTHN_RP_ID?"},
+		testCase{Config{JWTKey: "a", DatabaseBackend: DatabaseBackendMemory, StorageBackend: StorageBackendMemory, WebAuthn: true, WebAuthnOrigin: "https://example.com"}, "did you set WEBAUTHN_ORIGIN and WEBAUTHN_RP_ID?"},
+		testCase{Config{JWTKey: "a", DatabaseBackend: DatabaseBackendMemory, StorageBackend: StorageBackendMemory, WebAuthn: true, WebAuthnOrigin: "example.com", WebAuthnRPID: "example.com"}, "WEBAUTHN_ORIGIN must be a URL such as https://example.com"},
+		testCase{Config{JWTKey: "a", DatabaseBackend: DatabaseBackendMemory, StorageBackend: StorageBackendMemory, WebAuthn: true, WebAuthnOrigin: "https://notexample.com", WebAuthnRPID: "example.com"}, "WEBAUTHN_RP_ID must be the host of WEBAUTHN_ORIGIN or a domain it's part of"},
+		testCase{Config{JWTKey: "a", DatabaseBackend: DatabaseBackendMemory, StorageBackend: StorageBackendMemory, WebAuthn: true, WebAuthnOrigin: "https://files.example.com:8443", WebAuthnRPID: "example.com"}, ""},
+		testCase{Config{JWTKey: "a", DatabaseBackend: DatabaseBackendMemory, StorageBackend: StorageBackendMemory, KDFMemory: 1024}, "KDF_TIME must be at least 1, KDF_MEMORY at least 8192 and KDF_THREADS between 1 and 255"},
+		testCase{Config{JWTKey: "a", DatabaseBackend: DatabaseBackendMemory, StorageBackend: StorageBackendMemory, KDFThreads: 256}, "KDF_TIME must be at least 1, KDF_MEMORY at least 8192 and KDF_THREADS between 1 and 255"},
+		testCase{Config{JWTKey: "a", DatabaseBackend: DatabaseBackendMemory, StorageBackend: StorageBackendMemory}, ""},
+	}
+
+	for _, test := range tests {
+		err := test.config.Validate()
+
+		if test.expectedError == "" {
+			assert.Nil(t, err)
+		} else if assert.NotNil(t, err) {
+			assert.Equal(t, test.expectedError, err.Error())
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/datastore"
 	"golang.org/x/net/context"
@@ -19,6 +20,8 @@ const (
 )
 
 var _ FileDatabase = &datastoreDB{}
+var _ UserDatabase = &datastoreDB{}
+var _ UploadDatabase = &datastoreDB{}
 
 func newDatastoreDB(client *datastore.Client) (*datastoreDB, error) {
 	ctx := context.Background()
@@ -81,6 +84,29 @@ func (db *datastoreDB) UpdateFile(f *File, id int64) (err error) {
 	return nil
 }
 
+func (db *datastoreDB) IncrementDownloads(user string, id int64) error {
+	ctx := context.Background()
+	key := datastore.IDKey("FileStruct", id, nil)
+
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var f File
+
+		if err := tx.Get(key, &f); err != nil {
+			return fmt.Errorf("could not get file: %v", err)
+		}
+
+		if f.Username != user {
+			return errors.New(ErrorNotRequestingUsers)
+		}
+
+		f.Downloads++
+		_, err := tx.Put(key, &f)
+		return err
+	})
+
+	return err
+}
+
 func (db *datastoreDB) ListFiles(user, path string) ([]File, error) {
 	ctx := context.Background()
 
@@ -137,12 +163,16 @@ func (db *datastoreDB) ListFilesWithTags(tags []string) ([]File, error) {
 		q = q.Filter("Tags =", strings.ToLower(tag))
 	}
 
-	_, err := db.client.GetAll(ctx, q, &encfile)
+	keys, err := db.client.GetAll(ctx, q, &encfile)
 
 	if err != nil {
 		return nil, fmt.Errorf("could not list files: %v", err)
 	}
 
+	for index, key := range keys {
+		encfile[index].ID = key.ID
+	}
+
 	return encfile, nil
 }
 
@@ -159,6 +189,7 @@ func (db *datastoreDB) ListFolders(user, path string) ([]FolderTree, int64, erro
 	} else {
 		for _, ft := range PathToFolderTree(path) {
 			q = datastore.NewQuery("FolderStruct").
+				Filter("Username = ", user).
 				Filter("ParentKey = ", parentFolderKey).
 				Filter("ParentFolder = ", ft.ParentFolder).
 				Filter("Folder = ", ft.Folder).Limit(1)
@@ -245,7 +276,7 @@ func (db *datastoreDB) FilenameHMACExists(user, searchHMAC string) bool {
 	ctx := context.Background()
 	fmt.Println("looking for:", searchHMAC)
 	q := datastore.NewQuery("FileStruct").Filter("FilenameHMAC = ", searchHMAC)
-	q.Filter("Username = ", user)
+	q = q.Filter("Username = ", user)
 
 	encfile := make([]File, 0)
 	_, err := db.client.GetAll(ctx, q, &encfile)
@@ -313,7 +344,11 @@ func (db *datastoreDB) GetAllFiles(user string) ([]*File, error) {
 	q := datastore.NewQuery("FileStruct")
 	q = q.Filter("Username =", user)
 
-	_, err := db.client.GetAll(ctx, q, &encfile)
+	keys, err := db.client.GetAll(ctx, q, &encfile)
+
+	for index, key := range keys {
+		encfile[index].ID = key.ID
+	}
 
 	return encfile, err
 }
@@ -336,3 +371,86 @@ func (db *datastoreDB) ListAllFolders(user, search string, limit int) ([]string,
 	fmt.Println("matching folders: ", matchingFolders)
 	return matchingFolders, err
 }
+
+func (db *datastoreDB) AddUpload(u *Upload) error {
+	ctx := context.Background()
+	k := datastore.NameKey("Upload", u.ID, nil)
+
+	if _, err := db.client.Put(ctx, k, u); err != nil {
+		return fmt.Errorf("could not put upload: %v", err)
+	}
+	return nil
+}
+
+// getUpload loads an upload with get, which is either a client or a transaction Get.
+func (db *datastoreDB) getUpload(get func(*datastore.Key, interface{}) error, user, id string) (*Upload, error) {
+	var u Upload
+
+	err := get(datastore.NameKey("Upload", id, nil), &u)
+
+	if err == datastore.ErrNoSuchEntity {
+		return nil, errors.New(ErrorNoDatabaseEntryFound)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if u.Username != user {
+		return nil, errors.New(ErrorNoDatabaseEntryFound)
+	}
+
+	u.ID = id
+	return &u, nil
+}
+
+func (db *datastoreDB) GetUpload(user, id string) (*Upload, error) {
+	ctx := context.Background()
+	get := func(k *datastore.Key, dst interface{}) error { return db.client.Get(ctx, k, dst) }
+
+	return db.getUpload(get, user, id)
+}
+
+func (db *datastoreDB) UpdateUpload(u *Upload, offset int64) error {
+	ctx := context.Background()
+
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		stored, err := db.getUpload(tx.Get, u.Username, u.ID)
+
+		if err != nil {
+			return err
+		}
+
+		if stored.Offset != offset {
+			return errors.New(ErrorUploadConflict)
+		}
+
+		_, err = tx.Put(datastore.NameKey("Upload", u.ID, nil), u)
+		return err
+	})
+
+	return err
+}
+
+func (db *datastoreDB) DeleteUpload(user, id string) error {
+	ctx := context.Background()
+
+	if _, err := db.GetUpload(user, id); err != nil {
+		return err
+	}
+
+	return db.client.Delete(ctx, datastore.NameKey("Upload", id, nil))
+}
+
+func (db *datastoreDB) ListUploads(before time.Time) ([]*Upload, error) {
+	ctx := context.Background()
+
+	uploads := make([]*Upload, 0)
+	q := datastore.NewQuery("Upload").Filter("CreatedDate <", before)
+
+	keys, err := db.client.GetAll(ctx, q, &uploads)
+
+	for index, key := range keys {
+		uploads[index].ID = key.Name
+	}
+
+	return uploads, err
+}
@@ -0,0 +1,477 @@
+package gscrypto
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryDB is a FileDatabase, UserDatabase and UploadDatabase which keeps
+// everything in memory, it lets the HTTP tests run without Datastore or its emulator.
+type MemoryDB struct {
+	mu sync.RWMutex
+
+	files   map[int64]*File
+	folders map[int64]*FolderTree
+	users   map[int64]*UserEntry
+	uploads map[string]*Upload
+
+	lastFileID   int64
+	lastFolderID int64
+	lastUserID   int64
+}
+
+var _ FileDatabase = &MemoryDB{}
+var _ UserDatabase = &MemoryDB{}
+var _ UploadDatabase = &MemoryDB{}
+
+func NewMemoryDB() *MemoryDB {
+	db := &MemoryDB{}
+	db.Reset()
+	return db
+}
+
+// Reset removes all files, folders, users and uploads.
+func (db *MemoryDB) Reset() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.files = make(map[int64]*File)
+	db.folders = make(map[int64]*FolderTree)
+	db.users = make(map[int64]*UserEntry)
+	db.uploads = make(map[string]*Upload)
+	db.lastFileID, db.lastFolderID, db.lastUserID = 0, 0, 0
+}
+
+// Close closes the database.
+func (db *MemoryDB) Close() {
+	// No op.
+}
+
+// copies are stored and handed out so callers can't modify the database
+// without going through it.
+func copyFile(f *File) *File {
+	c := *f
+	c.Filename = append([]byte(nil), f.Filename...)
+	c.Tags = append([]string(nil), f.Tags...)
+	c.DataKey = append([]byte(nil), f.DataKey...)
+	c.Metadata = append([]byte(nil), f.Metadata...)
+	return &c
+}
+
+func copyFolder(ft *FolderTree) *FolderTree {
+	c := *ft
+	c.EncryptedFolder = append([]byte(nil), ft.EncryptedFolder...)
+	return &c
+}
+
+func copyUser(u *UserEntry) *UserEntry {
+	c := *u
+	c.Hash = append([]byte(nil), u.Hash...)
+	c.EncryptedPGPKey = append([]byte(nil), u.EncryptedPGPKey...)
+	c.EncryptedHMACSecret = append([]byte(nil), u.EncryptedHMACSecret...)
+	c.Salt = append([]byte(nil), u.Salt...)
+	c.KeySalt = append([]byte(nil), u.KeySalt...)
+	c.NextEncryptedPGPKey = append([]byte(nil), u.NextEncryptedPGPKey...)
+	c.NextEncryptedHMACSecret = append([]byte(nil), u.NextEncryptedHMACSecret...)
+	c.PublicKeys = append([]byte(nil), u.PublicKeys...)
+	c.KeyCheck = append([]byte(nil), u.KeyCheck...)
+	c.RecoveryCodes = append([]byte(nil), u.RecoveryCodes...)
+	c.TOTPSecret = append([]byte(nil), u.TOTPSecret...)
+	c.TOTPBackupCodes = append([]byte(nil), u.TOTPBackupCodes...)
+	c.WebAuthnCredentials = append([]byte(nil), u.WebAuthnCredentials...)
+	c.APITokens = append([]byte(nil), u.APITokens...)
+	return &c
+}
+
+func copyUpload(u *Upload) *Upload {
+	c := *u
+	c.Header = append([]byte(nil), u.Header...)
+	c.Pending = append([]byte(nil), u.Pending...)
+	c.HashState = append([]byte(nil), u.HashState...)
+	c.Metadata = append([]byte(nil), u.Metadata...)
+	c.DataKey = append([]byte(nil), u.DataKey...)
+	return &c
+}
+
+func sortIDs(ids []int64) []int64 {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// fileIDs returns the ids of every file in insertion order.
+func (db *MemoryDB) fileIDs() []int64 {
+	ids := make([]int64, 0, len(db.files))
+	for id := range db.files {
+		ids = append(ids, id)
+	}
+	return sortIDs(ids)
+}
+
+func (db *MemoryDB) folderIDs() []int64 {
+	ids := make([]int64, 0, len(db.folders))
+	for id := range db.folders {
+		ids = append(ids, id)
+	}
+	return sortIDs(ids)
+}
+
+func (db *MemoryDB) GetFile(user string, id int64) (*File, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	f, ok := db.files[id]
+
+	if !ok {
+		return nil, errors.New(ErrorNoDatabaseEntryFound)
+	}
+
+	if f.Username != user {
+		return nil, errors.New(ErrorNotRequestingUsers)
+	}
+
+	return copyFile(f), nil
+}
+
+func (db *MemoryDB) AddFile(f *File) (id int64, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.lastFileID++
+	id = db.lastFileID
+
+	stored := copyFile(f)
+	stored.ID = id
+	db.files[id] = stored
+
+	return id, nil
+}
+
+func (db *MemoryDB) UpdateFile(f *File, id int64) (err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stored := copyFile(f)
+	stored.ID = id
+	db.files[id] = stored
+
+	return nil
+}
+
+func (db *MemoryDB) IncrementDownloads(user string, id int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	f, ok := db.files[id]
+
+	if !ok {
+		return errors.New(ErrorNoDatabaseEntryFound)
+	}
+
+	if f.Username != user {
+		return errors.New(ErrorNotRequestingUsers)
+	}
+
+	f.Downloads++
+	return nil
+}
+
+func (db *MemoryDB) ListFiles(user, path string) ([]File, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	files := make([]File, 0)
+	for _, id := range db.fileIDs() {
+		f := db.files[id]
+		if f.Username == user && (path == "" || f.Folder == path) {
+			files = append(files, *copyFile(f))
+		}
+	}
+
+	return files, nil
+}
+
+func (db *MemoryDB) ListTags() ([]string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	tags := []string{}
+
+	for _, f := range db.files {
+		for _, tag := range f.Tags {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	sort.Strings(tags)
+	return tags, nil
+}
+
+func hasTag(f *File, tag string) bool {
+	for _, t := range f.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *MemoryDB) ListFilesWithTags(tags []string) ([]File, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	files := make([]File, 0)
+
+nextFile:
+	for _, id := range db.fileIDs() {
+		f := db.files[id]
+		for _, tag := range tags {
+			if !hasTag(f, strings.ToLower(tag)) {
+				continue nextFile
+			}
+		}
+		files = append(files, *copyFile(f))
+	}
+
+	return files, nil
+}
+
+func (db *MemoryDB) ListFolders(user, path string) ([]FolderTree, int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var parentFolderKey int64
+	folderIDs := db.folderIDs()
+
+	if path != "/" {
+	nextSegment:
+		for _, ft := range PathToFolderTree(path) {
+			for _, id := range folderIDs {
+				f := db.folders[id]
+				if f.Username == user && f.ParentKey == parentFolderKey && f.ParentFolder == ft.ParentFolder && f.Folder == ft.Folder {
+					parentFolderKey = id
+					continue nextSegment
+				}
+			}
+			return nil, 0, nil
+		}
+	}
+
+	folders := make([]FolderTree, 0)
+	for _, id := range folderIDs {
+		f := db.folders[id]
+		if f.Username == user && f.ParentKey == parentFolderKey {
+			folders = append(folders, *copyFolder(f))
+		}
+	}
+
+	return folders, parentFolderKey, nil
+}
+
+func (db *MemoryDB) AddFolder(ft *FolderTree) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.lastFolderID++
+	stored := copyFolder(ft)
+	stored.ID = db.lastFolderID
+	db.folders[stored.ID] = stored
+
+	return stored.ID, nil
+}
+
+func (db *MemoryDB) DeleteFile(user string, id int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	f, ok := db.files[id]
+
+	if !ok {
+		return errors.New(ErrorNoDatabaseEntryFound)
+	} else if f.Username != user {
+		return errors.New(ErrorNotRequestingUsers)
+	}
+
+	delete(db.files, id)
+	return nil
+}
+
+func (db *MemoryDB) DeleteFolder(user string, id int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	f, ok := db.folders[id]
+
+	if !ok || f.Username != user {
+		return errors.New(ErrorNoDatabaseEntryFound)
+	}
+
+	delete(db.folders, id)
+	return nil
+}
+
+func (db *MemoryDB) FilenameHMACExists(user, searchHMAC string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, f := range db.files {
+		if f.Username == user && f.FilenameHMAC == searchHMAC {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *MemoryDB) SetUserEntry(userEntry *UserEntry) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.lastUserID++
+	db.users[db.lastUserID] = copyUser(userEntry)
+
+	return nil
+}
+
+func (db *MemoryDB) UpdateUser(id int64, userEntry *UserEntry) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.users[id] = copyUser(userEntry)
+	return nil
+}
+
+func (db *MemoryDB) GetUserEntry(user string) (*UserEntry, int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for id := int64(1); id <= db.lastUserID; id++ {
+		if u, ok := db.users[id]; ok && u.Username == user {
+			return copyUser(u), id, nil
+		}
+	}
+
+	return nil, 0, errors.New(ErrorNoDatabaseEntryFound)
+}
+
+func (db *MemoryDB) GetUsers() ([]*UserEntry, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	users := make([]*UserEntry, 0)
+	for id := int64(1); id <= db.lastUserID; id++ {
+		if u, ok := db.users[id]; ok {
+			users = append(users, copyUser(u))
+		}
+	}
+
+	return users, nil
+}
+
+func (db *MemoryDB) GetAllFiles(user string) ([]*File, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	files := make([]*File, 0)
+	for _, id := range db.fileIDs() {
+		if f := db.files[id]; f.Username == user {
+			files = append(files, copyFile(f))
+		}
+	}
+
+	return files, nil
+}
+
+func (db *MemoryDB) ListAllFolders(user, search string, limit int) ([]string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	matchingFolders := make([]string, 0)
+
+	for _, f := range db.files {
+		if f.Username == user && strings.HasPrefix(f.Folder, search) && !seen[f.Folder] {
+			seen[f.Folder] = true
+			matchingFolders = append(matchingFolders, f.Folder)
+		}
+	}
+
+	sort.Strings(matchingFolders)
+
+	if limit > 0 && len(matchingFolders) > limit {
+		matchingFolders = matchingFolders[:limit]
+	}
+
+	return matchingFolders, nil
+}
+
+func (db *MemoryDB) AddUpload(u *Upload) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.uploads[u.ID] = copyUpload(u)
+	return nil
+}
+
+func (db *MemoryDB) GetUpload(user, id string) (*Upload, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	u, ok := db.uploads[id]
+
+	if !ok || u.Username != user {
+		return nil, errors.New(ErrorNoDatabaseEntryFound)
+	}
+
+	return copyUpload(u), nil
+}
+
+func (db *MemoryDB) UpdateUpload(u *Upload, offset int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stored, ok := db.uploads[u.ID]
+
+	if !ok || stored.Username != u.Username {
+		return errors.New(ErrorNoDatabaseEntryFound)
+	} else if stored.Offset != offset {
+		return errors.New(ErrorUploadConflict)
+	}
+
+	db.uploads[u.ID] = copyUpload(u)
+	return nil
+}
+
+func (db *MemoryDB) DeleteUpload(user, id string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, ok := db.uploads[id]
+
+	if !ok || u.Username != user {
+		return errors.New(ErrorNoDatabaseEntryFound)
+	}
+
+	delete(db.uploads, id)
+	return nil
+}
+
+func (db *MemoryDB) ListUploads(before time.Time) ([]*Upload, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	uploads := make([]*Upload, 0)
+	for _, u := range db.uploads {
+		if u.CreatedDate.Before(before) {
+			uploads = append(uploads, copyUpload(u))
+		}
+	}
+
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].CreatedDate.Before(uploads[j].CreatedDate) })
+	return uploads, nil
+}
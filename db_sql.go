@@ -0,0 +1,755 @@
+package gscrypto
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	SQLDialectSQLite   = "sqlite"
+	SQLDialectPostgres = "postgres"
+)
+
+//go:embed migrations
+var sqlMigrations embed.FS
+
+// sqlDB stores files, folders, users and uploads in SQLite for single node
+// installs, or in Postgres for bigger ones. Queries are written with '?'
+// placeholders and rewritten for Postgres by rebind.
+type sqlDB struct {
+	db      *sql.DB
+	dialect string
+}
+
+var _ FileDatabase = &sqlDB{}
+var _ UserDatabase = &sqlDB{}
+var _ UploadDatabase = &sqlDB{}
+
+const fileColumns = `id, username, filename, filename_hmac, google_cloud_object, folder, file_type,
+	file_size, upload_date, downloads, description, compressed, sha2, data_key, key_generation, metadata, format_version,
+	public_key_encrypted`
+
+const folderColumns = `id, username, upload_date, parent_key, parent_folder, folder, encrypted_folder, key_generation, format_version`
+
+const userColumns = `username, email, admin, enabled, created_date, hash, encrypted_pgp_key,
+	encrypted_hmac_secret, salt, iterations, key_salt, key_iterations, kdf_version, kdf_time, kdf_memory, kdf_threads,
+	key_generation, next_encrypted_pgp_key, next_encrypted_hmac_secret, zero_knowledge, metadata_encrypted, index_version, public_keys,
+	key_check, recovery_codes, totp_secret, totp_enabled, totp_last_step, totp_backup_codes,
+	webauthn_credentials, webauthn_required, api_tokens`
+
+const uploadColumns = `id, username, length, upload_offset, created_date, object, storage_class, parts,
+	header, segments, pending, hash_state, metadata, data_key, key_generation, format_version`
+
+func newSQLDB(dialect, dataSource string) (*sqlDB, error) {
+	if dialect != SQLDialectSQLite && dialect != SQLDialectPostgres {
+		return nil, fmt.Errorf("unsupported sql dialect: %s", dialect)
+	}
+
+	db, err := sql.Open(dialect, dataSource)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect: %v", err)
+	}
+
+	if dialect == SQLDialectSQLite {
+		// sqlite only allows a single writer, serialize access instead of
+		// failing with "database is locked".
+		db.SetMaxOpenConns(1)
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not connect: %v", err)
+	}
+
+	s := &sqlDB{db: db, dialect: dialect}
+
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not migrate database: %v", err)
+	}
+
+	return s, nil
+}
+
+// migrate applies every embedded migration for the dialect that hasn't been
+// applied yet, each one in its own transaction.
+func (db *sqlDB) migrate() error {
+	if _, err := db.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL)`); err != nil {
+		return err
+	}
+
+	dir := path.Join("migrations", db.dialect)
+	entries, err := sqlMigrations.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+
+		version, err := strconv.Atoi(strings.SplitN(name, "_", 2)[0])
+		if err != nil {
+			return fmt.Errorf("bad migration name %s: %v", name, err)
+		}
+
+		var applied int
+		if err := db.db.QueryRow(db.rebind("SELECT COUNT(*) FROM schema_migrations WHERE version = ?"), version).Scan(&applied); err != nil {
+			return err
+		}
+
+		if applied > 0 {
+			continue
+		}
+
+		migration, err := sqlMigrations.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return err
+		}
+
+		tx, err := db.db.Begin()
+		if err != nil {
+			return err
+		}
+
+		for _, statement := range strings.Split(string(migration), ";") {
+			if strings.TrimSpace(statement) == "" {
+				continue
+			}
+			if _, err := tx.Exec(statement); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %s failed: %v", name, err)
+			}
+		}
+
+		if _, err := tx.Exec(db.rebind("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)"), version, time.Now()); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rebind rewrites '?' placeholders into '$1', '$2'... for Postgres.
+func (db *sqlDB) rebind(query string) string {
+	if db.dialect != SQLDialectPostgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+type execQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// insert runs an INSERT and returns the id of the new row, Postgres has no
+// LastInsertId so the id is returned by the statement itself.
+func (db *sqlDB) insert(q execQuerier, query string, args ...interface{}) (int64, error) {
+	if db.dialect == SQLDialectPostgres {
+		var id int64
+		err := q.QueryRow(db.rebind(query+" RETURNING id"), args...).Scan(&id)
+		return id, err
+	}
+
+	res, err := q.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// Close closes the database.
+func (db *sqlDB) Close() {
+	db.db.Close()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanFile(row rowScanner) (*File, error) {
+	var f File
+	err := row.Scan(&f.ID, &f.Username, &f.Filename, &f.FilenameHMAC, &f.GoogleCloudObject, &f.Folder, &f.FileType,
+		&f.FileSize, &f.UploadDate, &f.Downloads, &f.Description, &f.Compressed, &f.SHA2, &f.DataKey, &f.KeyGeneration, &f.Metadata, &f.FormatVersion,
+		&f.PublicKeyEncrypted)
+	return &f, err
+}
+
+func scanFolder(row rowScanner) (*FolderTree, error) {
+	var ft FolderTree
+	err := row.Scan(&ft.ID, &ft.Username, &ft.UploadDate, &ft.ParentKey, &ft.ParentFolder, &ft.Folder, &ft.EncryptedFolder, &ft.KeyGeneration, &ft.FormatVersion)
+	return &ft, err
+}
+
+func scanUser(row rowScanner) (*UserEntry, int64, error) {
+	var u UserEntry
+	var id int64
+	err := row.Scan(&id, &u.Username, &u.Email, &u.Admin, &u.Enabled, &u.CreatedDate, &u.Hash, &u.EncryptedPGPKey,
+		&u.EncryptedHMACSecret, &u.Salt, &u.Iterations, &u.KeySalt, &u.KeyIterations,
+		&u.KDF.Version, &u.KDF.Time, &u.KDF.Memory, &u.KDF.Threads,
+		&u.KeyGeneration, &u.NextEncryptedPGPKey, &u.NextEncryptedHMACSecret, &u.ZeroKnowledge, &u.MetadataEncrypted, &u.IndexVersion, &u.PublicKeys,
+		&u.KeyCheck, &u.RecoveryCodes, &u.TOTPSecret, &u.TOTPEnabled, &u.TOTPLastStep, &u.TOTPBackupCodes,
+		&u.WebAuthnCredentials, &u.WebAuthnRequired, &u.APITokens)
+	return &u, id, err
+}
+
+// queryFiles runs a query selecting fileColumns and fills in the tags of
+// every returned file.
+func (db *sqlDB) queryFiles(query string, args ...interface{}) ([]*File, error) {
+	rows, err := db.db.Query(db.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make([]*File, 0)
+	byID := make(map[int64]*File)
+
+	for rows.Next() {
+		f, err := scanFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+		byID[f.ID] = f
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return files, nil
+	}
+
+	ids := make([]interface{}, 0, len(files))
+	for _, f := range files {
+		ids = append(ids, f.ID)
+	}
+
+	tagRows, err := db.db.Query(db.rebind("SELECT file_id, tag FROM file_tags WHERE file_id IN ("+placeholders(len(ids))+") ORDER BY tag"), ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer tagRows.Close()
+
+	for tagRows.Next() {
+		var id int64
+		var tag string
+		if err := tagRows.Scan(&id, &tag); err != nil {
+			return nil, err
+		}
+		byID[id].Tags = append(byID[id].Tags, tag)
+	}
+
+	return files, tagRows.Err()
+}
+
+func (db *sqlDB) getFile(id int64) (*File, error) {
+	files, err := db.queryFiles("SELECT "+fileColumns+" FROM files WHERE id = ?", id)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not list files: %v", err)
+	}
+
+	if len(files) == 0 {
+		return nil, errors.New(ErrorNoDatabaseEntryFound)
+	}
+
+	return files[0], nil
+}
+
+func (db *sqlDB) GetFile(user string, id int64) (*File, error) {
+	f, err := db.getFile(id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Username != user {
+		return nil, errors.New(ErrorNotRequestingUsers)
+	}
+
+	return f, nil
+}
+
+func (db *sqlDB) IncrementDownloads(user string, id int64) error {
+	res, err := db.db.Exec(db.rebind("UPDATE files SET downloads = downloads + 1 WHERE id = ? AND username = ?"), id, user)
+
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		// tell a missing file from one of another user
+		_, err := db.GetFile(user, id)
+		return err
+	}
+	return nil
+}
+
+func (db *sqlDB) insertTags(tx *sql.Tx, id int64, tags []string) error {
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+
+		if _, err := tx.Exec(db.rebind("INSERT INTO file_tags (file_id, tag) VALUES (?, ?)"), id, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *sqlDB) AddFile(f *File) (id int64, err error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("could not put file: %v", err)
+	}
+
+	id, err = db.insert(tx, `INSERT INTO files (username, filename, filename_hmac, google_cloud_object, folder,
+		file_type, file_size, upload_date, downloads, description, compressed, sha2, data_key, key_generation, metadata,
+		format_version, public_key_encrypted) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		f.Username, f.Filename, f.FilenameHMAC, f.GoogleCloudObject, f.Folder, f.FileType, f.FileSize,
+		f.UploadDate, f.Downloads, f.Description, f.Compressed, f.SHA2, f.DataKey, f.KeyGeneration, f.Metadata,
+		f.FormatVersion, f.PublicKeyEncrypted)
+
+	if err == nil {
+		err = db.insertTags(tx, id, f.Tags)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("could not put file: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("could not put file: %v", err)
+	}
+
+	return id, nil
+}
+
+func (db *sqlDB) UpdateFile(f *File, id int64) (err error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not put file: %v", err)
+	}
+
+	_, err = tx.Exec(db.rebind(`UPDATE files SET username = ?, filename = ?, filename_hmac = ?, google_cloud_object = ?,
+		folder = ?, file_type = ?, file_size = ?, upload_date = ?, downloads = ?, description = ?, compressed = ?, sha2 = ?,
+		data_key = ?, key_generation = ?, metadata = ?, format_version = ?, public_key_encrypted = ? WHERE id = ?`),
+		f.Username, f.Filename, f.FilenameHMAC, f.GoogleCloudObject, f.Folder, f.FileType, f.FileSize,
+		f.UploadDate, f.Downloads, f.Description, f.Compressed, f.SHA2, f.DataKey, f.KeyGeneration, f.Metadata,
+		f.FormatVersion, f.PublicKeyEncrypted, id)
+
+	if err == nil {
+		_, err = tx.Exec(db.rebind("DELETE FROM file_tags WHERE file_id = ?"), id)
+	}
+
+	if err == nil {
+		err = db.insertTags(tx, id, f.Tags)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("could not put file: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+func derefFiles(files []*File) []File {
+	result := make([]File, 0, len(files))
+	for _, f := range files {
+		result = append(result, *f)
+	}
+	return result
+}
+
+func (db *sqlDB) ListFiles(user, path string) ([]File, error) {
+	var files []*File
+	var err error
+
+	if path != "" {
+		files, err = db.queryFiles("SELECT "+fileColumns+" FROM files WHERE username = ? AND folder = ? ORDER BY id", user, path)
+	} else {
+		files, err = db.queryFiles("SELECT "+fileColumns+" FROM files WHERE username = ? ORDER BY id", user)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not list files: %v", err)
+	}
+
+	return derefFiles(files), nil
+}
+
+func (db *sqlDB) ListTags() ([]string, error) {
+	rows, err := db.db.Query("SELECT DISTINCT tag FROM file_tags ORDER BY tag")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []string{}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+func (db *sqlDB) ListFilesWithTags(tags []string) ([]File, error) {
+	query := "SELECT " + fileColumns + " FROM files"
+	args := make([]interface{}, 0, len(tags))
+
+	// a file must carry every requested tag
+	for i, tag := range tags {
+		if i == 0 {
+			query += " WHERE"
+		} else {
+			query += " AND"
+		}
+		query += " id IN (SELECT file_id FROM file_tags WHERE tag = ?)"
+		args = append(args, strings.ToLower(tag))
+	}
+
+	files, err := db.queryFiles(query+" ORDER BY id", args...)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not list files: %v", err)
+	}
+
+	return derefFiles(files), nil
+}
+
+func (db *sqlDB) ListFolders(user, path string) ([]FolderTree, int64, error) {
+	var parentFolderKey int64
+
+	if path != "/" {
+		for _, ft := range PathToFolderTree(path) {
+			err := db.db.QueryRow(db.rebind(`SELECT id FROM folders
+				WHERE username = ? AND parent_key = ? AND parent_folder = ? AND folder = ?
+				ORDER BY id LIMIT 1`), user, parentFolderKey, ft.ParentFolder, ft.Folder).Scan(&parentFolderKey)
+
+			if err == sql.ErrNoRows {
+				return nil, 0, nil
+			} else if err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	rows, err := db.db.Query(db.rebind("SELECT "+folderColumns+" FROM folders WHERE username = ? AND parent_key = ? ORDER BY id"),
+		user, parentFolderKey)
+
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not list files: %v", err)
+	}
+	defer rows.Close()
+
+	folders := make([]FolderTree, 0)
+	for rows.Next() {
+		ft, err := scanFolder(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not list files: %v", err)
+		}
+		folders = append(folders, *ft)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("could not list files: %v", err)
+	}
+
+	return folders, parentFolderKey, nil
+}
+
+func (db *sqlDB) AddFolder(ft *FolderTree) (int64, error) {
+	id, err := db.insert(db.db, `INSERT INTO folders (username, upload_date, parent_key, parent_folder, folder,
+		encrypted_folder, key_generation, format_version) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		ft.Username, ft.UploadDate, ft.ParentKey, ft.ParentFolder, ft.Folder, ft.EncryptedFolder, ft.KeyGeneration,
+		ft.FormatVersion)
+
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (db *sqlDB) DeleteFile(user string, id int64) error {
+	f, err := db.getFile(id)
+
+	if err != nil {
+		return err
+	} else if f.Username != user {
+		return errors.New(ErrorNotRequestingUsers)
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(db.rebind("DELETE FROM file_tags WHERE file_id = ?"), id); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec(db.rebind("DELETE FROM files WHERE id = ?"), id); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *sqlDB) DeleteFolder(user string, id int64) error {
+	ft, err := scanFolder(db.db.QueryRow(db.rebind("SELECT "+folderColumns+" FROM folders WHERE id = ?"), id))
+
+	if err == sql.ErrNoRows {
+		return errors.New(ErrorNoDatabaseEntryFound)
+	} else if err != nil {
+		return err
+	}
+
+	if ft.Username != user {
+		return errors.New(ErrorNoDatabaseEntryFound)
+	}
+
+	_, err = db.db.Exec(db.rebind("DELETE FROM folders WHERE id = ?"), id)
+	return err
+}
+
+func (db *sqlDB) FilenameHMACExists(user, searchHMAC string) bool {
+	var count int
+	err := db.db.QueryRow(db.rebind("SELECT COUNT(*) FROM files WHERE username = ? AND filename_hmac = ?"),
+		user, searchHMAC).Scan(&count)
+
+	return err == nil && count > 0
+}
+
+func (db *sqlDB) SetUserEntry(userEntry *UserEntry) error {
+	u := userEntry
+	_, err := db.db.Exec(db.rebind("INSERT INTO users ("+userColumns+") VALUES ("+placeholders(32)+")"),
+		u.Username, u.Email, u.Admin, u.Enabled, u.CreatedDate, u.Hash, u.EncryptedPGPKey,
+		u.EncryptedHMACSecret, u.Salt, u.Iterations, u.KeySalt, u.KeyIterations,
+		u.KDF.Version, u.KDF.Time, u.KDF.Memory, u.KDF.Threads,
+		u.KeyGeneration, u.NextEncryptedPGPKey, u.NextEncryptedHMACSecret, u.ZeroKnowledge, u.MetadataEncrypted, u.IndexVersion, u.PublicKeys,
+		u.KeyCheck, u.RecoveryCodes, u.TOTPSecret, u.TOTPEnabled, u.TOTPLastStep, u.TOTPBackupCodes,
+		u.WebAuthnCredentials, u.WebAuthnRequired, u.APITokens)
+
+	return err
+}
+
+func (db *sqlDB) UpdateUser(id int64, userEntry *UserEntry) error {
+	u := userEntry
+	_, err := db.db.Exec(db.rebind(`UPDATE users SET username = ?, email = ?, admin = ?, enabled = ?, created_date = ?,
+		hash = ?, encrypted_pgp_key = ?, encrypted_hmac_secret = ?, salt = ?, iterations = ?,
+		key_salt = ?, key_iterations = ?, kdf_version = ?, kdf_time = ?, kdf_memory = ?, kdf_threads = ?,
+		key_generation = ?, next_encrypted_pgp_key = ?, next_encrypted_hmac_secret = ?, zero_knowledge = ?, metadata_encrypted = ?,
+		index_version = ?, public_keys = ?, key_check = ?, recovery_codes = ?,
+		totp_secret = ?, totp_enabled = ?, totp_last_step = ?, totp_backup_codes = ?,
+		webauthn_credentials = ?, webauthn_required = ?, api_tokens = ? WHERE id = ?`),
+		u.Username, u.Email, u.Admin, u.Enabled, u.CreatedDate, u.Hash, u.EncryptedPGPKey,
+		u.EncryptedHMACSecret, u.Salt, u.Iterations, u.KeySalt, u.KeyIterations,
+		u.KDF.Version, u.KDF.Time, u.KDF.Memory, u.KDF.Threads,
+		u.KeyGeneration, u.NextEncryptedPGPKey, u.NextEncryptedHMACSecret, u.ZeroKnowledge, u.MetadataEncrypted, u.IndexVersion, u.PublicKeys,
+		u.KeyCheck, u.RecoveryCodes, u.TOTPSecret, u.TOTPEnabled, u.TOTPLastStep, u.TOTPBackupCodes,
+		u.WebAuthnCredentials, u.WebAuthnRequired, u.APITokens, id)
+
+	if err != nil {
+		return fmt.Errorf("could not put file: %v", err)
+	}
+	return nil
+}
+
+func (db *sqlDB) GetUserEntry(user string) (*UserEntry, int64, error) {
+	u, id, err := scanUser(db.db.QueryRow(db.rebind("SELECT id, "+userColumns+" FROM users WHERE username = ?"), user))
+
+	if err == sql.ErrNoRows {
+		return nil, 0, errors.New(ErrorNoDatabaseEntryFound)
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	return u, id, nil
+}
+
+func (db *sqlDB) GetUsers() ([]*UserEntry, error) {
+	rows, err := db.db.Query("SELECT id, " + userColumns + " FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]*UserEntry, 0)
+	for rows.Next() {
+		u, _, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+
+	return users, rows.Err()
+}
+
+func (db *sqlDB) GetAllFiles(user string) ([]*File, error) {
+	return db.queryFiles("SELECT "+fileColumns+" FROM files WHERE username = ? ORDER BY id", user)
+}
+
+func (db *sqlDB) ListAllFolders(user, search string, limit int) ([]string, error) {
+	rows, err := db.db.Query(db.rebind(`SELECT DISTINCT folder FROM files
+		WHERE username = ? AND substr(folder, 1, ?) = ? ORDER BY folder LIMIT ?`), user, utf8.RuneCountInString(search), search, limit)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matchingFolders := make([]string, 0)
+	for rows.Next() {
+		var folder string
+		if err := rows.Scan(&folder); err != nil {
+			return nil, err
+		}
+		matchingFolders = append(matchingFolders, folder)
+	}
+
+	return matchingFolders, rows.Err()
+}
+
+func scanUpload(row rowScanner) (*Upload, error) {
+	var u Upload
+	err := row.Scan(&u.ID, &u.Username, &u.Length, &u.Offset, &u.CreatedDate, &u.Object, &u.StorageClass, &u.Parts,
+		&u.Header, &u.Segments, &u.Pending, &u.HashState, &u.Metadata, &u.DataKey, &u.KeyGeneration, &u.FormatVersion)
+	return &u, err
+}
+
+func (db *sqlDB) AddUpload(u *Upload) error {
+	_, err := db.db.Exec(db.rebind("INSERT INTO uploads ("+uploadColumns+") VALUES ("+placeholders(16)+")"),
+		u.ID, u.Username, u.Length, u.Offset, u.CreatedDate, u.Object, u.StorageClass, u.Parts,
+		u.Header, u.Segments, u.Pending, u.HashState, u.Metadata, u.DataKey, u.KeyGeneration, u.FormatVersion)
+
+	if err != nil {
+		return fmt.Errorf("could not put upload: %v", err)
+	}
+	return nil
+}
+
+func (db *sqlDB) GetUpload(user, id string) (*Upload, error) {
+	u, err := scanUpload(db.db.QueryRow(db.rebind("SELECT "+uploadColumns+" FROM uploads WHERE id = ? AND username = ?"), id, user))
+
+	if err == sql.ErrNoRows {
+		return nil, errors.New(ErrorNoDatabaseEntryFound)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func (db *sqlDB) UpdateUpload(u *Upload, offset int64) error {
+	res, err := db.db.Exec(db.rebind(`UPDATE uploads SET length = ?, upload_offset = ?, object = ?, storage_class = ?,
+		parts = ?, header = ?, segments = ?, pending = ?, hash_state = ?, metadata = ?,
+		data_key = ?, key_generation = ?, format_version = ? WHERE id = ? AND username = ? AND upload_offset = ?`),
+		u.Length, u.Offset, u.Object, u.StorageClass, u.Parts, u.Header, u.Segments, u.Pending, u.HashState, u.Metadata,
+		u.DataKey, u.KeyGeneration, u.FormatVersion, u.ID, u.Username, offset)
+
+	if err != nil {
+		return fmt.Errorf("could not put upload: %v", err)
+	}
+
+	if updated, err := res.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		// either the upload is gone or another request moved it on
+		if _, err := db.GetUpload(u.Username, u.ID); err != nil {
+			return err
+		}
+		return errors.New(ErrorUploadConflict)
+	}
+
+	return nil
+}
+
+func (db *sqlDB) DeleteUpload(user, id string) error {
+	res, err := db.db.Exec(db.rebind("DELETE FROM uploads WHERE id = ? AND username = ?"), id, user)
+
+	if err != nil {
+		return err
+	}
+
+	if deleted, err := res.RowsAffected(); err != nil {
+		return err
+	} else if deleted == 0 {
+		return errors.New(ErrorNoDatabaseEntryFound)
+	}
+
+	return nil
+}
+
+func (db *sqlDB) ListUploads(before time.Time) ([]*Upload, error) {
+	rows, err := db.db.Query(db.rebind("SELECT "+uploadColumns+" FROM uploads WHERE created_date < ? ORDER BY created_date"), before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := make([]*Upload, 0)
+	for rows.Next() {
+		u, err := scanUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, u)
+	}
+
+	return uploads, rows.Err()
+}
@@ -0,0 +1,88 @@
+package gscrypto_test
+
+import (
+	"database/sql"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/GregorioDiStefano/gcloud-web-crypto/dbtest"
+)
+
+func TestMemoryDB(t *testing.T) {
+	dbtest.TestFileDatabase(t, func(t *testing.T) gc.FileDatabase { return gc.NewMemoryDB() })
+	dbtest.TestUserDatabase(t, func(t *testing.T) gc.UserDatabase { return gc.NewMemoryDB() })
+	dbtest.TestUploadDatabase(t, func(t *testing.T) gc.UploadDatabase { return gc.NewMemoryDB() })
+}
+
+func newSQLiteDB(t *testing.T) gc.FileDatabase {
+	db, err := gc.NewSQLDB(gc.SQLDialectSQLite, filepath.Join(t.TempDir(), "gscrypto.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestSQLiteDB(t *testing.T) {
+	dbtest.TestFileDatabase(t, newSQLiteDB)
+	dbtest.TestUserDatabase(t, func(t *testing.T) gc.UserDatabase { return newSQLiteDB(t).(gc.UserDatabase) })
+	dbtest.TestUploadDatabase(t, func(t *testing.T) gc.UploadDatabase { return newSQLiteDB(t).(gc.UploadDatabase) })
+}
+
+// newPostgresDB drops everything in the database at POSTGRES_TEST_URL, don't
+// point it at a database you care about.
+func newPostgresDB(t *testing.T) gc.FileDatabase {
+	dataSource := os.Getenv("POSTGRES_TEST_URL")
+
+	conn, err := sql.Open(gc.SQLDialectPostgres, dataSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Exec("DROP SCHEMA public CASCADE; CREATE SCHEMA public"); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := gc.NewSQLDB(gc.SQLDialectPostgres, dataSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestPostgresDB(t *testing.T) {
+	if os.Getenv("POSTGRES_TEST_URL") == "" {
+		t.Skip("POSTGRES_TEST_URL not set")
+	}
+
+	dbtest.TestFileDatabase(t, newPostgresDB)
+	dbtest.TestUserDatabase(t, func(t *testing.T) gc.UserDatabase { return newPostgresDB(t).(gc.UserDatabase) })
+	dbtest.TestUploadDatabase(t, func(t *testing.T) gc.UploadDatabase { return newPostgresDB(t).(gc.UploadDatabase) })
+}
+
+func newDatastoreDB(t *testing.T) gc.FileDatabase {
+	resp, err := http.Post("http://"+os.Getenv("DATASTORE_EMULATOR_HOST")+"/reset", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	db, err := gc.NewDatastoreDB(os.Getenv("GOOGLE_CLOUD_PROJECT_ID"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestDatastoreDB(t *testing.T) {
+	if os.Getenv("DATASTORE_EMULATOR_HOST") == "" || os.Getenv("GOOGLE_CLOUD_PROJECT_ID") == "" {
+		t.Skip("DATASTORE_EMULATOR_HOST and GOOGLE_CLOUD_PROJECT_ID not set")
+	}
+
+	dbtest.TestFileDatabase(t, newDatastoreDB)
+	dbtest.TestUserDatabase(t, func(t *testing.T) gc.UserDatabase { return newDatastoreDB(t).(gc.UserDatabase) })
+	dbtest.TestUploadDatabase(t, func(t *testing.T) gc.UploadDatabase { return newDatastoreDB(t).(gc.UploadDatabase) })
+}
@@ -0,0 +1,700 @@
+// Package dbtest is a conformance suite for gscrypto.FileDatabase,
+// gscrypto.UserDatabase and gscrypto.UploadDatabase implementations. Every backend runs the same tests so
+// Datastore, SQL and in-memory deployments behave identically, for example:
+//
+//	func TestMemoryDB(t *testing.T) {
+//		dbtest.TestFileDatabase(t, func(t *testing.T) gc.FileDatabase { return gc.NewMemoryDB() })
+//	}
+package dbtest
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	gc "github.com/GregorioDiStefano/gcloud-web-crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// NewFileDatabase returns an empty database, it's called once per test.
+type NewFileDatabase func(t *testing.T) gc.FileDatabase
+
+// NewUserDatabase returns an empty database, it's called once per test.
+type NewUserDatabase func(t *testing.T) gc.UserDatabase
+
+// NewUploadDatabase returns an empty database, it's called once per test.
+type NewUploadDatabase func(t *testing.T) gc.UploadDatabase
+
+const (
+	alice = "alice"
+	bob   = "bob"
+)
+
+func newFile(user, folder, hmac string, tags ...string) *gc.File {
+	return &gc.File{
+		Username:          user,
+		Filename:          []byte("encrypted-" + hmac),
+		FilenameHMAC:      hmac,
+		GoogleCloudObject: "object-" + hmac,
+		Folder:            folder,
+		FileType:          "text/plain",
+		FileSize:          3,
+		UploadDate:        time.Now().UTC().Truncate(time.Millisecond),
+		Description:       "description of " + hmac,
+		Tags:              tags,
+		Compressed:        true,
+		SHA2:              "sha2-" + hmac,
+		DataKey:           []byte("data-key-" + hmac),
+		KeyGeneration:     1,
+		Metadata:          []byte("metadata-" + hmac),
+		FormatVersion:     gc.FileFormatBound,
+	}
+}
+
+func addFile(t *testing.T, db gc.FileDatabase, f *gc.File) int64 {
+	id, err := db.AddFile(f)
+	require.NoError(t, err)
+	require.NotZero(t, id)
+	return id
+}
+
+// addFolders creates the folders of path for user which don't exist yet, the
+// same way the upload handler does, and returns the id of the deepest one.
+func addFolders(t *testing.T, db gc.FileDatabase, user, path string) int64 {
+	var parentKey int64
+	var segments []string
+
+	for _, ft := range gc.PathToFolderTree(path) {
+		segments = append(segments, ft.Folder)
+
+		existing, key, err := db.ListFolders(user, "/"+strings.Join(segments, "/")+"/")
+		require.NoError(t, err)
+
+		if existing != nil {
+			parentKey = key
+			continue
+		}
+
+		ft.Username = user
+		ft.ParentKey = parentKey
+		ft.UploadDate = time.Now()
+		ft.EncryptedFolder = []byte("encrypted-" + ft.Folder)
+		ft.KeyGeneration = 1
+		ft.FormatVersion = gc.FileFormatVersion
+
+		id, err := db.AddFolder(ft)
+		require.NoError(t, err)
+		require.NotZero(t, id)
+		parentKey = id
+	}
+	return parentKey
+}
+
+func hmacs(files []gc.File) []string {
+	result := make([]string, 0, len(files))
+	for _, f := range files {
+		result = append(result, f.FilenameHMAC)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func folderNames(folders []gc.FolderTree) []string {
+	result := make([]string, 0, len(folders))
+	for _, f := range folders {
+		result = append(result, f.Folder)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func assertSameFile(t *testing.T, expected, actual *gc.File) {
+	assert.Equal(t, expected.Username, actual.Username)
+	assert.Equal(t, expected.Filename, actual.Filename)
+	assert.Equal(t, expected.FilenameHMAC, actual.FilenameHMAC)
+	assert.Equal(t, expected.GoogleCloudObject, actual.GoogleCloudObject)
+	assert.Equal(t, expected.Folder, actual.Folder)
+	assert.Equal(t, expected.FileType, actual.FileType)
+	assert.Equal(t, expected.FileSize, actual.FileSize)
+	assert.Equal(t, expected.Downloads, actual.Downloads)
+	assert.Equal(t, expected.Description, actual.Description)
+	assert.ElementsMatch(t, expected.Tags, actual.Tags)
+	assert.Equal(t, expected.Compressed, actual.Compressed)
+	assert.Equal(t, expected.DataKey, actual.DataKey)
+	assert.Equal(t, expected.KeyGeneration, actual.KeyGeneration)
+	assert.Equal(t, expected.SHA2, actual.SHA2)
+	assert.Equal(t, expected.Metadata, actual.Metadata)
+	assert.Equal(t, expected.FormatVersion, actual.FormatVersion)
+	assert.Equal(t, expected.PublicKeyEncrypted, actual.PublicKeyEncrypted)
+	assert.WithinDuration(t, expected.UploadDate, actual.UploadDate, time.Second)
+}
+
+// TestFileDatabase runs the FileDatabase conformance tests against databases
+// returned by newDB.
+func TestFileDatabase(t *testing.T, newDB NewFileDatabase) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, db gc.FileDatabase)
+	}{
+		{"AddGetFile", testAddGetFile},
+		{"GetFileOwnership", testGetFileOwnership},
+		{"UpdateFile", testUpdateFile},
+		{"IncrementDownloads", testIncrementDownloads},
+		{"ListFiles", testListFiles},
+		{"FilenameHMACExists", testFilenameHMACExists},
+		{"DeleteFile", testDeleteFile},
+		{"Tags", testTags},
+		{"GetAllFiles", testGetAllFiles},
+		{"ListAllFolders", testListAllFolders},
+		{"ListFolders", testListFolders},
+		{"ListFoldersMissingPath", testListFoldersMissingPath},
+		{"ListFoldersOwnership", testListFoldersOwnership},
+		{"DeleteFolder", testDeleteFolder},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			db := newDB(t)
+			defer db.Close()
+			test.test(t, db)
+		})
+	}
+}
+
+func testAddGetFile(t *testing.T, db gc.FileDatabase) {
+	f := newFile(alice, "/a/", "hmac-a", "x", "y")
+	id := addFile(t, db, f)
+
+	got, err := db.GetFile(alice, id)
+	require.NoError(t, err)
+	assert.Equal(t, id, got.ID)
+	assertSameFile(t, f, got)
+
+	other := addFile(t, db, newFile(alice, "/a/", "hmac-b"))
+	assert.NotEqual(t, id, other, "ids must be unique")
+}
+
+func testGetFileOwnership(t *testing.T, db gc.FileDatabase) {
+	id := addFile(t, db, newFile(alice, "/", "hmac-a"))
+
+	_, err := db.GetFile(bob, id)
+	assert.EqualError(t, err, gc.ErrorNotRequestingUsers)
+
+	_, err = db.GetFile(alice, id+1000)
+	assert.Error(t, err, "missing file must return an error")
+}
+
+func testUpdateFile(t *testing.T, db gc.FileDatabase) {
+	f := newFile(alice, "/", "hmac-a", "x")
+	id := addFile(t, db, f)
+
+	f.Downloads = 5
+	f.Description = "changed"
+	f.Tags = []string{"z"}
+	f.GoogleCloudObject = "migrated"
+	f.DataKey = []byte("new data key")
+	f.KeyGeneration++
+	f.Metadata = []byte("new metadata")
+	f.FormatVersion++
+	f.PublicKeyEncrypted = true
+	require.NoError(t, db.UpdateFile(f, id))
+
+	got, err := db.GetFile(alice, id)
+	require.NoError(t, err)
+	assertSameFile(t, f, got)
+}
+
+func testIncrementDownloads(t *testing.T, db gc.FileDatabase) {
+	f := newFile(alice, "/", "hmac-a", "x")
+	id := addFile(t, db, f)
+
+	require.NoError(t, db.IncrementDownloads(alice, id))
+	require.NoError(t, db.IncrementDownloads(alice, id))
+
+	got, err := db.GetFile(alice, id)
+	require.NoError(t, err)
+	f.Downloads = 2
+	assertSameFile(t, f, got)
+
+	assert.EqualError(t, db.IncrementDownloads(bob, id), gc.ErrorNotRequestingUsers)
+	assert.Error(t, db.IncrementDownloads(alice, id+1000), "missing file must return an error")
+
+	got, err = db.GetFile(alice, id)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), got.Downloads)
+}
+
+func testListFiles(t *testing.T, db gc.FileDatabase) {
+	addFile(t, db, newFile(alice, "/", "root"))
+	addFile(t, db, newFile(alice, "/a/", "a1"))
+	addFile(t, db, newFile(alice, "/a/", "a2"))
+	addFile(t, db, newFile(alice, "/a/b/", "ab"))
+	addFile(t, db, newFile(bob, "/a/", "bob-a"))
+
+	files, err := db.ListFiles(alice, "/a/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a1", "a2"}, hmacs(files))
+
+	for _, f := range files {
+		assert.NotZero(t, f.ID, "listed files must have their id set")
+	}
+
+	files, err = db.ListFiles(alice, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a1", "a2", "ab", "root"}, hmacs(files), "empty path lists every file of the user")
+
+	files, err = db.ListFiles(bob, "/a/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bob-a"}, hmacs(files))
+
+	files, err = db.ListFiles(alice, "/missing/")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func testFilenameHMACExists(t *testing.T, db gc.FileDatabase) {
+	addFile(t, db, newFile(alice, "/", "hmac-a"))
+
+	assert.True(t, db.FilenameHMACExists(alice, "hmac-a"))
+	assert.False(t, db.FilenameHMACExists(alice, "hmac-b"))
+	assert.False(t, db.FilenameHMACExists(bob, "hmac-a"), "hmac lookups are scoped per user")
+}
+
+func testDeleteFile(t *testing.T, db gc.FileDatabase) {
+	id := addFile(t, db, newFile(alice, "/", "hmac-a", "x"))
+
+	assert.EqualError(t, db.DeleteFile(bob, id), gc.ErrorNotRequestingUsers)
+
+	_, err := db.GetFile(alice, id)
+	assert.NoError(t, err, "a foreign delete must not remove the file")
+
+	assert.NoError(t, db.DeleteFile(alice, id))
+
+	_, err = db.GetFile(alice, id)
+	assert.Error(t, err)
+	assert.False(t, db.FilenameHMACExists(alice, "hmac-a"))
+
+	assert.Error(t, db.DeleteFile(alice, id), "deleting a missing file must return an error")
+}
+
+func testTags(t *testing.T, db gc.FileDatabase) {
+	addFile(t, db, newFile(alice, "/", "none"))
+	addFile(t, db, newFile(alice, "/", "a", "a"))
+	addFile(t, db, newFile(alice, "/", "ab", "a", "b"))
+	addFile(t, db, newFile(alice, "/", "bc", "b", "c"))
+
+	tags, err := db.ListTags()
+	require.NoError(t, err)
+	sort.Strings(tags)
+	assert.Equal(t, []string{"a", "b", "c"}, tags)
+
+	files, err := db.ListFilesWithTags([]string{"a"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "ab"}, hmacs(files))
+
+	files, err = db.ListFilesWithTags([]string{"A", "b"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ab"}, hmacs(files), "files must carry every tag, tags are matched lower case")
+
+	files, err = db.ListFilesWithTags([]string{"missing"})
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func testGetAllFiles(t *testing.T, db gc.FileDatabase) {
+	addFile(t, db, newFile(alice, "/", "a"))
+	addFile(t, db, newFile(alice, "/x/y/", "b"))
+	addFile(t, db, newFile(bob, "/", "c"))
+
+	files, err := db.GetAllFiles(alice)
+	require.NoError(t, err)
+
+	found := make([]gc.File, 0)
+	for _, f := range files {
+		found = append(found, *f)
+	}
+	assert.Equal(t, []string{"a", "b"}, hmacs(found))
+
+	files, err = db.GetAllFiles("nobody")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func testListAllFolders(t *testing.T, db gc.FileDatabase) {
+	addFile(t, db, newFile(alice, "/a/", "1"))
+	addFile(t, db, newFile(alice, "/a/", "2"))
+	addFile(t, db, newFile(alice, "/a/b/", "3"))
+	addFile(t, db, newFile(alice, "/c/", "4"))
+	addFile(t, db, newFile(bob, "/a/z/", "5"))
+
+	folders, err := db.ListAllFolders(alice, "/a", 20)
+	require.NoError(t, err)
+	sort.Strings(folders)
+	assert.Equal(t, []string{"/a/", "/a/b/"}, folders, "folders are distinct, prefix matched and scoped per user")
+
+	folders, err = db.ListAllFolders(alice, "/", 20)
+	require.NoError(t, err)
+	assert.Len(t, folders, 3)
+
+	folders, err = db.ListAllFolders(alice, "/", 2)
+	require.NoError(t, err)
+	assert.Len(t, folders, 2)
+}
+
+func testListFolders(t *testing.T, db gc.FileDatabase) {
+	aID := addFolders(t, db, alice, "/a/")
+	bID := addFolders(t, db, alice, "/a/b/")
+	cID := addFolders(t, db, alice, "/a/b/c/")
+	addFolders(t, db, alice, "/d/")
+
+	folders, key, err := db.ListFolders(alice, "/")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), key, "root has no key")
+	assert.Equal(t, []string{"a", "d"}, folderNames(folders))
+
+	for _, f := range folders {
+		assert.NotZero(t, f.ID, "listed folders must have their id set")
+		assert.Equal(t, alice, f.Username)
+		assert.Equal(t, []byte("encrypted-"+f.Folder), f.EncryptedFolder)
+		assert.Equal(t, 1, f.KeyGeneration)
+		assert.Equal(t, gc.FileFormatVersion, f.FormatVersion)
+	}
+
+	folders, key, err = db.ListFolders(alice, "/a/")
+	require.NoError(t, err)
+	assert.Equal(t, aID, key)
+	require.Equal(t, []string{"b"}, folderNames(folders))
+	assert.Equal(t, bID, folders[0].ID)
+	assert.Equal(t, aID, folders[0].ParentKey)
+	assert.Equal(t, "a", folders[0].ParentFolder)
+
+	folders, key, err = db.ListFolders(alice, "/a/b/")
+	require.NoError(t, err)
+	assert.Equal(t, bID, key)
+	assert.Equal(t, []string{"c"}, folderNames(folders))
+
+	folders, key, err = db.ListFolders(alice, "/a/b/c/")
+	require.NoError(t, err)
+	assert.Equal(t, cID, key)
+	assert.Empty(t, folders)
+	assert.NotNil(t, folders, "an existing empty folder is not a missing folder")
+}
+
+func testListFoldersMissingPath(t *testing.T, db gc.FileDatabase) {
+	addFolders(t, db, alice, "/a/b/")
+
+	tests := []string{"/missing/", "/a/missing/", "/a/b/missing/", "/b/"}
+
+	for _, path := range tests {
+		folders, key, err := db.ListFolders(alice, path)
+		assert.NoError(t, err, path)
+		assert.Nil(t, folders, path)
+		assert.Equal(t, int64(0), key, path)
+	}
+}
+
+func testListFoldersOwnership(t *testing.T, db gc.FileDatabase) {
+	addFolders(t, db, alice, "/a/b/")
+
+	folders, key, err := db.ListFolders(bob, "/a/")
+	assert.NoError(t, err)
+	assert.Nil(t, folders, "another user's folders must not be found")
+	assert.Equal(t, int64(0), key)
+
+	folders, _, err = db.ListFolders(bob, "/")
+	assert.NoError(t, err)
+	assert.Empty(t, folders)
+
+	bobA := addFolders(t, db, bob, "/a/")
+	folders, key, err = db.ListFolders(bob, "/a/")
+	assert.NoError(t, err)
+	assert.Equal(t, bobA, key)
+	assert.Empty(t, folders, "alice's 'b' must not show up in bob's '/a/'")
+}
+
+func testDeleteFolder(t *testing.T, db gc.FileDatabase) {
+	id := addFolders(t, db, alice, "/a/")
+
+	assert.EqualError(t, db.DeleteFolder(bob, id), gc.ErrorNoDatabaseEntryFound)
+
+	_, key, err := db.ListFolders(alice, "/a/")
+	require.NoError(t, err)
+	assert.Equal(t, id, key, "a foreign delete must not remove the folder")
+
+	assert.NoError(t, db.DeleteFolder(alice, id))
+
+	folders, key, err := db.ListFolders(alice, "/a/")
+	assert.NoError(t, err)
+	assert.Nil(t, folders)
+	assert.Equal(t, int64(0), key)
+
+	assert.Error(t, db.DeleteFolder(alice, id), "deleting a missing folder must return an error")
+}
+
+// TestUserDatabase runs the UserDatabase conformance tests against databases
+// returned by newDB.
+func TestUserDatabase(t *testing.T, newDB NewUserDatabase) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, db gc.UserDatabase)
+	}{
+		{"SetGetUser", testSetGetUser},
+		{"UpdateUser", testUpdateUser},
+		{"GetUsers", testGetUsers},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, newDB(t))
+		})
+	}
+}
+
+func newUser(name string) *gc.UserEntry {
+	return &gc.UserEntry{
+		Username:            name,
+		Email:               name + "@example.com",
+		Admin:               name == "admin",
+		Enabled:             true,
+		CreatedDate:         time.Now().UTC().Truncate(time.Millisecond),
+		Hash:                []byte("hash-" + name),
+		EncryptedPGPKey:     []byte("pgp-" + name),
+		EncryptedHMACSecret: []byte("hmac-" + name),
+		Salt:                []byte("salt-" + name),
+		Iterations:          1000,
+		KeySalt:             []byte("key-salt-" + name),
+		KeyIterations:       2000,
+		KDF:                 gc.KDFParams{Version: gc.KDFArgon2id, Time: 3, Memory: 65536, Threads: 4},
+		KeyGeneration:       1,
+	}
+}
+
+func assertSameUser(t *testing.T, expected, actual *gc.UserEntry) {
+	assert.Equal(t, expected.Username, actual.Username)
+	assert.Equal(t, expected.Email, actual.Email)
+	assert.Equal(t, expected.Admin, actual.Admin)
+	assert.Equal(t, expected.Enabled, actual.Enabled)
+	assert.Equal(t, expected.Hash, actual.Hash)
+	assert.Equal(t, expected.EncryptedPGPKey, actual.EncryptedPGPKey)
+	assert.Equal(t, expected.EncryptedHMACSecret, actual.EncryptedHMACSecret)
+	assert.Equal(t, expected.Salt, actual.Salt)
+	assert.Equal(t, expected.Iterations, actual.Iterations)
+	assert.Equal(t, expected.KeySalt, actual.KeySalt)
+	assert.Equal(t, expected.KeyIterations, actual.KeyIterations)
+	assert.Equal(t, expected.KDF, actual.KDF)
+	assert.Equal(t, expected.KeyGeneration, actual.KeyGeneration)
+	assert.Equal(t, expected.NextEncryptedPGPKey, actual.NextEncryptedPGPKey)
+	assert.Equal(t, expected.NextEncryptedHMACSecret, actual.NextEncryptedHMACSecret)
+	assert.Equal(t, expected.ZeroKnowledge, actual.ZeroKnowledge)
+	assert.Equal(t, expected.MetadataEncrypted, actual.MetadataEncrypted)
+	assert.Equal(t, expected.IndexVersion, actual.IndexVersion)
+	assert.Equal(t, expected.PublicKeys, actual.PublicKeys)
+	assert.Equal(t, expected.KeyCheck, actual.KeyCheck)
+	assert.Equal(t, expected.RecoveryCodes, actual.RecoveryCodes)
+	assert.Equal(t, expected.TOTPSecret, actual.TOTPSecret)
+	assert.Equal(t, expected.TOTPEnabled, actual.TOTPEnabled)
+	assert.Equal(t, expected.TOTPLastStep, actual.TOTPLastStep)
+	assert.Equal(t, expected.TOTPBackupCodes, actual.TOTPBackupCodes)
+	assert.Equal(t, expected.WebAuthnCredentials, actual.WebAuthnCredentials)
+	assert.Equal(t, expected.WebAuthnRequired, actual.WebAuthnRequired)
+	assert.Equal(t, expected.APITokens, actual.APITokens)
+	assert.WithinDuration(t, expected.CreatedDate, actual.CreatedDate, time.Second)
+}
+
+func testSetGetUser(t *testing.T, db gc.UserDatabase) {
+	u := newUser(alice)
+	require.NoError(t, db.SetUserEntry(u))
+
+	got, id, err := db.GetUserEntry(alice)
+	require.NoError(t, err)
+	assert.NotZero(t, id)
+	assertSameUser(t, u, got)
+
+	_, _, err = db.GetUserEntry(bob)
+	assert.EqualError(t, err, gc.ErrorNoDatabaseEntryFound)
+}
+
+func testUpdateUser(t *testing.T, db gc.UserDatabase) {
+	require.NoError(t, db.SetUserEntry(newUser(alice)))
+	require.NoError(t, db.SetUserEntry(newUser(bob)))
+
+	u, id, err := db.GetUserEntry(alice)
+	require.NoError(t, err)
+
+	u.Enabled = false
+	u.Hash = []byte("new hash")
+	u.Salt = []byte("new salt")
+	u.KDF.Memory *= 2
+	u.NextEncryptedPGPKey = []byte("next pgp key")
+	u.NextEncryptedHMACSecret = []byte("next hmac secret")
+	u.ZeroKnowledge = true
+	u.MetadataEncrypted = true
+	u.IndexVersion = 2
+	u.PublicKeys = []byte("public keys")
+	u.KeyCheck = []byte("key check")
+	u.RecoveryCodes = []byte("recovery codes")
+	u.TOTPSecret = []byte("totp secret")
+	u.TOTPEnabled = true
+	u.TOTPLastStep = 56789012
+	u.TOTPBackupCodes = []byte("totp backup codes")
+	u.WebAuthnCredentials = []byte("webauthn credentials")
+	u.WebAuthnRequired = true
+	u.APITokens = []byte("api tokens")
+	require.NoError(t, db.UpdateUser(id, u))
+
+	got, gotID, err := db.GetUserEntry(alice)
+	require.NoError(t, err)
+	assert.Equal(t, id, gotID)
+	assertSameUser(t, u, got)
+
+	other, _, err := db.GetUserEntry(bob)
+	require.NoError(t, err)
+	assertSameUser(t, newUser(bob), other)
+}
+
+func testGetUsers(t *testing.T, db gc.UserDatabase) {
+	users, err := db.GetUsers()
+	require.NoError(t, err)
+	assert.Empty(t, users)
+
+	for _, name := range []string{"admin", alice, bob} {
+		require.NoError(t, db.SetUserEntry(newUser(name)))
+	}
+
+	users, err = db.GetUsers()
+	require.NoError(t, err)
+
+	names := make([]string, 0)
+	for _, u := range users {
+		names = append(names, u.Username)
+	}
+	assert.ElementsMatch(t, []string{"admin", alice, bob}, names)
+}
+
+// TestUploadDatabase runs the UploadDatabase conformance tests against
+// databases returned by newDB.
+func TestUploadDatabase(t *testing.T, newDB NewUploadDatabase) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, db gc.UploadDatabase)
+	}{
+		{"AddGetUpload", testAddGetUpload},
+		{"UpdateUpload", testUpdateUpload},
+		{"DeleteUpload", testDeleteUpload},
+		{"ListUploads", testListUploads},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, newDB(t))
+		})
+	}
+}
+
+func newUpload(user, id string, created time.Time) *gc.Upload {
+	return &gc.Upload{
+		ID:            id,
+		Username:      user,
+		Length:        1000,
+		CreatedDate:   created.UTC().Truncate(time.Millisecond),
+		Object:        "object-" + id,
+		StorageClass:  "NEARLINE",
+		Header:        []byte("header-" + id),
+		Metadata:      []byte("metadata-" + id),
+		DataKey:       []byte("data-key-" + id),
+		KeyGeneration: 1,
+		FormatVersion: gc.FileFormatBound,
+	}
+}
+
+func assertSameUpload(t *testing.T, expected, actual *gc.Upload) {
+	assert.Equal(t, expected.ID, actual.ID)
+	assert.Equal(t, expected.Username, actual.Username)
+	assert.Equal(t, expected.Length, actual.Length)
+	assert.Equal(t, expected.Offset, actual.Offset)
+	assert.Equal(t, expected.Object, actual.Object)
+	assert.Equal(t, expected.StorageClass, actual.StorageClass)
+	assert.Equal(t, expected.Parts, actual.Parts)
+	assert.Equal(t, expected.Header, actual.Header)
+	assert.Equal(t, expected.Segments, actual.Segments)
+	assert.Equal(t, string(expected.Pending), string(actual.Pending))
+	assert.Equal(t, string(expected.HashState), string(actual.HashState))
+	assert.Equal(t, expected.Metadata, actual.Metadata)
+	assert.Equal(t, expected.DataKey, actual.DataKey)
+	assert.Equal(t, expected.KeyGeneration, actual.KeyGeneration)
+	assert.Equal(t, expected.FormatVersion, actual.FormatVersion)
+	assert.WithinDuration(t, expected.CreatedDate, actual.CreatedDate, time.Second)
+}
+
+func testAddGetUpload(t *testing.T, db gc.UploadDatabase) {
+	u := newUpload(alice, "upload1", time.Now())
+	require.NoError(t, db.AddUpload(u))
+
+	got, err := db.GetUpload(alice, "upload1")
+	require.NoError(t, err)
+	assertSameUpload(t, u, got)
+
+	_, err = db.GetUpload(bob, "upload1")
+	assert.EqualError(t, err, gc.ErrorNoDatabaseEntryFound)
+
+	_, err = db.GetUpload(alice, "upload2")
+	assert.EqualError(t, err, gc.ErrorNoDatabaseEntryFound)
+}
+
+func testUpdateUpload(t *testing.T, db gc.UploadDatabase) {
+	u := newUpload(alice, "upload1", time.Now())
+	require.NoError(t, db.AddUpload(u))
+
+	u.Offset, u.Parts, u.Segments = 300, 1, 4
+	u.Pending = []byte("pending")
+	u.HashState = []byte("hash state")
+	require.NoError(t, db.UpdateUpload(u, 0))
+
+	got, err := db.GetUpload(alice, "upload1")
+	require.NoError(t, err)
+	assertSameUpload(t, u, got)
+
+	// a second request which also read offset 0 must lose
+	stale := newUpload(alice, "upload1", u.CreatedDate)
+	stale.Offset = 100
+	assert.EqualError(t, db.UpdateUpload(stale, 0), gc.ErrorUploadConflict)
+
+	got, err = db.GetUpload(alice, "upload1")
+	require.NoError(t, err)
+	assertSameUpload(t, u, got)
+
+	other := newUpload(bob, "upload1", u.CreatedDate)
+	assert.EqualError(t, db.UpdateUpload(other, 300), gc.ErrorNoDatabaseEntryFound)
+}
+
+func testDeleteUpload(t *testing.T, db gc.UploadDatabase) {
+	require.NoError(t, db.AddUpload(newUpload(alice, "upload1", time.Now())))
+
+	assert.EqualError(t, db.DeleteUpload(bob, "upload1"), gc.ErrorNoDatabaseEntryFound)
+	require.NoError(t, db.DeleteUpload(alice, "upload1"))
+	assert.EqualError(t, db.DeleteUpload(alice, "upload1"), gc.ErrorNoDatabaseEntryFound)
+
+	_, err := db.GetUpload(alice, "upload1")
+	assert.EqualError(t, err, gc.ErrorNoDatabaseEntryFound)
+}
+
+func testListUploads(t *testing.T, db gc.UploadDatabase) {
+	now := time.Now()
+	require.NoError(t, db.AddUpload(newUpload(alice, "old", now.Add(-48*time.Hour))))
+	require.NoError(t, db.AddUpload(newUpload(bob, "older", now.Add(-72*time.Hour))))
+	require.NoError(t, db.AddUpload(newUpload(alice, "new", now)))
+
+	uploads, err := db.ListUploads(now.Add(-24 * time.Hour))
+	require.NoError(t, err)
+
+	ids := make([]string, 0)
+	for _, u := range uploads {
+		ids = append(ids, u.ID)
+	}
+	assert.ElementsMatch(t, []string{"old", "older"}, ids)
+}
@@ -0,0 +1,8 @@
+package gscrypto
+
+// constructors of the unexported backends, for the conformance tests in db_test.go
+var NewSQLDB = newSQLDB
+
+func NewDatastoreDB(projectID string) (*datastoreDB, error) {
+	return configureDatastoreDB(projectID)
+}
@@ -18,10 +18,50 @@ type File struct {
 	Downloads         int64
 	Description       string
 	Tags              []string
-	Compressed        bool
 	SHA2              string
+
+	// Compressed is only set on legacy OpenPGP objects, the segmented
+	// format is never compressed so it can be read at any offset.
+	Compressed bool
+
+	// DataKey encrypts the object and Filename, it's wrapped by the owner's
+	// key. Files uploaded before data keys are encrypted by the owner's key.
+	DataKey []byte `datastore:",noindex"`
+
+	// KeyGeneration is the UserEntry.KeyGeneration of the key wrapping
+	// DataKey and computing FilenameHMAC.
+	KeyGeneration int
+
+	// Metadata is the folder, description, tags, type and size of the file
+	// encrypted by DataKey. Folder and Tags then hold their blind indexes,
+	// HMACs by the key of KeyGeneration, and the other fields are empty. The
+	// size of files of zero-knowledge accounts is kept, the server can tell
+	// it from the object anyway.
+	Metadata []byte `datastore:",noindex"`
+
+	// FormatVersion is the format of the encrypted fields and object of the
+	// file. From FileFormatBound on each of them authenticates the file, its
+	// owner and the field it is, so they can't be swapped between records.
+	// From FileFormatSubkeys on each is encrypted by a key of its own,
+	// derived from DataKey or the owner's key. Files stored before, and those
+	// of zero-knowledge accounts, are 0.
+	FormatVersion int
+
+	// PublicKeyEncrypted files were uploaded while the owner had
+	// UserEntry.PublicKeys, their object is an OpenPGP message encrypted to
+	// those keys which the server can't decrypt. Their name and metadata are
+	// still encrypted by DataKey.
+	PublicKeyEncrypted bool
 }
 
+// Formats of File.FormatVersion, new files are stored in FileFormatVersion.
+const (
+	FileFormatBound   = 1
+	FileFormatSubkeys = 2
+
+	FileFormatVersion = FileFormatSubkeys
+)
+
 type FolderTree struct {
 	ID           int64 `datastore:"-"`
 	Username     string
@@ -29,6 +69,16 @@ type FolderTree struct {
 	ParentKey    int64
 	ParentFolder string
 	Folder       string
+
+	// EncryptedFolder is the name of the folder encrypted by the owner's key
+	// of KeyGeneration, Folder and ParentFolder are then blind indexes.
+	// Folders created before metadata was encrypted are named in the clear.
+	EncryptedFolder []byte `datastore:",noindex"`
+	KeyGeneration   int
+
+	// FormatVersion is the File.FormatVersion of EncryptedFolder, from
+	// FileFormatSubkeys on it's encrypted by a key derived for folder names.
+	FormatVersion int
 }
 
 type FileDatabase interface {
@@ -46,6 +96,9 @@ type FileDatabase interface {
 	UpdateFile(f *File, id int64) (err error)
 	FilenameHMACExists(user string, hmac string) bool
 	GetFile(user string, id int64) (*File, error)
+	// IncrementDownloads counts a download without saving the rest of the
+	// file, which may have changed since it was read.
+	IncrementDownloads(user string, id int64) error
 	GetAllFiles(user string) ([]*File, error)
 	DeleteFile(user string, id int64) error
 	DeleteFolder(user string, id int64) error
@@ -21,17 +21,22 @@ class FileShell(cmd2.Cmd):
     intro = 'Welcome to the gscrypto shell.  Type help or ? to list commands.\n'
     prompt = '>> '
     cookie = None
+    headers = {}
     mimetypes.init()
 
     def __init__(self):
         cmd2.Cmd.__init__(self)
 
+        # a personal API token, instead of logging in with the password
+        if os.environ.get("GSCRYPTO_TOKEN"):
+            self.headers = {"Authorization": "Bearer " + os.environ["GSCRYPTO_TOKEN"]}
+
 
     def do_rm(self, arg):
         if len(arg.split()) == 2 and arg.split()[0] == "-folder":
-            response = requests.delete(self.host + "/auth/folder/?path=" + arg.split()[1], cookies=self.cookie)
+            response = requests.delete(self.host + "/auth/folder/?path=" + arg.split()[1], cookies=self.cookie, headers=self.headers)
         else:
-            response = requests.delete(self.host + "/auth/file/" + arg, cookies=self.cookie)
+            response = requests.delete(self.host + "/auth/file/" + arg, cookies=self.cookie, headers=self.headers)
         print(response.status_code)
 
 
@@ -51,8 +56,16 @@ class FileShell(cmd2.Cmd):
         else:
             logging.info("Logged in successfully")
 
+    def do_logout(self, arg):
+        response = requests.post(self.host + "/auth/account/logout", cookies=self.cookie)
+        print(response.status_code)
+        self.cookie = None
+
+    def do_token(self, arg):
+        self.headers = {"Authorization": "Bearer " + arg.strip()}
+
     def do_list(self, arg):
-        print(requests.get(self.host + "/auth/list/fs?path=" + arg, cookies=self.cookie).json())
+        print(requests.get(self.host + "/auth/list/fs?path=" + arg, cookies=self.cookie, headers=self.headers).json())
 
 
 
@@ -95,7 +108,7 @@ class FileShell(cmd2.Cmd):
                                                      progressbar.AdaptiveETA()], max_value=filesAsMultipart.len)
 
             m = MultipartEncoderMonitor(filesAsMultipart, read_callback)
-            response = requests.post(self.host + "/auth/file/", data=m, cookies=self.cookie,headers={'Content-Type': m.content_type})
+            response = requests.post(self.host + "/auth/file/", data=m, cookies=self.cookie,headers=dict(self.headers, **{'Content-Type': m.content_type}))
             bar.update(filesAsMultipart.len)
 
             if response.status_code != 201:
@@ -104,8 +117,8 @@ class FileShell(cmd2.Cmd):
                 os.remove(f)
 
     def precmd(self, line):
-        if self.cookie is None:
-            raise Exception("Please login with 'login <username> <password>' first")
+        if self.cookie is None and not self.headers and line.split(" ")[0] not in ("login", "token"):
+            raise Exception("Please login with 'login <username> <password>', or 'token <api token>', first")
         return line
 
     def close(self):
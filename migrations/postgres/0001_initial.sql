@@ -0,0 +1,51 @@
+CREATE TABLE files (
+	id                  BIGSERIAL PRIMARY KEY,
+	username            TEXT NOT NULL,
+	filename            BYTEA,
+	filename_hmac       TEXT NOT NULL,
+	google_cloud_object TEXT NOT NULL,
+	folder              TEXT NOT NULL,
+	file_type           TEXT NOT NULL DEFAULT '',
+	file_size           BIGINT NOT NULL DEFAULT 0,
+	upload_date         TIMESTAMPTZ NOT NULL,
+	downloads           BIGINT NOT NULL DEFAULT 0,
+	description         TEXT NOT NULL DEFAULT '',
+	compressed          BOOLEAN NOT NULL DEFAULT FALSE,
+	sha2                TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX files_username_hmac ON files (username, filename_hmac);
+CREATE INDEX files_username_folder ON files (username, folder);
+
+CREATE TABLE file_tags (
+	file_id BIGINT NOT NULL REFERENCES files (id) ON DELETE CASCADE,
+	tag     TEXT NOT NULL,
+	PRIMARY KEY (file_id, tag)
+);
+
+CREATE INDEX file_tags_tag ON file_tags (tag);
+
+CREATE TABLE folders (
+	id            BIGSERIAL PRIMARY KEY,
+	username      TEXT NOT NULL,
+	upload_date   TIMESTAMPTZ NOT NULL,
+	parent_key    BIGINT NOT NULL DEFAULT 0,
+	parent_folder TEXT NOT NULL DEFAULT '',
+	folder        TEXT NOT NULL
+);
+
+CREATE INDEX folders_username_parent ON folders (username, parent_key, parent_folder, folder);
+
+CREATE TABLE users (
+	id                    BIGSERIAL PRIMARY KEY,
+	username              TEXT NOT NULL UNIQUE,
+	email                 TEXT NOT NULL DEFAULT '',
+	admin                 BOOLEAN NOT NULL DEFAULT FALSE,
+	enabled               BOOLEAN NOT NULL DEFAULT FALSE,
+	created_date          TIMESTAMPTZ NOT NULL,
+	hash                  BYTEA,
+	encrypted_pgp_key     BYTEA,
+	encrypted_hmac_secret BYTEA,
+	salt                  BYTEA,
+	iterations            INTEGER NOT NULL DEFAULT 0
+);
@@ -0,0 +1,17 @@
+CREATE TABLE uploads (
+	id            TEXT PRIMARY KEY,
+	username      TEXT NOT NULL,
+	length        BIGINT NOT NULL,
+	upload_offset BIGINT NOT NULL DEFAULT 0,
+	created_date  TIMESTAMPTZ NOT NULL,
+	object        TEXT NOT NULL,
+	storage_class TEXT NOT NULL DEFAULT '',
+	parts         BIGINT NOT NULL DEFAULT 0,
+	header        BYTEA,
+	segments      BIGINT NOT NULL DEFAULT 0,
+	pending       BYTEA,
+	hash_state    BYTEA,
+	metadata      BYTEA
+);
+
+CREATE INDEX uploads_created_date ON uploads (created_date);
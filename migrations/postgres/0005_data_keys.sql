@@ -0,0 +1,2 @@
+ALTER TABLE files ADD COLUMN data_key BYTEA;
+ALTER TABLE uploads ADD COLUMN data_key BYTEA;
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN zero_knowledge BOOLEAN NOT NULL DEFAULT FALSE;
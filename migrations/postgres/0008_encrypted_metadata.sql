@@ -0,0 +1,4 @@
+ALTER TABLE files ADD COLUMN metadata BYTEA;
+ALTER TABLE folders ADD COLUMN encrypted_folder BYTEA;
+ALTER TABLE folders ADD COLUMN key_generation INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN metadata_encrypted BOOLEAN NOT NULL DEFAULT FALSE;
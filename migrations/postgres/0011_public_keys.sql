@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN public_keys BYTEA;
+ALTER TABLE files ADD COLUMN public_key_encrypted BOOLEAN NOT NULL DEFAULT FALSE;
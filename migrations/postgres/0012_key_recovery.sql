@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN key_check BYTEA;
+ALTER TABLE users ADD COLUMN recovery_codes BYTEA;
@@ -0,0 +1,4 @@
+ALTER TABLE users ADD COLUMN totp_secret BYTEA;
+ALTER TABLE users ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN totp_backup_codes BYTEA;
@@ -0,0 +1,17 @@
+CREATE TABLE uploads (
+	id            TEXT PRIMARY KEY,
+	username      TEXT NOT NULL,
+	length        INTEGER NOT NULL,
+	upload_offset INTEGER NOT NULL DEFAULT 0,
+	created_date  TIMESTAMP NOT NULL,
+	object        TEXT NOT NULL,
+	storage_class TEXT NOT NULL DEFAULT '',
+	parts         INTEGER NOT NULL DEFAULT 0,
+	header        BLOB,
+	segments      INTEGER NOT NULL DEFAULT 0,
+	pending       BLOB,
+	hash_state    BLOB,
+	metadata      BLOB
+);
+
+CREATE INDEX uploads_created_date ON uploads (created_date);
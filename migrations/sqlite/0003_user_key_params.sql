@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN key_salt BLOB;
+ALTER TABLE users ADD COLUMN key_iterations INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+ALTER TABLE users ADD COLUMN kdf_version INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN kdf_time INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN kdf_memory INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN kdf_threads INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,5 @@
+ALTER TABLE files ADD COLUMN key_generation INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE uploads ADD COLUMN key_generation INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN key_generation INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN next_encrypted_pgp_key BLOB;
+ALTER TABLE users ADD COLUMN next_encrypted_hmac_secret BLOB;
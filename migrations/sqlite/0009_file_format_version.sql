@@ -0,0 +1,2 @@
+ALTER TABLE files ADD COLUMN format_version INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE uploads ADD COLUMN format_version INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+ALTER TABLE folders ADD COLUMN format_version INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN index_version INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN public_keys BLOB;
+ALTER TABLE files ADD COLUMN public_key_encrypted BOOLEAN NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN webauthn_credentials BLOB;
+ALTER TABLE users ADD COLUMN webauthn_required BOOLEAN NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN api_tokens BLOB;
@@ -0,0 +1,219 @@
+package gscrypto
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// how often expired values are removed, nothing else would ask for them
+const memoryValueSweepInterval = time.Minute
+
+type memorySession struct {
+	username string
+	data     []byte
+	expires  time.Time
+}
+
+type memoryValue struct {
+	data    []byte
+	expires time.Time
+}
+
+// MemorySessionStore keeps sessions in memory, they're lost on restart and
+// can't be shared by several servers.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*memorySession
+	users    map[string]map[string]bool
+
+	values    map[string]memoryValue
+	lastSweep time.Time
+}
+
+var _ SessionStore = &MemorySessionStore{}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions:  make(map[string]*memorySession),
+		users:     make(map[string]map[string]bool),
+		values:    make(map[string]memoryValue),
+		lastSweep: time.Now(),
+	}
+}
+
+// session returns the session with id, removing it if it expired. The
+// caller holds mu.
+func (s *MemorySessionStore) session(id string) (*memorySession, bool) {
+	session, exists := s.sessions[id]
+
+	if !exists {
+		return nil, false
+	}
+
+	if time.Now().After(session.expires) {
+		s.delete(session.username, id)
+		return nil, false
+	}
+	return session, true
+}
+
+// delete removes the session of username with id. The caller holds mu.
+func (s *MemorySessionStore) delete(username, id string) {
+	delete(s.sessions, id)
+	delete(s.users[username], id)
+
+	if len(s.users[username]) == 0 {
+		delete(s.users, username)
+	}
+}
+
+func (s *MemorySessionStore) SetSession(username, id string, session []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.users[username] == nil {
+		s.users[username] = make(map[string]bool)
+	}
+
+	s.sessions[id] = &memorySession{username: username, data: append([]byte(nil), session...), expires: time.Now().Add(ttl)}
+	s.users[username][id] = true
+	return nil
+}
+
+func (s *MemorySessionStore) UpdateSession(username, id string, session []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, exists := s.session(id)
+
+	if !exists || existing.username != username {
+		return errors.New(ErrorSessionNotFound)
+	}
+
+	existing.data, existing.expires = append([]byte(nil), session...), time.Now().Add(ttl)
+	return nil
+}
+
+func (s *MemorySessionStore) GetSession(id string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, exists := s.session(id)
+
+	if !exists {
+		return nil, errors.New(ErrorSessionNotFound)
+	}
+	return append([]byte(nil), session.data...), nil
+}
+
+func (s *MemorySessionStore) SessionIDs(username string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []string
+
+	for id := range s.users[username] {
+		if _, exists := s.session(id); exists {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (s *MemorySessionStore) DeleteSession(username, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session, exists := s.session(id); !exists || session.username != username {
+		return errors.New(ErrorSessionNotFound)
+	}
+
+	s.delete(username, id)
+	return nil
+}
+
+func (s *MemorySessionStore) DeleteSessions(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id := range s.users[username] {
+		delete(s.sessions, id)
+	}
+
+	delete(s.users, username)
+	return nil
+}
+
+// value returns the value of key, removing it if it expired. The caller
+// holds mu.
+func (s *MemorySessionStore) value(key string) ([]byte, bool) {
+	value, exists := s.values[key]
+
+	if !exists {
+		return nil, false
+	}
+
+	if time.Now().After(value.expires) {
+		delete(s.values, key)
+		return nil, false
+	}
+	return value.data, true
+}
+
+func (s *MemorySessionStore) SetValue(key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(s.lastSweep) > memoryValueSweepInterval {
+		for k, v := range s.values {
+			if now.After(v.expires) {
+				delete(s.values, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	s.values[key] = memoryValue{data: append([]byte(nil), value...), expires: now.Add(ttl)}
+	return nil
+}
+
+func (s *MemorySessionStore) GetValue(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, exists := s.value(key)
+
+	if !exists {
+		return nil, errors.New(ErrorValueNotFound)
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (s *MemorySessionStore) TakeValue(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, exists := s.value(key)
+
+	if !exists {
+		return nil, errors.New(ErrorValueNotFound)
+	}
+
+	delete(s.values, key)
+	return value, nil
+}
+
+func (s *MemorySessionStore) DeleteValue(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.values, key)
+	return nil
+}
+
+func (s *MemorySessionStore) Close() error {
+	return nil
+}
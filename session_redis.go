@@ -0,0 +1,207 @@
+package gscrypto
+
+import (
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/net/context"
+)
+
+const (
+	redisSessionPrefix  = "gscrypto:session:"
+	redisSessionsPrefix = "gscrypto:sessions:"
+	redisValuePrefix    = "gscrypto:value:"
+)
+
+// the set of a user's session IDs lives as long as their longest session, a
+// session saved with a shorter TTL must not shorten it
+var redisSetSession = redis.NewScript(`
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+redis.call("SADD", KEYS[2], ARGV[3])
+if redis.call("PTTL", KEYS[2]) < tonumber(ARGV[2]) then
+	redis.call("PEXPIRE", KEYS[2], ARGV[2])
+end
+return 1
+`)
+
+// a session isn't updated once it expired or was deleted, nor its TTL
+// extended past the user's set
+var redisUpdateSession = redis.NewScript(`
+if redis.call("SISMEMBER", KEYS[2], ARGV[3]) == 0 or redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 1
+`)
+
+// only a session of the user is deleted, so one user can't remove another's
+var redisDeleteSession = redis.NewScript(`
+if redis.call("SREM", KEYS[2], ARGV[1]) == 0 then
+	return 0
+end
+return redis.call("DEL", KEYS[1])
+`)
+
+var redisDeleteSessions = redis.NewScript(`
+for _, id in ipairs(redis.call("SMEMBERS", KEYS[1])) do
+	redis.call("DEL", ARGV[1] .. id)
+end
+return redis.call("DEL", KEYS[1])
+`)
+
+// GETDEL needs Redis 6.2
+var redisTakeValue = redis.NewScript(`
+local value = redis.call("GET", KEYS[1])
+if value then
+	redis.call("DEL", KEYS[1])
+end
+return value
+`)
+
+// redisSessionStore keeps sessions in Redis, or anything speaking its
+// protocol, where every server using it finds them. Each session is a key
+// expiring with it, and each user a set of their session IDs.
+type redisSessionStore struct {
+	client *redis.Client
+}
+
+var _ SessionStore = &redisSessionStore{}
+
+// newRedisSessionStore connects to url, such as redis://:password@host:6379/0,
+// or rediss:// for TLS.
+func newRedisSessionStore(url string) (*redisSessionStore, error) {
+	opts, err := redis.ParseURL(url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	client := redis.NewClient(opts)
+
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &redisSessionStore{client: client}, nil
+}
+
+func (s *redisSessionStore) SetSession(username, id string, session []byte, ttl time.Duration) error {
+	keys := []string{redisSessionPrefix + id, redisSessionsPrefix + username}
+	return redisSetSession.Run(context.Background(), s.client, keys, session, ttl.Milliseconds(), id).Err()
+}
+
+func (s *redisSessionStore) UpdateSession(username, id string, session []byte, ttl time.Duration) error {
+	keys := []string{redisSessionPrefix + id, redisSessionsPrefix + username}
+	updated, err := redisUpdateSession.Run(context.Background(), s.client, keys, session, ttl.Milliseconds(), id).Int()
+
+	if err != nil {
+		return err
+	}
+
+	if updated == 0 {
+		return errors.New(ErrorSessionNotFound)
+	}
+	return nil
+}
+
+func (s *redisSessionStore) GetSession(id string) ([]byte, error) {
+	session, err := s.client.Get(context.Background(), redisSessionPrefix+id).Bytes()
+
+	if err == redis.Nil {
+		return nil, errors.New(ErrorSessionNotFound)
+	}
+	return session, err
+}
+
+func (s *redisSessionStore) SessionIDs(username string) ([]string, error) {
+	ctx := context.Background()
+	members, err := s.client.SMembers(ctx, redisSessionsPrefix+username).Result()
+
+	if err != nil || len(members) == 0 {
+		return nil, err
+	}
+
+	pipe := s.client.Pipeline()
+	exists := make([]*redis.IntCmd, len(members))
+
+	for i, id := range members {
+		exists[i] = pipe.Exists(ctx, redisSessionPrefix+id)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	var expired []interface{}
+
+	for i, id := range members {
+		if exists[i].Val() == 1 {
+			ids = append(ids, id)
+		} else {
+			expired = append(expired, id)
+		}
+	}
+
+	if len(expired) > 0 {
+		if err := s.client.SRem(ctx, redisSessionsPrefix+username, expired...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+func (s *redisSessionStore) DeleteSession(username, id string) error {
+	keys := []string{redisSessionPrefix + id, redisSessionsPrefix + username}
+	deleted, err := redisDeleteSession.Run(context.Background(), s.client, keys, id).Int()
+
+	if err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		return errors.New(ErrorSessionNotFound)
+	}
+	return nil
+}
+
+func (s *redisSessionStore) DeleteSessions(username string) error {
+	keys := []string{redisSessionsPrefix + username}
+	return redisDeleteSessions.Run(context.Background(), s.client, keys, redisSessionPrefix).Err()
+}
+
+func (s *redisSessionStore) SetValue(key string, value []byte, ttl time.Duration) error {
+	return s.client.Set(context.Background(), redisValuePrefix+key, value, ttl).Err()
+}
+
+func (s *redisSessionStore) GetValue(key string) ([]byte, error) {
+	value, err := s.client.Get(context.Background(), redisValuePrefix+key).Bytes()
+
+	if err == redis.Nil {
+		return nil, errors.New(ErrorValueNotFound)
+	}
+	return value, err
+}
+
+func (s *redisSessionStore) TakeValue(key string) ([]byte, error) {
+	value, err := redisTakeValue.Run(context.Background(), s.client, []string{redisValuePrefix + key}).Text()
+
+	if err == redis.Nil {
+		return nil, errors.New(ErrorValueNotFound)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return []byte(value), nil
+}
+
+func (s *redisSessionStore) DeleteValue(key string) error {
+	return s.client.Del(context.Background(), redisValuePrefix+key).Err()
+}
+
+func (s *redisSessionStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,43 @@
+package gscrypto
+
+import "time"
+
+const (
+	ErrorSessionNotFound = "session not found"
+	ErrorValueNotFound   = "value not found"
+)
+
+// SessionStore keeps the sessions of logged in users, so that any server
+// sharing the store can serve a request made with any of them, and they
+// survive restarts. Sessions are opaque: the keys in them are encrypted by a
+// secret the store never sees. It also keeps short lived values the servers
+// sharing it must agree on while users log in, such as the challenges they're
+// sent, under keys of their own.
+type SessionStore interface {
+	// SetSession saves the session id of username, replacing it if it
+	// exists. It expires after ttl.
+	SetSession(username, id string, session []byte, ttl time.Duration) error
+	// UpdateSession replaces the session id of username, unlike SetSession
+	// it returns ErrorSessionNotFound if it expired or was deleted.
+	UpdateSession(username, id string, session []byte, ttl time.Duration) error
+	GetSession(id string) ([]byte, error)
+	// SessionIDs returns the IDs of the sessions of username which haven't
+	// expired.
+	SessionIDs(username string) ([]string, error)
+	// DeleteSession returns ErrorSessionNotFound if id isn't a session of
+	// username.
+	DeleteSession(username, id string) error
+	DeleteSessions(username string) error
+
+	// SetValue saves value under key, replacing it if it exists. It expires
+	// after ttl.
+	SetValue(key string, value []byte, ttl time.Duration) error
+	// GetValue returns ErrorValueNotFound if key expired or was deleted.
+	GetValue(key string) ([]byte, error)
+	// TakeValue deletes key and returns its value, only one of the callers
+	// taking it at the same time gets it.
+	TakeValue(key string) ([]byte, error)
+	DeleteValue(key string) error
+
+	Close() error
+}
@@ -0,0 +1,124 @@
+package gscrypto
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSessionStore runs the same checks against every backend, wait lets
+// time pass for the store.
+func testSessionStore(t *testing.T, s SessionStore, wait func(time.Duration)) {
+	assert.Nil(t, s.SetSession("alice", "a1", []byte("first"), time.Hour))
+	assert.Nil(t, s.SetSession("alice", "a2", []byte("second"), 100*time.Millisecond))
+	assert.Nil(t, s.SetSession("bob", "b1", []byte("bob's"), time.Hour))
+
+	session, err := s.GetSession("a1")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("first"), session)
+
+	_, err = s.GetSession("nonexistent")
+	assert.Equal(t, ErrorSessionNotFound, err.Error())
+
+	ids, err := s.SessionIDs("alice")
+	assert.Nil(t, err)
+	sort.Strings(ids)
+	assert.Equal(t, []string{"a1", "a2"}, ids)
+
+	// replacing a session keeps it once
+	assert.Nil(t, s.SetSession("alice", "a1", []byte("updated"), time.Hour))
+	session, _ = s.GetSession("a1")
+	assert.Equal(t, []byte("updated"), session)
+
+	assert.Nil(t, s.UpdateSession("alice", "a1", []byte("again"), time.Hour))
+	session, _ = s.GetSession("a1")
+	assert.Equal(t, []byte("again"), session)
+	assert.Equal(t, ErrorSessionNotFound, s.UpdateSession("bob", "a1", []byte("bob's"), time.Hour).Error())
+	assert.Equal(t, ErrorSessionNotFound, s.UpdateSession("alice", "a3", []byte("new"), time.Hour).Error())
+
+	wait(200 * time.Millisecond)
+
+	_, err = s.GetSession("a2")
+	assert.Equal(t, ErrorSessionNotFound, err.Error())
+
+	ids, err = s.SessionIDs("alice")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a1"}, ids)
+
+	// an expired session isn't brought back
+	assert.Equal(t, ErrorSessionNotFound, s.UpdateSession("alice", "a2", []byte("second"), time.Hour).Error())
+
+	// a session of another user can't be deleted
+	assert.Equal(t, ErrorSessionNotFound, s.DeleteSession("alice", "b1").Error())
+	_, err = s.GetSession("b1")
+	assert.Nil(t, err)
+
+	assert.Nil(t, s.DeleteSession("alice", "a1"))
+	assert.Equal(t, ErrorSessionNotFound, s.DeleteSession("alice", "a1").Error())
+	ids, _ = s.SessionIDs("alice")
+	assert.Empty(t, ids)
+
+	assert.Nil(t, s.SetSession("bob", "b2", []byte("bob's"), time.Hour))
+	assert.Nil(t, s.DeleteSessions("bob"))
+	ids, _ = s.SessionIDs("bob")
+	assert.Empty(t, ids)
+
+	_, err = s.GetSession("b2")
+	assert.Equal(t, ErrorSessionNotFound, err.Error())
+
+	assert.Nil(t, s.SetValue("challenge", []byte("first"), time.Hour))
+	assert.Nil(t, s.SetValue("challenge", []byte("second"), time.Hour))
+	assert.Nil(t, s.SetValue("flag", []byte("set"), 100*time.Millisecond))
+
+	// values and sessions don't share their keys
+	assert.Nil(t, s.SetSession("carol", "c1", []byte("carol's"), time.Hour))
+	assert.Nil(t, s.SetValue("c1", []byte("value"), time.Hour))
+	session, _ = s.GetSession("c1")
+	assert.Equal(t, []byte("carol's"), session)
+
+	value, err := s.GetValue("challenge")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("second"), value)
+
+	// a value is only taken once
+	value, err = s.TakeValue("challenge")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("second"), value)
+	_, err = s.TakeValue("challenge")
+	assert.Equal(t, ErrorValueNotFound, err.Error())
+	_, err = s.GetValue("challenge")
+	assert.Equal(t, ErrorValueNotFound, err.Error())
+
+	wait(200 * time.Millisecond)
+
+	_, err = s.GetValue("flag")
+	assert.Equal(t, ErrorValueNotFound, err.Error())
+	_, err = s.TakeValue("flag")
+	assert.Equal(t, ErrorValueNotFound, err.Error())
+
+	assert.Nil(t, s.DeleteValue("c1"))
+	assert.Nil(t, s.DeleteValue("c1"))
+	_, err = s.GetValue("c1")
+	assert.Equal(t, ErrorValueNotFound, err.Error())
+
+	assert.Nil(t, s.Close())
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	testSessionStore(t, NewMemorySessionStore(), time.Sleep)
+}
+
+func TestRedisSessionStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	s, err := OpenSessionStore(&Config{SessionBackend: SessionBackendRedis, RedisURL: "redis://" + mr.Addr()})
+	assert.Nil(t, err)
+
+	testSessionStore(t, s, mr.FastForward)
+
+	_, err = newRedisSessionStore("redis://" + mr.Addr() + "/not-a-db")
+	assert.NotNil(t, err)
+}
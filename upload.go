@@ -0,0 +1,65 @@
+package gscrypto
+
+import (
+	"strconv"
+	"time"
+)
+
+const (
+	ErrorUploadConflict = "upload was modified by another request"
+)
+
+// Upload is the state of a resumable upload. Received data is encrypted and
+// stored in Parts objects named UploadPartName(ID, n), which are joined into
+// Object once Offset reaches Length.
+type Upload struct {
+	ID          string `datastore:"-"`
+	Username    string
+	Length      int64
+	Offset      int64
+	CreatedDate time.Time
+
+	Object       string
+	StorageClass string
+	Parts        int64
+
+	// Header and Segments are the stream header and the number of segments
+	// written to the parts so far.
+	Header   []byte `datastore:",noindex"`
+	Segments int64
+
+	// the following are encrypted by the owner's key: Pending holds what
+	// was received but doesn't fill a segment yet, HashState the state of
+	// the SHA2 of everything received and Metadata what the client sent
+	// when creating the upload.
+	Pending   []byte `datastore:",noindex"`
+	HashState []byte `datastore:",noindex"`
+	Metadata  []byte `datastore:",noindex"`
+
+	// DataKey becomes the File.DataKey of the completed upload, it and the
+	// encrypted fields above use the owner's keys of KeyGeneration.
+	DataKey       []byte `datastore:",noindex"`
+	KeyGeneration int
+
+	// FormatVersion becomes the File.FormatVersion, DataKey and the parts
+	// are bound to the file in Object from FileFormatBound on.
+	FormatVersion int
+}
+
+// UploadDatabase keeps the state of resumable uploads between requests.
+type UploadDatabase interface {
+	AddUpload(u *Upload) error
+	// GetUpload returns ErrorNoDatabaseEntryFound for uploads of other users
+	GetUpload(user, id string) (*Upload, error)
+	// UpdateUpload only saves u if the stored upload is still at offset,
+	// otherwise it returns ErrorUploadConflict.
+	UpdateUpload(u *Upload, offset int64) error
+	DeleteUpload(user, id string) error
+	// ListUploads returns the uploads of every user created before t
+	ListUploads(before time.Time) ([]*Upload, error)
+}
+
+// UploadPartName is the name of the n-th part object of an upload.
+func UploadPartName(id string, n int64) string {
+	return "upload-" + id + "-" + strconv.FormatInt(n, 10)
+}
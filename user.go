@@ -13,6 +13,116 @@ type UserEntry struct {
 	EncryptedHMACSecret []byte
 	Salt                []byte
 	Iterations          int
+
+	// KeySalt and KeyIterations derive the file key from the PGP key. Unlike
+	// Salt and Iterations, which wrap the keys with the password, they never
+	// change, so files stay readable after a password change.
+	KeySalt       []byte
+	KeyIterations int
+
+	// KDF derives the key wrapping the PGP key and HMAC secret from the
+	// password, Salt is its salt.
+	KDF KDFParams
+
+	// KeyGeneration counts the rotations of the PGP key and HMAC secret.
+	// While a rotation runs, the new ones are wrapped in the Next fields and
+	// files move from KeyGeneration to KeyGeneration+1.
+	KeyGeneration           int
+	NextEncryptedPGPKey     []byte
+	NextEncryptedHMACSecret []byte
+
+	// ZeroKnowledge accounts derive and unwrap their keys in the client, the
+	// server only knows Hash, of a key derived from the password, and keeps
+	// the wrapped keys and KDF parameters for the client.
+	ZeroKnowledge bool
+
+	// MetadataEncrypted is set once the folders, tags and other metadata of
+	// the user's files are encrypted. Accounts created before are migrated
+	// the next time they log in.
+	MetadataEncrypted bool
+
+	// IndexVersion is the format version of the HMACs and blind indexes made
+	// by the HMAC secret of KeyGeneration. From FileFormatSubkeys on they're
+	// made by a key derived from it. New keys get the current version, older
+	// ones keep theirs until they're rotated. Zero-knowledge clients make
+	// theirs with the HMAC secret itself.
+	IndexVersion int
+
+	// PublicKeys is an armored OpenPGP keyring, the user's own key and any
+	// extra recipients. While it's set, uploaded files are encrypted to every
+	// key in it instead of by their data key.
+	PublicKeys []byte `datastore:",noindex"`
+
+	// KeyCheck is a hash of the PGP key and HMAC secret, set once the user
+	// downloads a backup of them, which recovering from the backup is checked
+	// against. RecoveryCodes holds the unused recovery codes, each wrapping
+	// the same keys. Both are cleared when the keys are rotated.
+	KeyCheck      []byte `datastore:",noindex"`
+	RecoveryCodes []byte `datastore:",noindex"`
+
+	// TOTPSecret is the secret of two-factor authentication encrypted by the
+	// user's key, which once TOTPEnabled is set logging in needs a code of.
+	// TOTPLastStep is the time step of the last code used, older codes are
+	// refused. TOTPBackupCodes holds hashes of the unused backup codes.
+	TOTPSecret      []byte `datastore:",noindex"`
+	TOTPEnabled     bool
+	TOTPLastStep    int64
+	TOTPBackupCodes []byte `datastore:",noindex"`
+
+	// WebAuthnCredentials is a JSON list of the user's security keys, any of
+	// which logs in as a second factor. With WebAuthnRequired, set by an
+	// admin, TOTP isn't accepted and a key must be registered before
+	// anything else can be done.
+	WebAuthnCredentials []byte `datastore:",noindex"`
+	WebAuthnRequired    bool
+
+	// APITokens is a JSON list of the user's personal API tokens, each
+	// wrapping the user's key by a key derived from the token. They're
+	// revoked when the keys are rotated.
+	APITokens []byte `datastore:",noindex"`
+}
+
+// Rotating reports whether the user's keys are being rotated.
+func (u *UserEntry) Rotating() bool {
+	return len(u.NextEncryptedPGPKey) > 0
+}
+
+const (
+	// KDFPBKDF2 is PBKDF2-SHA256 with UserEntry.Iterations, used by accounts
+	// created before Argon2id, they're upgraded on their next login.
+	KDFPBKDF2   = 0
+	KDFArgon2id = 1
+
+	DefaultKDFTime    = 3
+	DefaultKDFMemory  = 64 * 1024
+	DefaultKDFThreads = 4
+
+	// MinKDFMemory is the lowest memory cost accepted, in KiB
+	MinKDFMemory = 8 * 1024
+)
+
+// KDFParams describes a key derivation function, the costs only apply to
+// Argon2id. Memory is in KiB.
+type KDFParams struct {
+	Version int
+	Time    int
+	Memory  int
+	Threads int
+}
+
+// Weaker reports whether p is an older version than q or costs less. Threads
+// aren't compared, they change the result but not the amount of work.
+func (p KDFParams) Weaker(q KDFParams) bool {
+	return p.Version < q.Version || p.Time < q.Time || p.Memory < q.Memory
+}
+
+// FileKeyParams returns the salt and iterations deriving the file key,
+// accounts which never changed their password only have Salt and Iterations.
+func (u *UserEntry) FileKeyParams() ([]byte, int) {
+	if len(u.KeySalt) == 0 {
+		return u.Salt, u.Iterations
+	}
+	return u.KeySalt, u.KeyIterations
 }
 
 type UserDatabase interface {